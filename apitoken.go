@@ -0,0 +1,214 @@
+package timetracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// ScopeRead allows the read only API routes,
+	// ScopeTimers starting and stopping timers and
+	// ScopeCalendar the /calendar.ics feed.  A token
+	// without scopes may use every API route.
+	ScopeRead     string = "read"
+	ScopeTimers   string = "timers"
+	ScopeCalendar string = "calendar:read"
+
+	TokenActive  string = "active"
+	TokenExpired string = "expired"
+	TokenRevoked string = "revoked"
+
+	// API_TOKEN_PREFIX starts every token, so leaked
+	// tokens are easy to search for
+	API_TOKEN_PREFIX string = "tt_"
+
+	// the first characters of a token are kept in
+	// the clear to tell tokens apart
+	API_TOKEN_DISPLAY_LENGTH int = 11
+
+	// last use is recorded at most once
+	// per API_TOKEN_TOUCH_INTERVAL
+	API_TOKEN_TOUCH_INTERVAL time.Duration = time.Minute
+)
+
+// APITokenScopes lists the scopes a token can be given
+var APITokenScopes = []string{ScopeRead, ScopeTimers, ScopeCalendar}
+
+// APIToken is a personal credential for scripts, acting
+// as the user who created it.  Only the SHA-256 hash of
+// the secret is stored.  Zero ExpiresAt, LastUsedAt and
+// RevokedAt mean never.
+type APIToken struct {
+	Id         int
+	UserId     int
+	Name       string
+	Prefix     string
+	Hash       string
+	Scopes     []string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	LastUsedAt time.Time
+	RevokedAt  time.Time
+}
+
+// NewAPIToken returns a token and its secret, which is
+// shown once and cannot be recovered from the token.
+// A zero expiresIn never expires.
+func NewAPIToken(userId int, name string, scopes []string, expiresIn time.Duration, now time.Time) (APIToken, string, error) {
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return APIToken{}, "", fmt.Errorf("token name must not be empty")
+	}
+
+	for _, scope := range scopes {
+		if !containsString(APITokenScopes, scope) {
+			return APIToken{}, "", fmt.Errorf("unknown scope: %q", scope)
+		}
+	}
+
+	if expiresIn < 0 {
+		return APIToken{}, "", fmt.Errorf("expiry must not be in the past")
+	}
+
+	random, err := newSecret()
+	if err != nil {
+		return APIToken{}, "", err
+	}
+	secret := API_TOKEN_PREFIX + random
+
+	token := APIToken{
+		UserId:    userId,
+		Name:      name,
+		Prefix:    secret[:API_TOKEN_DISPLAY_LENGTH],
+		Hash:      HashAPIToken(secret),
+		Scopes:    scopes,
+		CreatedAt: now.UTC(),
+	}
+	if expiresIn > 0 {
+		token.ExpiresAt = now.UTC().Add(expiresIn)
+	}
+
+	return token, secret, nil
+}
+
+// HashAPIToken is how a secret is stored and looked up.
+// Secrets are random, so a plain SHA-256 is enough.
+func HashAPIToken(secret string) string {
+	return hashSecret(secret)
+}
+
+// Allows reports whether the token may be used
+// for a route that needs scope.  The calendar feed
+// needs its scope given explicitly, as calendar apps
+// keep the token in the feed url.
+func (t APIToken) Allows(scope string) bool {
+	if len(t.Scopes) == 0 {
+		return scope != ScopeCalendar
+	}
+	return containsString(t.Scopes, scope)
+}
+
+// Status is active, expired or revoked at now
+func (t APIToken) Status(now time.Time) string {
+	switch {
+	case !t.RevokedAt.IsZero():
+		return TokenRevoked
+	case !t.ExpiresAt.IsZero() && !now.Before(t.ExpiresAt):
+		return TokenExpired
+	}
+	return TokenActive
+}
+
+type apiTokenKey struct{}
+
+// APITokenFrom returns the token that authenticated
+// the request, if any
+func APITokenFrom(ctx context.Context) (APIToken, bool) {
+	t, ok := ctx.Value(apiTokenKey{}).(APIToken)
+	return t, ok
+}
+
+// apiAuth checks an Authorization: Bearer token on an
+// API route.  A token that is unknown, expired or
+// revoked gets 401 and one without scope 403.  Requests
+// without a token pass unless tokens are required.
+func (s *Server) apiAuth(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		header := r.Header.Get("Authorization")
+		if header == "" {
+			if s.requireTokens {
+				unauthorized(w, "", "API token required")
+				return
+			}
+			next(w, r)
+			return
+		}
+
+		secret := strings.TrimPrefix(header, "Bearer ")
+		if secret == header || s.APITokenStore == nil {
+			unauthorized(w, "invalid_request", "use Authorization: Bearer with an API token")
+			return
+		}
+
+		token, ok := s.checkAPIToken(w, r, secret, scope)
+		if !ok {
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), apiTokenKey{}, token)))
+	}
+}
+
+// checkAPIToken looks up secret and records its use.
+// A token that is unknown, expired or revoked gets 401
+// and one without scope 403, and ok is false.
+func (s *Server) checkAPIToken(w http.ResponseWriter, r *http.Request, secret, scope string) (APIToken, bool) {
+
+	token, err := s.APITokenStore.GetAPITokenByHash(HashAPIToken(strings.TrimSpace(secret)))
+	if errors.Is(err, ErrNoRecord) {
+		unauthorized(w, "invalid_token", "unknown API token")
+		return APIToken{}, false
+	}
+	if err != nil {
+		s.requestLogger(r).Error("internal server error", "err", err)
+		writeJSONError(w, "Internal Server Error", http.StatusInternalServerError)
+		return APIToken{}, false
+	}
+
+	now := time.Now().UTC()
+	if status := token.Status(now); status != TokenActive {
+		unauthorized(w, "invalid_token", "API token "+status)
+		return APIToken{}, false
+	}
+
+	if !token.Allows(scope) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, scope))
+		writeJSONError(w, "API token lacks the "+scope+" scope", http.StatusForbidden)
+		return APIToken{}, false
+	}
+
+	if now.Sub(token.LastUsedAt) >= API_TOKEN_TOUCH_INTERVAL {
+		err := s.APITokenStore.TouchAPIToken(token.Id, now)
+		if err != nil {
+			s.requestLogger(r).Warn("recording api token use", "token", token.Prefix, "err", err)
+		}
+	}
+
+	return token, true
+}
+
+func unauthorized(w http.ResponseWriter, code, message string) {
+
+	challenge := `Bearer realm="timetracker"`
+	if code != "" {
+		challenge += fmt.Sprintf(`, error=%q`, code)
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	writeJSONError(w, message, http.StatusUnauthorized)
+}
@@ -0,0 +1,390 @@
+package timetracker_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"timetracker"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// memoryTokenStore keeps API tokens in memory
+type memoryTokenStore struct {
+	mu      sync.Mutex
+	tokens  []timetracker.APIToken
+	touches int
+}
+
+func (m *memoryTokenStore) CreateAPIToken(t timetracker.APIToken) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t.Id = len(m.tokens) + 1
+	m.tokens = append(m.tokens, t)
+	return t.Id, nil
+}
+
+func (m *memoryTokenStore) GetAPITokens() ([]timetracker.APIToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]timetracker.APIToken{}, m.tokens...), nil
+}
+
+func (m *memoryTokenStore) GetAPITokenByHash(hash string) (timetracker.APIToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range m.tokens {
+		if t.Hash == hash {
+			return t, nil
+		}
+	}
+	return timetracker.APIToken{}, timetracker.ErrNoRecord
+}
+
+func (m *memoryTokenStore) RevokeAPIToken(id int, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens[id-1].RevokedAt = at
+	return nil
+}
+
+func (m *memoryTokenStore) TouchAPIToken(id int, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tokens[id-1].LastUsedAt = at
+	m.touches++
+	return nil
+}
+
+// add stores a new token and returns its secret
+func (m *memoryTokenStore) add(t *testing.T, scopes []string, expiresIn time.Duration, now time.Time) string {
+	t.Helper()
+	token, secret, err := timetracker.NewAPIToken(timetracker.LOCAL_USER_ID, "test", scopes, expiresIn, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.CreateAPIToken(token)
+	return secret
+}
+
+func TestNewAPIToken(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2021, 1, 1, 9, 0, 0, 0, time.UTC)
+
+	token, secret, err := timetracker.NewAPIToken(timetracker.LOCAL_USER_ID, " ci ", []string{timetracker.ScopeRead}, 24*time.Hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(secret, timetracker.API_TOKEN_PREFIX) || !strings.HasPrefix(secret, token.Prefix) {
+		t.Errorf("want: secret starting tt_ and %q, got: %q", token.Prefix, secret)
+	}
+	if token.Hash != timetracker.HashAPIToken(secret) || strings.Contains(token.Hash, secret) {
+		t.Error("want: only the hash of the secret stored")
+	}
+	if token.Name != "ci" || !token.ExpiresAt.Equal(now.Add(24*time.Hour)) {
+		t.Errorf("want: name ci expiring a day later, got: %q %v", token.Name, token.ExpiresAt)
+	}
+
+	_, other, _ := timetracker.NewAPIToken(timetracker.LOCAL_USER_ID, "ci", nil, 0, now)
+	if other == secret {
+		t.Error("want: a new secret per token")
+	}
+
+	for _, tc := range []struct {
+		name      string
+		scopes    []string
+		expiresIn time.Duration
+	}{
+		{name: ""},
+		{name: "ci", scopes: []string{"admin"}},
+		{name: "ci", expiresIn: -time.Hour},
+	} {
+		_, _, err := timetracker.NewAPIToken(timetracker.LOCAL_USER_ID, tc.name, tc.scopes, tc.expiresIn, now)
+		if err == nil {
+			t.Errorf("%q %v %v: want: error, got: nil", tc.name, tc.scopes, tc.expiresIn)
+		}
+	}
+
+}
+
+func TestAPITokenStatus(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2021, 1, 1, 9, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		description string
+		token       timetracker.APIToken
+		want        string
+	}{
+		{description: "no expiry", token: timetracker.APIToken{}, want: timetracker.TokenActive},
+		{description: "expires later", token: timetracker.APIToken{ExpiresAt: now.Add(time.Second)}, want: timetracker.TokenActive},
+		{description: "expired", token: timetracker.APIToken{ExpiresAt: now}, want: timetracker.TokenExpired},
+		{description: "revoked", token: timetracker.APIToken{ExpiresAt: now, RevokedAt: now}, want: timetracker.TokenRevoked},
+	}
+
+	for _, tc := range testCases {
+		if got := tc.token.Status(now); tc.want != got {
+			t.Errorf("%s: want: %s, got: %s", tc.description, tc.want, got)
+		}
+	}
+
+	read := timetracker.APIToken{Scopes: []string{timetracker.ScopeRead}}
+	if !read.Allows(timetracker.ScopeRead) || read.Allows(timetracker.ScopeTimers) {
+		t.Error("want: read token allowed to read only")
+	}
+	if !(timetracker.APIToken{}).Allows(timetracker.ScopeTimers) {
+		t.Error("want: token without scopes allowed every API route")
+	}
+	if (timetracker.APIToken{}).Allows(timetracker.ScopeCalendar) {
+		t.Error("want: token without scopes kept from the calendar feed")
+	}
+
+}
+
+func TestAPITokenAuth(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	tokens := &memoryTokenStore{}
+	all := tokens.add(t, nil, 0, now)
+	read := tokens.add(t, []string{timetracker.ScopeRead}, 0, now)
+	timers := tokens.add(t, []string{timetracker.ScopeTimers}, 0, now)
+	expired := tokens.add(t, nil, time.Nanosecond, now.Add(-time.Hour))
+	revoked := tokens.add(t, nil, 0, now)
+	tokens.RevokeAPIToken(5, now)
+
+	s := timetracker.NewServer(timetracker.WithNoLogging())
+	s.APITokenStore = tokens
+	handler := s.Handler()
+
+	// requests that pass the token check fail
+	// validation, so no TaskStore is needed
+	testCases := []struct {
+		description string
+		method      string
+		path        string
+		auth        string
+		want        int
+	}{
+		{description: "no token", method: http.MethodGet, path: "/api/search", want: http.StatusBadRequest},
+		{description: "not bearer", method: http.MethodGet, path: "/api/search", auth: "Basic dXNlcjpwYXNz", want: http.StatusUnauthorized},
+		{description: "unknown", method: http.MethodGet, path: "/api/search", auth: "Bearer tt_nope", want: http.StatusUnauthorized},
+		{description: "expired", method: http.MethodGet, path: "/api/search", auth: "Bearer " + expired, want: http.StatusUnauthorized},
+		{description: "revoked", method: http.MethodGet, path: "/api/search", auth: "Bearer " + revoked, want: http.StatusUnauthorized},
+		{description: "read", method: http.MethodGet, path: "/api/task/history?limit=0", auth: "Bearer " + read, want: http.StatusBadRequest},
+		{description: "read starting", method: http.MethodPost, path: "/api/task/start", auth: "Bearer " + read, want: http.StatusForbidden},
+		{description: "timers reading", method: http.MethodGet, path: "/api/search", auth: "Bearer " + timers, want: http.StatusForbidden},
+		{description: "timers starting", method: http.MethodPost, path: "/api/task/start", auth: "Bearer " + timers, want: http.StatusBadRequest},
+		{description: "all scopes", method: http.MethodPost, path: "/api/task/start", auth: "Bearer " + all, want: http.StatusBadRequest},
+		{description: "post without token needs csrf", method: http.MethodPost, path: "/api/task/start", want: http.StatusForbidden},
+	}
+
+	for _, tc := range testCases {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(tc.method, tc.path, strings.NewReader("{"))
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		handler.ServeHTTP(rec, req)
+
+		if tc.want != rec.Code {
+			t.Errorf("%s: want: %d, got: %d %s", tc.description, tc.want, rec.Code, rec.Body)
+		}
+		if rec.Code == http.StatusUnauthorized && !strings.HasPrefix(rec.Header().Get("WWW-Authenticate"), "Bearer") {
+			t.Errorf("%s: want: Bearer challenge, got: %q", tc.description, rec.Header().Get("WWW-Authenticate"))
+		}
+	}
+
+	// three tokens were let through, each recorded once
+	got, _ := tokens.GetAPITokens()
+	if got[0].LastUsedAt.IsZero() || !got[3].LastUsedAt.IsZero() {
+		t.Errorf("want: last use of accepted tokens only, got: %v", got)
+	}
+	if tokens.touches != 3 {
+		t.Errorf("want: 3 touches, got: %d", tokens.touches)
+	}
+
+	required := timetracker.NewServer(timetracker.WithNoLogging(), timetracker.WithRequiredAPITokens())
+	required.APITokenStore = tokens
+	handler = required.Handler()
+
+	for auth, want := range map[string]int{"": http.StatusUnauthorized, "Bearer " + read: http.StatusBadRequest} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/api/search", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		handler.ServeHTTP(rec, req)
+
+		if want != rec.Code {
+			t.Errorf("required %q: want: %d, got: %d", auth, want, rec.Code)
+		}
+	}
+
+}
+
+func TestAPIStartStop(t *testing.T) {
+	t.Parallel()
+
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	s := timetracker.NewServer(
+		timetracker.WithNoLogging(),
+		timetracker.WithNoWebhooks(),
+		timetracker.WithDBStore(&timetracker.DBStore{Db: db}),
+	)
+	tokens := &memoryTokenStore{}
+	secret := tokens.add(t, []string{timetracker.ScopeTimers}, 0, time.Now())
+	s.APITokenStore = tokens
+	handler := s.Handler()
+
+	post := func(path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+secret)
+		req.Header.Set("Content-Type", "application/json")
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(timetracker.SQLInsert).
+		WithArgs("deploy", "ops", "ci,release", "", sqlmock.AnyArg(), timetracker.LOCAL_USER_ID).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+	mock.ExpectQuery(timetracker.SQLInsertAudit).
+		WithArgs(7, timetracker.AuditCreate, timetracker.LOCAL_USER_ID, sqlmock.AnyArg(), "", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectCommit()
+	mock.ExpectExec(timetracker.SQLDeleteTaskSession).WithArgs(timetracker.LOCAL_USER_ID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(timetracker.SQLInsertTaskSession).WithArgs(7, timetracker.LOCAL_USER_ID).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	rec := post("/api/task/start", `{"name": "deploy", "project": "ops", "tags": ["ci", "release"]}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("start: want: 201, got: %d %s", rec.Code, rec.Body)
+	}
+
+	var task timetracker.Task
+	err = json.NewDecoder(rec.Body).Decode(&task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Id != 7 || task.Name != "deploy" || !task.Active {
+		t.Errorf("start: want: running task 7 deploy, got: %+v", task)
+	}
+
+	columns := []string{"id", "task_name", "project", "tags", "notes", "start_time", "elapsed_time", "user_id"}
+	started := time.Now().Add(-time.Minute).UTC()
+
+	mock.ExpectQuery(timetracker.SQLBySession).WithArgs(timetracker.LOCAL_USER_ID).WillReturnRows(
+		sqlmock.NewRows(columns).AddRow(7, "deploy", "ops", "ci,release", "", started, 0.0, 1))
+	mock.ExpectBegin()
+	mock.ExpectExec(timetracker.SQLUpdateStopped).WithArgs(sqlmock.AnyArg(), "shipped", timetracker.LOCAL_USER_ID).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(timetracker.SQLInsertAudit).
+		WithArgs(7, timetracker.AuditStop, timetracker.LOCAL_USER_ID, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	mock.ExpectCommit()
+
+	rec = post("/api/task/stop", `{"notes": "shipped"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("stop: want: 200, got: %d %s", rec.Code, rec.Body)
+	}
+
+	task = timetracker.Task{}
+	json.NewDecoder(rec.Body).Decode(&task)
+	if task.Active || task.Notes != "shipped" || task.ElapsedTimeSec < 60 {
+		t.Errorf("stop: want: stopped task with notes, got: %+v", task)
+	}
+
+	// the session still names the stopped task
+	mock.ExpectQuery(timetracker.SQLBySession).WithArgs(timetracker.LOCAL_USER_ID).WillReturnRows(
+		sqlmock.NewRows(columns).AddRow(7, "deploy", "ops", "ci,release", "shipped", started, 60.0, 1))
+
+	rec = post("/api/task/stop", "")
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("stop again: want: 404, got: %d", rec.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+func TestCalendarFeed(t *testing.T) {
+	t.Parallel()
+
+	s, ts := newSqliteServer(t)
+
+	owner := newBrowser(t, ts)
+	owner.post("/workspace/create", url.Values{"name": {"Platform"}})
+
+	_, body := owner.post("/workspace/invite", url.Values{"workspace": {"1"}, "email": {"ana@example.com"}, "role": {"member"}})
+	link := regexp.MustCompile(`/invite\?token=[\w-]+`).FindString(body)
+
+	ana := newBrowser(t, ts)
+	ana.get(link)
+	ana.post("/invite/accept", url.Values{"token": {strings.TrimPrefix(link, "/invite?token=")}, "name": {"Ana"}})
+
+	start := time.Now().Add(-time.Hour)
+	for userId, name := range map[int]string{timetracker.LOCAL_USER_ID: "piano", 2: "standup"} {
+		_, err := s.TaskStore.CreateCompleted(timetracker.Task{Name: name, StartTime: start, ElapsedTimeSec: 600, UserId: userId})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	secret := regexp.MustCompile(timetracker.API_TOKEN_PREFIX + `[\w-]+`)
+	newToken := func(b *browser, scopes ...string) string {
+		_, body := b.post("/settings/tokens/create", url.Values{"name": {"calendar"}, "scope": scopes})
+		return secret.FindString(body)
+	}
+	feed := newToken(ana, timetracker.ScopeCalendar)
+	all := newToken(owner)
+	read := newToken(owner, timetracker.ScopeRead)
+
+	for _, tc := range []struct {
+		description string
+		token       string
+		want        int
+	}{
+		{description: "no token", want: http.StatusUnauthorized},
+		{description: "unknown token", token: "tt_nope", want: http.StatusUnauthorized},
+		{description: "token without scopes", token: all, want: http.StatusForbidden},
+		{description: "read token", token: read, want: http.StatusForbidden},
+		{description: "calendar token", token: feed, want: http.StatusOK},
+	} {
+		resp, err := http.Get(ts.URL + "/calendar.ics?token=" + url.QueryEscape(tc.token))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if tc.want != resp.StatusCode {
+			t.Errorf("%s: want: %d, got: %d %s", tc.description, tc.want, resp.StatusCode, body)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			continue
+		}
+		if !strings.Contains(string(body), "SUMMARY:standup") || strings.Contains(string(body), "piano") {
+			t.Errorf("%s: want: only the token user's tasks, got: %s", tc.description, body)
+		}
+	}
+
+}
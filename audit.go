@@ -0,0 +1,192 @@
+package timetracker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	AuditCreate  string = "create"
+	AuditUpdate  string = "update"
+	AuditStop    string = "stop"
+	AuditDelete  string = "delete"
+	AuditRestore string = "restore"
+	AuditImport  string = "import"
+
+	// the audit page and API list the latest AUDIT_LOG_LIMIT
+	// entries unless asked for fewer, and never more than
+	// AUDIT_LOG_MAX_LIMIT
+	AUDIT_LOG_LIMIT     int = 100
+	AUDIT_LOG_MAX_LIMIT int = 1000
+)
+
+// AuditEntry records one change to a task: who made it,
+// when, and the task before and after.  Before is nil for
+// creates and restores, After for deletes.  TaskDeleted is
+// whether the task is deleted now, so it can be restored.
+type AuditEntry struct {
+	Id          int       `json:"id"`
+	TaskId      int       `json:"task_id"`
+	Action      string    `json:"action"`
+	ActorId     int       `json:"actor_id"`
+	Actor       string    `json:"actor"`
+	At          time.Time `json:"at"`
+	Before      *Task     `json:"before"`
+	After       *Task     `json:"after"`
+	TaskDeleted bool      `json:"task_deleted"`
+}
+
+// AuditChange is a field that differs between
+// an entry's before and after values
+type AuditChange struct {
+	Field  string
+	Before string
+	After  string
+}
+
+// AuditFilter selects entries for GetAuditLog.  A zero
+// TaskId matches every task.  UserId keeps the entries
+// of tasks that user may see, ALL_USERS every entry.
+type AuditFilter struct {
+	UserId int
+	TaskId int
+	Limit  int
+}
+
+func NewAuditEntry(action string, actorId int, at time.Time, before, after *Task) AuditEntry {
+
+	entry := AuditEntry{
+		Action:  action,
+		ActorId: actorId,
+		At:      at.UTC(),
+		Before:  before,
+		After:   after,
+	}
+
+	switch {
+	case after != nil:
+		entry.TaskId = after.Id
+	case before != nil:
+		entry.TaskId = before.Id
+	}
+
+	return entry
+}
+
+// NewAuditFilter reads the task and limit query
+// parameters of the audit page and API
+func NewAuditFilter(query url.Values) (AuditFilter, error) {
+
+	filter := AuditFilter{Limit: AUDIT_LOG_LIMIT}
+
+	if v := query.Get("task"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil || id < 1 {
+			return AuditFilter{}, fmt.Errorf("invalid task: %q", v)
+		}
+		filter.TaskId = id
+	}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > AUDIT_LOG_MAX_LIMIT {
+			return AuditFilter{}, fmt.Errorf("limit must be between 1 and %d", AUDIT_LOG_MAX_LIMIT)
+		}
+		filter.Limit = limit
+	}
+
+	return filter, nil
+}
+
+// Changes lists the fields that differ between before
+// and after.  A create or delete lists every field.
+func (e AuditEntry) Changes() []AuditChange {
+
+	before, after := auditFields(e.Before), auditFields(e.After)
+
+	var changes []AuditChange
+	for i, field := range auditFieldNames {
+		if before[i] != after[i] {
+			changes = append(changes, AuditChange{Field: field, Before: before[i], After: after[i]})
+		}
+	}
+	return changes
+}
+
+var auditFieldNames = []string{"name", "project", "tags", "notes", "start time", "elapsed time"}
+
+// auditFields are the values Changes compares,
+// in the order of auditFieldNames
+func auditFields(t *Task) []string {
+
+	if t == nil {
+		return make([]string, len(auditFieldNames))
+	}
+
+	return []string{
+		t.Name,
+		t.Project,
+		JoinTags(t.Tags),
+		t.Notes,
+		t.StartTime.UTC().Format("2006-01-02 15:04:05"),
+		strconv.FormatFloat(t.ElapsedTimeSec, 'f', -1, 64),
+	}
+}
+
+// marshalAuditTask is how before and after values
+// are stored.  A nil task is stored as "".
+func marshalAuditTask(t *Task) (string, error) {
+
+	if t == nil {
+		return "", nil
+	}
+
+	b, err := json.Marshal(t)
+	if err != nil {
+		return "", fmt.Errorf("unable to encode audit value: %w", err)
+	}
+	return string(b), nil
+}
+
+func unmarshalAuditTask(s string) (*Task, error) {
+
+	if s == "" {
+		return nil, nil
+	}
+
+	var t Task
+	err := json.Unmarshal([]byte(s), &t)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode audit value: %w", err)
+	}
+	return &t, nil
+}
+
+// changeTask makes a change to a task as the current
+// user and returns the task's id.  With an AuditStore
+// the change and its audit entry are written in one
+// transaction, so neither is saved without the other.
+func (s *Server) changeTask(r *http.Request, action string, before, after *Task) (int, error) {
+
+	if s.AuditStore != nil {
+		entry, err := s.AuditStore.RecordChange(NewAuditEntry(action, s.currentUserID(r), s.now(), before, after))
+		return entry.TaskId, err
+	}
+
+	switch action {
+	case AuditCreate:
+		return s.TaskStore.Create(*after)
+	case AuditStop:
+		return after.Id, s.TaskStore.UpdateStopped(*after)
+	case AuditUpdate:
+		return after.Id, s.TaskStore.UpdateNotes(*after)
+	case AuditDelete:
+		return before.Id, s.TaskStore.Delete(*before)
+	default:
+		return 0, fmt.Errorf("unknown audit action: %q", action)
+	}
+}
@@ -0,0 +1,168 @@
+package timetracker_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"timetracker"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestAuditEntryChanges(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2021, 1, 1, 9, 0, 0, 0, time.UTC)
+	before := timetracker.Task{Id: 7, Name: "deploy", Project: "ops", Tags: []string{"ci"}, StartTime: start}
+	after := before
+	after.Notes = "shipped"
+	after.ElapsedTimeSec = 90.5
+
+	entry := timetracker.NewAuditEntry(timetracker.AuditStop, 1, start, &before, &after)
+	if entry.TaskId != 7 {
+		t.Errorf("want: task 7, got: %d", entry.TaskId)
+	}
+
+	want := []timetracker.AuditChange{
+		{Field: "notes", Before: "", After: "shipped"},
+		{Field: "elapsed time", Before: "0", After: "90.5"},
+	}
+	got := entry.Changes()
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+
+	deleted := timetracker.NewAuditEntry(timetracker.AuditDelete, 1, start, &after, nil)
+	if deleted.TaskId != 7 || len(deleted.Changes()) != 6 {
+		t.Errorf("delete: want: task 7 and every field, got: %d and %v", deleted.TaskId, deleted.Changes())
+	}
+
+}
+
+func TestNewAuditFilter(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		query   string
+		want    timetracker.AuditFilter
+		wantErr bool
+	}{
+		{query: "", want: timetracker.AuditFilter{Limit: timetracker.AUDIT_LOG_LIMIT}},
+		{query: "task=3&limit=10", want: timetracker.AuditFilter{TaskId: 3, Limit: 10}},
+		{query: "task=x", wantErr: true},
+		{query: "limit=0", wantErr: true},
+		{query: "limit=100000", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		q, _ := url.ParseQuery(tc.query)
+		got, err := timetracker.NewAuditFilter(q)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%q: want error %t, got: %v", tc.query, tc.wantErr, err)
+			continue
+		}
+		if tc.want != got {
+			t.Errorf("%q: want: %+v, got: %+v", tc.query, tc.want, got)
+		}
+	}
+
+}
+
+func TestAuditLog(t *testing.T) {
+	t.Parallel()
+
+	s, ts := newSqliteServer(t)
+	b := newBrowser(t, ts)
+
+	b.post("/task/started", url.Values{"task": {"deploy"}, "project": {"ops"}})
+	b.post("/task/notes", url.Values{"notes": {"rolling"}})
+	b.post("/task/stop", url.Values{})
+
+	// once stopped, the task is not stopped or edited again
+	for _, path := range []string{"/task/stop", "/task/notes"} {
+		code, _ := b.post(path, url.Values{"notes": {"again"}})
+		if code != http.StatusConflict {
+			t.Errorf("%s after stop: want: 409, got: %d", path, code)
+		}
+	}
+
+	code, _ := b.post("/task/delete", url.Values{"id": {"1"}})
+	if code != http.StatusSeeOther {
+		t.Fatalf("delete: want: 303, got: %d", code)
+	}
+
+	_, body := b.get("/task/history")
+	if strings.Contains(body, "deploy") {
+		t.Error("want: deleted task hidden from history")
+	}
+
+	entries := auditLog(t, b, "/api/audit?task=1")
+	var actions []string
+	for _, e := range entries {
+		actions = append(actions, e.Action)
+	}
+	want := []string{timetracker.AuditDelete, timetracker.AuditStop, timetracker.AuditUpdate, timetracker.AuditCreate}
+	if !cmp.Equal(want, actions) {
+		t.Fatal(cmp.Diff(want, actions))
+	}
+
+	deleted := entries[0]
+	if !deleted.TaskDeleted || deleted.Before == nil || deleted.Before.Notes != "rolling" || deleted.After != nil {
+		t.Errorf("want: deleted task with its notes before and nothing after, got: %+v", deleted)
+	}
+	if deleted.Actor != "me" || deleted.ActorId != timetracker.LOCAL_USER_ID {
+		t.Errorf("want: actor me, got: %q (%d)", deleted.Actor, deleted.ActorId)
+	}
+
+	_, body = b.get("/audit")
+	if !strings.Contains(body, "/audit/restore") {
+		t.Error("want: restore button on the audit page")
+	}
+
+	code, _ = b.post("/audit/restore", url.Values{"id": {"1"}})
+	if code != http.StatusSeeOther {
+		t.Fatalf("restore: want: 303, got: %d", code)
+	}
+	code, _ = b.post("/audit/restore", url.Values{"id": {"1"}})
+	if code != http.StatusNotFound {
+		t.Errorf("restore twice: want: 404, got: %d", code)
+	}
+
+	_, body = b.get("/task/history")
+	if !strings.Contains(body, "deploy") {
+		t.Error("want: restored task back in history")
+	}
+
+	entries = auditLog(t, b, "/api/audit?limit=1")
+	if len(entries) != 1 || entries[0].Action != timetracker.AuditRestore || entries[0].TaskDeleted {
+		t.Errorf("want: restore entry, got: %+v", entries)
+	}
+
+	db := s.AuditStore.(*timetracker.DBStore).Db
+	for _, q := range []string{"UPDATE audit_log SET action='x'", "DELETE FROM audit_log"} {
+		_, err := db.Exec(q)
+		if err == nil {
+			t.Errorf("%s: want: error, got: nil", q)
+		}
+	}
+
+}
+
+func auditLog(t *testing.T, b *browser, path string) []timetracker.AuditEntry {
+	t.Helper()
+
+	code, body := b.get(path)
+	if code != http.StatusOK {
+		t.Fatalf("GET %s: want: 200, got: %d", path, code)
+	}
+
+	var entries []timetracker.AuditEntry
+	err := json.Unmarshal([]byte(body), &entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
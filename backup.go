@@ -0,0 +1,670 @@
+package timetracker
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// SQLite stores are backed up as a copy of the database
+	// file, Postgres stores as a JSON dump of every table
+	BackupFormatSqlite string = "sqlite"
+	BackupFormatJSON   string = "json"
+
+	// BACKUP_DUMP_FORMAT and BACKUP_DUMP_VERSION identify
+	// a JSON dump, so restore can refuse other files
+	BACKUP_DUMP_FORMAT  string = "timetracker-backup"
+	BACKUP_DUMP_VERSION int    = 1
+
+	// backups are named timetracker-20060102T150405Z.db or
+	// .json, so they sort oldest first, and each has a
+	// sha256sum style .sha256 file next to it
+	BACKUP_FILE_PREFIX  string = "timetracker-"
+	BACKUP_TIME_FORMAT  string = "20060102T150405Z"
+	BACKUP_CHECKSUM_EXT string = ".sha256"
+
+	BACKUP_DEFAULT_DIR  string = "backups"
+	BACKUP_DEFAULT_KEEP int    = 7
+
+	// a failed scheduled backup is retried
+	// after BACKUP_RETRY_BACKOFF
+	BACKUP_RETRY_BACKOFF time.Duration = time.Minute
+)
+
+// ErrChecksumMismatch is returned when a backup does
+// not match the checksum written with it
+var ErrChecksumMismatch = errors.New("backup checksum mismatch")
+
+// TableCount is the number of rows
+// of a table in a backup
+type TableCount struct {
+	Table string
+	Rows  int
+}
+
+// BackupInfo describes a verified backup file
+type BackupInfo struct {
+	Path     string
+	Format   string
+	Checksum string
+	Tables   []TableCount
+}
+
+// backupDump is a JSON backup.  Rows hold the
+// values in the order of Columns.
+type backupDump struct {
+	Format    string        `json:"format"`
+	Version   int           `json:"version"`
+	Driver    string        `json:"driver"`
+	CreatedAt time.Time     `json:"created_at"`
+	Tables    []backupTable `json:"tables"`
+}
+
+type backupTable struct {
+	Name    string          `json:"name"`
+	Columns []string        `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+// BackupFileName is the name of a backup
+// in format taken at now
+func BackupFileName(format string, now time.Time) string {
+
+	ext := ".json"
+	if format == BackupFormatSqlite {
+		ext = ".db"
+	}
+	return BACKUP_FILE_PREFIX + now.UTC().Format(BACKUP_TIME_FORMAT) + ext
+}
+
+// CreateBackup writes a backup of store into dir with
+// its checksum, then reads it back to count its rows
+func CreateBackup(ctx context.Context, store BackupStore, dir string, now time.Time) (BackupInfo, error) {
+
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return BackupInfo{}, fmt.Errorf("unable to create backup directory: %w", err)
+	}
+
+	format := store.BackupFormat()
+	path := filepath.Join(dir, BackupFileName(format, now))
+	if _, err := os.Stat(path); err == nil {
+		return BackupInfo{}, fmt.Errorf("backup %s already exists", path)
+	}
+
+	// a backup that failed halfway must not
+	// look like one that can be restored
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+
+	err = store.Backup(ctx, tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return BackupInfo{}, err
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+		return BackupInfo{}, fmt.Errorf("unable to move backup into place: %w", err)
+	}
+
+	sum, err := FileChecksum(path)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+
+	err = os.WriteFile(path+BACKUP_CHECKSUM_EXT, []byte(sum+"  "+filepath.Base(path)+"\n"), 0o600)
+	if err != nil {
+		return BackupInfo{}, fmt.Errorf("unable to write checksum: %w", err)
+	}
+
+	return InspectBackup(ctx, store, path)
+}
+
+// InspectBackup verifies a backup against its checksum
+// file and counts the rows in each of its tables
+func InspectBackup(ctx context.Context, store BackupStore, path string) (BackupInfo, error) {
+
+	sum, err := VerifyChecksum(path)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+
+	tables, err := store.InspectBackup(ctx, path)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+
+	return BackupInfo{Path: path, Format: store.BackupFormat(), Checksum: sum, Tables: tables}, nil
+}
+
+// RestoreBackup verifies a backup and, unless dryRun,
+// replaces everything in store with it
+func RestoreBackup(ctx context.Context, store BackupStore, path string, dryRun bool) (BackupInfo, error) {
+
+	info, err := InspectBackup(ctx, store, path)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+
+	if dryRun {
+		return info, nil
+	}
+
+	err = store.Restore(ctx, path)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	return info, nil
+}
+
+// FileChecksum is the hex SHA-256 of the file at path
+func FileChecksum(path string) (string, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("unable to open backup: %w", err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", fmt.Errorf("unable to read backup: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// VerifyChecksum compares a backup with the checksum in
+// its .sha256 file and returns the checksum
+func VerifyChecksum(path string) (string, error) {
+
+	b, err := os.ReadFile(path + BACKUP_CHECKSUM_EXT)
+	if err != nil {
+		return "", fmt.Errorf("unable to read checksum: %w", err)
+	}
+
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("empty checksum file %s", path+BACKUP_CHECKSUM_EXT)
+	}
+
+	sum, err := FileChecksum(path)
+	if err != nil {
+		return "", err
+	}
+
+	if !strings.EqualFold(fields[0], sum) {
+		return "", fmt.Errorf("%s: %w", path, ErrChecksumMismatch)
+	}
+	return sum, nil
+}
+
+// PruneBackups removes all but the newest keep backups
+// in dir, with their checksums.  A keep of 0 keeps them
+// all.  It returns the backups removed.
+func PruneBackups(dir string, keep int) ([]string, error) {
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list backups: %w", err)
+	}
+
+	var backups []string
+	for _, e := range entries {
+		name := e.Name()
+		ext := filepath.Ext(name)
+		if e.IsDir() || !strings.HasPrefix(name, BACKUP_FILE_PREFIX) || (ext != ".db" && ext != ".json") {
+			continue
+		}
+		backups = append(backups, name)
+	}
+
+	if keep == 0 || len(backups) <= keep {
+		return nil, nil
+	}
+	sort.Strings(backups)
+
+	var removed []string
+	for _, name := range backups[:len(backups)-keep] {
+		path := filepath.Join(dir, name)
+		err := os.Remove(path)
+		if err != nil {
+			return removed, fmt.Errorf("unable to remove backup: %w", err)
+		}
+		os.Remove(path + BACKUP_CHECKSUM_EXT)
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
+
+// WriteBackupSummary prints a backup's checksum
+// and the rows in each table
+func WriteBackupSummary(w io.Writer, info BackupInfo) {
+
+	fmt.Fprintf(w, "%s (%s)\nsha256 %s\n", info.Path, info.Format, info.Checksum)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, t := range info.Tables {
+		fmt.Fprintf(tw, "%s\t%d\n", t.Table, t.Rows)
+	}
+	tw.Flush()
+}
+
+// BackupScheduler takes a backup every interval and
+// keeps the newest keep of them
+type BackupScheduler struct {
+	store    BackupStore
+	dir      string
+	interval time.Duration
+	keep     int
+	logger   *Logger
+}
+
+func NewBackupScheduler(store BackupStore, dir string, interval time.Duration, keep int, logger *Logger) *BackupScheduler {
+	return &BackupScheduler{store: store, dir: dir, interval: interval, keep: keep, logger: logger}
+}
+
+// Run takes backups until ctx is done.  The first is
+// taken one interval after starting, and a failed one
+// is retried after BACKUP_RETRY_BACKOFF.
+func (b *BackupScheduler) Run(ctx context.Context) {
+
+	wait := b.interval
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		wait = b.interval
+		err := b.RunOnce(ctx, time.Now())
+		if err != nil {
+			b.logger.Error("scheduled backup", "err", err)
+			if BACKUP_RETRY_BACKOFF < wait {
+				wait = BACKUP_RETRY_BACKOFF
+			}
+		}
+	}
+}
+
+// RunOnce takes a backup and prunes old ones
+func (b *BackupScheduler) RunOnce(ctx context.Context, now time.Time) error {
+
+	info, err := CreateBackup(ctx, b.store, b.dir, now)
+	if err != nil {
+		return err
+	}
+	b.logger.Info("backup written", "path", info.Path, "sha256", info.Checksum)
+
+	removed, err := PruneBackups(b.dir, b.keep)
+	for _, path := range removed {
+		b.logger.Info("backup removed", "path", path)
+	}
+	return err
+}
+
+// BackupFormat is sqlite for SQLite stores,
+// which back up to a database file, else json
+func (d *DBStore) BackupFormat() string {
+	if d.Driver == "sqlite3" {
+		return BackupFormatSqlite
+	}
+	return BackupFormatJSON
+}
+
+// Backup writes a backup to path while the store
+// stays in use
+func (d *DBStore) Backup(ctx context.Context, path string) error {
+
+	if d.BackupFormat() == BackupFormatSqlite {
+		_, err := d.Db.ExecContext(ctx, SQLVacuumInto, path)
+		if err != nil {
+			return fmt.Errorf("unable to back up database: %w", err)
+		}
+		return nil
+	}
+
+	dump, err := d.dump(ctx)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("unable to create backup: %w", err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	err = json.NewEncoder(w).Encode(dump)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write backup: %w", err)
+	}
+	return f.Close()
+}
+
+// InspectBackup checks that path is a backup this
+// store can restore and counts its rows
+func (d *DBStore) InspectBackup(ctx context.Context, path string) ([]TableCount, error) {
+
+	if d.BackupFormat() == BackupFormatSqlite {
+		return inspectSqliteBackup(ctx, path)
+	}
+
+	dump, err := readDump(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var counts []TableCount
+	for _, t := range dump.Tables {
+		counts = append(counts, TableCount{Table: t.Name, Rows: len(t.Rows)})
+	}
+	return counts, nil
+}
+
+// Restore replaces every table with the backup at
+// path, which InspectBackup should have checked
+func (d *DBStore) Restore(ctx context.Context, path string) error {
+
+	if d.BackupFormat() == BackupFormatSqlite {
+		return d.restoreSqlite(ctx, path)
+	}
+
+	dump, err := readDump(path)
+	if err != nil {
+		return err
+	}
+	return d.restoreDump(ctx, dump)
+}
+
+// queryer is a *sql.DB or a *sql.Tx
+type queryer interface {
+	QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
+}
+
+// tableColumns are the columns a backup holds for
+// table.  Generated columns such as the Postgres
+// search column are left out.
+func (d *DBStore) tableColumns(ctx context.Context, q queryer, table string) ([]string, error) {
+
+	if d.Driver == "postgres" {
+		rows, err := q.QueryContext(ctx, SQLTableColumns, table)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list columns of %s: %w", table, err)
+		}
+		defer rows.Close()
+
+		var columns []string
+		for rows.Next() {
+			var c string
+			err := rows.Scan(&c)
+			if err != nil {
+				return nil, fmt.Errorf("unable to list columns of %s: %w", table, err)
+			}
+			columns = append(columns, c)
+		}
+		return columns, rows.Err()
+	}
+
+	rows, err := q.QueryContext(ctx, fmt.Sprintf(SQLCheckTable, table))
+	if err != nil {
+		return nil, fmt.Errorf("unable to list columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+	return rows.Columns()
+}
+
+// dump reads every table in SchemaTables
+func (d *DBStore) dump(ctx context.Context) (backupDump, error) {
+
+	dump := backupDump{
+		Format:    BACKUP_DUMP_FORMAT,
+		Version:   BACKUP_DUMP_VERSION,
+		Driver:    d.Driver,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	// one transaction gives a consistent snapshot.  SQLite
+	// transactions always read one, Postgres only above
+	// its default READ COMMITTED.
+	opts := &sql.TxOptions{ReadOnly: true}
+	if d.Driver == "postgres" {
+		opts.Isolation = sql.LevelRepeatableRead
+	}
+	tx, err := d.Db.BeginTx(ctx, opts)
+	if err != nil {
+		return backupDump{}, fmt.Errorf("unable to begin backup: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, table := range SchemaTables {
+		columns, err := d.tableColumns(ctx, tx, table)
+		if err != nil {
+			return backupDump{}, err
+		}
+
+		t := backupTable{Name: table, Columns: columns, Rows: [][]interface{}{}}
+
+		query := fmt.Sprintf("SELECT %s FROM %s", strings.Join(columns, ", "), table)
+		rows, err := tx.QueryContext(ctx, query)
+		if err != nil {
+			return backupDump{}, fmt.Errorf("unable to read %s: %w", table, err)
+		}
+
+		for rows.Next() {
+			values := make([]interface{}, len(columns))
+			dest := make([]interface{}, len(columns))
+			for i := range values {
+				dest[i] = &values[i]
+			}
+			err := rows.Scan(dest...)
+			if err != nil {
+				rows.Close()
+				return backupDump{}, fmt.Errorf("unable to read %s: %w", table, err)
+			}
+			// text and numeric columns may come back as
+			// bytes, which JSON would encode as base64
+			for i, v := range values {
+				if b, ok := v.([]byte); ok {
+					values[i] = string(b)
+				}
+			}
+			t.Rows = append(t.Rows, values)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return backupDump{}, fmt.Errorf("unable to read %s: %w", table, err)
+		}
+
+		dump.Tables = append(dump.Tables, t)
+	}
+
+	return dump, nil
+}
+
+// readDump reads a JSON backup and checks that it only
+// names tables and columns the schema has
+func readDump(path string) (backupDump, error) {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return backupDump{}, fmt.Errorf("unable to open backup: %w", err)
+	}
+	defer f.Close()
+
+	var dump backupDump
+	dec := json.NewDecoder(bufio.NewReader(f))
+	dec.UseNumber()
+	err = dec.Decode(&dump)
+	if err != nil {
+		return backupDump{}, fmt.Errorf("not a timetracker backup: %w", err)
+	}
+
+	if dump.Format != BACKUP_DUMP_FORMAT {
+		return backupDump{}, fmt.Errorf("not a timetracker backup: format %q", dump.Format)
+	}
+	if dump.Version != BACKUP_DUMP_VERSION {
+		return backupDump{}, fmt.Errorf("unsupported backup version %d", dump.Version)
+	}
+
+	for _, t := range dump.Tables {
+		if !containsString(SchemaTables, t.Name) {
+			return backupDump{}, fmt.Errorf("backup has unknown table %q", t.Name)
+		}
+		for _, row := range t.Rows {
+			if len(row) != len(t.Columns) {
+				return backupDump{}, fmt.Errorf("backup table %s has a row of %d values for %d columns", t.Name, len(row), len(t.Columns))
+			}
+		}
+	}
+
+	return dump, nil
+}
+
+// restoreDump empties every table and loads the dump
+// in one transaction, then moves id sequences past
+// the restored ids
+func (d *DBStore) restoreDump(ctx context.Context, dump backupDump) error {
+
+	tx, err := d.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("unable to begin restore: %w", err)
+	}
+	defer tx.Rollback()
+
+	// TRUNCATE skips the row triggers
+	// that keep audit_log append-only
+	_, err = tx.ExecContext(ctx, "TRUNCATE "+strings.Join(SchemaTables, ", "))
+	if err != nil {
+		return fmt.Errorf("unable to empty tables: %w", err)
+	}
+
+	for _, t := range dump.Tables {
+		columns, err := d.tableColumns(ctx, tx, t.Name)
+		if err != nil {
+			return err
+		}
+		for _, c := range t.Columns {
+			if !containsString(columns, c) {
+				return fmt.Errorf("backup table %s has unknown column %q", t.Name, c)
+			}
+		}
+
+		err = insertRows(ctx, tx, t)
+		if err != nil {
+			return err
+		}
+
+		if containsString(t.Columns, "id") {
+			_, err = tx.ExecContext(ctx, fmt.Sprintf(SQLResetSequence, t.Name, t.Name))
+			if err != nil {
+				return fmt.Errorf("unable to reset %s ids: %w", t.Name, err)
+			}
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("unable to commit restore: %w", err)
+	}
+	return nil
+}
+
+// insertRows inserts a table's rows with one
+// prepared statement
+func insertRows(ctx context.Context, tx *sql.Tx, t backupTable) error {
+
+	if len(t.Rows) == 0 {
+		return nil
+	}
+
+	params := make([]string, len(t.Columns))
+	for i := range params {
+		params[i] = fmt.Sprintf("$%d", i+1)
+	}
+	query := fmt.Sprintf("INSERT INTO %s(%s) VALUES(%s)", t.Name, strings.Join(t.Columns, ", "), strings.Join(params, ", "))
+
+	stmt, err := tx.PrepareContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("unable to prepare restore of %s: %w", t.Name, err)
+	}
+	defer stmt.Close()
+
+	for _, row := range t.Rows {
+		_, err := stmt.ExecContext(ctx, row...)
+		if err != nil {
+			return fmt.Errorf("unable to restore %s: %w", t.Name, err)
+		}
+	}
+	return nil
+}
+
+// inspectSqliteBackup checks the integrity of a
+// SQLite backup and counts the rows of each table
+func inspectSqliteBackup(ctx context.Context, path string) ([]TableCount, error) {
+
+	db, err := sql.Open(SQLITE_DRIVER, "file:"+path+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var result string
+	err = db.QueryRowContext(ctx, "PRAGMA integrity_check").Scan(&result)
+	if err != nil {
+		return nil, fmt.Errorf("not a timetracker backup: %w", err)
+	}
+	if result != "ok" {
+		return nil, fmt.Errorf("backup is corrupt: %s", result)
+	}
+
+	var counts []TableCount
+	for _, table := range SchemaTables {
+		var n int
+		err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table).Scan(&n)
+		if err != nil {
+			return nil, fmt.Errorf("not a timetracker backup: %w", err)
+		}
+		counts = append(counts, TableCount{Table: table, Rows: n})
+	}
+	return counts, nil
+}
+
+// restoreSqlite copies the backup over the open
+// database with SQLite's online backup API
+func (d *DBStore) restoreSqlite(ctx context.Context, path string) error {
+
+	conn, err := d.Db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to open database: %w", err)
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(dc interface{}) error {
+		return sqliteRestore(ctx, dc, path)
+	})
+}
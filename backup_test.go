@@ -0,0 +1,311 @@
+package timetracker_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"timetracker"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSqliteBackupRestore(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	store, err := timetracker.NewSqliteStore(filepath.Join(dir, "timetracker.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	start := time.Date(2021, 1, 1, 9, 0, 0, 0, time.UTC)
+	for _, name := range []string{"deploy", "review"} {
+		_, err := store.Create(timetracker.Task{Name: name, StartTime: start})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	info, err := timetracker.CreateBackup(ctx, store, filepath.Join(dir, "backups"), start)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := filepath.Join(dir, "backups", "timetracker-20210101T090000Z.db")
+	if info.Path != want || info.Format != timetracker.BackupFormatSqlite {
+		t.Errorf("want: %s as sqlite, got: %s as %s", want, info.Path, info.Format)
+	}
+	if info.Tables[0] != (timetracker.TableCount{Table: "tasks", Rows: 2}) {
+		t.Errorf("want: 2 tasks, got: %+v", info.Tables[0])
+	}
+
+	_, err = store.Create(timetracker.Task{Name: "after the backup", StartTime: start})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = timetracker.RestoreBackup(ctx, store, info.Path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := taskNames(t, store); len(got) != 3 {
+		t.Errorf("dry run: want: 3 tasks, got: %v", got)
+	}
+
+	_, err = timetracker.RestoreBackup(ctx, store, info.Path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := taskNames(t, store); !cmp.Equal([]string{"deploy", "review"}, got) {
+		t.Errorf("restored: want: deploy and review, got: %v", got)
+	}
+
+	f, err := os.OpenFile(info.Path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("tampered"))
+	f.Close()
+
+	_, err = timetracker.RestoreBackup(ctx, store, info.Path, true)
+	if !errors.Is(err, timetracker.ErrChecksumMismatch) {
+		t.Errorf("tampered: want: ErrChecksumMismatch, got: %v", err)
+	}
+
+}
+
+func taskNames(t *testing.T, store *timetracker.DBStore) []string {
+	t.Helper()
+
+	tasks, err := store.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, task := range tasks {
+		names = append(names, task.Name)
+	}
+	return names
+}
+
+func TestPruneBackups(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	for _, name := range []string{
+		"timetracker-20210101T090000Z.db", "timetracker-20210101T090000Z.db.sha256",
+		"timetracker-20210102T090000Z.db", "timetracker-20210102T090000Z.db.sha256",
+		"timetracker-20210103T090000Z.db", "timetracker-20210103T090000Z.db.sha256",
+		"notes.txt",
+	} {
+		err := os.WriteFile(filepath.Join(dir, name), nil, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := timetracker.PruneBackups(dir, 0)
+	if err != nil || len(removed) != 0 {
+		t.Fatalf("keep 0: want: nothing removed, got: %v, %v", removed, err)
+	}
+
+	removed, err = timetracker.PruneBackups(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal([]string{filepath.Join(dir, "timetracker-20210101T090000Z.db")}, removed) {
+		t.Errorf("want: oldest removed, got: %v", removed)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 5 {
+		t.Errorf("want: 2 backups, their checksums and notes.txt left, got: %d files", len(entries))
+	}
+
+}
+
+func TestRestoreJSONDump(t *testing.T) {
+	t.Parallel()
+
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	store := &timetracker.DBStore{Db: db, Driver: "postgres"}
+	if store.BackupFormat() != timetracker.BackupFormatJSON {
+		t.Fatalf("want: json backups for postgres, got: %s", store.BackupFormat())
+	}
+
+	dump := `{"format":"timetracker-backup","version":1,"driver":"postgres","created_at":"2021-01-01T09:00:00Z","tables":[` +
+		`{"name":"tasks","columns":["id","task_name","start_time","elapsed_time"],"rows":[[7,"deploy","2021-01-01T09:00:00Z","5400"]]},` +
+		`{"name":"goals","columns":["id","name"],"rows":[]}]}`
+
+	path := filepath.Join(t.TempDir(), "timetracker-20210101T090000Z.json")
+	writeBackup(t, path, dump)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("TRUNCATE " + strings.Join(timetracker.SchemaTables, ", ")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(timetracker.SQLTableColumns).WithArgs("tasks").WillReturnRows(
+		sqlmock.NewRows([]string{"column_name"}).AddRow("id").AddRow("task_name").AddRow("project").AddRow("start_time").AddRow("elapsed_time"))
+	mock.ExpectPrepare("INSERT INTO tasks(id, task_name, start_time, elapsed_time) VALUES($1, $2, $3, $4)").
+		ExpectExec().WithArgs("7", "deploy", "2021-01-01T09:00:00Z", "5400").WillReturnResult(sqlmock.NewResult(7, 1))
+	mock.ExpectExec("SELECT setval(pg_get_serial_sequence('tasks', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM tasks").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(timetracker.SQLTableColumns).WithArgs("goals").WillReturnRows(
+		sqlmock.NewRows([]string{"column_name"}).AddRow("id").AddRow("name"))
+	mock.ExpectExec("SELECT setval(pg_get_serial_sequence('goals', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM goals").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	info, err := timetracker.RestoreBackup(context.Background(), store, path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []timetracker.TableCount{{Table: "tasks", Rows: 1}, {Table: "goals", Rows: 0}}
+	if !cmp.Equal(want, info.Tables) {
+		t.Error(cmp.Diff(want, info.Tables))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	for _, bad := range []string{
+		`{"format":"something else","version":1}`,
+		`{"format":"timetracker-backup","version":2}`,
+		`{"format":"timetracker-backup","version":1,"tables":[{"name":"pg_user","columns":[],"rows":[]}]}`,
+		`{"format":"timetracker-backup","version":1,"tables":[{"name":"tasks","columns":["id"],"rows":[[1,2]]}]}`,
+	} {
+		writeBackup(t, path, bad)
+		_, err := timetracker.RestoreBackup(context.Background(), store, path, true)
+		if err == nil {
+			t.Errorf("%s: want: error, got: nil", bad)
+		}
+	}
+
+}
+
+// writeBackup writes a backup and its checksum
+func writeBackup(t *testing.T, path, content string) {
+	t.Helper()
+
+	err := os.WriteFile(path, []byte(content), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum, err := timetracker.FileChecksum(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path+timetracker.BACKUP_CHECKSUM_EXT, []byte(sum+"  "+filepath.Base(path)+"\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackupCommands(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "timetracker.db")
+	backups := filepath.Join(dir, "backups")
+
+	run := func(args ...string) (string, error) {
+		s := timetracker.NewServer(timetracker.WithNoLogging(), timetracker.WithSqliteStore(dbPath))
+		var out bytes.Buffer
+		err := s.RunCommand(args, &out)
+		return out.String(), err
+	}
+
+	out, err := run("backup", "-dir", backups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "sha256 ") || !strings.Contains(out, "tasks") {
+		t.Errorf("backup: want: checksum and row counts, got:\n%s", out)
+	}
+
+	entries, err := os.ReadDir(backups)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("want: backup and checksum, got: %v, %v", entries, err)
+	}
+
+	out, err = run("restore", "-dry-run", filepath.Join(backups, entries[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "nothing restored") {
+		t.Errorf("dry run: want: nothing restored, got:\n%s", out)
+	}
+
+	_, err = run("restore")
+	if err == nil {
+		t.Error("restore without a file: want: error, got: nil")
+	}
+
+}
+
+func TestJSONBackup(t *testing.T) {
+	t.Parallel()
+
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	store := &timetracker.DBStore{Db: db, Driver: "postgres"}
+	start := time.Date(2021, 1, 1, 9, 0, 0, 0, time.UTC)
+
+	mock.ExpectBegin()
+	for _, table := range timetracker.SchemaTables {
+		mock.ExpectQuery(timetracker.SQLTableColumns).WithArgs(table).WillReturnRows(
+			sqlmock.NewRows([]string{"column_name"}).AddRow("id").AddRow("name"))
+		rows := sqlmock.NewRows([]string{"id", "name"})
+		if table == "tasks" {
+			rows.AddRow(7, []byte("deploy")).AddRow(8, nil)
+		}
+		mock.ExpectQuery("SELECT id, name FROM " + table).WillReturnRows(rows)
+	}
+	mock.ExpectRollback()
+
+	info, err := timetracker.CreateBackup(context.Background(), store, t.TempDir(), start)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasSuffix(info.Path, "timetracker-20210101T090000Z.json") {
+		t.Errorf("want: a .json backup, got: %s", info.Path)
+	}
+	if len(info.Tables) != len(timetracker.SchemaTables) || info.Tables[0] != (timetracker.TableCount{Table: "tasks", Rows: 2}) {
+		t.Errorf("want: every table and 2 tasks, got: %+v", info.Tables)
+	}
+
+	b, err := os.ReadFile(info.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"rows":[[7,"deploy"],[8,null]]`) {
+		t.Errorf("want: text as strings, got:\n%s", b)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
@@ -1,15 +1,55 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"log"
+	"os"
 	"timetracker"
+
+	// scratch images and some hosts have no zoneinfo,
+	// which the time zone setting and calendar imports
+	// need
+	_ "time/tzdata"
 )
 
 func main() {
 
-	s := timetracker.NewServer(
-		timetracker.WithSqliteStore(),
-	)
-	log.Fatal(s.ListenAndServe())
+	cfg, args, err := timetracker.LoadConfig(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ok, err := timetracker.RunStandaloneCommand(args, os.Stdout)
+	if ok {
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	opts, err := cfg.Options()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s := timetracker.NewServer(opts...)
+
+	if len(args) > 0 {
+		err := s.RunCommand(args, os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	err = s.Run(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
 
 }
@@ -0,0 +1,458 @@
+package timetracker
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// RunStandaloneCommand runs the subcommands that need
+// no store: healthcheck, dev-cert and copy-store, which
+// opens the stores it is given.  Run it before NewServer
+// so that these commands never open or migrate the
+// configured store.  It reports false for any other
+// command.
+func RunStandaloneCommand(args []string, out io.Writer) (bool, error) {
+
+	if len(args) == 0 {
+		return false, nil
+	}
+
+	switch args[0] {
+	case "healthcheck":
+		return true, healthcheckCommand(args[1:], out)
+	case "dev-cert":
+		return true, devCertCommand(args[1:], out)
+	case "copy-store":
+		return true, copyStoreCommand(args[1:], out)
+	default:
+		return false, nil
+	}
+}
+
+// RunCommand runs a command line subcommand against
+// the stores the Server was configured with
+func (s *Server) RunCommand(args []string, out io.Writer) error {
+
+	if len(args) == 0 {
+		return fmt.Errorf("no command given")
+	}
+
+	if ok, err := RunStandaloneCommand(args, out); ok {
+		return err
+	}
+
+	if s.err != nil {
+		return s.err
+	}
+	defer s.close()
+
+	switch args[0] {
+	case "import-ics":
+		return s.importICSCommand(args[1:], out)
+	case "login-link":
+		return s.loginLinkCommand(args[1:], out)
+	case "backup":
+		return s.backupCommand(args[1:], out)
+	case "restore":
+		return s.restoreCommand(args[1:], out)
+	case "export-json":
+		return s.exportJSONCommand(args[1:], out)
+	case "import-json":
+		return s.importJSONCommand(args[1:], out)
+	case "rebuild":
+		return s.rebuildCommand(args[1:], out)
+	default:
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+}
+
+// importICSCommand imports a local .ics file:
+//
+//	timetracker import-ics [-dry-run] [-user 1] calendar.ics
+func (s *Server) importICSCommand(args []string, out io.Writer) error {
+
+	fs := flag.NewFlagSet("import-ics", flag.ContinueOnError)
+	fs.SetOutput(out)
+	dryRun := fs.Bool("dry-run", false, "preview the import without saving tasks")
+	user := fs.Int("user", LOCAL_USER_ID, "id of the user who owns the imported tasks")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: import-ics [-dry-run] [-user ID] FILE")
+	}
+
+	if s.ImportStore == nil {
+		return fmt.Errorf("the store does not support calendar imports")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("unable to open calendar: %s", err)
+	}
+	defer f.Close()
+
+	events, err := ImportICS(s.ImportStore, f, *user, s.now(), *dryRun)
+	if err != nil {
+		return err
+	}
+
+	WriteImportSummary(out, events, *dryRun)
+	return nil
+}
+
+// healthcheckCommand probes a running server so
+// images without a shell or curl can still have a
+// HEALTHCHECK:
+//
+//	timetracker healthcheck [-insecure] [-url http://127.0.0.1:4000/readyz]
+func healthcheckCommand(args []string, out io.Writer) error {
+
+	fs := flag.NewFlagSet("healthcheck", flag.ContinueOnError)
+	fs.SetOutput(out)
+	url := fs.String("url", "http://127.0.0.1:4000/readyz", "url to probe")
+	insecure := fs.Bool("insecure", false, "accept any certificate, such as a self-signed one")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: READY_TIMEOUT + time.Second}
+	if *insecure {
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+
+	resp, err := client.Get(*url)
+	if err != nil {
+		return fmt.Errorf("healthcheck failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	io.Copy(out, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("healthcheck failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// devCertCommand writes a self-signed certificate
+// for local HTTPS:
+//
+//	timetracker dev-cert [-cert cert.pem] [-key key.pem] [-hosts a.local,10.0.0.2]
+func devCertCommand(args []string, out io.Writer) error {
+
+	fs := flag.NewFlagSet("dev-cert", flag.ContinueOnError)
+	fs.SetOutput(out)
+	certFile := fs.String("cert", "cert.pem", "certificate file to write")
+	keyFile := fs.String("key", "key.pem", "key file to write")
+	hosts := fs.String("hosts", "", "comma separated host names and addresses besides localhost")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	err = GenerateDevCert(*certFile, *keyFile, strings.Split(*hosts, ","), time.Now())
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "wrote %s and %s\n", *certFile, *keyFile)
+	return nil
+}
+
+// loginLinkCommand prints a one-time link that signs a
+// browser in, for servers that require login:
+//
+//	timetracker login-link [-user 1] [-url http://127.0.0.1:4000]
+func (s *Server) loginLinkCommand(args []string, out io.Writer) error {
+
+	fs := flag.NewFlagSet("login-link", flag.ContinueOnError)
+	fs.SetOutput(out)
+	user := fs.Int("user", LOCAL_USER_ID, "id of the user to sign in as")
+	baseURL := fs.String("url", "http://127.0.0.1:4000", "address the server is browsed at")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if s.WorkspaceStore == nil {
+		return fmt.Errorf("login-link needs a database store")
+	}
+
+	link, err := NewLoginLink(s.WorkspaceStore, *baseURL, *user, s.now())
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "%s\nvalid for %s\n", link, LOGIN_LINK_LIFETIME)
+	return nil
+}
+
+// WriteImportSummary prints one line per event
+// occurrence followed by the number imported
+func WriteImportSummary(w io.Writer, events []ICSEvent, dryRun bool) {
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	imported := 0
+	for _, e := range events {
+		status := e.Status
+		if e.Reason != "" {
+			status += ": " + e.Reason
+		}
+		if e.Status == ImportNew {
+			imported++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", e.Start.Format(time.RFC3339), e.End.Sub(e.Start), e.Summary, status)
+	}
+	tw.Flush()
+
+	verb := "imported"
+	if dryRun {
+		verb = "would import"
+	}
+	fmt.Fprintf(w, "%s %d of %d events\n", verb, imported, len(events))
+}
+
+// backupCommand backs up the store while it may be in
+// use, into a timestamped file with a .sha256 checksum:
+//
+//	timetracker backup [-dir backups] [-keep 7]
+func (s *Server) backupCommand(args []string, out io.Writer) error {
+
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	fs.SetOutput(out)
+	dir := fs.String("dir", BACKUP_DEFAULT_DIR, "directory to write the backup to")
+	keep := fs.Int("keep", 0, "remove all but this many of the newest backups, 0 keeps them all")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *keep < 0 {
+		return fmt.Errorf("-keep must not be negative")
+	}
+	if s.BackupStore == nil {
+		return fmt.Errorf("the store does not support backups")
+	}
+
+	info, err := CreateBackup(context.Background(), s.BackupStore, *dir, s.now())
+	if err != nil {
+		return err
+	}
+	WriteBackupSummary(out, info)
+
+	removed, err := PruneBackups(*dir, *keep)
+	for _, path := range removed {
+		fmt.Fprintf(out, "removed %s\n", path)
+	}
+	return err
+}
+
+// restoreCommand replaces the store's data with a
+// backup after checking it against its checksum:
+//
+//	timetracker restore [-dry-run] backups/timetracker-20210101T090000Z.db
+func (s *Server) restoreCommand(args []string, out io.Writer) error {
+
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	fs.SetOutput(out)
+	dryRun := fs.Bool("dry-run", false, "verify the backup and show what it holds without restoring it")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: restore [-dry-run] FILE")
+	}
+	if s.BackupStore == nil {
+		return fmt.Errorf("the store does not support backups")
+	}
+
+	info, err := RestoreBackup(context.Background(), s.BackupStore, fs.Arg(0), *dryRun)
+	if err != nil {
+		return err
+	}
+	WriteBackupSummary(out, info)
+
+	if *dryRun {
+		fmt.Fprintln(out, "checksum ok, nothing restored (dry run)")
+		return nil
+	}
+	fmt.Fprintln(out, "restored")
+	return nil
+}
+
+// rebuildCommand replays the event log into a new
+// projection of the tasks:
+//
+//	timetracker -store events -sqlite-path timetracker.events rebuild [-full]
+func (s *Server) rebuildCommand(args []string, out io.Writer) error {
+
+	fs := flag.NewFlagSet("rebuild", flag.ContinueOnError)
+	fs.SetOutput(out)
+	full := fs.Bool("full", false, "replay every event instead of starting from the latest snapshot")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if s.ProjectionStore == nil {
+		return fmt.Errorf("the store does not keep an event log")
+	}
+
+	result, err := s.ProjectionStore.Rebuild(*full)
+	if err != nil {
+		return err
+	}
+
+	from := "the first event"
+	if result.FromSnapshot {
+		from = "the snapshot"
+	}
+	fmt.Fprintf(out, "replayed %d events from %s, tasks are up to event %d\n", result.Events, from, result.Seq)
+	return nil
+}
+
+// exportJSONCommand writes every user's tasks
+// as a versioned JSON document:
+//
+//	timetracker export-json [-o timetracker.json]
+func (s *Server) exportJSONCommand(args []string, out io.Writer) error {
+
+	fs := flag.NewFlagSet("export-json", flag.ContinueOnError)
+	fs.SetOutput(out)
+	file := fs.String("o", "", "file to write, standard output if empty")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if *file == "" {
+		return ExportJSON(out, s.TaskStore, ALL_USERS, s.now())
+	}
+
+	f, err := os.Create(*file)
+	if err != nil {
+		return fmt.Errorf("unable to create export: %w", err)
+	}
+
+	err = ExportJSON(f, s.TaskStore, ALL_USERS, s.now())
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// importJSONCommand imports a document written by
+// export-json, adding to or replacing the tasks:
+//
+//	timetracker import-json [-mode merge|replace] [-dry-run] timetracker.json
+func (s *Server) importJSONCommand(args []string, out io.Writer) error {
+
+	fs := flag.NewFlagSet("import-json", flag.ContinueOnError)
+	fs.SetOutput(out)
+	mode := fs.String("mode", ImportMerge, "merge adds tasks not already there, replace deletes every task first")
+	dryRun := fs.Bool("dry-run", false, "check the file and show what would change without changing anything")
+	actor := fs.Int("actor", LOCAL_USER_ID, "id of the user the audit log records as making the import")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: import-json [-mode merge|replace] [-dry-run] [-actor ID] FILE")
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("unable to open export: %w", err)
+	}
+	defer f.Close()
+
+	result, err := ImportJSON(s.TaskStore, s.ImportStore, s.AuditStore, f, *actor, *mode, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	verb := "imported"
+	if *dryRun {
+		verb = "would import"
+	}
+	fmt.Fprintf(out, "%s %d tasks, skipped %d already there, deleted %d\n", verb, len(result.Created), result.Skipped, len(result.Deleted))
+	return nil
+}
+
+// copyStoreCommand copies every table from one store
+// to another and compares them afterwards:
+//
+//	timetracker copy-store -from-driver sqlite -from timetracker.db -to-driver postgres -to "host=db user=timetracker"
+//
+// An interrupted copy picks up from its state file
+// when run again with the same stores.
+func copyStoreCommand(args []string, out io.Writer) error {
+
+	fs := flag.NewFlagSet("copy-store", flag.ContinueOnError)
+	fs.SetOutput(out)
+	fromDriver := fs.String("from-driver", StoreSqlite, "driver of the store to copy from, sqlite or postgres")
+	from := fs.String("from", "", "sqlite file or postgres dsn to copy from")
+	toDriver := fs.String("to-driver", StorePostgres, "driver of the store to copy to, sqlite or postgres")
+	to := fs.String("to", "", "sqlite file or postgres dsn to copy to")
+	batch := fs.Int("batch", COPY_BATCH_SIZE, "rows copied per transaction")
+	state := fs.String("state", COPY_STATE_FILE, "file that records progress so the copy can resume")
+	verify := fs.Bool("verify", false, "only compare the stores, copy nothing")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *batch < 1 {
+		return fmt.Errorf("-batch must be at least 1")
+	}
+
+	src, err := OpenStore(*fromDriver, *from)
+	if err != nil {
+		return fmt.Errorf("source store: %w", err)
+	}
+	defer src.Close()
+
+	dst, err := OpenStore(*toDriver, *to)
+	if err != nil {
+		return fmt.Errorf("target store: %w", err)
+	}
+	defer dst.Close()
+
+	report, err := CopyStore(context.Background(), src, dst, CopyOptions{
+		SourceName: StoreName(*fromDriver, *from),
+		TargetName: StoreName(*toDriver, *to),
+		StateFile:  *state,
+		BatchSize:  *batch,
+		VerifyOnly: *verify,
+	})
+	if err != nil {
+		return err
+	}
+	WriteCopyReport(out, report)
+
+	if len(report.Diffs) > 0 {
+		return fmt.Errorf("stores differ after copy")
+	}
+	return nil
+}
@@ -0,0 +1,479 @@
+package timetracker
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	StoreSqlite   string = "sqlite"
+	StorePostgres string = "postgres"
+	StoreKV       string = "kv"
+	StoreEvents   string = "events"
+
+	// ConfigEnv names the config file when
+	// there is no -config flag
+	ConfigEnv string = "TIMETRACKER_CONFIG"
+)
+
+// Config is the server setup.  It is read from a YAML,
+// TOML or JSON file, then TIMETRACKER_* environment
+// variables, then command line flags, each overriding
+// the ones before, and turned into Options.
+type Config struct {
+	Port            int           `json:"port" yaml:"port" toml:"port"`
+	TimeZone        string        `json:"time_zone" yaml:"time_zone" toml:"time_zone"`
+	ShutdownTimeout Duration      `json:"shutdown_timeout" yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	MetricsToken    string        `json:"metrics_token" yaml:"metrics_token" toml:"metrics_token"`
+	Store           StoreConfig   `json:"store" yaml:"store" toml:"store"`
+	Log             LogConfig     `json:"log" yaml:"log" toml:"log"`
+	TLS             TLSConfigFile `json:"tls" yaml:"tls" toml:"tls"`
+	Features        FeatureConfig `json:"features" yaml:"features" toml:"features"`
+	Backup          BackupConfig  `json:"backup" yaml:"backup" toml:"backup"`
+}
+
+type StoreConfig struct {
+	// Driver is sqlite, postgres, kv or events
+	Driver string `json:"driver" yaml:"driver" toml:"driver"`
+	// DSN is the Postgres connection string
+	DSN string `json:"dsn" yaml:"dsn" toml:"dsn"`
+	// Path is the SQLite database, KV store
+	// or event log file
+	Path string `json:"path" yaml:"path" toml:"path"`
+	// BusyTimeout and MaxOpenConns tune the SQLite store
+	BusyTimeout  Duration `json:"busy_timeout" yaml:"busy_timeout" toml:"busy_timeout"`
+	MaxOpenConns int      `json:"max_open_conns" yaml:"max_open_conns" toml:"max_open_conns"`
+}
+
+type LogConfig struct {
+	Level  string `json:"level" yaml:"level" toml:"level"`
+	Format string `json:"format" yaml:"format" toml:"format"`
+}
+
+// TLSConfigFile names the certificate files.  With a
+// RedirectPort, plain HTTP on that port is redirected.
+type TLSConfigFile struct {
+	Cert         string `json:"cert" yaml:"cert" toml:"cert"`
+	Key          string `json:"key" yaml:"key" toml:"key"`
+	RedirectPort int    `json:"redirect_port" yaml:"redirect_port" toml:"redirect_port"`
+}
+
+// BackupConfig schedules backups while the server
+// runs.  A zero Interval takes none.
+type BackupConfig struct {
+	Dir      string   `json:"dir" yaml:"dir" toml:"dir"`
+	Interval Duration `json:"interval" yaml:"interval" toml:"interval"`
+	Keep     int      `json:"keep" yaml:"keep" toml:"keep"`
+}
+
+type FeatureConfig struct {
+	Metrics          bool `json:"metrics" yaml:"metrics" toml:"metrics"`
+	TaskMetrics      bool `json:"task_metrics" yaml:"task_metrics" toml:"task_metrics"`
+	Webhooks         bool `json:"webhooks" yaml:"webhooks" toml:"webhooks"`
+	RequireAPITokens bool `json:"require_api_tokens" yaml:"require_api_tokens" toml:"require_api_tokens"`
+	RequireLogin     bool `json:"require_login" yaml:"require_login" toml:"require_login"`
+}
+
+// Duration reads and writes time.Duration
+// strings such as 30s or 1m30s
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// DefaultConfig is the setup used when nothing
+// is configured
+func DefaultConfig() Config {
+	return Config{
+		Port:            4000,
+		TimeZone:        "Local",
+		ShutdownTimeout: Duration(15 * time.Second),
+		Store: StoreConfig{
+			Driver:       StoreSqlite,
+			Path:         SQLITE_DEFAULT_PATH,
+			BusyTimeout:  Duration(SQLITE_BUSY_TIMEOUT),
+			MaxOpenConns: SQLITE_MAX_OPEN_CONNS,
+		},
+		Log: LogConfig{
+			Level:  LevelInfo.String(),
+			Format: LogFormatLogfmt,
+		},
+		Features: FeatureConfig{
+			Webhooks: true,
+		},
+		Backup: BackupConfig{
+			Dir:  BACKUP_DEFAULT_DIR,
+			Keep: BACKUP_DEFAULT_KEEP,
+		},
+	}
+}
+
+// configKey is a setting that can be overridden by
+// an environment variable and a flag
+type configKey struct {
+	name   string
+	env    string
+	flag   string
+	usage  string
+	isBool bool
+	set    func(*Config, string) error
+}
+
+var configKeys = []configKey{
+	{name: "port", env: "TIMETRACKER_PORT", flag: "port", usage: "port to listen on",
+		set: func(c *Config, v string) (err error) { c.Port, err = strconv.Atoi(v); return }},
+	{name: "store.driver", env: "TIMETRACKER_STORE", flag: "store", usage: "store driver, sqlite, postgres, kv or events",
+		set: func(c *Config, v string) error { c.Store.Driver = v; return nil }},
+	{name: "store.dsn", env: "TIMETRACKER_DSN", flag: "dsn", usage: "Postgres connection string",
+		set: func(c *Config, v string) error { c.Store.DSN = v; return nil }},
+	{name: "store.path", env: "TIMETRACKER_SQLITE_PATH", flag: "sqlite-path", usage: "SQLite database, KV store or event log file",
+		set: func(c *Config, v string) error { c.Store.Path = v; return nil }},
+	{name: "store.busy_timeout", env: "TIMETRACKER_SQLITE_BUSY_TIMEOUT", flag: "sqlite-busy-timeout", usage: "how long SQLite waits for a lock, such as 5s",
+		set: func(c *Config, v string) error { return c.Store.BusyTimeout.UnmarshalText([]byte(v)) }},
+	{name: "store.max_open_conns", env: "TIMETRACKER_SQLITE_MAX_OPEN_CONNS", flag: "sqlite-max-open-conns", usage: "most connections open to the SQLite database",
+		set: func(c *Config, v string) (err error) { c.Store.MaxOpenConns, err = strconv.Atoi(v); return }},
+	{name: "log.level", env: "TIMETRACKER_LOG_LEVEL", flag: "log-level", usage: "debug, info, warn or error",
+		set: func(c *Config, v string) error { c.Log.Level = v; return nil }},
+	{name: "log.format", env: "TIMETRACKER_LOG_FORMAT", flag: "log-format", usage: "logfmt or json",
+		set: func(c *Config, v string) error { c.Log.Format = v; return nil }},
+	{name: "time_zone", env: "TIMETRACKER_TIME_ZONE", flag: "time-zone", usage: "IANA time zone, such as Europe/Berlin, or Local",
+		set: func(c *Config, v string) error { c.TimeZone = v; return nil }},
+	{name: "shutdown_timeout", env: "TIMETRACKER_SHUTDOWN_TIMEOUT", flag: "shutdown-timeout", usage: "how long to wait for requests on shutdown",
+		set: func(c *Config, v string) error { return c.ShutdownTimeout.UnmarshalText([]byte(v)) }},
+	{name: "metrics_token", env: "TIMETRACKER_METRICS_TOKEN", flag: "metrics-token", usage: "bearer token scrapers send for /metrics",
+		set: func(c *Config, v string) error { c.MetricsToken = v; return nil }},
+	{name: "tls.cert", env: "TIMETRACKER_TLS_CERT", flag: "tls-cert", usage: "PEM certificate file, serves HTTPS",
+		set: func(c *Config, v string) error { c.TLS.Cert = v; return nil }},
+	{name: "tls.key", env: "TIMETRACKER_TLS_KEY", flag: "tls-key", usage: "PEM key file",
+		set: func(c *Config, v string) error { c.TLS.Key = v; return nil }},
+	{name: "tls.redirect_port", env: "TIMETRACKER_TLS_REDIRECT_PORT", flag: "tls-redirect-port", usage: "port to redirect plain HTTP to HTTPS from",
+		set: func(c *Config, v string) (err error) { c.TLS.RedirectPort, err = strconv.Atoi(v); return }},
+	{name: "features.metrics", env: "TIMETRACKER_METRICS", flag: "metrics", usage: "serve Prometheus metrics on /metrics", isBool: true,
+		set: func(c *Config, v string) (err error) { c.Features.Metrics, err = strconv.ParseBool(v); return }},
+	{name: "features.task_metrics", env: "TIMETRACKER_TASK_METRICS", flag: "task-metrics", usage: "label tracked seconds metrics with task names", isBool: true,
+		set: func(c *Config, v string) (err error) { c.Features.TaskMetrics, err = strconv.ParseBool(v); return }},
+	{name: "features.webhooks", env: "TIMETRACKER_WEBHOOKS", flag: "webhooks", usage: "serve webhook pages and deliver webhooks", isBool: true,
+		set: func(c *Config, v string) (err error) { c.Features.Webhooks, err = strconv.ParseBool(v); return }},
+	{name: "features.require_api_tokens", env: "TIMETRACKER_REQUIRE_API_TOKENS", flag: "require-api-tokens", usage: "reject API requests without a bearer token", isBool: true,
+		set: func(c *Config, v string) (err error) { c.Features.RequireAPITokens, err = strconv.ParseBool(v); return }},
+	{name: "features.require_login", env: "TIMETRACKER_REQUIRE_LOGIN", flag: "require-login", usage: "turn away browsers that have not signed in", isBool: true,
+		set: func(c *Config, v string) (err error) { c.Features.RequireLogin, err = strconv.ParseBool(v); return }},
+	{name: "backup.dir", env: "TIMETRACKER_BACKUP_DIR", flag: "backup-dir", usage: "directory for scheduled backups",
+		set: func(c *Config, v string) error { c.Backup.Dir = v; return nil }},
+	{name: "backup.interval", env: "TIMETRACKER_BACKUP_INTERVAL", flag: "backup-interval", usage: "take a backup this often while serving, such as 24h",
+		set: func(c *Config, v string) error { return c.Backup.Interval.UnmarshalText([]byte(v)) }},
+	{name: "backup.keep", env: "TIMETRACKER_BACKUP_KEEP", flag: "backup-keep", usage: "scheduled backups to keep, 0 keeps them all",
+		set: func(c *Config, v string) (err error) { c.Backup.Keep, err = strconv.Atoi(v); return }},
+}
+
+// LoadConfig layers the config file, environment and
+// flags over DefaultConfig
+func LoadConfig(args []string, getenv func(string) string) (Config, []string, error) {
+	c := DefaultConfig()
+	rest, err := c.Load(args, getenv)
+	return c, rest, err
+}
+
+// Load layers the config file named by -config or
+// TIMETRACKER_CONFIG, the environment and the flags in
+// args over c.  It returns the arguments after the
+// flags, such as a command.
+func (c *Config) Load(args []string, getenv func(string) string) ([]string, error) {
+
+	fs := flag.NewFlagSet("timetracker", flag.ContinueOnError)
+	path := fs.String("config", getenv(ConfigEnv), "YAML, TOML or JSON config file")
+
+	flags := map[string]string{}
+	for _, k := range configKeys {
+		fs.Var(&configFlag{key: k, values: flags}, k.flag, k.usage)
+	}
+
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if *path != "" {
+		err := c.LoadFile(*path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = c.applyEnv(getenv)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, k := range configKeys {
+		v, ok := flags[k.flag]
+		if !ok {
+			continue
+		}
+		err := k.set(c, v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -%s %q: %w", k.flag, v, err)
+		}
+	}
+
+	return fs.Args(), nil
+}
+
+// LoadFile reads a config file over c.  The format
+// follows the extension: .yaml, .yml, .toml or .json.
+// Unknown keys are errors, so typos do not go unseen.
+func (c *Config) LoadFile(path string) error {
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read config: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		err = dec.Decode(c)
+		if err == io.EOF {
+			err = nil
+		}
+	case ".toml":
+		var md toml.MetaData
+		md, err = toml.Decode(string(b), c)
+		if err == nil {
+			if undecoded := md.Undecoded(); len(undecoded) > 0 {
+				err = fmt.Errorf("unknown key %s", undecoded[0])
+			}
+		}
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(c)
+	default:
+		return fmt.Errorf("unable to read config %s: unknown format, use .yaml, .toml or .json", path)
+	}
+
+	if err != nil {
+		return fmt.Errorf("unable to read config %s: %w", path, err)
+	}
+	return nil
+}
+
+// applyEnv reads every TIMETRACKER_* variable that is
+// set.  The TIMETRACKER_DB_* variables used by the
+// compose files build a Postgres DSN when
+// TIMETRACKER_DSN is not set.
+func (c *Config) applyEnv(getenv func(string) string) error {
+
+	for _, k := range configKeys {
+		v := getenv(k.env)
+		if v == "" {
+			continue
+		}
+		err := k.set(c, v)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %w", k.env, v, err)
+		}
+	}
+
+	if getenv("TIMETRACKER_DSN") == "" && getenv("TIMETRACKER_DB_HOST") != "" {
+		dsn, err := buildDbConnection(getenv)
+		if err != nil {
+			return err
+		}
+		c.Store.DSN = dsn
+	}
+
+	return nil
+}
+
+// configFlag records the flags given on the command
+// line, so only those override the file and environment
+type configFlag struct {
+	key    configKey
+	values map[string]string
+}
+
+func (f *configFlag) String() string {
+	return ""
+}
+
+func (f *configFlag) Set(v string) error {
+	err := f.key.set(&Config{}, v)
+	if err != nil {
+		return err
+	}
+	f.values[f.key.flag] = v
+	return nil
+}
+
+func (f *configFlag) IsBoolFlag() bool {
+	return f.key.isBool
+}
+
+// Validate reports the first setting that
+// NewServer would not accept
+func (c Config) Validate() error {
+
+	switch c.Store.Driver {
+	case StoreSqlite:
+		if c.Store.Path == "" {
+			return fmt.Errorf("store.path must be set for the sqlite store")
+		}
+		if c.Store.BusyTimeout < 0 {
+			return fmt.Errorf("store.busy_timeout must not be negative")
+		}
+		if c.Store.MaxOpenConns < 1 {
+			return fmt.Errorf("store.max_open_conns must be at least 1")
+		}
+	case StorePostgres:
+		if c.Store.DSN == "" {
+			return fmt.Errorf("store.dsn must be set for the postgres store")
+		}
+	case StoreKV, StoreEvents:
+		if c.Store.Path == "" {
+			return fmt.Errorf("store.path must be set for the %s store", c.Store.Driver)
+		}
+	default:
+		return fmt.Errorf("unknown store driver %q, want %s, %s, %s or %s", c.Store.Driver, StoreSqlite, StorePostgres, StoreKV, StoreEvents)
+	}
+
+	if c.Port < 1 || c.Port > 65535 {
+		return fmt.Errorf("port %d out of range", c.Port)
+	}
+
+	_, err := ParseLevel(c.Log.Level)
+	if err != nil {
+		return err
+	}
+
+	if c.Log.Format != LogFormatLogfmt && c.Log.Format != LogFormatJSON {
+		return fmt.Errorf("unknown log format: %q", c.Log.Format)
+	}
+
+	if c.TimeZone != "" {
+		_, err := time.LoadLocation(c.TimeZone)
+		if err != nil {
+			return fmt.Errorf("unknown time zone %q: %w", c.TimeZone, err)
+		}
+	}
+
+	if c.ShutdownTimeout <= 0 {
+		return fmt.Errorf("shutdown timeout must be positive")
+	}
+
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return fmt.Errorf("tls.cert and tls.key must be set together")
+	}
+	if c.TLS.RedirectPort != 0 {
+		if c.TLS.Cert == "" {
+			return fmt.Errorf("tls.redirect_port needs tls.cert and tls.key")
+		}
+		if c.TLS.RedirectPort < 1 || c.TLS.RedirectPort > 65535 || c.TLS.RedirectPort == c.Port {
+			return fmt.Errorf("tls.redirect_port %d out of range or same as port", c.TLS.RedirectPort)
+		}
+	}
+
+	if c.Backup.Interval < 0 || c.Backup.Keep < 0 {
+		return fmt.Errorf("backup.interval and backup.keep must not be negative")
+	}
+	if c.Backup.Interval > 0 && c.Backup.Dir == "" {
+		return fmt.Errorf("backup.dir must be set for scheduled backups")
+	}
+
+	return nil
+}
+
+// Options translates the config into the Options
+// passed to NewServer.  Logs go to stdout.
+func (c Config) Options() ([]Option, error) {
+
+	err := c.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	level, _ := ParseLevel(c.Log.Level)
+	logger, err := NewLogger(os.Stdout, level, c.Log.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []Option{
+		WithPort(c.Port),
+		WithLogger(logger),
+		WithShutdownTimeout(time.Duration(c.ShutdownTimeout)),
+	}
+
+	switch c.Store.Driver {
+	case StorePostgres:
+		opts = append(opts, WithPostgresStore(c.Store.DSN))
+	case StoreKV:
+		opts = append(opts, WithKVStore(c.Store.Path))
+	case StoreEvents:
+		opts = append(opts, WithEventStore(c.Store.Path))
+	default:
+		opts = append(opts, WithSqliteStore(c.Store.Path,
+			SqliteBusyTimeout(time.Duration(c.Store.BusyTimeout)),
+			SqliteMaxOpenConns(c.Store.MaxOpenConns)))
+	}
+
+	if c.TLS.Cert != "" {
+		opts = append(opts, WithTLS(c.TLS.Cert, c.TLS.Key))
+	}
+	if c.TLS.RedirectPort != 0 {
+		opts = append(opts, WithHTTPRedirect(c.TLS.RedirectPort))
+	}
+
+	if c.TimeZone != "" {
+		opts = append(opts, WithTimeZone(c.TimeZone))
+	}
+	if c.Features.Metrics {
+		opts = append(opts, WithMetrics())
+	}
+	if c.MetricsToken != "" {
+		opts = append(opts, WithMetricsToken(c.MetricsToken))
+	}
+	if c.Features.TaskMetrics {
+		opts = append(opts, WithTaskMetrics())
+	}
+	if !c.Features.Webhooks {
+		opts = append(opts, WithNoWebhooks())
+	}
+	if c.Features.RequireAPITokens {
+		opts = append(opts, WithRequiredAPITokens())
+	}
+	if c.Features.RequireLogin {
+		opts = append(opts, WithRequiredLogin())
+	}
+	if c.Backup.Interval > 0 {
+		opts = append(opts, WithBackups(c.Backup.Dir, time.Duration(c.Backup.Interval), c.Backup.Keep))
+	}
+
+	return opts, nil
+}
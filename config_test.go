@@ -0,0 +1,282 @@
+package timetracker_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"timetracker"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// env returns a getenv over a fixed set of variables
+func env(vars map[string]string) func(string) string {
+	return func(key string) string {
+		return vars[key]
+	}
+}
+
+func writeConfig(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFormats(t *testing.T) {
+	t.Parallel()
+
+	want := timetracker.DefaultConfig()
+	want.Port = 8080
+	want.TimeZone = "Europe/Berlin"
+	want.ShutdownTimeout = timetracker.Duration(30 * time.Second)
+	want.Store.Driver = "postgres"
+	want.Store.DSN = "host=db dbname=timetracker"
+	want.Log = timetracker.LogConfig{Level: "debug", Format: "json"}
+	want.Features = timetracker.FeatureConfig{Metrics: true, Webhooks: false}
+
+	files := map[string]string{
+		"config.yaml": `
+port: 8080
+time_zone: Europe/Berlin
+shutdown_timeout: 30s
+store:
+  driver: postgres
+  dsn: host=db dbname=timetracker
+log:
+  level: debug
+  format: json
+features:
+  metrics: true
+  webhooks: false
+`,
+		"config.toml": `
+port = 8080
+time_zone = "Europe/Berlin"
+shutdown_timeout = "30s"
+
+[store]
+driver = "postgres"
+dsn = "host=db dbname=timetracker"
+
+[log]
+level = "debug"
+format = "json"
+
+[features]
+metrics = true
+webhooks = false
+`,
+		"config.json": `{
+	"port": 8080,
+	"time_zone": "Europe/Berlin",
+	"shutdown_timeout": "30s",
+	"store": {"driver": "postgres", "dsn": "host=db dbname=timetracker"},
+	"log": {"level": "debug", "format": "json"},
+	"features": {"metrics": true, "webhooks": false}
+}`,
+	}
+
+	for name, content := range files {
+		path := writeConfig(t, name, content)
+
+		got, _, err := timetracker.LoadConfig([]string{"-config", path}, env(nil))
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		if !cmp.Equal(want, got) {
+			t.Error(name, cmp.Diff(want, got))
+		}
+	}
+
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	t.Parallel()
+
+	path := writeConfig(t, "config.yml", `
+port: 8080
+log:
+  level: debug
+  format: json
+store:
+  path: /var/lib/timetracker/file.db
+`)
+
+	vars := map[string]string{
+		"TIMETRACKER_CONFIG":          path,
+		"TIMETRACKER_PORT":            "9090",
+		"TIMETRACKER_LOG_LEVEL":       "warn",
+		"TIMETRACKER_METRICS":         "1",
+		"TIMETRACKER_BACKUP_INTERVAL": "24h",
+	}
+
+	got, args, err := timetracker.LoadConfig([]string{"-port", "7070", "-webhooks=false", "import-ics", "-dry-run", "cal.ics"}, env(vars))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := timetracker.DefaultConfig()
+	want.Port = 7070
+	want.Log = timetracker.LogConfig{Level: "warn", Format: "json"}
+	want.Store.Path = "/var/lib/timetracker/file.db"
+	want.Features = timetracker.FeatureConfig{Metrics: true, Webhooks: false}
+	want.Backup.Interval = timetracker.Duration(24 * time.Hour)
+
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+
+	wantArgs := []string{"import-ics", "-dry-run", "cal.ics"}
+	if !cmp.Equal(wantArgs, args) {
+		t.Error(cmp.Diff(wantArgs, args))
+	}
+
+}
+
+func TestLoadConfigDBEnvironment(t *testing.T) {
+	t.Parallel()
+
+	vars := map[string]string{
+		"TIMETRACKER_STORE":   "postgres",
+		"TIMETRACKER_DB_HOST": "postgres",
+		"TIMETRACKER_DB_PORT": "5432",
+		"TIMETRACKER_DB_USER": "postgres",
+		"TIMETRACKER_DB_NAME": "timetracker",
+	}
+
+	got, _, err := timetracker.LoadConfig(nil, env(vars))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "host=postgres port=5432 user=postgres dbname=timetracker sslmode=disable"
+	if want != got.Store.DSN {
+		t.Errorf("want: %q, got: %q", want, got.Store.DSN)
+	}
+
+	// an explicit DSN wins
+	vars["TIMETRACKER_DSN"] = "host=elsewhere"
+	got, _, err = timetracker.LoadConfig(nil, env(vars))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Store.DSN != "host=elsewhere" {
+		t.Errorf("want: host=elsewhere, got: %q", got.Store.DSN)
+	}
+
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		description string
+		file        string
+		content     string
+		args        []string
+		vars        map[string]string
+		want        string
+	}{
+		{description: "unknown yaml key", file: "c.yaml", content: "prot: 80\n", want: "prot"},
+		{description: "unknown toml key", file: "c.toml", content: "[store]\ndirver = \"sqlite\"\n", want: "store.dirver"},
+		{description: "unknown json key", file: "c.json", content: `{"log": {"lvl": "debug"}}`, want: "lvl"},
+		{description: "unknown format", file: "c.ini", content: "port=80", want: "unknown format"},
+		{description: "bad duration", file: "c.yaml", content: "shutdown_timeout: soon\n", want: "soon"},
+		{description: "bad env", vars: map[string]string{"TIMETRACKER_PORT": "eighty"}, want: "TIMETRACKER_PORT"},
+		{description: "bad flag", args: []string{"-metrics=maybe"}, want: "metrics"},
+		{description: "partial db env", vars: map[string]string{"TIMETRACKER_DB_HOST": "postgres"}, want: "TIMETRACKER_DB_PORT"},
+		{description: "missing file", args: []string{"-config", "/nonexistent/config.yaml"}, want: "unable to read config"},
+	}
+
+	for _, tc := range testCases {
+		args := tc.args
+		if tc.file != "" {
+			args = []string{"-config", writeConfig(t, tc.file, tc.content)}
+		}
+
+		_, _, err := timetracker.LoadConfig(args, env(tc.vars))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: want error containing %q, got: %v", tc.description, tc.want, err)
+		}
+	}
+
+}
+
+func TestConfigValidate(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		description string
+		change      func(*timetracker.Config)
+		want        string
+	}{
+		{description: "driver", change: func(c *timetracker.Config) { c.Store.Driver = "mysql" }, want: "unknown store driver"},
+		{description: "postgres without dsn", change: func(c *timetracker.Config) { c.Store.Driver = "postgres" }, want: "store.dsn"},
+		{description: "sqlite without path", change: func(c *timetracker.Config) { c.Store.Path = "" }, want: "store.path"},
+		{description: "kv without path", change: func(c *timetracker.Config) { c.Store.Driver, c.Store.Path = "kv", "" }, want: "store.path"},
+		{description: "events without path", change: func(c *timetracker.Config) { c.Store.Driver, c.Store.Path = "events", "" }, want: "store.path"},
+		{description: "port", change: func(c *timetracker.Config) { c.Port = 70000 }, want: "port"},
+		{description: "log level", change: func(c *timetracker.Config) { c.Log.Level = "loud" }, want: "log level"},
+		{description: "log format", change: func(c *timetracker.Config) { c.Log.Format = "xml" }, want: "log format"},
+		{description: "time zone", change: func(c *timetracker.Config) { c.TimeZone = "Mars/Olympus" }, want: "time zone"},
+		{description: "shutdown timeout", change: func(c *timetracker.Config) { c.ShutdownTimeout = 0 }, want: "shutdown timeout"},
+		{description: "backup keep", change: func(c *timetracker.Config) { c.Backup.Keep = -1 }, want: "backup.keep"},
+		{description: "sqlite connections", change: func(c *timetracker.Config) { c.Store.MaxOpenConns = 0 }, want: "store.max_open_conns"},
+		{description: "backup dir", change: func(c *timetracker.Config) { c.Backup.Interval, c.Backup.Dir = timetracker.Duration(time.Hour), "" }, want: "backup.dir"},
+	}
+
+	err := timetracker.DefaultConfig().Validate()
+	if err != nil {
+		t.Fatalf("default config: %s", err)
+	}
+
+	for _, tc := range testCases {
+		c := timetracker.DefaultConfig()
+		tc.change(&c)
+
+		_, err := c.Options()
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: want error containing %q, got: %v", tc.description, tc.want, err)
+		}
+	}
+
+}
+
+func TestConfigOptions(t *testing.T) {
+	t.Parallel()
+
+	c := timetracker.DefaultConfig()
+	c.Port = 4321
+	c.Store.Path = filepath.Join(t.TempDir(), "timetracker.db")
+	c.Log.Level = "error"
+	c.Features.Metrics = true
+	c.Features.Webhooks = false
+
+	opts, err := c.Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := timetracker.NewServer(opts...)
+	if s.Port != 4321 {
+		t.Errorf("want: port 4321, got: %d", s.Port)
+	}
+	if s.TaskStore == nil {
+		t.Error("want: sqlite store, got: nil")
+	}
+	if s.WebhookStore != nil {
+		t.Error("want: webhooks turned off")
+	}
+
+	_, err = os.Stat(c.Store.Path)
+	if err != nil {
+		t.Errorf("want: database at %s, got: %s", c.Store.Path, err)
+	}
+
+}
@@ -0,0 +1,599 @@
+package timetracker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// COPY_BATCH_SIZE rows are copied per transaction,
+	// and progress is saved after each batch
+	COPY_BATCH_SIZE int = 500
+
+	// COPY_STATE_FILE is where copy-store keeps its
+	// progress, so an interrupted copy can resume
+	COPY_STATE_FILE string = "copy-store.state.json"
+
+	// at most COPY_DIFF_LIMIT differences
+	// are listed per table
+	COPY_DIFF_LIMIT int = 10
+)
+
+// tableKeys are the columns that identify a row of each
+// table in SchemaTables.  Tables are copied in key order
+// and rows matched on their key.  task_session has no
+// key and is copied whole.
+var tableKeys = map[string][]string{
+	"tasks":                 {"id"},
+	"task_session":          nil,
+	"goals":                 {"id"},
+	"task_templates":        {"id"},
+	"imported_events":       {"user_id", "uid"},
+	"webhooks":              {"id"},
+	"webhook_deliveries":    {"id"},
+	"api_tokens":            {"id"},
+	"users":                 {"id"},
+	"user_sessions":         {"hash"},
+	"workspaces":            {"id"},
+	"workspace_members":     {"workspace_id", "user_id"},
+	"workspace_invitations": {"id"},
+	"workspace_projects":    {"workspace_id", "project"},
+	"audit_log":             {"id"},
+}
+
+// appendOnlyTables reject updates, so rows that
+// are already there are left alone
+var appendOnlyTables = []string{"audit_log"}
+
+// CopyState is the progress of a copy.  LastKey is the
+// key of the last row copied of each table and Done
+// marks the tables that are finished.
+type CopyState struct {
+	Source  string                   `json:"source"`
+	Target  string                   `json:"target"`
+	LastKey map[string][]interface{} `json:"last_key"`
+	Done    map[string]bool          `json:"done"`
+}
+
+// CopyCount is what a copy did to one table
+type CopyCount struct {
+	Table  string
+	Source int
+	Copied int
+	Target int
+}
+
+// CopyDiff is a row that differs between the stores
+// after a copy, identified by its key
+type CopyDiff struct {
+	Table  string
+	Key    string
+	Reason string
+}
+
+// CopyReport is the outcome of CopyStore
+type CopyReport struct {
+	Counts []CopyCount
+	Diffs  []CopyDiff
+}
+
+// CopyOptions tunes CopyStore.  Names describe the
+// stores in the state file, so a state is only resumed
+// for the same pair of stores.
+type CopyOptions struct {
+	SourceName string
+	TargetName string
+	StateFile  string
+	BatchSize  int
+	VerifyOnly bool
+}
+
+// CopyStore copies every table in SchemaTables from src to
+// dst, keeping ids and timestamps, then compares the two.
+// Rows already in dst are overwritten.  Progress is saved
+// to StateFile after each batch, and a copy started again
+// with the same StateFile carries on where it stopped.
+// The state file is removed once the stores match.
+func CopyStore(ctx context.Context, src, dst *DBStore, opts CopyOptions) (CopyReport, error) {
+
+	if opts.BatchSize < 1 {
+		opts.BatchSize = COPY_BATCH_SIZE
+	}
+
+	err := dst.CheckSchema(ctx)
+	if err != nil {
+		return CopyReport{}, fmt.Errorf("target store: %w", err)
+	}
+
+	state, err := loadCopyState(opts)
+	if err != nil {
+		return CopyReport{}, err
+	}
+
+	var report CopyReport
+	for _, table := range SchemaTables {
+		count := CopyCount{Table: table}
+
+		if !opts.VerifyOnly && !state.Done[table] {
+			count.Copied, err = copyTable(ctx, src, dst, table, opts, &state)
+			if err != nil {
+				return report, err
+			}
+		}
+
+		diffs, counts, err := compareTable(ctx, src, dst, table)
+		if err != nil {
+			return report, err
+		}
+		count.Source, count.Target = counts[0], counts[1]
+
+		report.Counts = append(report.Counts, count)
+		report.Diffs = append(report.Diffs, diffs...)
+	}
+
+	if !opts.VerifyOnly && len(report.Diffs) == 0 && opts.StateFile != "" {
+		err := os.Remove(opts.StateFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return report, fmt.Errorf("unable to remove copy state: %w", err)
+		}
+	}
+
+	return report, nil
+}
+
+func loadCopyState(opts CopyOptions) (CopyState, error) {
+
+	state := CopyState{
+		Source:  opts.SourceName,
+		Target:  opts.TargetName,
+		LastKey: map[string][]interface{}{},
+		Done:    map[string]bool{},
+	}
+
+	if opts.StateFile == "" {
+		return state, nil
+	}
+
+	f, err := os.Open(opts.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return CopyState{}, fmt.Errorf("unable to read copy state: %w", err)
+	}
+	defer f.Close()
+
+	var saved CopyState
+	dec := json.NewDecoder(f)
+	dec.UseNumber()
+	err = dec.Decode(&saved)
+	if err != nil {
+		return CopyState{}, fmt.Errorf("unable to read copy state %s: %w", opts.StateFile, err)
+	}
+
+	if saved.Source != opts.SourceName || saved.Target != opts.TargetName {
+		return CopyState{}, fmt.Errorf("copy state %s is for %s to %s, remove it to start over", opts.StateFile, saved.Source, saved.Target)
+	}
+
+	// ids compare as numbers, not as the text
+	// json.Number would be bound as
+	for table, key := range saved.LastKey {
+		for i, v := range key {
+			if n, ok := v.(json.Number); ok {
+				if id, err := n.Int64(); err == nil {
+					key[i] = id
+				}
+			}
+		}
+		state.LastKey[table] = key
+	}
+	if saved.Done != nil {
+		state.Done = saved.Done
+	}
+	return state, nil
+}
+
+func saveCopyState(opts CopyOptions, state CopyState) error {
+
+	if opts.StateFile == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("unable to save copy state: %w", err)
+	}
+
+	// written aside and renamed, so a crash
+	// never leaves half a state file
+	tmp := opts.StateFile + ".tmp"
+	err = os.WriteFile(tmp, b, 0o600)
+	if err == nil {
+		err = os.Rename(tmp, opts.StateFile)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to save copy state: %w", err)
+	}
+	return nil
+}
+
+// copyColumns are the columns of table both stores
+// have, in the source's order
+func copyColumns(ctx context.Context, src, dst *DBStore, table string) ([]string, error) {
+
+	from, err := src.tableColumns(ctx, src.Db, table)
+	if err != nil {
+		return nil, fmt.Errorf("source store: %w", err)
+	}
+	to, err := dst.tableColumns(ctx, dst.Db, table)
+	if err != nil {
+		return nil, fmt.Errorf("target store: %w", err)
+	}
+
+	var columns []string
+	for _, c := range from {
+		if containsString(to, c) {
+			columns = append(columns, c)
+		}
+	}
+	return columns, nil
+}
+
+// copyTable copies the rows of table after the last key
+// in state, one batch per transaction in dst
+func copyTable(ctx context.Context, src, dst *DBStore, table string, opts CopyOptions, state *CopyState) (int, error) {
+
+	columns, err := copyColumns(ctx, src, dst, table)
+	if err != nil {
+		return 0, err
+	}
+
+	keys, ok := tableKeys[table]
+	if !ok {
+		return 0, fmt.Errorf("no key known for table %s", table)
+	}
+
+	copied := 0
+	for {
+		rows, err := readBatch(ctx, src, table, columns, keys, state.LastKey[table], opts.BatchSize)
+		if err != nil {
+			return copied, err
+		}
+
+		err = writeBatch(ctx, dst, table, columns, keys, rows)
+		if err != nil {
+			return copied, err
+		}
+		copied += len(rows)
+
+		// a table without a key is read whole
+		if keys == nil || len(rows) < opts.BatchSize {
+			break
+		}
+
+		state.LastKey[table] = keyOf(columns, keys, rows[len(rows)-1])
+		err = saveCopyState(opts, *state)
+		if err != nil {
+			return copied, err
+		}
+	}
+
+	state.Done[table] = true
+	return copied, saveCopyState(opts, *state)
+}
+
+// readBatch reads up to limit rows of table ordered by
+// keys, starting after the row with key after
+func readBatch(ctx context.Context, db *DBStore, table string, columns, keys []string, after []interface{}, limit int) ([][]interface{}, error) {
+
+	query := fmt.Sprintf("SELECT %s FROM %s", strings.Join(columns, ", "), table)
+	var args []interface{}
+
+	if keys != nil {
+		if len(after) == len(keys) {
+			args = append(args, after...)
+			query += fmt.Sprintf(" WHERE (%s) > (%s)", strings.Join(keys, ", "), placeholders(1, len(keys)))
+		}
+		args = append(args, limit)
+		query += fmt.Sprintf(" ORDER BY %s LIMIT $%d", strings.Join(keys, ", "), len(args))
+	}
+
+	return queryValues(ctx, db.Db, query, len(columns), args...)
+}
+
+// queryValues returns every row of a query.  Bytes
+// are returned as strings, as text and numeric
+// columns may be read as bytes.
+func queryValues(ctx context.Context, q queryer, query string, n int, args ...interface{}) ([][]interface{}, error) {
+
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read rows: %w", err)
+	}
+	defer rows.Close()
+
+	var result [][]interface{}
+	for rows.Next() {
+		values := make([]interface{}, n)
+		dest := make([]interface{}, n)
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		err := rows.Scan(dest...)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read rows: %w", err)
+		}
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+		result = append(result, values)
+	}
+	return result, rows.Err()
+}
+
+// writeBatch inserts rows into table in one transaction,
+// replacing rows with the same key.  A table without a
+// key is emptied first.
+func writeBatch(ctx context.Context, db *DBStore, table string, columns, keys []string, rows [][]interface{}) error {
+
+	tx, err := db.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("unable to begin copy of %s: %w", table, err)
+	}
+	defer tx.Rollback()
+
+	if keys == nil {
+		_, err := tx.ExecContext(ctx, "DELETE FROM "+table)
+		if err != nil {
+			return fmt.Errorf("unable to empty %s: %w", table, err)
+		}
+	}
+
+	if len(rows) > 0 {
+		stmt, err := tx.PrepareContext(ctx, upsertQuery(table, columns, keys))
+		if err != nil {
+			return fmt.Errorf("unable to prepare copy of %s: %w", table, err)
+		}
+		defer stmt.Close()
+
+		for _, row := range rows {
+			_, err := stmt.ExecContext(ctx, row...)
+			if err != nil {
+				return fmt.Errorf("unable to copy %s row %s: %w", table, formatKey(keyOf(columns, keys, row)), err)
+			}
+		}
+	}
+
+	if db.Driver == "postgres" && containsString(columns, "id") {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(SQLResetSequence, table, table))
+		if err != nil {
+			return fmt.Errorf("unable to reset %s ids: %w", table, err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("unable to commit copy of %s: %w", table, err)
+	}
+	return nil
+}
+
+// upsertQuery inserts a row or, when its key exists,
+// overwrites it.  Both SQLite and Postgres accept
+// ON CONFLICT with excluded.
+func upsertQuery(table string, columns, keys []string) string {
+
+	query := fmt.Sprintf("INSERT INTO %s(%s) VALUES(%s)", table, strings.Join(columns, ", "), placeholders(1, len(columns)))
+	if keys == nil {
+		return query
+	}
+
+	var set []string
+	for _, c := range columns {
+		if !containsString(keys, c) {
+			set = append(set, fmt.Sprintf("%s=excluded.%s", c, c))
+		}
+	}
+
+	conflict := fmt.Sprintf(" ON CONFLICT (%s) DO ", strings.Join(keys, ", "))
+	if len(set) == 0 || containsString(appendOnlyTables, table) {
+		return query + conflict + "NOTHING"
+	}
+	return query + conflict + "UPDATE SET " + strings.Join(set, ", ")
+}
+
+func placeholders(from, n int) string {
+
+	p := make([]string, n)
+	for i := range p {
+		p[i] = fmt.Sprintf("$%d", from+i)
+	}
+	return strings.Join(p, ", ")
+}
+
+func keyOf(columns, keys []string, row []interface{}) []interface{} {
+
+	var key []interface{}
+	for _, k := range keys {
+		for i, c := range columns {
+			if c == k {
+				key = append(key, row[i])
+			}
+		}
+	}
+	return key
+}
+
+func formatKey(key []interface{}) string {
+
+	parts := make([]string, len(key))
+	for i, v := range key {
+		parts[i] = normalizeValue(v)
+	}
+	return strings.Join(parts, ",")
+}
+
+// compareTable lists the rows of table that are
+// missing, extra or different in dst, and returns
+// the row counts of src and dst
+func compareTable(ctx context.Context, src, dst *DBStore, table string) ([]CopyDiff, [2]int, error) {
+
+	columns, err := copyColumns(ctx, src, dst, table)
+	if err != nil {
+		return nil, [2]int{}, err
+	}
+	keys := tableKeys[table]
+
+	query := fmt.Sprintf("SELECT %s FROM %s", strings.Join(columns, ", "), table)
+	from, err := queryValues(ctx, src.Db, query, len(columns))
+	if err != nil {
+		return nil, [2]int{}, fmt.Errorf("source store: %w", err)
+	}
+	to, err := queryValues(ctx, dst.Db, query, len(columns))
+	if err != nil {
+		return nil, [2]int{}, fmt.Errorf("target store: %w", err)
+	}
+	counts := [2]int{len(from), len(to)}
+
+	// without a key, whole rows are the key
+	if keys == nil {
+		keys = columns
+	}
+
+	target := map[string][]interface{}{}
+	for _, row := range to {
+		target[formatKey(keyOf(columns, keys, row))] = row
+	}
+
+	var diffs []CopyDiff
+	add := func(key, reason string) {
+		if len(diffs) < COPY_DIFF_LIMIT {
+			diffs = append(diffs, CopyDiff{Table: table, Key: key, Reason: reason})
+		}
+	}
+
+	for _, row := range from {
+		key := formatKey(keyOf(columns, keys, row))
+		other, ok := target[key]
+		if !ok {
+			add(key, "missing in target")
+			continue
+		}
+		delete(target, key)
+
+		var differ []string
+		for i, c := range columns {
+			if normalizeValue(row[i]) != normalizeValue(other[i]) {
+				differ = append(differ, c)
+			}
+		}
+		if len(differ) > 0 {
+			add(key, "differs in "+strings.Join(differ, ", "))
+		}
+	}
+
+	var extra []string
+	for key := range target {
+		extra = append(extra, key)
+	}
+	sort.Strings(extra)
+	for _, key := range extra {
+		add(key, "only in target")
+	}
+
+	return diffs, counts, nil
+}
+
+// normalizeValue formats a value the same way whichever
+// driver read it.  Numbers may be integers, floats or
+// numeric text and Postgres keeps microseconds.
+func normalizeValue(v interface{}) string {
+
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case time.Time:
+		return v.UTC().Round(time.Microsecond).Format(time.RFC3339Nano)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case json.Number:
+		return normalizeValue(v.String())
+	case string:
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return strconv.FormatFloat(f, 'g', -1, 64)
+		}
+		return v
+	}
+	return fmt.Sprint(v)
+}
+
+// WriteCopyReport prints the row counts of each table
+// and the differences found after a copy
+func WriteCopyReport(w io.Writer, report CopyReport) {
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "table\tsource\tcopied\ttarget")
+	for _, c := range report.Counts {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\n", c.Table, c.Source, c.Copied, c.Target)
+	}
+	tw.Flush()
+
+	if len(report.Diffs) == 0 {
+		fmt.Fprintln(w, "verified: every table matches")
+		return
+	}
+
+	fmt.Fprintf(w, "%d differences:\n", len(report.Diffs))
+	for _, d := range report.Diffs {
+		fmt.Fprintf(w, "%s %s: %s\n", d.Table, d.Key, d.Reason)
+	}
+}
+
+// OpenStore opens a SQLite store at the path
+// location or a Postgres store at the DSN location
+func OpenStore(driver, location string) (*DBStore, error) {
+
+	if location == "" {
+		return nil, fmt.Errorf("no location given for the %s store", driver)
+	}
+
+	switch driver {
+	case StoreSqlite:
+		return NewSqliteStore(location)
+	case StorePostgres:
+		return NewPostgresStore(location)
+	}
+	return nil, fmt.Errorf("unknown store driver %q, want %s or %s", driver, StoreSqlite, StorePostgres)
+}
+
+// StoreName describes a store in a copy state file
+// without the password a DSN may hold
+func StoreName(driver, location string) string {
+
+	if driver == StoreSqlite {
+		return driver + ":" + location
+	}
+
+	var parts []string
+	for _, field := range strings.Fields(location) {
+		if !strings.HasPrefix(field, "password=") {
+			parts = append(parts, field)
+		}
+	}
+	return driver + ":" + strings.Join(parts, " ")
+}
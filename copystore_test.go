@@ -0,0 +1,148 @@
+package timetracker_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"timetracker"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCopyStore(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	statePath := filepath.Join(dir, "copy.state.json")
+
+	src := newSqliteStore(t, filepath.Join(dir, "src.db"))
+	dst := newSqliteStore(t, filepath.Join(dir, "dst.db"))
+
+	start := time.Date(2021, 1, 1, 9, 0, 0, 0, time.UTC)
+	for _, name := range []string{"deploy", "review", "standup"} {
+		_, err := src.Create(timetracker.Task{Name: name, Project: "ops", StartTime: start, ElapsedTimeSec: 90})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := src.Db.Exec("UPDATE tasks SET deleted_at=$1 WHERE id=2", start)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := timetracker.CopyOptions{SourceName: "src", TargetName: "dst", StateFile: statePath, BatchSize: 2}
+	report, err := timetracker.CopyStore(ctx, src, dst, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Diffs) != 0 {
+		t.Errorf("want: no differences, got: %+v", report.Diffs)
+	}
+	want := timetracker.CopyCount{Table: "tasks", Source: 3, Copied: 3, Target: 3}
+	if report.Counts[0] != want {
+		t.Errorf("want: %+v, got: %+v", want, report.Counts[0])
+	}
+	if len(report.Counts) != len(timetracker.SchemaTables) {
+		t.Errorf("want: every table counted, got: %d", len(report.Counts))
+	}
+	if _, err := os.Stat(statePath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("want: state file removed after a clean copy, got: %v", err)
+	}
+
+	task, err := dst.GetTask(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Name != "standup" || !task.StartTime.Equal(start) {
+		t.Errorf("want: standup started at %s, got: %+v", start, task)
+	}
+
+	_, err = dst.Db.Exec("UPDATE tasks SET task_name='renamed' WHERE id=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err = timetracker.CopyStore(ctx, src, dst, timetracker.CopyOptions{VerifyOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantDiffs := []timetracker.CopyDiff{{Table: "tasks", Key: "1", Reason: "differs in task_name"}}
+	if !cmp.Equal(wantDiffs, report.Diffs) {
+		t.Error(cmp.Diff(wantDiffs, report.Diffs))
+	}
+
+	var out bytes.Buffer
+	timetracker.WriteCopyReport(&out, report)
+	if !strings.Contains(out.String(), "tasks 1: differs in task_name") {
+		t.Errorf("want: difference in the report, got:\n%s", out.String())
+	}
+
+}
+
+func TestCopyStoreResume(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	statePath := filepath.Join(dir, "copy.state.json")
+
+	src := newSqliteStore(t, filepath.Join(dir, "src.db"))
+	dst := newSqliteStore(t, filepath.Join(dir, "dst.db"))
+
+	for _, name := range []string{"deploy", "review", "standup"} {
+		_, err := src.Create(timetracker.Task{Name: name, StartTime: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// as if a copy stopped after the second task
+	err := os.WriteFile(statePath, []byte(`{"source":"src","target":"dst","last_key":{"tasks":[2]},"done":{}}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := timetracker.CopyOptions{SourceName: "src", TargetName: "dst", StateFile: statePath}
+	report, err := timetracker.CopyStore(ctx, src, dst, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Counts[0].Copied != 1 {
+		t.Errorf("want: only the third task copied, got: %+v", report.Counts[0])
+	}
+	wantDiffs := []timetracker.CopyDiff{
+		{Table: "tasks", Key: "1", Reason: "missing in target"},
+		{Table: "tasks", Key: "2", Reason: "missing in target"},
+	}
+	if !cmp.Equal(wantDiffs, report.Diffs) {
+		t.Error(cmp.Diff(wantDiffs, report.Diffs))
+	}
+	if _, err := os.Stat(statePath); err != nil {
+		t.Errorf("want: state kept while the stores differ, got: %v", err)
+	}
+
+	opts.TargetName = "elsewhere"
+	_, err = timetracker.CopyStore(ctx, src, dst, opts)
+	if err == nil {
+		t.Error("state for other stores: want: error, got: nil")
+	}
+
+}
+
+func newSqliteStore(t *testing.T, path string) *timetracker.DBStore {
+	t.Helper()
+
+	store, err := timetracker.NewSqliteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
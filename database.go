@@ -1,199 +1,1449 @@
 package timetracker
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"strings"
+	"time"
 )
 
 const (
-	SQLByName            string = `SELECT task_name ,SUM(elapsed_time) elapsed_time FROM tasks WHERE task_name=$1 GROUP BY task_name`
-	SQLBySession         string = `SELECT id, task_name, start_time,elapsed_time FROM tasks t INNER JOIN task_session s ON t.id=s.taskid`
-	SQLInsert            string = `INSERT INTO tasks(task_name, start_time) VALUES($1, $2) RETURNING id`
-	SQLReport            string = `SELECT task_name, SUM(elapsed_time) total_time FROM tasks GROUP BY task_name ORDER BY SUM(elapsed_time) DESC`
-	SQLLatestTasks       string = `SELECT task_name, start_time, elapsed_time FROM tasks ORDER BY start_time DESC LIMIT 10`
-	SQLUpdateStopped     string = `UPDATE tasks SET elapsed_time=$1 FROM task_session  WHERE tasks.id = task_session.taskid`
-	SQLDelete            string = `DELETE FROM tasks WHERE id=$1`
-	SQLInsertTaskSession string = `INSERT INTO task_session (taskid) VALUES ($1)`
-	SQLDeleteTaskSession string = `DELETE FROM task_session`
+	// SQLVisibleTo matches the tasks user $1 may see: their
+	// own, and as a workspace owner or admin, the tasks of
+	// members in the workspace's projects.  $1 of 0 is
+	// every user.
+	SQLVisibleTo string = `($1 = 0 OR tasks.user_id = $1 OR EXISTS (SELECT 1 FROM workspace_projects p INNER JOIN workspace_members m ON m.workspace_id=p.workspace_id INNER JOIN workspace_members v ON v.workspace_id=p.workspace_id WHERE p.project=tasks.project AND m.user_id=tasks.user_id AND v.user_id=$1 AND v.role IN ('owner', 'admin')))`
+
+	SQLByName            string = `SELECT task_name ,SUM(elapsed_time) elapsed_time FROM tasks WHERE ` + SQLVisibleTo + ` AND task_name=$2 AND deleted_at IS NULL GROUP BY task_name`
+	SQLBySession         string = `SELECT t.id, t.task_name, t.project, t.tags, t.notes, t.start_time, t.elapsed_time, t.user_id FROM tasks t INNER JOIN task_session s ON t.id=s.taskid WHERE s.user_id=$1 AND t.deleted_at IS NULL`
+	SQLCountRunning      string = `SELECT COUNT(*) FROM tasks t INNER JOIN task_session s ON t.id=s.taskid WHERE t.elapsed_time = 0 AND t.deleted_at IS NULL`
+	SQLInsert            string = `INSERT INTO tasks(task_name, project, tags, notes, start_time, user_id) VALUES($1, $2, $3, $4, $5, $6) RETURNING id`
+	SQLReport            string = `SELECT task_name, SUM(elapsed_time) total_time FROM tasks WHERE ` + SQLVisibleTo + ` AND deleted_at IS NULL GROUP BY task_name ORDER BY SUM(elapsed_time) DESC`
+	SQLReportSince       string = `SELECT task_name, SUM(elapsed_time) total_time FROM tasks WHERE ` + SQLVisibleTo + ` AND start_time >= $2 AND deleted_at IS NULL GROUP BY task_name ORDER BY SUM(elapsed_time) DESC`
+	SQLProjectReport     string = `SELECT project, SUM(elapsed_time) total_time FROM tasks WHERE ` + SQLVisibleTo + ` AND project <> '' AND start_time >= $2 AND deleted_at IS NULL GROUP BY project ORDER BY SUM(elapsed_time) DESC`
+	SQLListTasks         string = `SELECT id, task_name, project, tags, notes, start_time, elapsed_time, user_id FROM tasks`
+	SQLAllTasks          string = `SELECT id, task_name, project, tags, notes, start_time, elapsed_time, user_id FROM tasks WHERE deleted_at IS NULL ORDER BY start_time`
+	SQLCompletedTasks    string = `SELECT id, task_name, project, tags, notes, start_time, elapsed_time, user_id FROM tasks WHERE ` + SQLVisibleTo + ` AND deleted_at IS NULL AND elapsed_time > 0 AND start_time >= $2 AND start_time < $3 AND (project = $4 OR $4 = '') AND ',' || tags || ',' LIKE $5 ESCAPE '\' ORDER BY start_time`
+	SQLSearchSqlite      string = `SELECT tasks.id, tasks.task_name, tasks.project, tasks.tags, tasks.notes, tasks.start_time, tasks.elapsed_time, tasks.user_id, -bm25(tasks_fts) AS rank FROM tasks_fts f INNER JOIN tasks ON tasks.id=f.rowid WHERE ` + SQLVisibleTo + ` AND tasks_fts MATCH $2 AND tasks.start_time >= $3 AND tasks.start_time < $4 AND tasks.deleted_at IS NULL`
+	SQLSearchSqliteWords string = `WITH search(viewer, text, since, until, lim) AS (SELECT $1, $2, $3, $4, $5) SELECT tasks.id, tasks.task_name, tasks.project, tasks.tags, tasks.notes, tasks.start_time, tasks.elapsed_time, tasks.user_id, (instr(LOWER(tasks.task_name), search.text) > 0) + (instr(LOWER(tasks.notes), search.text) > 0) AS rank FROM tasks, search WHERE ` + SQLVisibleTo + ` AND tasks.start_time >= $3 AND tasks.start_time < $4 AND tasks.deleted_at IS NULL`
+	SQLSearchSqliteWord  string = ` AND (instr(LOWER(tasks.task_name), $%d) > 0 OR instr(LOWER(tasks.notes), $%d) > 0)`
+	SQLSearchPostgres    string = `SELECT id, task_name, project, tags, notes, start_time, elapsed_time, user_id, ts_rank(search, plainto_tsquery('english', $2)) AS rank FROM tasks WHERE ` + SQLVisibleTo + ` AND search @@ plainto_tsquery('english', $2) AND start_time >= $3 AND start_time < $4 AND deleted_at IS NULL`
+	SQLSearchByRelevance string = ` ORDER BY rank DESC, start_time DESC LIMIT $5`
+	SQLSearchByTime      string = ` ORDER BY start_time DESC LIMIT $5`
+	SQLRecentNames       string = `SELECT task_name FROM tasks WHERE ` + SQLVisibleTo + ` AND deleted_at IS NULL GROUP BY task_name ORDER BY MAX(start_time) DESC LIMIT $2`
+	SQLUpdateStopped     string = `UPDATE tasks SET elapsed_time=$1, notes=$2 FROM task_session  WHERE tasks.id = task_session.taskid AND task_session.user_id=$3`
+	SQLUpdateNotes       string = `UPDATE tasks SET notes=$1 WHERE id=$2`
+	SQLDelete            string = `UPDATE tasks SET deleted_at=CURRENT_TIMESTAMP WHERE id=$1 AND deleted_at IS NULL`
+	SQLInsertTaskSession string = `INSERT INTO task_session (taskid, user_id) VALUES ($1, $2)`
+	SQLDeleteTaskSession string = `DELETE FROM task_session WHERE user_id=$1`
+	SQLInsertGoal        string = `INSERT INTO goals(name, scope, kind, period, target, user_id) VALUES($1, $2, $3, $4, $5, $6) RETURNING id`
+	SQLGoals             string = `SELECT id, name, scope, kind, period, target, user_id FROM goals WHERE (user_id=$1 OR $1=0) ORDER BY name`
+	SQLDeleteGoal        string = `DELETE FROM goals WHERE id=$1 AND user_id=$2`
+	SQLInsertTemplate    string = `INSERT INTO task_templates(name, project, tags, notes, user_id) VALUES($1, $2, $3, $4, $5) RETURNING id`
+	SQLTemplates         string = `SELECT id, name, project, tags, notes, user_id FROM task_templates WHERE (user_id=$1 OR $1=0) ORDER BY name`
+	SQLTemplateById      string = `SELECT id, name, project, tags, notes, user_id FROM task_templates WHERE id=$1 AND user_id=$2`
+	SQLDeleteTemplate    string = `DELETE FROM task_templates WHERE id=$1 AND user_id=$2`
+	SQLCreateCompleted   string = `INSERT INTO tasks(task_name, project, tags, notes, start_time, elapsed_time, user_id) VALUES($1, $2, $3, $4, $5, $6, $7) RETURNING id`
+	SQLInsertImported    string = `INSERT INTO imported_events(uid, task_id, user_id) VALUES($1, $2, $3)`
+	SQLIsImported        string = `SELECT COUNT(*) FROM imported_events WHERE user_id=$1 AND uid=$2`
+	SQLTaskById          string = `SELECT id, task_name, project, tags, notes, start_time, elapsed_time, user_id FROM tasks WHERE id=$1 AND deleted_at IS NULL`
+	SQLVisibleTaskById   string = `SELECT id, task_name, project, tags, notes, start_time, elapsed_time, user_id FROM tasks WHERE ` + SQLVisibleTo + ` AND id=$2 AND deleted_at IS NULL`
+	SQLInsertWebhook     string = `INSERT INTO webhooks(url, secret, events, user_id) VALUES($1, $2, $3, $4) RETURNING id`
+	SQLWebhooks          string = `SELECT id, url, secret, events, user_id FROM webhooks WHERE (user_id=$1 OR $1=0) ORDER BY id`
+	SQLDeleteWebhook     string = `DELETE FROM webhooks WHERE id=$1 AND user_id=$2`
+	// SQLTaskWebhooks matches the webhooks whose owner may see
+	// a task of user $1 in project $2, as SQLVisibleTo would
+	// with the webhook owner as the viewer
+	SQLTaskWebhooks     string = `SELECT id, url, secret, events, user_id FROM webhooks w WHERE w.user_id = $1 OR EXISTS (SELECT 1 FROM workspace_projects p INNER JOIN workspace_members m ON m.workspace_id=p.workspace_id INNER JOIN workspace_members v ON v.workspace_id=p.workspace_id WHERE p.project=$2 AND m.user_id=$1 AND v.user_id=w.user_id AND v.role IN ('owner', 'admin')) ORDER BY id`
+	SQLDeleteDeliveries string = `DELETE FROM webhook_deliveries WHERE webhook_id IN (SELECT id FROM webhooks WHERE id=$1 AND user_id=$2)`
+	SQLInsertDelivery   string = `INSERT INTO webhook_deliveries(webhook_id, event, payload, status, attempts, response_code, error, next_attempt, created_at) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`
+	SQLDeliveryColumns  string = `SELECT d.id, d.webhook_id, w.url, w.secret, d.event, d.payload, d.status, d.attempts, d.response_code, d.error, d.next_attempt, d.created_at FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id`
+	SQLDueDeliveries    string = SQLDeliveryColumns + ` WHERE d.status = 'pending' AND d.next_attempt <= $1 ORDER BY d.next_attempt LIMIT $2`
+	SQLDeliveries       string = SQLDeliveryColumns + ` WHERE (w.user_id=$1 OR $1=0) ORDER BY d.id DESC LIMIT $2`
+	SQLUpdateDelivery   string = `UPDATE webhook_deliveries SET status=$1, attempts=$2, response_code=$3, error=$4, next_attempt=$5 WHERE id=$6`
+	SQLCheckTable       string = `SELECT * FROM %s WHERE 1=0`
+	SQLInsertAPIToken   string = `INSERT INTO api_tokens(user_id, name, prefix, hash, scopes, created_at, expires_at) VALUES($1, $2, $3, $4, $5, $6, $7) RETURNING id`
+	SQLAPITokenColumns  string = `SELECT id, user_id, name, prefix, hash, scopes, created_at, expires_at, last_used_at, revoked_at FROM api_tokens`
+	SQLAPITokens        string = SQLAPITokenColumns + ` ORDER BY id`
+	SQLAPITokenByHash   string = SQLAPITokenColumns + ` WHERE hash=$1`
+	SQLRevokeAPIToken   string = `UPDATE api_tokens SET revoked_at=$1 WHERE id=$2 AND revoked_at IS NULL`
+	SQLTouchAPIToken    string = `UPDATE api_tokens SET last_used_at=$1 WHERE id=$2`
+
+	SQLUser              string = `SELECT id, name, email, created_at FROM users WHERE id=$1`
+	SQLUserByEmail       string = `SELECT id, name, email, created_at FROM users WHERE email=$1`
+	SQLInsertUser        string = `INSERT INTO users(name, email, created_at) VALUES($1, $2, $3) RETURNING id`
+	SQLInsertSession     string = `INSERT INTO user_sessions(hash, user_id, expires_at) VALUES($1, $2, $3)`
+	SQLSessionUser       string = `SELECT u.id, u.name, u.email, u.created_at FROM users u INNER JOIN user_sessions s ON s.user_id=u.id WHERE s.hash=$1 AND s.expires_at > $2`
+	SQLDeleteSession     string = `DELETE FROM user_sessions WHERE hash=$1`
+	SQLInsertWorkspace   string = `INSERT INTO workspaces(name, created_at) VALUES($1, $2) RETURNING id`
+	SQLWorkspaces        string = `SELECT w.id, w.name, w.created_at, m.role FROM workspaces w INNER JOIN workspace_members m ON m.workspace_id=w.id WHERE m.user_id=$1 ORDER BY w.name, w.id`
+	SQLInsertMember      string = `INSERT INTO workspace_members(workspace_id, user_id, role, joined_at) VALUES($1, $2, $3, $4) ON CONFLICT DO NOTHING`
+	SQLMembers           string = `SELECT m.workspace_id, m.user_id, u.name, u.email, m.role, m.joined_at FROM workspace_members m INNER JOIN users u ON u.id=m.user_id WHERE m.workspace_id=$1 ORDER BY u.name, u.id`
+	SQLUpdateMemberRole  string = `UPDATE workspace_members SET role=$1 WHERE workspace_id=$2 AND user_id=$3`
+	SQLDeleteMember      string = `DELETE FROM workspace_members WHERE workspace_id=$1 AND user_id=$2`
+	SQLInsertInvitation  string = `INSERT INTO workspace_invitations(workspace_id, email, role, hash, invited_by, created_at, expires_at) VALUES($1, $2, $3, $4, $5, $6, $7) RETURNING id`
+	SQLInvitations       string = `SELECT id, workspace_id, email, role, hash, invited_by, created_at, expires_at FROM workspace_invitations WHERE workspace_id=$1 AND accepted_at IS NULL ORDER BY id`
+	SQLPendingInvitation string = `SELECT id, workspace_id, email, role FROM workspace_invitations WHERE hash=$1 AND accepted_at IS NULL AND expires_at > $2`
+	SQLAcceptInvitation  string = `UPDATE workspace_invitations SET accepted_at=$1 WHERE id=$2`
+	SQLDeleteInvitation  string = `DELETE FROM workspace_invitations WHERE workspace_id=$1 AND id=$2`
+	SQLWorkspaceProjects string = `SELECT project FROM workspace_projects WHERE workspace_id=$1 ORDER BY project`
+	SQLInsertProject     string = `INSERT INTO workspace_projects(workspace_id, project) VALUES($1, $2) ON CONFLICT DO NOTHING`
+	SQLDeleteProject     string = `DELETE FROM workspace_projects WHERE workspace_id=$1 AND project=$2`
+	SQLInsertAudit       string = `INSERT INTO audit_log(task_id, action, actor_id, created_at, before_value, after_value) VALUES($1, $2, $3, $4, $5, $6) RETURNING id`
+	SQLAuditLog          string = `SELECT a.id, a.task_id, a.action, a.actor_id, COALESCE(u.name, ''), a.created_at, a.before_value, a.after_value, tasks.deleted_at IS NOT NULL FROM audit_log a LEFT JOIN users u ON u.id=a.actor_id LEFT JOIN tasks ON tasks.id=a.task_id WHERE ` + SQLVisibleTo + ` AND (a.task_id=$2 OR $2=0) ORDER BY a.id DESC LIMIT $3`
+	SQLRestoreTask       string = `UPDATE tasks SET deleted_at=NULL WHERE ` + SQLVisibleTo + ` AND id=$2 AND deleted_at IS NOT NULL`
+	SQLVacuumInto        string = `VACUUM INTO $1`
+	SQLTableColumns      string = `SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1 AND is_generated = 'NEVER' ORDER BY ordinal_position`
+	SQLResetSequence     string = `SELECT setval(pg_get_serial_sequence('%s', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM %s`
+	SQLTeamReport        string = `SELECT t.user_id, t.task_name, SUM(t.elapsed_time) total_time FROM tasks t INNER JOIN workspace_projects p ON p.project=t.project INNER JOIN workspace_members m ON m.workspace_id=p.workspace_id AND m.user_id=t.user_id WHERE p.workspace_id=$1 AND t.deleted_at IS NULL GROUP BY t.user_id, t.task_name ORDER BY t.user_id, SUM(t.elapsed_time) DESC`
 )
 
+// SQLITE_DEFAULT_PATH is the database file used
+// when the config names none
+const SQLITE_DEFAULT_PATH string = "./timetracker.db"
+
+// ErrNoRecord is returned when a lookup by id
+// matches nothing
+var ErrNoRecord = errors.New("no matching record found")
+
+// DBStore keeps tasks in a SQL database.  Driver
+// is postgres or sqlite3 and selects between
+// dialects where the SQL differs, whichever
+// database/sql driver opened Db.
 type DBStore struct {
-	Db *sql.DB
+	Db     *sql.DB
+	Driver string
+
+	// noFTS is set when a sqlite database has no full
+	// text index because the driver lacks FTS5
+	noFTS bool
+}
+
+func NewPostgresStore(conn string) (*DBStore, error) {
+	db, err := sql.Open("postgres", conn)
+	if err != nil {
+		return nil, err
+	}
+	return &DBStore{Db: db, Driver: "postgres"}, nil
+}
+
+// splitSQL splits a file into statements on semicolons,
+// keeping the body of a CREATE TRIGGER in one piece
+func splitSQL(file string) []string {
+
+	var statements []string
+	var current []string
+
+	for _, part := range strings.Split(file, ";") {
+		current = append(current, part)
+		q := strings.TrimSpace(strings.Join(current, ";"))
+		upper := strings.ToUpper(q)
+		if strings.HasPrefix(upper, "CREATE TRIGGER") && !strings.HasSuffix(upper, "END") {
+			continue
+		}
+		current = nil
+		if q != "" {
+			statements = append(statements, q)
+		}
+	}
+
+	return statements
+}
+
+// Close closes the database
+func (d *DBStore) Close() error {
+	return d.Db.Close()
+}
+
+// Ping checks the database connection
+func (d *DBStore) Ping(ctx context.Context) error {
+
+	err := d.Db.PingContext(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to reach database: %w", err)
+	}
+	return nil
+}
+
+// CheckSchema returns an error naming the first
+// of SchemaTables that cannot be queried
+func (d *DBStore) CheckSchema(ctx context.Context) error {
+
+	for _, table := range SchemaTables {
+		rows, err := d.Db.QueryContext(ctx, fmt.Sprintf(SQLCheckTable, table))
+		if err != nil {
+			return fmt.Errorf("table %s not available: %w", table, err)
+		}
+		rows.Close()
+	}
+	return nil
+}
+
+func (d *DBStore) Create(task Task) (int, error) {
+
+	stmt, err := d.Db.Prepare(SQLInsert)
+	if err != nil {
+		return 0, fmt.Errorf("unable to prepare query: %w", err)
+	}
+	defer stmt.Close()
+
+	var taskid int
+
+	err = stmt.QueryRow(task.Name, task.Project, JoinTags(task.Tags), task.Notes, task.StartTime, ownerOf(task)).Scan(&taskid)
+
+	if err != nil {
+		return 0, fmt.Errorf("error creating task in database: %w", err)
+	}
+	return taskid, nil
+}
+
+// CreateCompleted saves a task that has already been
+// stopped, with its elapsed time, without touching the
+// task session
+func (d *DBStore) CreateCompleted(task Task) (int, error) {
+
+	var taskid int
+
+	err := d.Db.QueryRow(SQLCreateCompleted, task.Name, task.Project, JoinTags(task.Tags), task.Notes, task.StartTime, task.ElapsedTimeSec, ownerOf(task)).Scan(&taskid)
+	if err != nil {
+		return 0, fmt.Errorf("error creating completed task in database: %w", err)
+	}
+	return taskid, nil
+}
+
+// ownerOf is the user a task belongs to.  Tasks
+// without a user belong to the local user.
+func ownerOf(task Task) int {
+	return ownerId(task.UserId)
+}
+
+// ownerId is userId, or the local user for none
+func ownerId(userId int) int {
+	if userId == 0 {
+		return LOCAL_USER_ID
+	}
+	return userId
+}
+
+// expectDeleted returns ErrNoRecord when a delete
+// matched no row, such as one of another user
+func expectDeleted(result sql.Result, what string) error {
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("unable to delete %s: %w", what, err)
+	}
+	if n == 0 {
+		return ErrNoRecord
+	}
+	return nil
+}
+
+// NewTaskSession makes task the current task
+// of the user it belongs to
+func (d *DBStore) NewTaskSession(task Task) error {
+
+	_, err := d.Db.Exec(SQLDeleteTaskSession, ownerOf(task))
+	if err != nil {
+		return fmt.Errorf("unable to delete record: %w", err)
+	}
+
+	_, err = d.Db.Exec(SQLInsertTaskSession, task.Id, ownerOf(task))
+	if err != nil {
+		return fmt.Errorf("unable to insert task_session: %w", err)
+	}
+
+	return nil
+
+}
+
+func (d *DBStore) UpdateStopped(task Task) error {
+
+	_, err := d.Db.Exec(SQLUpdateStopped, task.ElapsedTimeSec, task.Notes, ownerOf(task))
+	if err != nil {
+		return fmt.Errorf("unable to update elapsed time: %w", err)
+	}
+	return nil
+
+}
+
+func (d *DBStore) UpdateNotes(task Task) error {
+
+	_, err := d.Db.Exec(SQLUpdateNotes, task.Notes, task.Id)
+	if err != nil {
+		return fmt.Errorf("unable to update notes: %w", err)
+	}
+	return nil
+
+}
+
+func (d *DBStore) Delete(task Task) error {
+
+	_, err := d.Db.Exec(SQLDelete, task.Id)
+	if err != nil {
+		return fmt.Errorf("unable to delete record: %w", err)
+	}
+	return nil
+
+}
+
+// GetTaskByName returns the name and total elapsed
+// time of the tasks called taskname that userId may see
+func (d *DBStore) GetTaskByName(userId int, taskname string) (Task, error) {
+
+	rows, err := d.Db.Query(SQLByName, userId, taskname)
+	if err != nil {
+		return Task{}, fmt.Errorf("failed to get report: %w", err)
+	}
+	defer rows.Close()
+
+	task, err := ParseRowsTaskByName(rows)
+	if err != nil {
+		return Task{}, fmt.Errorf("failed to parse rows: %w", err)
+	}
+
+	return task, nil
+}
+
+// GetTask returns ErrNoRecord when no task has the id
+func (d *DBStore) GetTask(id int) (Task, error) {
+
+	rows, err := d.Db.Query(SQLTaskById, id)
+	if err != nil {
+		return Task{}, fmt.Errorf("failed to get task: %w", err)
+	}
+	defer rows.Close()
+
+	task, err := ParseRowsTask(rows)
+	if err != nil {
+		return Task{}, fmt.Errorf("failed to parse rows: %w", err)
+	}
+	if task.Id == 0 {
+		return Task{}, ErrNoRecord
+	}
+
+	return task, nil
+}
+
+// GetVisibleTask is GetTask for the tasks userId
+// may see
+func (d *DBStore) GetVisibleTask(id, userId int) (Task, error) {
+
+	rows, err := d.Db.Query(SQLVisibleTaskById, userId, id)
+	if err != nil {
+		return Task{}, fmt.Errorf("failed to get task: %w", err)
+	}
+	defer rows.Close()
+
+	task, err := ParseRowsTask(rows)
+	if err != nil {
+		return Task{}, fmt.Errorf("failed to parse rows: %w", err)
+	}
+	if task.Id == 0 {
+		return Task{}, ErrNoRecord
+	}
+
+	return task, nil
+}
+
+// GetTaskBySession returns the current task of userId,
+// which is running until it has an elapsed time
+func (d *DBStore) GetTaskBySession(userId int) (Task, error) {
+
+	rows, err := d.Db.Query(SQLBySession, userId)
+	if err != nil {
+		return Task{}, fmt.Errorf("failed to get report: %w", err)
+	}
+	defer rows.Close()
+
+	task, err := ParseRowsTask(rows)
+	if err != nil {
+		return Task{}, fmt.Errorf("failed to parse rows: %w", err)
+	}
+	if task.Id != 0 {
+		task.UserId = userId
+	}
+
+	return task, nil
+}
+
+// CountRunning counts the running tasks of all users
+func (d *DBStore) CountRunning() (int, error) {
+
+	var count int
+
+	err := d.Db.QueryRow(SQLCountRunning).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("unable to count running tasks: %w", err)
+	}
+	return count, nil
+}
+
+// GetReport returns the total time of each task
+// name over the tasks userId may see
+func (d *DBStore) GetReport(userId int) ([]Report, error) {
+
+	rows, err := d.Db.Query(SQLReport, userId)
+	if err != nil {
+		return []Report{}, fmt.Errorf("failed to get report: %w", err)
+	}
+	defer rows.Close()
+
+	reports, err := ParseRowsReport(rows)
+	if err != nil {
+		return []Report{}, fmt.Errorf("failed to parse rows: %w", err)
+	}
+
+	return reports, nil
+
+}
+
+// GetLatest returns the most recently started
+// tasks userId may see
+func (d *DBStore) GetLatest(userId int) ([]Task, error) {
+
+	page, err := d.List(ListOptions{Limit: LATEST_LIMIT, Sort: ListSortStart, Desc: true, UserId: userId})
+	if err != nil {
+		return []Task{}, err
+	}
+	return page.Tasks, nil
+
+}
+
+// listColumns maps ListOptions sorts to the
+// columns they order by
+var listColumns = map[string]string{
+	ListSortName:     "task_name",
+	ListSortStart:    "start_time",
+	ListSortDuration: "elapsed_time",
+}
+
+// List returns a page of tasks using keyset pagination
+// on the sort column and id.  One extra row is fetched
+// to find out whether there is a next page.
+func (d *DBStore) List(opts ListOptions) (TaskPage, error) {
+
+	query, args := listQuery(opts)
+
+	rows, err := d.Db.Query(query, args...)
+	if err != nil {
+		return TaskPage{}, fmt.Errorf("failed to list tasks: %w", err)
+	}
+	defer rows.Close()
+
+	tasks, err := ParseRowsTasks(rows)
+	if err != nil {
+		return TaskPage{}, fmt.Errorf("failed to parse rows: %w", err)
+	}
+
+	page := TaskPage{Tasks: tasks}
+	if len(tasks) > opts.Limit {
+		page.Tasks = tasks[:opts.Limit]
+		page.Next = NewCursor(opts.Sort, page.Tasks[opts.Limit-1]).Encode()
+	}
+
+	return page, nil
+
+}
+
+// listQuery builds the SQL for List.  Column names
+// only ever come from listColumns, values are
+// always passed as arguments.
+func listQuery(opts ListOptions) (string, []interface{}) {
+
+	column, ok := listColumns[opts.Sort]
+	if !ok {
+		column = listColumns[ListSortStart]
+	}
+
+	direction, compare := "ASC", ">"
+	if opts.Desc {
+		direction, compare = "DESC", "<"
+	}
+
+	where := []string{SQLVisibleTo, "deleted_at IS NULL"}
+	args := []interface{}{opts.UserId}
+
+	if opts.NamePrefix != "" {
+		args = append(args, likePrefix(opts.NamePrefix))
+		where = append(where, fmt.Sprintf(`LOWER(task_name) LIKE $%d ESCAPE '\'`, len(args)))
+	}
+
+	if opts.Cursor != nil {
+		args = append(args, opts.Cursor.Key(), opts.Cursor.Id)
+		where = append(where, fmt.Sprintf("(%s, id) %s ($%d, $%d)", column, compare, len(args)-1, len(args)))
+	}
+
+	query := SQLListTasks + " WHERE " + strings.Join(where, " AND ")
+
+	args = append(args, opts.Limit+1)
+	query += fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT $%d", column, direction, direction, len(args))
+
+	return query, args
+}
+
+// GetCompleted returns the stopped tasks matching
+// filter, oldest first
+func (d *DBStore) GetCompleted(filter TaskFilter) ([]Task, error) {
+
+	tag := "%"
+	if filter.Tag != "" {
+		tag = "%," + likeEscape(filter.Tag) + ",%"
+	}
+
+	rows, err := d.Db.Query(SQLCompletedTasks, filter.UserId, filter.From.UTC(), filter.until().UTC(), filter.Project, tag)
+	if err != nil {
+		return []Task{}, fmt.Errorf("failed to get completed tasks: %w", err)
+	}
+	defer rows.Close()
+
+	tasks, err := ParseRowsTasks(rows)
+	if err != nil {
+		return []Task{}, fmt.Errorf("failed to parse rows: %w", err)
+	}
+
+	return tasks, nil
+
+}
+
+// likePrefix returns a LIKE pattern matching
+// strings that start with prefix, ignoring case
+func likePrefix(prefix string) string {
+
+	return likeEscape(strings.ToLower(prefix)) + "%"
+}
+
+// likeEscape escapes the LIKE wildcards in s
+// for use with ESCAPE '\'
+func likeEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// GetReportSince runs the GetReport aggregation over
+// the tasks userId may see started at or after since.
+// scope selects whether totals are grouped by task name
+// or by project.
+func (d *DBStore) GetReportSince(userId int, since time.Time, scope string) ([]Report, error) {
+
+	query := SQLReportSince
+	if scope == GoalScopeProject {
+		query = SQLProjectReport
+	}
+
+	rows, err := d.Db.Query(query, userId, since.UTC())
+	if err != nil {
+		return []Report{}, fmt.Errorf("failed to get report: %w", err)
+	}
+	defer rows.Close()
+
+	reports, err := ParseRowsReport(rows)
+	if err != nil {
+		return []Report{}, fmt.Errorf("failed to parse rows: %w", err)
+	}
+
+	return reports, nil
+
+}
+
+func (d *DBStore) CreateGoal(goal Goal) (int, error) {
+
+	var goalid int
+
+	err := d.Db.QueryRow(SQLInsertGoal, goal.Name, goal.Scope, goal.Kind, goal.Period, goal.Target, ownerId(goal.UserId)).Scan(&goalid)
+	if err != nil {
+		return 0, fmt.Errorf("error creating goal in database: %w", err)
+	}
+	return goalid, nil
+}
+
+// GetGoals returns the goals of userId, every
+// goal for ALL_USERS
+func (d *DBStore) GetGoals(userId int) ([]Goal, error) {
+
+	rows, err := d.Db.Query(SQLGoals, userId)
+	if err != nil {
+		return []Goal{}, fmt.Errorf("failed to get goals: %w", err)
+	}
+	defer rows.Close()
+
+	goals, err := ParseRowsGoals(rows)
+	if err != nil {
+		return []Goal{}, fmt.Errorf("failed to parse rows: %w", err)
+	}
+
+	return goals, nil
+}
+
+// DeleteGoal deletes the goal if it belongs to
+// goal.UserId and returns ErrNoRecord if not
+func (d *DBStore) DeleteGoal(goal Goal) error {
+
+	result, err := d.Db.Exec(SQLDeleteGoal, goal.Id, ownerId(goal.UserId))
+	if err != nil {
+		return fmt.Errorf("unable to delete goal: %w", err)
+	}
+	return expectDeleted(result, "goal")
+}
+
+// GetGoalProgress computes progress for the goals of
+// userId as at now over the tasks userId may see.  Goals
+// sharing a scope and period share a single report query.
+func (d *DBStore) GetGoalProgress(userId int, now time.Time) ([]GoalProgress, error) {
+
+	goals, err := d.GetGoals(userId)
+	if err != nil {
+		return []GoalProgress{}, err
+	}
+
+	reports := map[string][]Report{}
+	var progress []GoalProgress
+
+	for _, goal := range goals {
+		since := goal.PeriodStart(now)
+		key := goal.Scope + since.String()
+
+		report, ok := reports[key]
+		if !ok {
+			report, err = d.GetReportSince(userId, since, goal.Scope)
+			if err != nil {
+				return []GoalProgress{}, err
+			}
+			reports[key] = report
+		}
+
+		progress = append(progress, NewGoalProgress(goal, report))
+	}
+
+	return progress, nil
+}
+
+// GetRecentNames returns up to limit distinct names
+// of the tasks userId may see, most recently started
+// first
+func (d *DBStore) GetRecentNames(userId, limit int) ([]string, error) {
+
+	rows, err := d.Db.Query(SQLRecentNames, userId, limit)
+	if err != nil {
+		return []string{}, fmt.Errorf("failed to get recent names: %w", err)
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return []string{}, fmt.Errorf("unable to scan names: %w", err)
+		}
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+func (d *DBStore) CreateTemplate(tt TaskTemplate) (int, error) {
+
+	var templateid int
+
+	err := d.Db.QueryRow(SQLInsertTemplate, tt.Name, tt.Project, JoinTags(tt.Tags), tt.Notes, ownerId(tt.UserId)).Scan(&templateid)
+	if err != nil {
+		return 0, fmt.Errorf("error creating template in database: %w", err)
+	}
+	return templateid, nil
+}
+
+// GetTemplates returns the templates of userId,
+// every template for ALL_USERS
+func (d *DBStore) GetTemplates(userId int) ([]TaskTemplate, error) {
+
+	rows, err := d.Db.Query(SQLTemplates, userId)
+	if err != nil {
+		return []TaskTemplate{}, fmt.Errorf("failed to get templates: %w", err)
+	}
+	defer rows.Close()
+
+	templates, err := ParseRowsTemplates(rows)
+	if err != nil {
+		return []TaskTemplate{}, fmt.Errorf("failed to parse rows: %w", err)
+	}
+
+	return templates, nil
+}
+
+// GetTemplate returns the template with id if it
+// belongs to userId and ErrNoRecord if not
+func (d *DBStore) GetTemplate(id, userId int) (TaskTemplate, error) {
+
+	rows, err := d.Db.Query(SQLTemplateById, id, ownerId(userId))
+	if err != nil {
+		return TaskTemplate{}, fmt.Errorf("failed to get template: %w", err)
+	}
+	defer rows.Close()
+
+	templates, err := ParseRowsTemplates(rows)
+	if err != nil {
+		return TaskTemplate{}, fmt.Errorf("failed to parse rows: %w", err)
+	}
+	if len(templates) == 0 {
+		return TaskTemplate{}, ErrNoRecord
+	}
+
+	return templates[0], nil
+}
+
+// DeleteTemplate deletes the template if it belongs
+// to tt.UserId and returns ErrNoRecord if not
+func (d *DBStore) DeleteTemplate(tt TaskTemplate) error {
+
+	result, err := d.Db.Exec(SQLDeleteTemplate, tt.Id, ownerId(tt.UserId))
+	if err != nil {
+		return fmt.Errorf("unable to delete template: %w", err)
+	}
+	return expectDeleted(result, "template")
+}
+
+// IsImported reports whether userId has imported
+// a calendar event occurrence before
+func (d *DBStore) IsImported(userId int, uid string) (bool, error) {
+
+	var count int
+
+	err := d.Db.QueryRow(SQLIsImported, ownerId(userId), uid).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("unable to look up imported event: %w", err)
+	}
+	return count > 0, nil
+}
+
+// ImportTask creates a completed task for a calendar
+// event occurrence and records its uid in one transaction
+func (d *DBStore) ImportTask(uid string, task Task) (int, error) {
+
+	tx, err := d.Db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("unable to begin import: %w", err)
+	}
+	defer tx.Rollback()
+
+	var taskid int
+
+	err = tx.QueryRow(SQLCreateCompleted, task.Name, task.Project, JoinTags(task.Tags), task.Notes, task.StartTime, task.ElapsedTimeSec, ownerOf(task)).Scan(&taskid)
+	if err != nil {
+		return 0, fmt.Errorf("error importing task in database: %w", err)
+	}
+
+	_, err = tx.Exec(SQLInsertImported, uid, taskid, ownerOf(task))
+	if err != nil {
+		return 0, fmt.Errorf("unable to record imported event: %w", err)
+	}
+
+	task.Id = taskid
+	_, err = insertAudit(tx, NewAuditEntry(AuditImport, ownerOf(task), time.Now(), nil, &task))
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("unable to commit import: %w", err)
+	}
+	return taskid, nil
+}
+
+// ReplaceTasks deletes and creates tasks, with an
+// audit entry by actor for each, in one transaction
+// and returns the ids of the created tasks
+func (d *DBStore) ReplaceTasks(actor int, deleted, created []Task) ([]int, error) {
+
+	tx, err := d.Db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("unable to begin import: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	for i, task := range deleted {
+		_, err := tx.Exec(SQLDelete, task.Id)
+		if err != nil {
+			return nil, fmt.Errorf("unable to delete record: %w", err)
+		}
+		_, err = insertAudit(tx, NewAuditEntry(AuditDelete, actor, now, &deleted[i], nil))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ids := make([]int, len(created))
+	for i, task := range created {
+		err := tx.QueryRow(SQLCreateCompleted, task.Name, task.Project, JoinTags(task.Tags), task.Notes, task.StartTime, task.ElapsedTimeSec, ownerOf(task)).Scan(&ids[i])
+		if err != nil {
+			return nil, fmt.Errorf("error creating completed task in database: %w", err)
+		}
+		task.Id = ids[i]
+		_, err = insertAudit(tx, NewAuditEntry(AuditImport, actor, now, nil, &task))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("unable to commit import: %w", err)
+	}
+	return ids, nil
+}
+
+func (d *DBStore) CreateWebhook(wh Webhook) (int, error) {
+
+	var webhookid int
+
+	err := d.Db.QueryRow(SQLInsertWebhook, wh.URL, wh.Secret, JoinTags(wh.Events), ownerId(wh.UserId)).Scan(&webhookid)
+	if err != nil {
+		return 0, fmt.Errorf("error creating webhook in database: %w", err)
+	}
+	return webhookid, nil
+}
+
+// GetWebhooks returns the webhooks of userId,
+// every webhook for ALL_USERS
+func (d *DBStore) GetWebhooks(userId int) ([]Webhook, error) {
+
+	rows, err := d.Db.Query(SQLWebhooks, userId)
+	if err != nil {
+		return []Webhook{}, fmt.Errorf("failed to get webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	return ParseRowsWebhooks(rows)
+}
+
+// GetTaskWebhooks returns the webhooks whose owner
+// may see task
+func (d *DBStore) GetTaskWebhooks(task Task) ([]Webhook, error) {
+
+	rows, err := d.Db.Query(SQLTaskWebhooks, ownerOf(task), task.Project)
+	if err != nil {
+		return []Webhook{}, fmt.Errorf("failed to get webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	return ParseRowsWebhooks(rows)
+}
+
+// DeleteWebhook removes the webhook and its deliveries
+// in one transaction if it belongs to wh.UserId and
+// returns ErrNoRecord if not
+func (d *DBStore) DeleteWebhook(wh Webhook) error {
+
+	tx, err := d.Db.Begin()
+	if err != nil {
+		return fmt.Errorf("unable to begin webhook delete: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(SQLDeleteDeliveries, wh.Id, ownerId(wh.UserId))
+	if err != nil {
+		return fmt.Errorf("unable to delete webhook deliveries: %w", err)
+	}
+
+	result, err := tx.Exec(SQLDeleteWebhook, wh.Id, ownerId(wh.UserId))
+	if err != nil {
+		return fmt.Errorf("unable to delete webhook: %w", err)
+	}
+	err = expectDeleted(result, "webhook")
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("unable to commit webhook delete: %w", err)
+	}
+	return nil
+}
+
+func (d *DBStore) CreateDelivery(wd WebhookDelivery) (int, error) {
+
+	var deliveryid int
+
+	err := d.Db.QueryRow(SQLInsertDelivery, wd.WebhookId, wd.Event, wd.Payload, wd.Status, wd.Attempts, wd.ResponseCode, wd.Error, wd.NextAttempt, wd.CreatedAt).Scan(&deliveryid)
+	if err != nil {
+		return 0, fmt.Errorf("error creating webhook delivery in database: %w", err)
+	}
+	return deliveryid, nil
+}
+
+// GetDueDeliveries returns pending deliveries whose
+// next attempt is at or before now, oldest first
+func (d *DBStore) GetDueDeliveries(now time.Time, limit int) ([]WebhookDelivery, error) {
+
+	rows, err := d.Db.Query(SQLDueDeliveries, now, limit)
+	if err != nil {
+		return []WebhookDelivery{}, fmt.Errorf("failed to get due deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	deliveries, err := ParseRowsDeliveries(rows)
+	if err != nil {
+		return []WebhookDelivery{}, fmt.Errorf("failed to parse rows: %w", err)
+	}
+
+	return deliveries, nil
+}
+
+// GetDeliveries returns the most recent deliveries
+// to the webhooks of userId, all for ALL_USERS
+func (d *DBStore) GetDeliveries(userId, limit int) ([]WebhookDelivery, error) {
+
+	rows, err := d.Db.Query(SQLDeliveries, userId, limit)
+	if err != nil {
+		return []WebhookDelivery{}, fmt.Errorf("failed to get deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	deliveries, err := ParseRowsDeliveries(rows)
+	if err != nil {
+		return []WebhookDelivery{}, fmt.Errorf("failed to parse rows: %w", err)
+	}
+
+	return deliveries, nil
 }
 
-func NewPostgresStore(conn string) (*DBStore, error) {
-	db, err := sql.Open("postgres", conn)
+func (d *DBStore) UpdateDelivery(wd WebhookDelivery) error {
+
+	_, err := d.Db.Exec(SQLUpdateDelivery, wd.Status, wd.Attempts, wd.ResponseCode, wd.Error, wd.NextAttempt, wd.Id)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("unable to update webhook delivery: %w", err)
+	}
+	return nil
+}
+
+func ParseRowsWebhooks(r *sql.Rows) ([]Webhook, error) {
+
+	var webhooks []Webhook
+	for r.Next() {
+		var wh Webhook
+		var events string
+		if err := r.Scan(&wh.Id, &wh.URL, &wh.Secret, &events, &wh.UserId); err != nil {
+			return []Webhook{}, fmt.Errorf("unable to scan webhooks: %w", err)
+		}
+		wh.Events = ParseTags(events)
+		webhooks = append(webhooks, wh)
+	}
+
+	return webhooks, nil
+}
+
+func ParseRowsDeliveries(r *sql.Rows) ([]WebhookDelivery, error) {
+
+	var deliveries []WebhookDelivery
+	for r.Next() {
+		var wd WebhookDelivery
+		if err := r.Scan(&wd.Id, &wd.WebhookId, &wd.URL, &wd.Secret, &wd.Event, &wd.Payload, &wd.Status, &wd.Attempts, &wd.ResponseCode, &wd.Error, &wd.NextAttempt, &wd.CreatedAt); err != nil {
+			return []WebhookDelivery{}, fmt.Errorf("unable to scan deliveries: %w", err)
+		}
+		deliveries = append(deliveries, wd)
 	}
-	return &DBStore{Db: db}, nil
+
+	return deliveries, nil
 }
 
-func NewSqliteStore() (*DBStore, error) {
-	db, err := sql.Open("sqlite3", "./timetracker.db")
+func (d *DBStore) CreateAPIToken(t APIToken) (int, error) {
+
+	var tokenid int
+
+	err := d.Db.QueryRow(SQLInsertAPIToken, t.UserId, t.Name, t.Prefix, t.Hash, JoinTags(t.Scopes), t.CreatedAt, nullTime(t.ExpiresAt)).Scan(&tokenid)
 	if err != nil {
-		return nil, err
+		return 0, fmt.Errorf("error creating api token in database: %w", err)
 	}
+	return tokenid, nil
+}
+
+func (d *DBStore) GetAPITokens() ([]APIToken, error) {
 
-	loadSQLFile(db, "store/sqlite/sqlite_init.sql")
+	rows, err := d.Db.Query(SQLAPITokens)
+	if err != nil {
+		return []APIToken{}, fmt.Errorf("failed to get api tokens: %w", err)
+	}
+	defer rows.Close()
 
-	return &DBStore{Db: db}, nil
+	return ParseRowsAPITokens(rows)
 }
 
-func loadSQLFile(db *sql.DB, sqlFile string) error {
-	file, err := ioutil.ReadFile(sqlFile)
+// GetAPITokenByHash returns ErrNoRecord for an unknown
+// token.  Revoked and expired tokens are returned.
+func (d *DBStore) GetAPITokenByHash(hash string) (APIToken, error) {
+
+	rows, err := d.Db.Query(SQLAPITokenByHash, hash)
 	if err != nil {
-		return err
+		return APIToken{}, fmt.Errorf("failed to get api token: %w", err)
 	}
-	tx, err := db.Begin()
+	defer rows.Close()
+
+	tokens, err := ParseRowsAPITokens(rows)
 	if err != nil {
-		return err
+		return APIToken{}, err
 	}
-	defer func() {
-		tx.Rollback()
-	}()
-	for _, q := range strings.Split(string(file), ";") {
-		q := strings.TrimSpace(q)
-		if q == "" {
-			continue
-		}
-		if _, err := tx.Exec(q); err != nil {
-			return err
-		}
+	if len(tokens) == 0 {
+		return APIToken{}, ErrNoRecord
 	}
-	return tx.Commit()
+	return tokens[0], nil
 }
 
-func (d *DBStore) Create(task Task) (int, error) {
+func (d *DBStore) RevokeAPIToken(id int, at time.Time) error {
 
-	stmt, err := d.Db.Prepare(SQLInsert)
+	_, err := d.Db.Exec(SQLRevokeAPIToken, at, id)
 	if err != nil {
-		return 0, fmt.Errorf("unable to prepare query")
+		return fmt.Errorf("unable to revoke api token: %w", err)
 	}
-	defer stmt.Close()
+	return nil
+}
 
-	var taskid int
+// TouchAPIToken records the last use of a token
+func (d *DBStore) TouchAPIToken(id int, at time.Time) error {
+
+	_, err := d.Db.Exec(SQLTouchAPIToken, at, id)
+	if err != nil {
+		return fmt.Errorf("unable to record api token use: %w", err)
+	}
+	return nil
+}
+
+func ParseRowsAPITokens(r *sql.Rows) ([]APIToken, error) {
+
+	var tokens []APIToken
+	for r.Next() {
+		var t APIToken
+		var scopes string
+		var expires, used, revoked sql.NullTime
+		if err := r.Scan(&t.Id, &t.UserId, &t.Name, &t.Prefix, &t.Hash, &scopes, &t.CreatedAt, &expires, &used, &revoked); err != nil {
+			return []APIToken{}, fmt.Errorf("unable to scan api tokens: %w", err)
+		}
+		t.Scopes = ParseTags(scopes)
+		t.ExpiresAt = expires.Time
+		t.LastUsedAt = used.Time
+		t.RevokedAt = revoked.Time
+		tokens = append(tokens, t)
+	}
+
+	return tokens, nil
+}
 
-	err = stmt.QueryRow(task.Name, task.StartTime).Scan(&taskid)
+func (d *DBStore) GetUser(id int) (User, error) {
 
+	var u User
+	err := d.Db.QueryRow(SQLUser, id).Scan(&u.Id, &u.Name, &u.Email, &u.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrNoRecord
+	}
 	if err != nil {
-		return 0, fmt.Errorf("error creating task in database: %s", err)
+		return User{}, fmt.Errorf("failed to get user: %w", err)
 	}
-	return taskid, nil
+	return u, nil
 }
 
-func (d *DBStore) NewTaskSession(task Task) error {
+func (d *DBStore) CreateSession(hash string, userId int, expires time.Time) error {
 
-	_, err := d.Db.Exec(SQLDeleteTaskSession)
+	_, err := d.Db.Exec(SQLInsertSession, hash, userId, expires)
 	if err != nil {
-		return fmt.Errorf("unable to delete record: %s", err)
+		return fmt.Errorf("unable to create session: %w", err)
 	}
+	return nil
+}
 
-	_, err = d.Db.Exec(SQLInsertTaskSession, task.Id)
+// GetSessionUser returns ErrNoRecord for an unknown
+// or expired session
+func (d *DBStore) GetSessionUser(hash string, now time.Time) (User, error) {
+
+	var u User
+	err := d.Db.QueryRow(SQLSessionUser, hash, now.UTC()).Scan(&u.Id, &u.Name, &u.Email, &u.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrNoRecord
+	}
 	if err != nil {
-		return fmt.Errorf("unable to insert task_session: %s", err)
+		return User{}, fmt.Errorf("failed to get session: %w", err)
 	}
+	return u, nil
+}
+
+func (d *DBStore) DeleteSession(hash string) error {
 
+	_, err := d.Db.Exec(SQLDeleteSession, hash)
+	if err != nil {
+		return fmt.Errorf("unable to delete session: %w", err)
+	}
 	return nil
+}
+
+// CreateWorkspace creates ws with owner as
+// its owner in one transaction
+func (d *DBStore) CreateWorkspace(ws Workspace, owner int) (int, error) {
+
+	tx, err := d.Db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("unable to begin workspace: %w", err)
+	}
+	defer tx.Rollback()
+
+	var workspaceid int
+
+	err = tx.QueryRow(SQLInsertWorkspace, ws.Name, ws.CreatedAt).Scan(&workspaceid)
+	if err != nil {
+		return 0, fmt.Errorf("error creating workspace in database: %w", err)
+	}
+
+	_, err = tx.Exec(SQLInsertMember, workspaceid, owner, RoleOwner, ws.CreatedAt)
+	if err != nil {
+		return 0, fmt.Errorf("unable to add workspace owner: %w", err)
+	}
 
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("unable to commit workspace: %w", err)
+	}
+	return workspaceid, nil
 }
 
-func (d *DBStore) UpdateStopped(task Task) error {
+// GetWorkspaces lists the workspaces userId is a
+// member of, with the user's role in each
+func (d *DBStore) GetWorkspaces(userId int) ([]Workspace, error) {
 
-	_, err := d.Db.Exec(SQLUpdateStopped, task.ElapsedTimeSec)
+	rows, err := d.Db.Query(SQLWorkspaces, userId)
 	if err != nil {
-		return fmt.Errorf("unable to update elapsed time: %s", err)
+		return []Workspace{}, fmt.Errorf("failed to get workspaces: %w", err)
 	}
-	return nil
+	defer rows.Close()
 
+	var workspaces []Workspace
+	for rows.Next() {
+		var ws Workspace
+		if err := rows.Scan(&ws.Id, &ws.Name, &ws.CreatedAt, &ws.Role); err != nil {
+			return []Workspace{}, fmt.Errorf("unable to scan workspaces: %w", err)
+		}
+		workspaces = append(workspaces, ws)
+	}
+	return workspaces, nil
 }
 
-func (d *DBStore) Delete(task Task) error {
+func (d *DBStore) GetMembers(workspaceId int) ([]Member, error) {
 
-	_, err := d.Db.Exec(SQLDelete, task.Id)
+	rows, err := d.Db.Query(SQLMembers, workspaceId)
+	if err != nil {
+		return []Member{}, fmt.Errorf("failed to get members: %w", err)
+	}
+	defer rows.Close()
+
+	var members []Member
+	for rows.Next() {
+		var m Member
+		if err := rows.Scan(&m.WorkspaceId, &m.UserId, &m.Name, &m.Email, &m.Role, &m.JoinedAt); err != nil {
+			return []Member{}, fmt.Errorf("unable to scan members: %w", err)
+		}
+		members = append(members, m)
+	}
+	return members, nil
+}
+
+func (d *DBStore) SetMemberRole(workspaceId, userId int, role string) error {
+
+	_, err := d.Db.Exec(SQLUpdateMemberRole, role, workspaceId, userId)
+	if err != nil {
+		return fmt.Errorf("unable to change role: %w", err)
+	}
+	return nil
+}
+
+func (d *DBStore) RemoveMember(workspaceId, userId int) error {
+
+	_, err := d.Db.Exec(SQLDeleteMember, workspaceId, userId)
 	if err != nil {
-		return fmt.Errorf("unable to delete record: %s", err)
+		return fmt.Errorf("unable to remove member: %w", err)
 	}
 	return nil
+}
+
+func (d *DBStore) CreateInvitation(inv Invitation) (int, error) {
 
+	var invitationid int
+
+	err := d.Db.QueryRow(SQLInsertInvitation, inv.WorkspaceId, inv.Email, inv.Role, inv.Hash, inv.InvitedBy, inv.CreatedAt, inv.ExpiresAt).Scan(&invitationid)
+	if err != nil {
+		return 0, fmt.Errorf("error creating invitation in database: %w", err)
+	}
+	return invitationid, nil
 }
 
-// stop here
-func (d *DBStore) GetTaskByName(taskname string) (Task, error) {
+// GetInvitations lists the invitations to a
+// workspace that have not been accepted
+func (d *DBStore) GetInvitations(workspaceId int) ([]Invitation, error) {
 
-	rows, err := d.Db.Query(SQLByName, taskname)
+	rows, err := d.Db.Query(SQLInvitations, workspaceId)
 	if err != nil {
-		return Task{}, fmt.Errorf("failed to get report: %s", err)
+		return []Invitation{}, fmt.Errorf("failed to get invitations: %w", err)
 	}
 	defer rows.Close()
 
-	task, err := ParseRowsTaskByName(rows)
+	var invitations []Invitation
+	for rows.Next() {
+		var inv Invitation
+		if err := rows.Scan(&inv.Id, &inv.WorkspaceId, &inv.Email, &inv.Role, &inv.Hash, &inv.InvitedBy, &inv.CreatedAt, &inv.ExpiresAt); err != nil {
+			return []Invitation{}, fmt.Errorf("unable to scan invitations: %w", err)
+		}
+		invitations = append(invitations, inv)
+	}
+	return invitations, nil
+}
+
+func (d *DBStore) DeleteInvitation(workspaceId, id int) error {
+
+	_, err := d.Db.Exec(SQLDeleteInvitation, workspaceId, id)
 	if err != nil {
-		return Task{}, fmt.Errorf("failed to parse rows: %s", err)
+		return fmt.Errorf("unable to delete invitation: %w", err)
 	}
+	return nil
+}
 
-	return task, nil
+// AcceptInvitation adds the invited user to the
+// workspace, creating the user named name when no
+// user has the invitation's email.  An unknown,
+// expired or used invitation is ErrNoRecord.
+func (d *DBStore) AcceptInvitation(hash, name string, now time.Time) (User, error) {
+
+	tx, err := d.Db.Begin()
+	if err != nil {
+		return User{}, fmt.Errorf("unable to begin invitation: %w", err)
+	}
+	defer tx.Rollback()
+
+	now = now.UTC()
+
+	var inv Invitation
+	err = tx.QueryRow(SQLPendingInvitation, hash, now).Scan(&inv.Id, &inv.WorkspaceId, &inv.Email, &inv.Role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrNoRecord
+	}
+	if err != nil {
+		return User{}, fmt.Errorf("failed to get invitation: %w", err)
+	}
+
+	var u User
+	err = tx.QueryRow(SQLUserByEmail, inv.Email).Scan(&u.Id, &u.Name, &u.Email, &u.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		u = User{Name: name, Email: inv.Email, CreatedAt: now}
+		if u.Name == "" {
+			u.Name = strings.SplitN(inv.Email, "@", 2)[0]
+		}
+		err = tx.QueryRow(SQLInsertUser, u.Name, u.Email, u.CreatedAt).Scan(&u.Id)
+	}
+	if err != nil {
+		return User{}, fmt.Errorf("unable to find or create user: %w", err)
+	}
+
+	_, err = tx.Exec(SQLInsertMember, inv.WorkspaceId, u.Id, inv.Role, now)
+	if err != nil {
+		return User{}, fmt.Errorf("unable to add member: %w", err)
+	}
+
+	_, err = tx.Exec(SQLAcceptInvitation, now, inv.Id)
+	if err != nil {
+		return User{}, fmt.Errorf("unable to accept invitation: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return User{}, fmt.Errorf("unable to commit invitation: %w", err)
+	}
+	return u, nil
 }
 
-func (d *DBStore) GetTaskBySession() (Task, error) {
+func (d *DBStore) GetWorkspaceProjects(workspaceId int) ([]string, error) {
 
-	rows, err := d.Db.Query(SQLBySession)
+	rows, err := d.Db.Query(SQLWorkspaceProjects, workspaceId)
 	if err != nil {
-		return Task{}, fmt.Errorf("failed to get report: %s", err)
+		return []string{}, fmt.Errorf("failed to get workspace projects: %w", err)
 	}
 	defer rows.Close()
 
-	task, err := ParseRowsTask(rows)
+	var projects []string
+	for rows.Next() {
+		var project string
+		if err := rows.Scan(&project); err != nil {
+			return []string{}, fmt.Errorf("unable to scan workspace projects: %w", err)
+		}
+		projects = append(projects, project)
+	}
+	return projects, nil
+}
+
+func (d *DBStore) AddWorkspaceProject(workspaceId int, project string) error {
+
+	_, err := d.Db.Exec(SQLInsertProject, workspaceId, project)
 	if err != nil {
-		return Task{}, fmt.Errorf("failed to parse rows: %s", err)
+		return fmt.Errorf("unable to add workspace project: %w", err)
 	}
+	return nil
+}
 
-	return task, nil
+func (d *DBStore) RemoveWorkspaceProject(workspaceId int, project string) error {
+
+	_, err := d.Db.Exec(SQLDeleteProject, workspaceId, project)
+	if err != nil {
+		return fmt.Errorf("unable to remove workspace project: %w", err)
+	}
+	return nil
 }
 
-func (d *DBStore) GetReport() ([]Report, error) {
+// GetTeamReport totals each member's time by task
+// over the workspace's projects
+func (d *DBStore) GetTeamReport(workspaceId int) ([]TeamTotal, error) {
 
-	rows, err := d.Db.Query(SQLReport)
+	rows, err := d.Db.Query(SQLTeamReport, workspaceId)
 	if err != nil {
-		return []Report{}, fmt.Errorf("failed to get report: %s", err)
+		return []TeamTotal{}, fmt.Errorf("failed to get team report: %w", err)
 	}
 	defer rows.Close()
 
-	reports, err := ParseRowsReport(rows)
-	if err != nil {
-		return []Report{}, fmt.Errorf("failed to parse rows: %s", err)
+	var totals []TeamTotal
+	for rows.Next() {
+		var t TeamTotal
+		if err := rows.Scan(&t.UserId, &t.Task, &t.TotalTime); err != nil {
+			return []TeamTotal{}, fmt.Errorf("unable to scan team report: %w", err)
+		}
+		totals = append(totals, t)
 	}
+	return totals, nil
+}
 
-	return reports, nil
+// nullTime stores a zero time as NULL
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+func ParseRowsTemplates(r *sql.Rows) ([]TaskTemplate, error) {
+
+	var templates []TaskTemplate
+	for r.Next() {
+		var tt TaskTemplate
+		var tags string
+		if err := r.Scan(&tt.Id, &tt.Name, &tt.Project, &tags, &tt.Notes, &tt.UserId); err != nil {
+			return []TaskTemplate{}, fmt.Errorf("unable to scan templates: %w", err)
+		}
+		tt.Tags = ParseTags(tags)
+		templates = append(templates, tt)
+	}
+
+	return templates, nil
+
+}
+
+func ParseRowsGoals(r *sql.Rows) ([]Goal, error) {
+
+	var goals []Goal
+	for r.Next() {
+		var goal Goal
+		if err := r.Scan(&goal.Id, &goal.Name, &goal.Scope, &goal.Kind, &goal.Period, &goal.Target, &goal.UserId); err != nil {
+			return []Goal{}, fmt.Errorf("unable to scan goals: %w", err)
+		}
+		goals = append(goals, goal)
+	}
+
+	return goals, nil
 
 }
 
-func (d *DBStore) GetLatest() ([]Task, error) {
+// GetAll returns every task, oldest first
+func (d *DBStore) GetAll() ([]Task, error) {
 
-	rows, err := d.Db.Query(SQLLatestTasks)
+	rows, err := d.Db.Query(SQLAllTasks)
 	if err != nil {
-		return []Task{}, fmt.Errorf("failed to get latest: %s", err)
+		return []Task{}, fmt.Errorf("failed to get tasks: %w", err)
 	}
 	defer rows.Close()
 
 	tasks, err := ParseRowsTasks(rows)
 	if err != nil {
-		return []Task{}, fmt.Errorf("failed to parse rows: %s", err)
+		return []Task{}, fmt.Errorf("failed to parse rows: %w", err)
 	}
 
 	return tasks, nil
 
 }
 
+// Search runs a full text search over task names and
+// notes, using FTS5 on SQLite and tsvector on Postgres.
+// SQLite databases without FTS5 match every word as a
+// substring instead, ranking tasks whose name or notes
+// hold the whole text first.
+func (d *DBStore) Search(q SearchQuery) ([]SearchResult, error) {
+
+	query := SQLSearchPostgres
+	args := []interface{}{q.UserId, q.Text, q.From.UTC(), q.until().UTC(), q.Limit}
+	if d.Driver == "sqlite3" && d.noFTS {
+		// go-sqlite3 numbers parameters in the order they
+		// first appear, so the query names $1 to $5 up front
+		// and each word follows
+		query = SQLSearchSqliteWords
+		args[1] = strings.ToLower(q.Text)
+		for _, word := range strings.Fields(strings.ToLower(q.Text)) {
+			args = append(args, word)
+			query += fmt.Sprintf(SQLSearchSqliteWord, len(args), len(args))
+		}
+	} else if d.Driver == "sqlite3" {
+		query = SQLSearchSqlite
+		args[1] = ftsQuery(q.Text)
+	}
+
+	if q.Sort == SearchSortTime {
+		query += SQLSearchByTime
+	} else {
+		query += SQLSearchByRelevance
+	}
+
+	rows, err := d.Db.Query(query, args...)
+	if err != nil {
+		return []SearchResult{}, fmt.Errorf("failed to search: %w", err)
+	}
+	defer rows.Close()
+
+	results, err := ParseRowsSearchResults(rows)
+	if err != nil {
+		return []SearchResult{}, fmt.Errorf("failed to parse rows: %w", err)
+	}
+
+	return results, nil
+
+}
+
+func ParseRowsSearchResults(r *sql.Rows) ([]SearchResult, error) {
+
+	var results []SearchResult
+	for r.Next() {
+		var result SearchResult
+		var tags string
+		task := &result.Task
+		if err := r.Scan(&task.Id, &task.Name, &task.Project, &tags, &task.Notes, &task.StartTime, &task.ElapsedTimeSec, &task.UserId, &result.Rank); err != nil {
+			return []SearchResult{}, fmt.Errorf("unable to scan search results: %w", err)
+		}
+		task.Tags = ParseTags(tags)
+		results = append(results, result)
+	}
+
+	return results, nil
+
+}
+
 func ParseRowsReport(r *sql.Rows) ([]Report, error) {
 
 	var reports []Report
 	for r.Next() {
 		var report Report
 		if err := r.Scan(&report.Task, &report.TotalTime); err != nil {
-			return []Report{}, fmt.Errorf("unable to scan report: %s", err)
+			return []Report{}, fmt.Errorf("unable to scan report: %w", err)
 		}
 		reports = append(reports, report)
 	}
@@ -206,12 +1456,14 @@ func ParseRowsTasks(r *sql.Rows) ([]Task, error) {
 
 	var tasks []Task
 	var task Task
+	var tags string
 
 	for r.Next() {
 
-		if err := r.Scan(&task.Name, &task.StartTime, &task.ElapsedTimeSec); err != nil {
-			return []Task{}, fmt.Errorf("unable to scan tasks: %s", err)
+		if err := r.Scan(&task.Id, &task.Name, &task.Project, &tags, &task.Notes, &task.StartTime, &task.ElapsedTimeSec, &task.UserId); err != nil {
+			return []Task{}, fmt.Errorf("unable to scan tasks: %w", err)
 		}
+		task.Tags = ParseTags(tags)
 		tasks = append(tasks, task)
 	}
 
@@ -222,12 +1474,14 @@ func ParseRowsTasks(r *sql.Rows) ([]Task, error) {
 func ParseRowsTask(r *sql.Rows) (Task, error) {
 
 	var task Task
+	var tags string
 
 	for r.Next() {
 
-		if err := r.Scan(&task.Id, &task.Name, &task.StartTime, &task.ElapsedTimeSec); err != nil {
-			return Task{}, fmt.Errorf("unable to scan tasks: %s", err)
+		if err := r.Scan(&task.Id, &task.Name, &task.Project, &tags, &task.Notes, &task.StartTime, &task.ElapsedTimeSec, &task.UserId); err != nil {
+			return Task{}, fmt.Errorf("unable to scan tasks: %w", err)
 		}
+		task.Tags = ParseTags(tags)
 
 	}
 
@@ -242,7 +1496,7 @@ func ParseRowsTaskByName(r *sql.Rows) (Task, error) {
 	for r.Next() {
 
 		if err := r.Scan(&task.Name, &task.ElapsedTimeSec); err != nil {
-			return Task{}, fmt.Errorf("unable to scan tasks: %s", err)
+			return Task{}, fmt.Errorf("unable to scan tasks: %w", err)
 		}
 
 	}
@@ -250,3 +1504,158 @@ func ParseRowsTaskByName(r *sql.Rows) (Task, error) {
 	return task, nil
 
 }
+
+// queryRower is a *sql.DB or a *sql.Tx
+type queryRower interface {
+	QueryRow(string, ...interface{}) *sql.Row
+}
+
+func insertAudit(q queryRower, entry AuditEntry) (int, error) {
+
+	before, err := marshalAuditTask(entry.Before)
+	if err != nil {
+		return 0, err
+	}
+	after, err := marshalAuditTask(entry.After)
+	if err != nil {
+		return 0, err
+	}
+
+	var id int
+	err = q.QueryRow(SQLInsertAudit, entry.TaskId, entry.Action, entry.ActorId, entry.At, before, after).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("unable to record audit entry: %w", err)
+	}
+	return id, nil
+}
+
+// GetAuditLog returns the entries matching filter,
+// newest first.  Entries are kept for the tasks
+// filter.UserId may see, as SQLVisibleTo decides for
+// the task as it is now.
+func (d *DBStore) GetAuditLog(filter AuditFilter) ([]AuditEntry, error) {
+
+	rows, err := d.Db.Query(SQLAuditLog, filter.UserId, filter.TaskId, filter.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query audit log: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		var before, after string
+		err := rows.Scan(&e.Id, &e.TaskId, &e.Action, &e.ActorId, &e.Actor, &e.At, &before, &after, &e.TaskDeleted)
+		if err != nil {
+			return nil, fmt.Errorf("unable to scan audit entry: %w", err)
+		}
+		e.Before, err = unmarshalAuditTask(before)
+		if err != nil {
+			return nil, err
+		}
+		e.After, err = unmarshalAuditTask(after)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// RecordChange makes the change entry records and
+// appends entry to the audit log in one transaction.
+// Creates fill in entry.TaskId and the id of
+// entry.After.  A restore undoes the soft delete of
+// entry.TaskId if entry.ActorId may see it, fills in
+// entry.After and returns ErrNoRecord when there is
+// no such deleted task.
+func (d *DBStore) RecordChange(entry AuditEntry) (AuditEntry, error) {
+
+	tx, err := d.Db.Begin()
+	if err != nil {
+		return AuditEntry{}, fmt.Errorf("unable to begin change: %w", err)
+	}
+	defer tx.Rollback()
+
+	switch entry.Action {
+	case AuditCreate:
+		task := *entry.After
+		err = tx.QueryRow(SQLInsert, task.Name, task.Project, JoinTags(task.Tags), task.Notes, task.StartTime, ownerOf(task)).Scan(&task.Id)
+		if err != nil {
+			return AuditEntry{}, fmt.Errorf("error creating task in database: %w", err)
+		}
+		entry.TaskId, entry.After = task.Id, &task
+	case AuditImport:
+		task := *entry.After
+		err = tx.QueryRow(SQLCreateCompleted, task.Name, task.Project, JoinTags(task.Tags), task.Notes, task.StartTime, task.ElapsedTimeSec, ownerOf(task)).Scan(&task.Id)
+		if err != nil {
+			return AuditEntry{}, fmt.Errorf("error creating completed task in database: %w", err)
+		}
+		entry.TaskId, entry.After = task.Id, &task
+	case AuditStop:
+		_, err = tx.Exec(SQLUpdateStopped, entry.After.ElapsedTimeSec, entry.After.Notes, ownerOf(*entry.After))
+		if err != nil {
+			return AuditEntry{}, fmt.Errorf("unable to update elapsed time: %w", err)
+		}
+	case AuditUpdate:
+		_, err = tx.Exec(SQLUpdateNotes, entry.After.Notes, entry.After.Id)
+		if err != nil {
+			return AuditEntry{}, fmt.Errorf("unable to update notes: %w", err)
+		}
+	case AuditDelete:
+		_, err = tx.Exec(SQLDelete, entry.Before.Id)
+		if err != nil {
+			return AuditEntry{}, fmt.Errorf("unable to delete record: %w", err)
+		}
+	case AuditRestore:
+		task, err := restoreTask(tx, entry.TaskId, entry.ActorId)
+		if err != nil {
+			return AuditEntry{}, err
+		}
+		entry.After = &task
+	default:
+		return AuditEntry{}, fmt.Errorf("unknown audit action: %q", entry.Action)
+	}
+
+	entry.Id, err = insertAudit(tx, entry)
+	if err != nil {
+		return AuditEntry{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return AuditEntry{}, fmt.Errorf("unable to commit change: %w", err)
+	}
+	return entry, nil
+}
+
+// restoreTask undoes the soft delete of a task userId
+// may see.  It returns ErrNoRecord when there is no
+// such deleted task.
+func restoreTask(tx *sql.Tx, id, userId int) (Task, error) {
+
+	result, err := tx.Exec(SQLRestoreTask, userId, id)
+	if err != nil {
+		return Task{}, fmt.Errorf("unable to restore task: %w", err)
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return Task{}, fmt.Errorf("unable to restore task: %w", err)
+	}
+	if n == 0 {
+		return Task{}, ErrNoRecord
+	}
+
+	rows, err := tx.Query(SQLTaskById, id)
+	if err != nil {
+		return Task{}, fmt.Errorf("failed to get task: %w", err)
+	}
+	defer rows.Close()
+
+	task, err := ParseRowsTask(rows)
+	if err != nil {
+		return Task{}, fmt.Errorf("failed to parse rows: %w", err)
+	}
+	return task, nil
+}
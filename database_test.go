@@ -1,6 +1,8 @@
 package timetracker_test
 
 import (
+	"errors"
+	"strings"
 	"testing"
 	"time"
 	"timetracker"
@@ -15,21 +17,27 @@ func TestPostgres(t *testing.T) {
 	conn := "host=localhost port=5432 user=postgres dbname=timetracker sslmode=disable"
 
 	var store timetracker.TaskStore
-	var err error
 
-	store, err = timetracker.NewPostgresStore(conn)
+	db, err := timetracker.NewPostgresStore(conn)
 	if err != nil {
 		t.Errorf("Error connecting to postgres: %s", conn)
 	}
 
+	if err := db.Db.Ping(); err != nil {
+		t.Skipf("postgres not available: %s", err)
+	}
+
+	store = db
+
 	taskname := "zzzzzzzz"
-	_, err = store.GetTaskByName(taskname)
+	_, err = store.GetTaskByName(timetracker.LOCAL_USER_ID, taskname)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	task := timetracker.Task{
-		Name: taskname,
+		Name:   taskname,
+		UserId: timetracker.LOCAL_USER_ID,
 	}
 
 	var id int
@@ -45,7 +53,7 @@ func TestPostgres(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	got, err := store.GetTaskBySession()
+	got, err := store.GetTaskBySession(timetracker.LOCAL_USER_ID)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -69,11 +77,18 @@ func TestParseRowsTasks(t *testing.T) {
 
 	want := []timetracker.Task{
 		{
+			Id:             1,
+			UserId:         1,
 			Name:           "piano",
+			Project:        "music",
+			Tags:           []string{"practice", "scales"},
+			Notes:          "C major",
 			StartTime:      time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
 			ElapsedTimeSec: 10.0,
 		},
 		{
+			Id:             2,
+			UserId:         1,
 			Name:           "swim",
 			StartTime:      time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
 			ElapsedTimeSec: 10.0,
@@ -86,15 +101,15 @@ func TestParseRowsTasks(t *testing.T) {
 	}
 	defer db.Close()
 
-	rows := sqlmock.NewRows([]string{"task_name", "start_time", "elapsed_time"}).
-		AddRow("piano", time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), 10.0).
-		AddRow("swim", time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), 10.0)
+	rows := sqlmock.NewRows([]string{"id", "task_name", "project", "tags", "notes", "start_time", "elapsed_time", "user_id"}).
+		AddRow(1, "piano", "music", "practice,scales", "C major", time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), 10.0, 1).
+		AddRow(2, "swim", "", "", "", time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), 10.0, 1)
 
-	mock.ExpectQuery("SELECT task_name, start_time, elapsed_time FROM tasks ORDER BY start_time DESC LIMIT 10").WillReturnRows(rows)
+	mock.ExpectQuery("SELECT id, task_name, project, tags, notes, start_time, elapsed_time, user_id FROM tasks WHERE deleted_at IS NULL ORDER BY start_time").WillReturnRows(rows)
 
 	e := &timetracker.DBStore{Db: db}
 
-	results, err := e.Db.Query(timetracker.LATEST)
+	results, err := e.Db.Query(timetracker.SQLAllTasks)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -136,11 +151,11 @@ func TestParseRowsReport(t *testing.T) {
 		AddRow("piano", 10).
 		AddRow("swim", 10)
 
-	mock.ExpectQuery("SELECT task_name, SUM(elapsed_time) total_time FROM tasks GROUP BY task_name ORDER BY SUM(elapsed_time) DESC").WillReturnRows(rows)
+	mock.ExpectQuery(timetracker.SQLReport).WithArgs(timetracker.ALL_USERS).WillReturnRows(rows)
 
 	e := &timetracker.DBStore{Db: db}
 
-	results, err := e.Db.Query(timetracker.REPORT)
+	results, err := e.Db.Query(timetracker.SQLReport, timetracker.ALL_USERS)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -156,3 +171,675 @@ func TestParseRowsReport(t *testing.T) {
 	}
 
 }
+
+func TestGetGoalProgress(t *testing.T) {
+
+	t.Parallel()
+
+	now := time.Date(2021, 1, 6, 12, 0, 0, 0, time.UTC)
+	monday := time.Date(2021, 1, 4, 0, 0, 0, 0, time.UTC)
+
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	goals := sqlmock.NewRows([]string{"id", "name", "scope", "kind", "period", "target", "user_id"}).
+		AddRow(1, "piano", "task", "target", "weekly", 36000, 1).
+		AddRow(2, "website", "project", "budget", "total", 3600, 1).
+		AddRow(3, "swim", "task", "target", "weekly", 7200, 1)
+
+	mock.ExpectQuery(timetracker.SQLGoals).WithArgs(timetracker.LOCAL_USER_ID).WillReturnRows(goals)
+
+	mock.ExpectQuery(timetracker.SQLReportSince).WithArgs(timetracker.LOCAL_USER_ID, monday).WillReturnRows(
+		sqlmock.NewRows([]string{"task_name", "total_time"}).
+			AddRow("piano", 18000).
+			AddRow("swim", 3600))
+
+	mock.ExpectQuery(timetracker.SQLProjectReport).WithArgs(timetracker.LOCAL_USER_ID, time.Time{}).WillReturnRows(
+		sqlmock.NewRows([]string{"project", "total_time"}).
+			AddRow("website", 5400))
+
+	store := &timetracker.DBStore{Db: db}
+
+	got, err := store.GetGoalProgress(timetracker.LOCAL_USER_ID, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []timetracker.GoalProgress{
+		{
+			Goal:  timetracker.Goal{Id: 1, Name: "piano", Scope: "task", Kind: "target", Period: "weekly", Target: 36000, UserId: 1},
+			Spent: 18000,
+		},
+		{
+			Goal:  timetracker.Goal{Id: 2, Name: "website", Scope: "project", Kind: "budget", Period: "total", Target: 3600, UserId: 1},
+			Spent: 5400,
+		},
+		{
+			Goal:  timetracker.Goal{Id: 3, Name: "swim", Scope: "task", Kind: "target", Period: "weekly", Target: 7200, UserId: 1},
+			Spent: 3600,
+		},
+	}
+
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+func TestTemplates(t *testing.T) {
+
+	t.Parallel()
+
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	store := &timetracker.DBStore{Db: db}
+
+	tt := timetracker.TaskTemplate{
+		Name:    "standup",
+		Project: "team",
+		Tags:    []string{"meeting", "daily"},
+		Notes:   "what I did yesterday",
+		UserId:  2,
+	}
+
+	mock.ExpectQuery(timetracker.SQLInsertTemplate).
+		WithArgs("standup", "team", "meeting,daily", "what I did yesterday", 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+
+	id, err := store.CreateTemplate(tt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 7 {
+		t.Errorf("want: 7, got: %d", id)
+	}
+
+	tt.Id = id
+
+	mock.ExpectQuery(timetracker.SQLTemplateById).WithArgs(7, 2).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "name", "project", "tags", "notes", "user_id"}).
+			AddRow(7, "standup", "team", "meeting,daily", "what I did yesterday", 2))
+
+	got, err := store.GetTemplate(7, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !cmp.Equal(tt, got) {
+		t.Error(cmp.Diff(tt, got))
+	}
+
+	mock.ExpectQuery(timetracker.SQLTemplateById).WithArgs(7, 3).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "name", "project", "tags", "notes", "user_id"}))
+
+	_, err = store.GetTemplate(7, 3)
+	if err != timetracker.ErrNoRecord {
+		t.Errorf("want: ErrNoRecord, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+func TestGetRecentNames(t *testing.T) {
+
+	t.Parallel()
+
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(timetracker.SQLRecentNames).WithArgs(timetracker.LOCAL_USER_ID, 20).WillReturnRows(
+		sqlmock.NewRows([]string{"task_name"}).AddRow("email").AddRow("code review"))
+
+	store := &timetracker.DBStore{Db: db}
+
+	got, err := store.GetRecentNames(timetracker.LOCAL_USER_ID, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"email", "code review"}
+
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+
+}
+
+func TestSearch(t *testing.T) {
+
+	t.Parallel()
+
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	columns := []string{"id", "task_name", "project", "tags", "notes", "start_time", "elapsed_time", "user_id", "rank"}
+
+	q := timetracker.SearchQuery{
+		Text:   `piano "scales`,
+		From:   start,
+		To:     start.AddDate(0, 1, 0),
+		Sort:   timetracker.SearchSortRelevance,
+		Limit:  10,
+		UserId: 2,
+	}
+
+	want := []timetracker.SearchResult{
+		{
+			Task: timetracker.Task{
+				Id:             1,
+				UserId:         1,
+				Name:           "piano",
+				Notes:          "scales",
+				StartTime:      start,
+				ElapsedTimeSec: 600.0,
+			},
+			Rank: 1.5,
+		},
+	}
+
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(timetracker.SQLSearchSqlite+timetracker.SQLSearchByRelevance).
+		WithArgs(2, `"piano" """scales"`, q.From, q.To, 10).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(1, "piano", "", "", "scales", start, 600.0, 1, 1.5))
+
+	mock.ExpectQuery(timetracker.SQLSearchPostgres+timetracker.SQLSearchByTime).
+		WithArgs(2, `piano "scales`, q.From, q.To, 10).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(1, "piano", "", "", "scales", start, 600.0, 1, 1.5))
+
+	sqlite := &timetracker.DBStore{Db: db, Driver: "sqlite3"}
+
+	got, err := sqlite.Search(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+
+	postgres := &timetracker.DBStore{Db: db, Driver: "postgres"}
+
+	q.Sort = timetracker.SearchSortTime
+
+	got, err = postgres.Search(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+func TestList(t *testing.T) {
+
+	t.Parallel()
+
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	columns := []string{"id", "task_name", "project", "tags", "notes", "start_time", "elapsed_time", "user_id"}
+
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	store := &timetracker.DBStore{Db: db}
+
+	mock.ExpectQuery(timetracker.SQLListTasks+` WHERE `+timetracker.SQLVisibleTo+` AND deleted_at IS NULL AND LOWER(task_name) LIKE $2 ESCAPE '\' ORDER BY task_name ASC, id ASC LIMIT $3`).
+		WithArgs(2, `pi\_%`, 3).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(4, "pi_a", "", "", "", start, 60.0, 1).
+			AddRow(2, "pi_b", "", "", "", start, 60.0, 1).
+			AddRow(9, "pi_c", "", "", "", start, 60.0, 1))
+
+	page, err := store.List(timetracker.ListOptions{Limit: 2, Sort: timetracker.ListSortName, NamePrefix: "Pi_", UserId: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page.Tasks) != 2 {
+		t.Fatalf("want: 2 tasks, got: %d", len(page.Tasks))
+	}
+
+	cursor, err := timetracker.DecodeCursor(page.Next)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &timetracker.Cursor{Sort: timetracker.ListSortName, Name: "pi_b", Id: 2}
+
+	if !cmp.Equal(want, cursor) {
+		t.Error(cmp.Diff(want, cursor))
+	}
+
+	mock.ExpectQuery(timetracker.SQLListTasks+` WHERE `+timetracker.SQLVisibleTo+` AND deleted_at IS NULL AND (start_time, id) < ($2, $3) ORDER BY start_time DESC, id DESC LIMIT $4`).
+		WithArgs(timetracker.ALL_USERS, start, 7, 3).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(6, "swim", "", "", "", start, 60.0, 1))
+
+	cursor = timetracker.NewCursor(timetracker.ListSortStart, timetracker.Task{Id: 7, StartTime: start})
+
+	page, err = store.List(timetracker.ListOptions{Limit: 2, Sort: timetracker.ListSortStart, Desc: true, Cursor: cursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page.Tasks) != 1 || page.Next != "" {
+		t.Errorf("want: 1 task and no next page, got: %d tasks and next %q", len(page.Tasks), page.Next)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+func TestGetCompleted(t *testing.T) {
+
+	t.Parallel()
+
+	from := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	columns := []string{"id", "task_name", "project", "tags", "notes", "start_time", "elapsed_time", "user_id"}
+
+	mock.ExpectQuery(timetracker.SQLCompletedTasks).
+		WithArgs(2, from, to, "music", `%,100\%,%`).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(1, "piano", "music", "100%", "", from, 60.0, 1))
+
+	mock.ExpectQuery(timetracker.SQLCompletedTasks).
+		WithArgs(timetracker.ALL_USERS, time.Time{}, time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC), "", "%").
+		WillReturnRows(sqlmock.NewRows(columns))
+
+	store := &timetracker.DBStore{Db: db}
+
+	got, err := store.GetCompleted(timetracker.TaskFilter{From: from, To: to, Project: "music", Tag: "100%", UserId: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 1 {
+		t.Errorf("want: 1 task, got: %d", len(got))
+	}
+
+	_, err = store.GetCompleted(timetracker.TaskFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+func TestImportTask(t *testing.T) {
+
+	t.Parallel()
+
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	store := &timetracker.DBStore{Db: db}
+
+	start := time.Date(2021, 1, 15, 15, 0, 0, 0, time.UTC)
+	task := timetracker.Task{
+		Name:           "Design review",
+		Tags:           []string{"work"},
+		StartTime:      start,
+		ElapsedTimeSec: 5400,
+		UserId:         2,
+	}
+
+	mock.ExpectQuery(timetracker.SQLIsImported).WithArgs(2, "review@example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(timetracker.SQLCreateCompleted).
+		WithArgs("Design review", "", "work", "", start, 5400.0, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+	mock.ExpectExec(timetracker.SQLInsertImported).WithArgs("review@example.com", 3, 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(timetracker.SQLInsertAudit).
+		WithArgs(3, timetracker.AuditImport, 2, sqlmock.AnyArg(), "", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectCommit()
+
+	imported, err := store.IsImported(2, "review@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported {
+		t.Error("want: not imported, got: imported")
+	}
+
+	id, err := store.ImportTask("review@example.com", task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 3 {
+		t.Errorf("want: 3, got: %d", id)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+func TestImportJSONRollback(t *testing.T) {
+
+	t.Parallel()
+
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	store := &timetracker.DBStore{Db: db}
+
+	start := time.Date(2021, 1, 1, 9, 0, 0, 0, time.UTC)
+	doc := `{"format":"timetracker-export","version":1,"tasks":[
+{"name":"piano","start_time":"2021-01-01T09:00:00Z","elapsed_time":60},
+{"name":"swim","start_time":"2021-01-01T10:00:00Z","elapsed_time":60}
+]}`
+
+	cause := errors.New("disk full")
+
+	mock.ExpectQuery(timetracker.SQLAllTasks).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "task_name", "project", "tags", "notes", "start_time", "elapsed_time", "user_id"}).
+			AddRow(7, "run", "", "", "", start, 60.0, 1))
+	mock.ExpectBegin()
+	mock.ExpectExec(timetracker.SQLDelete).WithArgs(7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(timetracker.SQLInsertAudit).
+		WithArgs(7, timetracker.AuditDelete, 2, sqlmock.AnyArg(), sqlmock.AnyArg(), "").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(timetracker.SQLCreateCompleted).
+		WithArgs("piano", "", "", "", start, 60.0, timetracker.LOCAL_USER_ID).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(8))
+	mock.ExpectQuery(timetracker.SQLInsertAudit).
+		WithArgs(8, timetracker.AuditImport, 2, sqlmock.AnyArg(), "", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	mock.ExpectQuery(timetracker.SQLCreateCompleted).
+		WithArgs("swim", "", "", "", start.Add(time.Hour), 60.0, timetracker.LOCAL_USER_ID).
+		WillReturnError(cause)
+	mock.ExpectRollback()
+
+	result, err := timetracker.ImportJSON(store, store, store, strings.NewReader(doc), 2, timetracker.ImportReplace, false)
+	if !errors.Is(err, cause) {
+		t.Errorf("want: error wrapping %q, got: %v", cause, err)
+	}
+	if len(result.Created) != 0 || len(result.Deleted) != 0 {
+		t.Errorf("want: nothing changed, got: %+v", result)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+func TestRecordChangeRollback(t *testing.T) {
+
+	t.Parallel()
+
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	store := &timetracker.DBStore{Db: db}
+
+	start := time.Date(2021, 1, 1, 9, 0, 0, 0, time.UTC)
+	task := timetracker.Task{Id: 7, UserId: 1, Name: "deploy", StartTime: start, ElapsedTimeSec: 60}
+
+	cause := errors.New("disk full")
+
+	mock.ExpectBegin()
+	mock.ExpectExec(timetracker.SQLDelete).WithArgs(7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(timetracker.SQLInsertAudit).
+		WithArgs(7, timetracker.AuditDelete, 2, start, sqlmock.AnyArg(), "").
+		WillReturnError(cause)
+	mock.ExpectRollback()
+
+	_, err = store.RecordChange(timetracker.NewAuditEntry(timetracker.AuditDelete, 2, start, &task, nil))
+	if !errors.Is(err, cause) {
+		t.Errorf("want: error wrapping %q, got: %v", cause, err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(timetracker.SQLRestoreTask).WithArgs(2, 7).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	entry := timetracker.NewAuditEntry(timetracker.AuditRestore, 2, start, nil, nil)
+	entry.TaskId = 7
+
+	_, err = store.RecordChange(entry)
+	if !errors.Is(err, timetracker.ErrNoRecord) {
+		t.Errorf("restore: want: ErrNoRecord, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+func TestWebhookStore(t *testing.T) {
+
+	t.Parallel()
+
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	store := &timetracker.DBStore{Db: db}
+
+	wh := timetracker.Webhook{
+		URL:    "https://example.com/hook",
+		Secret: "s3cret",
+		Events: []string{"task.started", "task.stopped"},
+		UserId: 1,
+	}
+
+	mock.ExpectQuery(timetracker.SQLInsertWebhook).
+		WithArgs("https://example.com/hook", "s3cret", "task.started,task.stopped", 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+
+	id, err := store.CreateWebhook(wh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wh.Id = id
+
+	mock.ExpectQuery(timetracker.SQLWebhooks).WithArgs(1).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "url", "secret", "events", "user_id"}).
+			AddRow(2, "https://example.com/hook", "s3cret", "task.started,task.stopped", 1))
+
+	webhooks, err := store.GetWebhooks(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []timetracker.Webhook{wh}
+	if !cmp.Equal(want, webhooks) {
+		t.Error(cmp.Diff(want, webhooks))
+	}
+
+	now := time.Date(2021, 1, 1, 9, 0, 0, 0, time.UTC)
+	delivery := timetracker.WebhookDelivery{
+		Id:          5,
+		WebhookId:   2,
+		URL:         "https://example.com/hook",
+		Secret:      "s3cret",
+		Event:       "task.started",
+		Payload:     `{"event":"task.started"}`,
+		Status:      timetracker.DeliveryPending,
+		NextAttempt: now,
+		CreatedAt:   now,
+	}
+
+	mock.ExpectQuery(timetracker.SQLDueDeliveries).WithArgs(now, 50).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "webhook_id", "url", "secret", "event", "payload", "status", "attempts", "response_code", "error", "next_attempt", "created_at"}).
+			AddRow(5, 2, "https://example.com/hook", "s3cret", "task.started", `{"event":"task.started"}`, "pending", 0, 0, "", now, now))
+
+	due, err := store.GetDueDeliveries(now, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantDue := []timetracker.WebhookDelivery{delivery}
+	if !cmp.Equal(wantDue, due) {
+		t.Error(cmp.Diff(wantDue, due))
+	}
+
+	mock.ExpectExec(timetracker.SQLUpdateDelivery).
+		WithArgs("delivered", 1, 200, "", now, 5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	delivery.Status, delivery.Attempts, delivery.ResponseCode = timetracker.DeliveryDelivered, 1, 200
+	err = store.UpdateDelivery(delivery)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(timetracker.SQLDeleteDeliveries).WithArgs(2, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(timetracker.SQLDeleteWebhook).WithArgs(2, 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err = store.DeleteWebhook(wh)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+func TestAPITokenStore(t *testing.T) {
+
+	t.Parallel()
+
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	store := &timetracker.DBStore{Db: db}
+
+	now := time.Date(2021, 1, 1, 9, 0, 0, 0, time.UTC)
+	token := timetracker.APIToken{
+		UserId:    1,
+		Name:      "laptop",
+		Prefix:    "tt_abcdefgh",
+		Hash:      "5e88",
+		Scopes:    []string{"read"},
+		CreatedAt: now,
+	}
+
+	// no expiry is stored as NULL
+	mock.ExpectQuery(timetracker.SQLInsertAPIToken).
+		WithArgs(1, "laptop", "tt_abcdefgh", "5e88", "read", now, nil).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+
+	id, err := store.CreateAPIToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token.Id = id
+
+	columns := []string{"id", "user_id", "name", "prefix", "hash", "scopes", "created_at", "expires_at", "last_used_at", "revoked_at"}
+
+	mock.ExpectQuery(timetracker.SQLAPITokenByHash).WithArgs("5e88").WillReturnRows(
+		sqlmock.NewRows(columns).AddRow(3, 1, "laptop", "tt_abcdefgh", "5e88", "read", now, nil, now, nil))
+
+	got, err := store.GetAPITokenByHash("5e88")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token.LastUsedAt = now
+	if !cmp.Equal(token, got) {
+		t.Error(cmp.Diff(token, got))
+	}
+
+	mock.ExpectQuery(timetracker.SQLAPITokenByHash).WithArgs("nope").WillReturnRows(sqlmock.NewRows(columns))
+
+	_, err = store.GetAPITokenByHash("nope")
+	if !errors.Is(err, timetracker.ErrNoRecord) {
+		t.Errorf("want: ErrNoRecord, got: %v", err)
+	}
+
+	mock.ExpectExec(timetracker.SQLTouchAPIToken).WithArgs(now, 3).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(timetracker.SQLRevokeAPIToken).WithArgs(now, 3).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err = store.TouchAPIToken(3, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.RevokeAPIToken(3, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mock.ExpectQuery(timetracker.SQLAPITokens).WillReturnRows(
+		sqlmock.NewRows(columns).AddRow(3, 1, "laptop", "tt_abcdefgh", "5e88", "read", now, nil, now, now))
+
+	tokens, err := store.GetAPITokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token.RevokedAt = now
+	want := []timetracker.APIToken{token}
+	if !cmp.Equal(want, tokens) {
+		t.Error(cmp.Diff(want, tokens))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
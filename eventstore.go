@@ -0,0 +1,748 @@
+package timetracker
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// kinds of TaskEvent.  A task is started, or added
+	// already stopped by an import, then made a user's
+	// session, paused and resumed, stopped, edited and
+	// deleted.
+	EventStart   string = "start"
+	EventAdd     string = "add"
+	EventSession string = "session"
+	EventPause   string = "pause"
+	EventResume  string = "resume"
+	EventStop    string = "stop"
+	EventEdit    string = "edit"
+	EventDelete  string = "delete"
+
+	// EVENT_SNAPSHOT_INTERVAL is how many events are
+	// written between snapshots of the projection
+	EVENT_SNAPSHOT_INTERVAL int = 1000
+
+	// EVENT_REPLAY_BATCH is how many events are
+	// applied to the projection in one transaction
+	EVENT_REPLAY_BATCH int = 1000
+
+	// files kept next to the event log
+	EVENT_VIEW_EXT     string = ".view"
+	EVENT_SNAPSHOT_EXT string = ".snapshot"
+)
+
+// keys in the meta bucket of the projection
+var (
+	kvEventSeq    = []byte("event_seq")
+	kvEventOffset = []byte("event_offset")
+)
+
+// TaskEvent is one line of the event log.  Seq counts
+// events from 1 with no gaps.  Start and add events
+// carry the whole task, the others only what changed.
+// The elapsed time of a stop runs from the start; the
+// projection takes the time paused off it.
+type TaskEvent struct {
+	Seq     int         `json:"seq"`
+	Kind    string      `json:"kind"`
+	At      time.Time   `json:"at"`
+	TaskId  int         `json:"task_id"`
+	UserId  int         `json:"user_id,omitempty"`
+	Task    *ExportTask `json:"task,omitempty"`
+	Elapsed float64     `json:"elapsed_time,omitempty"`
+	Notes   *string     `json:"notes,omitempty"`
+}
+
+// RebuildResult is what a rebuild of the
+// projection replayed
+type RebuildResult struct {
+	FromSnapshot bool
+	Events       int
+	Seq          int
+}
+
+// EventStore keeps every change to a task as an
+// immutable event in an append-only JSON lines file.
+// Tasks are read from a projection of the events, a
+// KVStore next to the log that records how far into
+// the log it is.  The projection can be deleted at any
+// time and is rebuilt from the latest snapshot, or from
+// the first event, when the store is opened.  mu is
+// held to write events or swap the projection, and
+// read held to read from it.
+type EventStore struct {
+	mu   sync.RWMutex
+	path string
+	log  *os.File
+	view *KVStore
+}
+
+// NewEventStore opens the event log at path, creating
+// it if needed, and brings the projection up to date
+func NewEventStore(path string) (*EventStore, error) {
+
+	if path == "" {
+		return nil, fmt.Errorf("event log path must not be empty")
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open event log: %w", err)
+	}
+
+	e := &EventStore{path: path, log: f}
+
+	_, err = e.openView(true)
+	if err == nil {
+		_, err = e.catchUp()
+	}
+	if err != nil {
+		e.Close()
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// Close closes the projection and the log
+func (e *EventStore) Close() error {
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var err error
+	if e.view != nil {
+		err = e.view.Close()
+	}
+	if cerr := e.log.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Ping checks the log and the projection are open
+func (e *EventStore) Ping(ctx context.Context) error {
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	_, err := e.log.Stat()
+	if err != nil {
+		return fmt.Errorf("unable to reach event log: %w", err)
+	}
+	return e.view.Ping(ctx)
+}
+
+// CheckSchema checks the projection has its buckets
+// and has not read past the end of the log
+func (e *EventStore) CheckSchema(ctx context.Context) error {
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	err := e.view.CheckSchema(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = e.unread()
+	return err
+}
+
+// Rebuild throws the projection away and replays the
+// log into a new one, starting from the latest snapshot
+// or, when full is set or there is none, from the first
+// event.  A snapshot of the result is written after.
+func (e *EventStore) Rebuild(full bool) (RebuildResult, error) {
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	err := e.view.Close()
+	if err != nil {
+		return RebuildResult{}, fmt.Errorf("unable to close projection: %w", err)
+	}
+	err = os.Remove(e.path + EVENT_VIEW_EXT)
+	if err != nil && !os.IsNotExist(err) {
+		return RebuildResult{}, fmt.Errorf("unable to remove projection: %w", err)
+	}
+
+	var result RebuildResult
+
+	result.FromSnapshot, err = e.openView(!full)
+	if err != nil {
+		return RebuildResult{}, err
+	}
+	result.Events, err = e.catchUp()
+	if err != nil {
+		return RebuildResult{}, err
+	}
+	result.Seq, _, err = e.position()
+	if err != nil {
+		return RebuildResult{}, err
+	}
+
+	return result, e.snapshot()
+}
+
+func (e *EventStore) Create(task Task) (int, error) {
+
+	var id int
+
+	err := e.record(func(tx *bolt.Tx) (*TaskEvent, error) {
+		id = int(tx.Bucket(kvTasks).Sequence()) + 1
+		task.Id, task.ElapsedTimeSec = id, 0
+		et := NewExportTask(task)
+		return &TaskEvent{Kind: EventStart, TaskId: id, UserId: ownerOf(task), Task: &et}, nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error creating task in event log: %w", err)
+	}
+	return id, nil
+}
+
+// CreateCompleted saves a task that has already been
+// stopped, with its elapsed time, without touching the
+// task session
+func (e *EventStore) CreateCompleted(task Task) (int, error) {
+
+	var id int
+
+	err := e.record(func(tx *bolt.Tx) (*TaskEvent, error) {
+		id = int(tx.Bucket(kvTasks).Sequence()) + 1
+		task.Id = id
+		et := NewExportTask(task)
+		return &TaskEvent{Kind: EventAdd, TaskId: id, UserId: ownerOf(task), Task: &et}, nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error creating completed task in event log: %w", err)
+	}
+	return id, nil
+}
+
+// NewTaskSession makes task the current task
+// of the user it belongs to
+func (e *EventStore) NewTaskSession(task Task) error {
+
+	err := e.record(func(tx *bolt.Tx) (*TaskEvent, error) {
+		return &TaskEvent{Kind: EventSession, TaskId: task.Id, UserId: ownerOf(task)}, nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to save task session: %w", err)
+	}
+	return nil
+}
+
+func (e *EventStore) UpdateStopped(task Task) error {
+
+	err := e.record(func(tx *bolt.Tx) (*TaskEvent, error) {
+		id := tx.Bucket(kvSessions).Get(kvId(ownerOf(task)))
+		if id == nil {
+			return nil, nil
+		}
+		t, err := getTask(tx, id)
+		if err != nil || t == nil {
+			return nil, err
+		}
+		notes := task.Notes
+		return &TaskEvent{Kind: EventStop, TaskId: t.Id, UserId: ownerOf(task), Elapsed: task.ElapsedTimeSec, Notes: &notes}, nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to update elapsed time: %w", err)
+	}
+	return nil
+}
+
+// Pause pauses the running task of the user task
+// belongs to, until Resume.  A task that is not
+// running, or already paused, is left as it is.
+func (e *EventStore) Pause(task Task) error {
+
+	err := e.record(func(tx *bolt.Tx) (*TaskEvent, error) {
+		t, err := sessionTask(tx, ownerOf(task))
+		if err != nil || t == nil || t.ElapsedTimeSec != 0 || t.PausedAt != nil {
+			return nil, err
+		}
+		return &TaskEvent{Kind: EventPause, TaskId: t.Id, UserId: ownerOf(task)}, nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to pause task: %w", err)
+	}
+	return nil
+}
+
+// Resume restarts the paused task of the user
+// task belongs to
+func (e *EventStore) Resume(task Task) error {
+
+	err := e.record(func(tx *bolt.Tx) (*TaskEvent, error) {
+		t, err := sessionTask(tx, ownerOf(task))
+		if err != nil || t == nil || t.PausedAt == nil {
+			return nil, err
+		}
+		return &TaskEvent{Kind: EventResume, TaskId: t.Id, UserId: ownerOf(task)}, nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to resume task: %w", err)
+	}
+	return nil
+}
+
+// sessionTask is the current task of userId in the
+// projection, if there is one
+func sessionTask(tx *bolt.Tx, userId int) (*kvTask, error) {
+
+	id := tx.Bucket(kvSessions).Get(kvId(userId))
+	if id == nil {
+		return nil, nil
+	}
+	t, err := getTask(tx, id)
+	if err != nil || t == nil || t.DeletedAt != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (e *EventStore) UpdateNotes(task Task) error {
+
+	err := e.record(func(tx *bolt.Tx) (*TaskEvent, error) {
+		t, err := getTask(tx, kvId(task.Id))
+		if err != nil || t == nil {
+			return nil, err
+		}
+		notes := task.Notes
+		return &TaskEvent{Kind: EventEdit, TaskId: t.Id, Notes: &notes}, nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to update notes: %w", err)
+	}
+	return nil
+}
+
+func (e *EventStore) Delete(task Task) error {
+
+	err := e.record(func(tx *bolt.Tx) (*TaskEvent, error) {
+		t, err := getTask(tx, kvId(task.Id))
+		if err != nil || t == nil || t.DeletedAt != nil {
+			return nil, err
+		}
+		return &TaskEvent{Kind: EventDelete, TaskId: t.Id}, nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to delete record: %w", err)
+	}
+	return nil
+}
+
+// the reads all come from the projection, under the
+// read lock so that a Rebuild cannot close it mid read
+
+func (e *EventStore) GetReport(userId int) ([]Report, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.view.GetReport(userId)
+}
+
+func (e *EventStore) GetLatest(userId int) ([]Task, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.view.GetLatest(userId)
+}
+
+func (e *EventStore) List(opts ListOptions) (TaskPage, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.view.List(opts)
+}
+
+func (e *EventStore) GetRecentNames(userId, limit int) ([]string, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.view.GetRecentNames(userId, limit)
+}
+
+func (e *EventStore) GetAll() ([]Task, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.view.GetAll()
+}
+
+func (e *EventStore) Search(q SearchQuery) ([]SearchResult, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.view.Search(q)
+}
+
+func (e *EventStore) GetCompleted(filter TaskFilter) ([]Task, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.view.GetCompleted(filter)
+}
+
+func (e *EventStore) GetTask(id int) (Task, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.view.GetTask(id)
+}
+
+func (e *EventStore) GetVisibleTask(id, userId int) (Task, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.view.GetVisibleTask(id, userId)
+}
+
+func (e *EventStore) GetTaskByName(userId int, taskname string) (Task, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.view.GetTaskByName(userId, taskname)
+}
+
+func (e *EventStore) GetTaskBySession(userId int) (Task, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.view.GetTaskBySession(userId)
+}
+
+func (e *EventStore) CountRunning() (int, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.view.CountRunning()
+}
+
+// record appends the event that decide returns, if
+// any, and applies it to the projection.  decide
+// reads the projection after any events left over
+// from an earlier failure have been applied, so the
+// event is checked against the current state.
+func (e *EventStore) record(decide func(*bolt.Tx) (*TaskEvent, error)) error {
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	_, err := e.catchUp()
+	if err != nil {
+		return err
+	}
+
+	var ev *TaskEvent
+	err = e.view.db.View(func(tx *bolt.Tx) error {
+		ev, err = decide(tx)
+		return err
+	})
+	if err != nil || ev == nil {
+		return err
+	}
+
+	seq, _, err := e.position()
+	if err != nil {
+		return err
+	}
+	ev.Seq = seq + 1
+	ev.At = time.Now().UTC()
+
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = e.log.Write(append(b, '\n'))
+	if err == nil {
+		err = e.log.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("unable to append to event log: %w", err)
+	}
+
+	_, err = e.catchUp()
+	if err != nil {
+		return err
+	}
+
+	if ev.Seq%EVENT_SNAPSHOT_INTERVAL == 0 {
+		return e.snapshot()
+	}
+	return nil
+}
+
+// position is the seq of the last event applied to
+// the projection and the log offset just past it
+func (e *EventStore) position() (int, int64, error) {
+
+	var seq int
+	var offset int64
+
+	err := e.view.db.View(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(kvMeta)
+		if v := meta.Get(kvEventSeq); v != nil {
+			n, err := strconv.Atoi(string(v))
+			if err != nil {
+				return err
+			}
+			seq = n
+		}
+		if v := meta.Get(kvEventOffset); v != nil {
+			n, err := strconv.ParseInt(string(v), 10, 64)
+			if err != nil {
+				return err
+			}
+			offset = n
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("unable to read projection position: %w", err)
+	}
+	return seq, offset, nil
+}
+
+// unread is the number of bytes of the log
+// the projection has not applied yet
+func (e *EventStore) unread() (int64, error) {
+
+	_, offset, err := e.position()
+	if err != nil {
+		return 0, err
+	}
+	info, err := e.log.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("unable to read event log: %w", err)
+	}
+	if offset > info.Size() {
+		return 0, fmt.Errorf("projection is past the end of the event log %s, run rebuild -full", e.path)
+	}
+	return info.Size() - offset, nil
+}
+
+// catchUp applies the events the projection has not
+// seen yet and returns how many there were.  A last
+// line without a newline is a write that never
+// finished, and is cut off the log.
+func (e *EventStore) catchUp() (int, error) {
+
+	size, err := e.unread()
+	if err != nil || size == 0 {
+		return 0, err
+	}
+	seq, offset, err := e.position()
+	if err != nil {
+		return 0, err
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(e.log, offset, size))
+
+	var batch []TaskEvent
+	var applied int
+
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				terr := e.log.Truncate(offset)
+				if terr != nil {
+					return applied, fmt.Errorf("unable to cut unfinished event from log: %w", terr)
+				}
+			}
+			break
+		}
+		if err != nil {
+			return applied, fmt.Errorf("unable to read event log: %w", err)
+		}
+
+		var ev TaskEvent
+		err = json.Unmarshal(line, &ev)
+		if err != nil {
+			return applied, fmt.Errorf("event log %s: byte %d: %w", e.path, offset, err)
+		}
+		if ev.Seq != seq+1 {
+			return applied, fmt.Errorf("event log %s: byte %d: want event %d, got %d", e.path, offset, seq+1, ev.Seq)
+		}
+		seq, offset = ev.Seq, offset+int64(len(line))
+
+		batch = append(batch, ev)
+		if len(batch) == EVENT_REPLAY_BATCH {
+			err := e.apply(batch, offset)
+			if err != nil {
+				return applied, err
+			}
+			applied += len(batch)
+			batch = nil
+		}
+	}
+
+	if len(batch) > 0 {
+		err := e.apply(batch, offset)
+		if err != nil {
+			return applied, err
+		}
+		applied += len(batch)
+	}
+	return applied, nil
+}
+
+// apply projects events in one transaction, moving
+// the position to offset, just past the last one
+func (e *EventStore) apply(events []TaskEvent, offset int64) error {
+
+	return e.view.db.Update(func(tx *bolt.Tx) error {
+		for _, ev := range events {
+			err := applyEvent(tx, ev)
+			if err != nil {
+				return fmt.Errorf("event %d: %w", ev.Seq, err)
+			}
+		}
+
+		meta := tx.Bucket(kvMeta)
+		err := meta.Put(kvEventSeq, []byte(strconv.Itoa(events[len(events)-1].Seq)))
+		if err != nil {
+			return err
+		}
+		return meta.Put(kvEventOffset, []byte(strconv.FormatInt(offset, 10)))
+	})
+}
+
+// applyEvent changes the projection as ev says.  An
+// event about a task that is not in the projection
+// means the log has been tampered with.
+func applyEvent(tx *bolt.Tx, ev TaskEvent) error {
+
+	if ev.Kind == EventSession {
+		return tx.Bucket(kvSessions).Put(kvId(ev.UserId), kvId(ev.TaskId))
+	}
+
+	old, err := getTask(tx, kvId(ev.TaskId))
+	if err != nil {
+		return err
+	}
+
+	switch ev.Kind {
+	case EventStart, EventAdd:
+		if ev.Task == nil {
+			return fmt.Errorf("%s of task %d without the task", ev.Kind, ev.TaskId)
+		}
+		if old != nil {
+			return fmt.Errorf("task %d started twice", ev.TaskId)
+		}
+
+		tasks := tx.Bucket(kvTasks)
+		if uint64(ev.TaskId) > tasks.Sequence() {
+			err := tasks.SetSequence(uint64(ev.TaskId))
+			if err != nil {
+				return err
+			}
+		}
+
+		return putTask(tx, nil, kvTask{
+			Id:             ev.TaskId,
+			UserId:         ev.UserId,
+			Name:           ev.Task.Name,
+			Project:        ev.Task.Project,
+			Tags:           ParseTags(JoinTags(ev.Task.Tags)),
+			Notes:          ev.Task.Notes,
+			StartTime:      ev.Task.StartTime,
+			ElapsedTimeSec: ev.Task.ElapsedTimeSec,
+		})
+
+	case EventPause, EventResume, EventStop, EventEdit, EventDelete:
+		if old == nil {
+			return fmt.Errorf("%s of unknown task %d", ev.Kind, ev.TaskId)
+		}
+
+		t := *old
+		switch ev.Kind {
+		case EventPause:
+			at := ev.At
+			t.PausedAt = &at
+		case EventResume:
+			t.PausedSec, t.PausedAt = t.pausedSec(ev.At), nil
+		case EventStop:
+			t.ElapsedTimeSec = ev.Elapsed - t.pausedSec(ev.At)
+			t.PausedSec, t.PausedAt = t.pausedSec(ev.At), nil
+		case EventDelete:
+			at := ev.At
+			t.DeletedAt = &at
+		}
+		if ev.Notes != nil {
+			t.Notes = *ev.Notes
+		}
+		return putTask(tx, old, t)
+
+	default:
+		return fmt.Errorf("unknown event %q", ev.Kind)
+	}
+}
+
+// openView opens the projection, first copying the
+// snapshot into place when there is no projection
+// and fromSnapshot is set.  It reports whether the
+// snapshot was used.
+func (e *EventStore) openView(fromSnapshot bool) (bool, error) {
+
+	view := e.path + EVENT_VIEW_EXT
+	restored := false
+
+	_, err := os.Stat(view)
+	if os.IsNotExist(err) && fromSnapshot {
+		err = copySnapshot(e.path+EVENT_SNAPSHOT_EXT, view)
+		if err != nil && !os.IsNotExist(err) {
+			return false, fmt.Errorf("unable to restore snapshot: %w", err)
+		}
+		restored = err == nil
+	}
+
+	e.view, err = NewKVStore(view)
+	if err != nil {
+		return false, err
+	}
+	return restored, nil
+}
+
+// snapshot copies the projection aside, so that a
+// rebuild only replays the events written after it
+func (e *EventStore) snapshot() error {
+
+	path := e.path + EVENT_SNAPSHOT_EXT
+	tmp := path + ".tmp"
+
+	err := e.view.db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(tmp, 0o600)
+	})
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("unable to write snapshot: %w", err)
+	}
+	return nil
+}
+
+func copySnapshot(src, dst string) error {
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
@@ -0,0 +1,456 @@
+package timetracker_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"timetracker"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func newEventStore(t *testing.T, path string) *timetracker.EventStore {
+	t.Helper()
+
+	store, err := timetracker.NewEventStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// readEvents returns the events in the log at path
+func readEvents(t *testing.T, path string) []timetracker.TaskEvent {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var events []timetracker.TaskEvent
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var ev timetracker.TaskEvent
+		err := json.Unmarshal(s.Bytes(), &ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+// timerActions starts, stops, edits and deletes
+// tasks through the TaskStore interface
+func timerActions(t *testing.T, store timetracker.TaskStore) {
+	t.Helper()
+
+	start := time.Date(2021, 3, 1, 9, 0, 0, 0, time.UTC)
+	for i, name := range []string{"piano", "swim", "piano"} {
+		task := timetracker.Task{Name: name, Project: "home", Tags: []string{"daily"}, StartTime: start.Add(time.Duration(i) * time.Hour)}
+		id, err := store.Create(task)
+		if err != nil {
+			t.Fatal(err)
+		}
+		task.Id = id
+		err = store.NewTaskSession(task)
+		if err == nil {
+			err = store.UpdateStopped(timetracker.Task{ElapsedTimeSec: float64(60 * (i + 1)), Notes: "done"})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := store.UpdateNotes(timetracker.Task{Id: 1, Notes: "scales"})
+	if err == nil {
+		err = store.Delete(timetracker.Task{Id: 2})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEventStoreLog(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "timetracker.events")
+	store := newEventStore(t, path)
+
+	timerActions(t, store)
+
+	// changes to nothing are not events
+	for _, err := range []error{
+		store.Delete(timetracker.Task{Id: 2}),
+		store.UpdateNotes(timetracker.Task{Id: 99, Notes: "lost"}),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var kinds []string
+	for i, ev := range readEvents(t, path) {
+		if ev.Seq != i+1 || ev.At.IsZero() {
+			t.Errorf("event %d: want: seq %d and a time, got: %+v", i, i+1, ev)
+		}
+		kinds = append(kinds, ev.Kind)
+	}
+	want := []string{
+		"start", "session", "stop",
+		"start", "session", "stop",
+		"start", "session", "stop",
+		"edit", "delete",
+	}
+	if !cmp.Equal(want, kinds) {
+		t.Error(cmp.Diff(want, kinds))
+	}
+
+}
+
+func TestEventStoreReplay(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "timetracker.events")
+
+	store, err := timetracker.NewEventStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timerActions(t, store)
+	want, err := store.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	// the projection is only a cache of the log
+	err = os.Remove(path + timetracker.EVENT_VIEW_EXT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store = newEventStore(t, path)
+
+	got, err := store.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+
+	report, err := store.GetReport(timetracker.ALL_USERS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantReport := []timetracker.Report{{Task: "piano", TotalTime: 240}}
+	if !cmp.Equal(wantReport, report) {
+		t.Error(cmp.Diff(wantReport, report))
+	}
+
+	id, err := store.Create(timetracker.Task{Name: "read", StartTime: time.Now()})
+	if err != nil || id != 4 {
+		t.Errorf("want: ids to carry on at 4, got: %d, %v", id, err)
+	}
+
+}
+
+func TestEventStoreRebuild(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "timetracker.events")
+
+	store, err := timetracker.NewEventStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timerActions(t, store)
+
+	result, err := store.Rebuild(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.FromSnapshot || result.Events != 11 || result.Seq != 11 {
+		t.Errorf("full: want: 11 events from the start, got: %+v", result)
+	}
+
+	_, err = store.CreateCompleted(timetracker.Task{Name: "read", StartTime: time.Now(), ElapsedTimeSec: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = store.Rebuild(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.FromSnapshot || result.Events != 1 || result.Seq != 12 {
+		t.Errorf("from snapshot: want: 1 event after it, got: %+v", result)
+	}
+	want, err := store.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	// a lost projection is restored from the snapshot
+	err = os.Remove(path + timetracker.EVENT_VIEW_EXT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = newEventStore(t, path)
+
+	got, err := store.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+
+}
+
+func TestEventStoreReadDuringRebuild(t *testing.T) {
+	t.Parallel()
+
+	store := newEventStore(t, filepath.Join(t.TempDir(), "timetracker.events"))
+	timerActions(t, store)
+
+	done := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, err := store.GetReport(timetracker.ALL_USERS); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		_, err := store.Rebuild(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+
+	if err := <-errs; err != nil {
+		t.Errorf("read during rebuild: %s", err)
+	}
+
+}
+
+func TestEventStoreUnfinishedWrite(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "timetracker.events")
+
+	store, err := timetracker.NewEventStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.CreateCompleted(timetracker.Task{Name: "piano", StartTime: time.Now(), ElapsedTimeSec: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":2,"kind":"add","task_id":2,"ta`)
+	f.Close()
+
+	store = newEventStore(t, path)
+
+	_, err = store.CreateCompleted(timetracker.Task{Name: "swim", StartTime: time.Now(), ElapsedTimeSec: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := readEvents(t, path)
+	if len(events) != 2 || events[1].Seq != 2 || events[1].Task.Name != "swim" {
+		t.Errorf("want: unfinished event replaced, got: %+v", events)
+	}
+
+	// a log cut short behind the projection's back
+	store.Close()
+	err = os.Truncate(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = timetracker.NewEventStore(path)
+	if err == nil || !strings.Contains(err.Error(), "rebuild") {
+		t.Errorf("want: error asking for a rebuild, got: %v", err)
+	}
+
+}
+
+func TestEventStorePause(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "timetracker.events")
+	store := newEventStore(t, path)
+
+	task := timetracker.Task{Name: "piano", StartTime: time.Now().Add(-time.Hour)}
+	id, err := store.Create(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	task.Id = id
+	err = store.NewTaskSession(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a second pause or resume in a row is no event
+	for _, change := range []func(timetracker.Task) error{store.Pause, store.Pause, store.Resume, store.Resume, store.Pause} {
+		err := change(task)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	running, err := store.GetTaskBySession(timetracker.LOCAL_USER_ID)
+	if err != nil || !running.Paused {
+		t.Errorf("want: paused, got: %+v, %v", running, err)
+	}
+
+	// stopped while paused
+	err = store.UpdateStopped(timetracker.Task{ElapsedTimeSec: 3600})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var kinds []string
+	var paused float64
+	var pausedAt time.Time
+	for _, ev := range readEvents(t, path) {
+		kinds = append(kinds, ev.Kind)
+		switch ev.Kind {
+		case timetracker.EventPause:
+			pausedAt = ev.At
+		case timetracker.EventResume, timetracker.EventStop:
+			paused += ev.At.Sub(pausedAt).Seconds()
+		}
+	}
+	wantKinds := []string{"start", "session", "pause", "resume", "pause", "stop"}
+	if !cmp.Equal(wantKinds, kinds) {
+		t.Error(cmp.Diff(wantKinds, kinds))
+	}
+
+	want, err := store.GetTask(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want.ElapsedTimeSec != 3600-paused || want.Paused {
+		t.Errorf("want: %fs not paused, got: %+v", 3600-paused, want)
+	}
+
+	_, err = store.Rebuild(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.GetTask(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cmp.Equal(want, got) {
+		t.Errorf("replayed: %s", cmp.Diff(want, got))
+	}
+
+}
+
+func TestPauseRoutes(t *testing.T) {
+	t.Parallel()
+
+	s := timetracker.NewServer(
+		timetracker.WithNoLogging(),
+		timetracker.WithEventStore(filepath.Join(t.TempDir(), "timetracker.events")),
+	)
+	err := s.LoadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+
+	b := newBrowser(t, ts)
+
+	if code, _ := b.post("/task/pause", url.Values{}); code != http.StatusConflict {
+		t.Errorf("nothing running: want: 409, got: %d", code)
+	}
+
+	_, body := b.post("/task/started", url.Values{"task": {"piano"}})
+	for _, tc := range []struct{ path, button string }{
+		{"", "Pause"},
+		{"/task/pause", "Resume"},
+		{"/task/resume", "Pause"},
+	} {
+		if tc.path != "" {
+			_, body = b.post(tc.path, url.Values{})
+		}
+		if !strings.Contains(body, "value='"+tc.button+"'") {
+			t.Errorf("%s: want: %s button", tc.path, tc.button)
+		}
+	}
+
+	// only the events store keeps pauses
+	_, sqlite := newSqliteServer(t)
+	if _, body := newBrowser(t, sqlite).post("/task/started", url.Values{"task": {"piano"}}); strings.Contains(body, "value='Pause'") {
+		t.Error("sqlite: want: no Pause button")
+	}
+
+}
+
+func TestRebuildCommand(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "timetracker.events")
+
+	run := func(opt timetracker.Option, args ...string) (string, error) {
+		s := timetracker.NewServer(timetracker.WithNoLogging(), opt)
+		var out bytes.Buffer
+		err := s.RunCommand(args, &out)
+		return out.String(), err
+	}
+
+	store, err := timetracker.NewEventStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timerActions(t, store)
+	store.Close()
+
+	out, err := run(timetracker.WithEventStore(path), "rebuild", "-full")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "replayed 11 events from the first event, tasks are up to event 11\n" {
+		t.Errorf("got: %q", out)
+	}
+
+	_, err = run(timetracker.WithSqliteStore(filepath.Join(dir, "timetracker.db")), "rebuild")
+	if err == nil {
+		t.Error("sqlite: want: error, got: nil")
+	}
+
+}
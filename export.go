@@ -0,0 +1,86 @@
+package timetracker
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// CSVHeader is the first row written by WriteCSV
+var CSVHeader = []string{"task", "project", "tags", "start_time", "elapsed_time", "notes"}
+
+// WriteCSV writes tasks as CSV with a header row.
+// Start times are written as RFC 3339 and elapsed
+// time in seconds.
+func WriteCSV(w io.Writer, tasks []Task) error {
+
+	cw := csv.NewWriter(w)
+
+	err := cw.Write(CSVHeader)
+	if err != nil {
+		return fmt.Errorf("unable to write csv header: %s", err)
+	}
+
+	err = writeCSVTasks(cw, tasks)
+	if err != nil {
+		return err
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// ExportCSV writes the tasks userId may see as WriteCSV
+// does, every task for ALL_USERS.  Tasks are read a page
+// at a time and written oldest first.
+func ExportCSV(w io.Writer, store TaskStore, userId int) error {
+
+	cw := csv.NewWriter(w)
+
+	err := cw.Write(CSVHeader)
+	if err != nil {
+		return fmt.Errorf("unable to write csv header: %s", err)
+	}
+
+	opts := ListOptions{Limit: HISTORY_LIMIT_MAX, Sort: ListSortStart, UserId: userId}
+	for {
+		page, err := store.List(opts)
+		if err != nil {
+			return err
+		}
+
+		err = writeCSVTasks(cw, page.Tasks)
+		if err != nil {
+			return err
+		}
+
+		if page.Next == "" {
+			break
+		}
+		opts.Cursor = NewCursor(opts.Sort, page.Tasks[len(page.Tasks)-1])
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeCSVTasks(cw *csv.Writer, tasks []Task) error {
+
+	for _, task := range tasks {
+		record := []string{
+			task.Name,
+			task.Project,
+			JoinTags(task.Tags),
+			task.StartTime.UTC().Format(time.RFC3339),
+			strconv.FormatFloat(task.ElapsedTimeSec, 'f', -1, 64),
+			task.Notes,
+		}
+		err := cw.Write(record)
+		if err != nil {
+			return fmt.Errorf("unable to write csv record: %s", err)
+		}
+	}
+	return nil
+}
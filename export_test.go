@@ -0,0 +1,267 @@
+package timetracker_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"timetracker"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWriteCSV(t *testing.T) {
+
+	t.Parallel()
+
+	tasks := []timetracker.Task{
+		{
+			Name:           "piano",
+			Project:        "music",
+			Tags:           []string{"practice", "scales"},
+			Notes:          "C major,\nhands together",
+			StartTime:      time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+			ElapsedTimeSec: 600.5,
+		},
+		{
+			Name:      "swim",
+			StartTime: time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC),
+		},
+	}
+
+	var buf bytes.Buffer
+
+	err := timetracker.WriteCSV(&buf, tasks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "task,project,tags,start_time,elapsed_time,notes\n" +
+		"piano,music,\"practice,scales\",2021-01-01T00:00:00Z,600.5,\"C major,\nhands together\"\n" +
+		"swim,,,2021-01-02T00:00:00Z,0,\n"
+
+	got := buf.String()
+
+	if want != got {
+		t.Errorf("want: %q, got: %q", want, got)
+	}
+
+}
+
+func TestExportImportJSON(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	src := newSqliteStore(t, filepath.Join(dir, "src.db"))
+	dst := newSqliteStore(t, filepath.Join(dir, "dst.db"))
+
+	start := time.Date(2021, 1, 1, 9, 0, 0, 0, time.UTC)
+	tasks := []timetracker.Task{
+		{UserId: timetracker.LOCAL_USER_ID, Name: "piano", Project: "music", Tags: []string{"practice", "scales"}, Notes: "C major,\nhands together", StartTime: start, ElapsedTimeSec: 600.5},
+		{UserId: timetracker.LOCAL_USER_ID, Name: "swim", StartTime: start.Add(time.Hour), ElapsedTimeSec: 1800},
+	}
+	for _, task := range tasks {
+		_, err := src.CreateCompleted(task)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	err := timetracker.ExportJSON(&buf, src, timetracker.ALL_USERS, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := `{"format":"timetracker-export","version":2,"exported_at":"2021-01-01T09:00:00Z","tasks":[`
+	if !strings.HasPrefix(buf.String(), header) {
+		t.Fatalf("want: header %s, got:\n%s", header, buf.String())
+	}
+	footer := `],"projects":["music"],"tags":["practice","scales"]}`
+	if !strings.HasSuffix(buf.String(), footer+"\n") {
+		t.Fatalf("want: footer %s, got:\n%s", footer, buf.String())
+	}
+	export := buf.String()
+
+	_, err = dst.CreateCompleted(timetracker.Task{Name: "swim", StartTime: start.Add(time.Hour), ElapsedTimeSec: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := timetracker.ImportJSON(dst, nil, dst, strings.NewReader(export), timetracker.LOCAL_USER_ID, timetracker.ImportMerge, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Created) != 1 || result.Skipped != 1 || len(result.Deleted) != 0 {
+		t.Errorf("merge: want: 1 created and 1 skipped, got: %+v", result)
+	}
+
+	result, err = timetracker.ImportJSON(dst, dst, dst, strings.NewReader(export), 2, timetracker.ImportReplace, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Created) != 2 || len(result.Deleted) != 2 {
+		t.Errorf("replace: want: 2 deleted and 2 created, got: %+v", result)
+	}
+
+	// newest first, each by the actor of its import
+	entries, err := dst.GetAuditLog(timetracker.AuditFilter{UserId: timetracker.ALL_USERS, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var audited []string
+	for _, e := range entries {
+		audited = append(audited, fmt.Sprintf("%s %d", e.Action, e.ActorId))
+	}
+	wantAudited := []string{"import 2", "import 2", "delete 2", "delete 2", "import 1"}
+	if !cmp.Equal(wantAudited, audited) {
+		t.Error(cmp.Diff(wantAudited, audited))
+	}
+
+	got, err := dst.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range got {
+		got[i].Id = 0
+	}
+	if !cmp.Equal(tasks, got) {
+		t.Error(cmp.Diff(tasks, got))
+	}
+
+}
+
+func TestExportJSONPages(t *testing.T) {
+	t.Parallel()
+
+	store := newSqliteStore(t, filepath.Join(t.TempDir(), "timetracker.db"))
+
+	start := time.Date(2021, 1, 1, 9, 0, 0, 0, time.UTC)
+	var tasks []timetracker.Task
+	for i := 0; i <= timetracker.HISTORY_LIMIT_MAX; i++ {
+		tasks = append(tasks, timetracker.Task{UserId: timetracker.LOCAL_USER_ID, Name: "piano", StartTime: start.Add(time.Duration(i) * time.Minute), ElapsedTimeSec: 60})
+	}
+	tasks = append(tasks, timetracker.Task{UserId: 2, Name: "swim", Project: "sport", StartTime: start, ElapsedTimeSec: 60})
+	_, err := store.ReplaceTasks(timetracker.LOCAL_USER_ID, nil, tasks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		userId int
+		want   int
+	}{
+		{timetracker.ALL_USERS, len(tasks)},
+		{timetracker.LOCAL_USER_ID, len(tasks) - 1},
+		{2, 1},
+	} {
+		var buf bytes.Buffer
+		err := timetracker.ExportJSON(&buf, store, tc.userId, start)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dst := newSqliteStore(t, filepath.Join(t.TempDir(), "timetracker.db"))
+		result, err := timetracker.ImportJSON(dst, dst, dst, &buf, timetracker.LOCAL_USER_ID, timetracker.ImportMerge, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Created) != tc.want {
+			t.Errorf("user %d: want: %d tasks, got: %d", tc.userId, tc.want, len(result.Created))
+		}
+		for _, task := range result.Created {
+			if tc.userId != timetracker.ALL_USERS && task.UserId != tc.userId {
+				t.Errorf("user %d: want: own tasks, got: %+v", tc.userId, task)
+			}
+		}
+	}
+
+}
+
+func TestImportJSONValidation(t *testing.T) {
+	t.Parallel()
+
+	store := newSqliteStore(t, filepath.Join(t.TempDir(), "timetracker.db"))
+
+	doc := `{"format":"timetracker-export","version":1,"tasks":[
+{"name":"piano","start_time":"2021-01-01T09:00:00Z","elapsed_time":60},
+{"name":"","start_time":"2021-01-01T10:00:00Z","elapsed_time":-1},
+{"name":"swim","start_time":"2021-01-01T11:00:00Z","elapsed_time":"long"},
+{"name":"run","start_time":"2021-01-01T12:00:00Z","colour":"red"}
+]}`
+
+	_, err := timetracker.ImportJSON(store, store, store, strings.NewReader(doc), timetracker.LOCAL_USER_ID, timetracker.ImportMerge, false)
+
+	var invalid timetracker.ValidationErrors
+	if !errors.As(err, &invalid) {
+		t.Fatalf("want: ValidationErrors, got: %v", err)
+	}
+
+	var got []string
+	for _, e := range invalid {
+		got = append(got, fmt.Sprintf("%d %s", e.Record, e.Field))
+	}
+	want := []string{"2 name", "2 elapsed_time", "3 elapsed_time", "4 "}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+
+	if tasks, _ := store.GetAll(); len(tasks) != 0 {
+		t.Errorf("want: nothing imported, got: %d tasks", len(tasks))
+	}
+
+	for _, bad := range []string{
+		`{"format":"something else","version":1,"tasks":[]}`,
+		`{"format":"timetracker-export","version":3,"tasks":[]}`,
+		`{"format":"timetracker-export","version":1,"tasks":{}}`,
+		`[]`,
+	} {
+		_, err := timetracker.ImportJSON(store, store, store, strings.NewReader(bad), timetracker.LOCAL_USER_ID, timetracker.ImportMerge, true)
+		if err == nil {
+			t.Errorf("%s: want: error, got: nil", bad)
+		}
+	}
+
+	_, err = timetracker.ImportJSON(store, store, store, strings.NewReader(doc), timetracker.LOCAL_USER_ID, "append", true)
+	if err == nil {
+		t.Error("unknown mode: want: error, got: nil")
+	}
+
+}
+
+func TestJSONCommands(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "timetracker.db")
+	file := filepath.Join(dir, "timetracker.json")
+
+	run := func(args ...string) (string, error) {
+		s := timetracker.NewServer(timetracker.WithNoLogging(), timetracker.WithSqliteStore(dbPath))
+		var out bytes.Buffer
+		err := s.RunCommand(args, &out)
+		return out.String(), err
+	}
+
+	_, err := run("export-json", "-o", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := run("import-json", "-mode", "replace", "-dry-run", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "would import 0 tasks, skipped 0 already there, deleted 0\n" {
+		t.Errorf("dry run: got: %q", out)
+	}
+
+	_, err = run("import-json")
+	if err == nil {
+		t.Error("import without a file: want: error, got: nil")
+	}
+
+}
@@ -1,19 +1,44 @@
 package timetracker
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
+	"io"
 	"io/fs"
-	"log"
 	"net/http"
 	"path/filepath"
-	"text/template"
+	"strconv"
+	"strings"
 	"time"
 	"timetracker/ui"
 )
 
 const (
-	HOME_PAGE_TEMPLATE   string = "home.page.tmpl"
-	REPORT_PAGE_TEMPLATE string = "report.page.tmpl"
+	HOME_PAGE_TEMPLATE     string = "home.page.tmpl"
+	REPORT_PAGE_TEMPLATE   string = "report.page.tmpl"
+	GOAL_PAGE_TEMPLATE     string = "goal.page.tmpl"
+	TEMPLATE_PAGE_TEMPLATE string = "template.page.tmpl"
+	SEARCH_PAGE_TEMPLATE   string = "search.page.tmpl"
+	HISTORY_PAGE_TEMPLATE  string = "history.page.tmpl"
+	IMPORT_PAGE_TEMPLATE   string = "import.page.tmpl"
+	WEBHOOK_PAGE_TEMPLATE  string = "webhook.page.tmpl"
+	DELIVERY_PAGE_TEMPLATE string = "delivery.page.tmpl"
+	TOKEN_PAGE_TEMPLATE    string = "tokens.page.tmpl"
+
+	WORKSPACES_PAGE_TEMPLATE string = "workspaces.page.tmpl"
+	WORKSPACE_PAGE_TEMPLATE  string = "workspace.page.tmpl"
+	TEAM_PAGE_TEMPLATE       string = "team.page.tmpl"
+	INVITE_PAGE_TEMPLATE     string = "invite.page.tmpl"
+	AUDIT_PAGE_TEMPLATE      string = "audit.page.tmpl"
+
+	// number of recent task names offered
+	// as suggestions on the create form
+	RECENT_NAMES_LIMIT int = 20
+
+	// largest .ics upload accepted by the import page
+	ICS_UPLOAD_LIMIT int64 = 10 << 20
 )
 
 // TemplateData is used to load struct
@@ -21,18 +46,61 @@ const (
 type TemplateData struct {
 	Reports      []Report
 	Tasks        []Task
+	Goals        []GoalProgress
+	Templates    []TaskTemplate
+	Names        []string
+	Search       SearchQuery
+	Results      []SearchResult
+	List         ListOptions
+	Page         TaskPage
+	Imports      []ICSEvent
+	Calendar     string
+	Imported     bool
+	Webhooks     []Webhook
+	Deliveries   []WebhookDelivery
+	Events       []string
+	Tokens       []APIToken
+	NewToken     string
+	Scopes       []string
+	Now          time.Time
+	Workspaces   []Workspace
+	Workspace    Workspace
+	Viewer       Member
+	Members      []Member
+	Invitations  []Invitation
+	Projects     []string
+	Roles        []string
+	TeamReport   []MemberReport
+	InviteLink   string
+	InviteToken  string
+	User         User
+	SignedIn     bool
+	Audit        []AuditEntry
+	AuditFilter  AuditFilter
+	Error        string
+	Pausable     bool
+	CSRFToken    string
 	PageTemplate *template.Template
 }
 
 func (s *Server) home(w http.ResponseWriter, r *http.Request) {
 
-	tasks, err := s.TaskStore.GetLatest()
+	tasks, err := s.TaskStore.GetLatest(s.currentUserID(r))
 	if err != nil {
-		log.Println(err.Error())
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		s.serverError(w, r, err)
 		return
 	}
-	data := TemplateData{Tasks: tasks}
+	goals, err := s.goalProgress(r)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	templates, err := s.taskTemplates(r)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	data := TemplateData{Tasks: tasks, Goals: goals, Templates: templates}
 
 	data.PageTemplate = s.templateCache[HOME_PAGE_TEMPLATE]
 
@@ -45,13 +113,17 @@ func (s *Server) showTaskReport(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	report, err := s.TaskStore.GetReport()
+	report, err := s.TaskStore.GetReport(s.currentUserID(r))
 	if err != nil {
-		log.Println(err.Error())
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		s.serverError(w, r, err)
 		return
 	}
-	data := TemplateData{Reports: report}
+	goals, err := s.goalProgress(r)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	data := TemplateData{Reports: report, Goals: goals}
 
 	var ok bool
 
@@ -67,7 +139,13 @@ func (s *Server) showTaskReport(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) createNewTaskForm(w http.ResponseWriter, r *http.Request) {
 
-	data := TemplateData{}
+	names, err := s.TaskStore.GetRecentNames(s.currentUserID(r), RECENT_NAMES_LIMIT)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	data := TemplateData{Names: names}
 
 	var ok bool
 
@@ -83,6 +161,12 @@ func (s *Server) createNewTaskForm(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) startedTask(w http.ResponseWriter, r *http.Request) {
 
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
 	err := r.ParseForm()
 	if err != nil {
 		fmt.Fprint(w, http.StatusBadRequest)
@@ -92,26 +176,28 @@ func (s *Server) startedTask(w http.ResponseWriter, r *http.Request) {
 	taskName := r.Form.Get("task")
 
 	task := NewTask(taskName)
-	task.StartAt(time.Now())
+	task.Project = r.Form.Get("project")
+	task.Tags = ParseTags(r.Form.Get("tags"))
+	task.Notes = r.Form.Get("notes")
 
-	id, err := s.TaskStore.Create(task)
-	if err != nil {
-		fmt.Fprint(w, "error creating task:", http.StatusInternalServerError)
-		return
-	}
+	s.start(w, r, task)
 
-	task.Id = id
+}
 
-	err = s.TaskStore.NewTaskSession(task)
+// start begins tracking task, makes it the current
+// session and renders the started page
+func (s *Server) start(w http.ResponseWriter, r *http.Request, task Task) {
+
+	task, err := s.beginTask(r, task)
 	if err != nil {
-		fmt.Fprint(w, "error creating task_session:", http.StatusInternalServerError)
+		fmt.Fprint(w, err, http.StatusInternalServerError)
 		return
 	}
 
 	tasks := []Task{}
 	tasks = append(tasks, task)
 
-	data := TemplateData{Tasks: tasks}
+	data := TemplateData{Tasks: tasks, Pausable: s.PauseStore != nil}
 	var ok bool
 
 	data.PageTemplate, ok = s.templateCache["started.page.tmpl"]
@@ -126,23 +212,33 @@ func (s *Server) startedTask(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) stopTask(w http.ResponseWriter, r *http.Request) {
 
-	err := r.ParseForm()
-	if err != nil {
-		fmt.Fprint(w, http.StatusBadRequest)
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	task, err := s.TaskStore.GetTaskBySession()
+	err := r.ParseForm()
 	if err != nil {
-		fmt.Fprint(w, "error GetTaskBySession", http.StatusInternalServerError)
+		fmt.Fprint(w, http.StatusBadRequest)
 		return
 	}
 
-	task.Stop(time.Now())
+	// notes may be edited on the stop form.  A stop
+	// without a notes field keeps what is stored.
+	var notes *string
+	if _, ok := r.Form["notes"]; ok {
+		n := r.Form.Get("notes")
+		notes = &n
+	}
 
-	err = s.TaskStore.UpdateStopped(task)
+	task, err := s.finishTask(r, notes)
+	if errors.Is(err, ErrNoRunningTask) {
+		http.Error(w, "Conflict - no task is running", http.StatusConflict)
+		return
+	}
 	if err != nil {
-		fmt.Fprint(w, "error stopped", http.StatusInternalServerError)
+		fmt.Fprint(w, err, http.StatusInternalServerError)
 		return
 	}
 
@@ -162,45 +258,1695 @@ func (s *Server) stopTask(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func (td TemplateData) Render(w http.ResponseWriter, r *http.Request) {
+// beginTask starts task for the current user
+// and makes it the current session
+func (s *Server) beginTask(r *http.Request, task Task) (Task, error) {
 
-	ts := td.PageTemplate
+	task.UserId = s.currentUserID(r)
+	task.StartAt(s.now())
 
-	err := ts.Execute(w, td)
+	id, err := s.changeTask(r, AuditCreate, nil, &task)
 	if err != nil {
-		log.Println(err.Error())
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return Task{}, fmt.Errorf("error creating task: %w", err)
+	}
+
+	task.Id = id
+
+	err = s.TaskStore.NewTaskSession(task)
+	if err != nil {
+		return Task{}, fmt.Errorf("error creating task_session: %w", err)
 	}
 
+	s.emit(r, EventTaskStarted, task)
+
+	return task, nil
 }
 
-func NewTemplateCache() (map[string]*template.Template, error) {
-	cache := map[string]*template.Template{}
+// ErrNoRunningTask is returned when the current
+// user has no task running to stop or edit
+var ErrNoRunningTask = errors.New("no task is running")
 
-	pages, err := fs.Glob(ui.Files, "html/*.page.tmpl")
+// runningTask returns the current session's task
+// while it runs, or ErrNoRunningTask
+func (s *Server) runningTask(r *http.Request) (Task, error) {
+
+	task, err := s.TaskStore.GetTaskBySession(s.currentUserID(r))
 	if err != nil {
-		return nil, err
+		return Task{}, fmt.Errorf("error GetTaskBySession: %w", err)
+	}
+	if task.Id == 0 || task.ElapsedTimeSec != 0 {
+		return Task{}, ErrNoRunningTask
 	}
+	return task, nil
+}
 
-	for _, page := range pages {
-		name := filepath.Base(page)
+// finishTask stops the current session's task,
+// replacing its notes when notes is not nil
+func (s *Server) finishTask(r *http.Request, notes *string) (Task, error) {
 
-		ts, err := template.New(name).ParseFS(ui.Files, page)
-		if err != nil {
-			return nil, err
-		}
+	task, err := s.runningTask(r)
+	if err != nil {
+		return Task{}, err
+	}
 
-		ts, err = ts.ParseFS(ui.Files, "html/*.layout.tmpl")
+	before := task
+	if notes != nil {
+		task.Notes = *notes
+	}
+
+	task.Stop(s.now())
+
+	_, err = s.changeTask(r, AuditStop, &before, &task)
+	if err != nil {
+		return Task{}, fmt.Errorf("error stopped: %w", err)
+	}
+
+	s.emit(r, EventTaskStopped, task)
+
+	return task, nil
+}
+
+// saveNotes updates the notes of the running
+// task and shows it again
+func (s *Server) saveNotes(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	task, err := s.runningTask(r)
+	if errors.Is(err, ErrNoRunningTask) {
+		http.Error(w, "Conflict - no task is running", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	before := task
+	task.Notes = r.Form.Get("notes")
+
+	_, err = s.changeTask(r, AuditUpdate, &before, &task)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	s.emit(r, EventTaskUpdated, task)
+
+	data := TemplateData{Tasks: []Task{task}, Pausable: s.PauseStore != nil}
+	var ok bool
+
+	data.PageTemplate, ok = s.templateCache["started.page.tmpl"]
+	if !ok {
+		fmt.Fprint(w, fmt.Sprintf("template does not exist: started.page.tmpl"))
+		return
+	}
+
+	data.Render(w, r)
+
+}
+
+// pauseTask pauses the running task, or resumes it
+// on /task/resume, and shows it again
+func (s *Server) pauseTask(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	task, err := s.runningTask(r)
+	if errors.Is(err, ErrNoRunningTask) {
+		http.Error(w, "Conflict - no task is running", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	change := s.PauseStore.Pause
+	if r.URL.Path == "/task/resume" {
+		change = s.PauseStore.Resume
+	}
+	err = change(task)
+	if err == nil {
+		task, err = s.runningTask(r)
+	}
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	data := TemplateData{Tasks: []Task{task}, Pausable: true}
+	var ok bool
+
+	data.PageTemplate, ok = s.templateCache["started.page.tmpl"]
+	if !ok {
+		fmt.Fprint(w, fmt.Sprintf("template does not exist: started.page.tmpl"))
+		return
+	}
+
+	data.Render(w, r)
+
+}
+
+func (s *Server) deleteTask(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.Atoi(r.Form.Get("id"))
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	task, err := s.TaskStore.GetVisibleTask(id, s.currentUserID(r))
+	if errors.Is(err, ErrNoRecord) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	_, err = s.changeTask(r, AuditDelete, &task, nil)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	s.emit(r, EventTaskDeleted, task)
+
+	http.Redirect(w, r, "/task/history", http.StatusSeeOther)
+
+}
+
+// emit queues webhook deliveries for a task event.  A
+// failure is logged rather than failing the request.
+func (s *Server) emit(r *http.Request, event string, task Task) {
+
+	if s.webhooks == nil {
+		return
+	}
+
+	err := s.webhooks.Emit(event, task, s.now())
+	if err != nil {
+		s.requestLogger(r).Error("queueing webhooks", "event", event, "err", err)
+	}
+
+}
+
+func (s *Server) exportTasks(w http.ResponseWriter, r *http.Request) {
+
+	if r.URL.Query().Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="timetracker.json"`)
+
+		err := ExportJSON(w, s.TaskStore, s.currentUserID(r), s.now())
 		if err != nil {
-			return nil, err
+			s.requestLogger(r).Error("writing json export", "err", err)
 		}
+		return
+	}
 
-		ts, err = ts.ParseFS(ui.Files, "html/*.partial.tmpl")
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="timetracker.csv"`)
+
+	err := ExportCSV(w, s.TaskStore, s.currentUserID(r))
+	if err != nil {
+		s.requestLogger(r).Error("writing csv", "err", err)
+	}
+
+}
+
+// search shows the search form and, when a query
+// has been given, its results
+func (s *Server) search(w http.ResponseWriter, r *http.Request) {
+
+	data := TemplateData{}
+
+	if r.URL.Query().Get("q") != "" {
+		q, err := NewSearchQuery(r.URL.Query())
 		if err != nil {
-			return nil, err
+			w.WriteHeader(http.StatusBadRequest)
+			data.Error = err.Error()
+		} else {
+			q.UserId = s.currentUserID(r)
+			data.Search = q
+			data.Results, err = s.TaskStore.Search(q)
+			if err != nil {
+				s.serverError(w, r, err)
+				return
+			}
 		}
+	}
 
-		cache[name] = ts
+	var ok bool
+
+	data.PageTemplate, ok = s.templateCache[SEARCH_PAGE_TEMPLATE]
+	if !ok {
+		fmt.Fprint(w, fmt.Sprintf("template does not exist: %s", SEARCH_PAGE_TEMPLATE))
+		return
 	}
-	return cache, nil
+
+	data.Render(w, r)
+
+}
+
+func (s *Server) apiSearch(w http.ResponseWriter, r *http.Request) {
+
+	q, err := NewSearchQuery(r.URL.Query())
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q.UserId = s.currentUserID(r)
+
+	results, err := s.TaskStore.Search(q)
+	if err != nil {
+		s.requestLogger(r).Error("internal server error", "err", err)
+		writeJSONError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if results == nil {
+		results = []SearchResult{}
+	}
+
+	writeJSON(w, results, http.StatusOK)
+
+}
+
+func (s *Server) showHistory(w http.ResponseWriter, r *http.Request) {
+
+	opts, err := NewListOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.UserId = s.currentUserID(r)
+
+	page, err := s.TaskStore.List(opts)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	data := TemplateData{List: opts, Page: page}
+
+	var ok bool
+
+	data.PageTemplate, ok = s.templateCache[HISTORY_PAGE_TEMPLATE]
+	if !ok {
+		fmt.Fprint(w, fmt.Sprintf("template does not exist: %s", HISTORY_PAGE_TEMPLATE))
+		return
+	}
+
+	data.Render(w, r)
+
+}
+
+func (s *Server) apiHistory(w http.ResponseWriter, r *http.Request) {
+
+	opts, err := NewListOptions(r.URL.Query())
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.UserId = s.currentUserID(r)
+
+	page, err := s.TaskStore.List(opts)
+	if err != nil {
+		s.requestLogger(r).Error("internal server error", "err", err)
+		writeJSONError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if page.Tasks == nil {
+		page.Tasks = []Task{}
+	}
+
+	writeJSON(w, page, http.StatusOK)
+
+}
+
+// apiTaskRequest is the body of POST /api/task/start
+type apiTaskRequest struct {
+	Name    string   `json:"name"`
+	Project string   `json:"project"`
+	Tags    []string `json:"tags"`
+	Notes   string   `json:"notes"`
+}
+
+// apiStartTask starts a task from a JSON body
+// and answers with the running task
+func (s *Server) apiStartTask(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSONError(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req apiTaskRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_FORM_SIZE)).Decode(&req)
+	if err != nil {
+		writeJSONError(w, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if strings.TrimSpace(req.Name) == "" {
+		writeJSONError(w, "name must not be empty", http.StatusBadRequest)
+		return
+	}
+
+	task := NewTask(req.Name)
+	task.Project = req.Project
+	task.Tags = ParseTags(strings.Join(req.Tags, ","))
+	task.Notes = req.Notes
+
+	task, err = s.beginTask(r, task)
+	if err != nil {
+		s.requestLogger(r).Error("internal server error", "err", err)
+		writeJSONError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, task, http.StatusCreated)
+
+}
+
+// apiStopTask stops the running task.  The
+// optional JSON body {"notes": "..."} replaces
+// its notes.
+func (s *Server) apiStopTask(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSONError(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Notes *string `json:"notes"`
+	}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_FORM_SIZE)).Decode(&req)
+	if err != nil && err != io.EOF {
+		writeJSONError(w, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	task, err := s.finishTask(r, req.Notes)
+	if errors.Is(err, ErrNoRunningTask) {
+		writeJSONError(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.requestLogger(r).Error("internal server error", "err", err)
+		writeJSONError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, task, http.StatusOK)
+
+}
+
+// calendar serves the completed tasks of the user
+// whose API token the request carries as an iCalendar
+// feed.  Calendar apps cannot send headers, so the
+// token may be in ?token=.  It needs ScopeCalendar.
+func (s *Server) calendar(w http.ResponseWriter, r *http.Request) {
+
+	secret := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		secret = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if secret == "" {
+		unauthorized(w, "", "API token with the "+ScopeCalendar+" scope required")
+		return
+	}
+
+	token, ok := s.checkAPIToken(w, r, secret, ScopeCalendar)
+	if !ok {
+		return
+	}
+
+	filter, err := NewTaskFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.UserId = token.UserId
+
+	tasks, err := s.TaskStore.GetCompleted(filter)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="timetracker.ics"`)
+
+	err = WriteICS(w, tasks, s.now())
+	if err != nil {
+		s.requestLogger(r).Error("writing calendar", "err", err)
+	}
+
+}
+
+// writeJSON writes v as the JSON response body.  The
+// values written always encode, so an error here is
+// the client going away and is not logged.
+func writeJSON(w http.ResponseWriter, v interface{}, status int) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(v)
+
+}
+
+// requestLogger returns the Logger carrying the
+// request id, or the server Logger outside the
+// access log middleware
+func (s *Server) requestLogger(r *http.Request) *Logger {
+	if l, ok := r.Context().Value(loggerKey{}).(*Logger); ok {
+		return l
+	}
+	return s.logger
+}
+
+// serverError logs err and answers 500 without
+// showing the error to the client
+func (s *Server) serverError(w http.ResponseWriter, r *http.Request, err error) {
+	s.requestLogger(r).Error("internal server error", "method", r.Method, "path", r.URL.Path, "err", err)
+	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+}
+
+// writeJSONError writes an error response in
+// the form {"error": "message"}
+func writeJSONError(w http.ResponseWriter, message string, status int) {
+	writeJSON(w, map[string]string{"error": message}, status)
+}
+
+// goalProgress returns progress for all goals over the
+// current user's tasks, or nothing when the server has
+// no GoalStore
+func (s *Server) goalProgress(r *http.Request) ([]GoalProgress, error) {
+
+	if s.GoalStore == nil {
+		return nil, nil
+	}
+	return s.GoalStore.GetGoalProgress(s.currentUserID(r), s.now())
+}
+
+func (s *Server) showGoals(w http.ResponseWriter, r *http.Request) {
+
+	goals, err := s.goalProgress(r)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	data := TemplateData{Goals: goals}
+
+	var ok bool
+
+	data.PageTemplate, ok = s.templateCache[GOAL_PAGE_TEMPLATE]
+	if !ok {
+		fmt.Fprint(w, fmt.Sprintf("template does not exist: %s", GOAL_PAGE_TEMPLATE))
+		return
+	}
+
+	data.Render(w, r)
+
+}
+
+func (s *Server) createGoal(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	hours, err := strconv.ParseFloat(r.Form.Get("hours"), 64)
+	if err != nil {
+		http.Error(w, "hours must be a number", http.StatusBadRequest)
+		return
+	}
+
+	goal, err := NewGoal(r.Form.Get("name"), r.Form.Get("scope"), r.Form.Get("kind"), r.Form.Get("period"), hours)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	goal.UserId = s.currentUserID(r)
+
+	_, err = s.GoalStore.CreateGoal(goal)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/goal", http.StatusSeeOther)
+
+}
+
+func (s *Server) deleteGoal(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.Atoi(r.Form.Get("id"))
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	err = s.GoalStore.DeleteGoal(Goal{Id: id, UserId: s.currentUserID(r)})
+	if errors.Is(err, ErrNoRecord) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/goal", http.StatusSeeOther)
+
+}
+
+// taskTemplates returns the current user's saved templates,
+// or nothing when the server has no TemplateStore
+func (s *Server) taskTemplates(r *http.Request) ([]TaskTemplate, error) {
+
+	if s.TemplateStore == nil {
+		return nil, nil
+	}
+	return s.TemplateStore.GetTemplates(s.currentUserID(r))
+}
+
+func (s *Server) showTemplates(w http.ResponseWriter, r *http.Request) {
+
+	templates, err := s.taskTemplates(r)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+	data := TemplateData{Templates: templates}
+
+	var ok bool
+
+	data.PageTemplate, ok = s.templateCache[TEMPLATE_PAGE_TEMPLATE]
+	if !ok {
+		fmt.Fprint(w, fmt.Sprintf("template does not exist: %s", TEMPLATE_PAGE_TEMPLATE))
+		return
+	}
+
+	data.Render(w, r)
+
+}
+
+func (s *Server) createTemplate(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	tt, err := NewTaskTemplate(r.Form.Get("name"), r.Form.Get("project"), r.Form.Get("tags"), r.Form.Get("notes"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tt.UserId = s.currentUserID(r)
+
+	_, err = s.TemplateStore.CreateTemplate(tt)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/template", http.StatusSeeOther)
+
+}
+
+func (s *Server) deleteTemplate(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.Atoi(r.Form.Get("id"))
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	err = s.TemplateStore.DeleteTemplate(TaskTemplate{Id: id, UserId: s.currentUserID(r)})
+	if errors.Is(err, ErrNoRecord) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/template", http.StatusSeeOther)
+
+}
+
+// startTemplate is the one-click start for a saved template
+func (s *Server) startTemplate(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.Atoi(r.Form.Get("id"))
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	tt, err := s.TemplateStore.GetTemplate(id, s.currentUserID(r))
+	if errors.Is(err, ErrNoRecord) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	s.start(w, r, tt.NewTask())
+
+}
+
+// importCalendar previews and imports an uploaded .ics
+// file.  The preview carries the calendar in a hidden
+// field so confirming does not need a second upload.
+func (s *Server) importCalendar(w http.ResponseWriter, r *http.Request) {
+
+	data := TemplateData{}
+
+	if r.Method == http.MethodPost {
+		r.Body = http.MaxBytesReader(w, r.Body, ICS_UPLOAD_LIMIT)
+
+		err := r.ParseMultipartForm(ICS_UPLOAD_LIMIT)
+		if err != nil && err != http.ErrNotMultipart {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		calendar := r.FormValue("calendar")
+
+		file, _, err := r.FormFile("file")
+		if err == nil {
+			b, err := io.ReadAll(file)
+			file.Close()
+			if err != nil {
+				http.Error(w, "Bad Request", http.StatusBadRequest)
+				return
+			}
+			calendar = string(b)
+		}
+
+		dryRun := r.FormValue("action") != "import"
+
+		data.Imports, err = ImportICS(s.ImportStore, strings.NewReader(calendar), s.currentUserID(r), s.now(), dryRun)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			data.Error = err.Error()
+		} else if dryRun {
+			data.Calendar = calendar
+		} else {
+			data.Imported = true
+		}
+	}
+
+	var ok bool
+
+	data.PageTemplate, ok = s.templateCache[IMPORT_PAGE_TEMPLATE]
+	if !ok {
+		fmt.Fprint(w, fmt.Sprintf("template does not exist: %s", IMPORT_PAGE_TEMPLATE))
+		return
+	}
+
+	data.Render(w, r)
+
+}
+
+func (s *Server) showWebhooks(w http.ResponseWriter, r *http.Request) {
+
+	webhooks, err := s.WebhookStore.GetWebhooks(s.currentUserID(r))
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	data := TemplateData{Webhooks: webhooks, Events: WebhookEvents}
+	var ok bool
+
+	data.PageTemplate, ok = s.templateCache[WEBHOOK_PAGE_TEMPLATE]
+	if !ok {
+		fmt.Fprint(w, fmt.Sprintf("template does not exist: %s", WEBHOOK_PAGE_TEMPLATE))
+		return
+	}
+
+	data.Render(w, r)
+
+}
+
+func (s *Server) createWebhook(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	wh, err := NewWebhook(r.Form.Get("url"), r.Form.Get("secret"), r.Form["event"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	wh.UserId = s.currentUserID(r)
+
+	_, err = s.WebhookStore.CreateWebhook(wh)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/webhook", http.StatusSeeOther)
+
+}
+
+func (s *Server) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.Atoi(r.Form.Get("id"))
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	err = s.WebhookStore.DeleteWebhook(Webhook{Id: id, UserId: s.currentUserID(r)})
+	if errors.Is(err, ErrNoRecord) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/webhook", http.StatusSeeOther)
+
+}
+
+// showDeliveries is the delivery log, newest first
+func (s *Server) showDeliveries(w http.ResponseWriter, r *http.Request) {
+
+	deliveries, err := s.WebhookStore.GetDeliveries(s.currentUserID(r), DELIVERY_LOG_LIMIT)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	data := TemplateData{Deliveries: deliveries}
+	var ok bool
+
+	data.PageTemplate, ok = s.templateCache[DELIVERY_PAGE_TEMPLATE]
+	if !ok {
+		fmt.Fprint(w, fmt.Sprintf("template does not exist: %s", DELIVERY_PAGE_TEMPLATE))
+		return
+	}
+
+	data.Render(w, r)
+
+}
+
+// showTokens lists the API tokens.  A token
+// just created is shown once in NewToken.
+func (s *Server) showTokens(w http.ResponseWriter, r *http.Request) {
+	s.renderTokens(w, r, "")
+}
+
+func (s *Server) renderTokens(w http.ResponseWriter, r *http.Request, secret string) {
+
+	tokens, err := s.ownTokens(r)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	data := TemplateData{
+		Tokens:   tokens,
+		NewToken: secret,
+		Scopes:   APITokenScopes,
+		Now:      s.now(),
+	}
+	var ok bool
+
+	data.PageTemplate, ok = s.templateCache[TOKEN_PAGE_TEMPLATE]
+	if !ok {
+		fmt.Fprint(w, fmt.Sprintf("template does not exist: %s", TOKEN_PAGE_TEMPLATE))
+		return
+	}
+
+	data.Render(w, r)
+
+}
+
+func (s *Server) createToken(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	var expiresIn time.Duration
+	if days := r.Form.Get("expires"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			http.Error(w, "expiry must be a number of days", http.StatusBadRequest)
+			return
+		}
+		expiresIn = time.Duration(n) * 24 * time.Hour
+	}
+
+	token, secret, err := NewAPIToken(s.currentUserID(r), r.Form.Get("name"), r.Form["scope"], expiresIn, s.now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = s.APITokenStore.CreateAPIToken(token)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	// the secret is not stored, so the page is
+	// rendered here rather than redirected to
+	w.Header().Set("Cache-Control", "no-store")
+	s.renderTokens(w, r, secret)
+
+}
+
+func (s *Server) revokeToken(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.Atoi(r.Form.Get("id"))
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := s.ownTokens(r)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	for _, t := range tokens {
+		if t.Id == id {
+			err = s.APITokenStore.RevokeAPIToken(id, s.now())
+			if err != nil {
+				s.serverError(w, r, err)
+				return
+			}
+			http.Redirect(w, r, "/settings/tokens", http.StatusSeeOther)
+			return
+		}
+	}
+
+	http.NotFound(w, r)
+
+}
+
+// ownTokens are the API tokens of the current user
+func (s *Server) ownTokens(r *http.Request) ([]APIToken, error) {
+
+	tokens, err := s.APITokenStore.GetAPITokens()
+	if err != nil {
+		return nil, err
+	}
+
+	userId := s.currentUserID(r)
+
+	var own []APIToken
+	for _, t := range tokens {
+		if t.UserId == userId {
+			own = append(own, t)
+		}
+	}
+	return own, nil
+}
+
+func (s *Server) showWorkspaces(w http.ResponseWriter, r *http.Request) {
+
+	user, err := s.currentUser(r)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	workspaces, err := s.WorkspaceStore.GetWorkspaces(user.Id)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	_, signedIn := r.Context().Value(userKey{}).(User)
+
+	data := TemplateData{Workspaces: workspaces, User: user, SignedIn: signedIn}
+	var ok bool
+
+	data.PageTemplate, ok = s.templateCache[WORKSPACES_PAGE_TEMPLATE]
+	if !ok {
+		fmt.Fprint(w, fmt.Sprintf("template does not exist: %s", WORKSPACES_PAGE_TEMPLATE))
+		return
+	}
+
+	data.Render(w, r)
+
+}
+
+func (s *Server) createWorkspace(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	ws, err := NewWorkspace(r.Form.Get("name"), s.now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := s.WorkspaceStore.CreateWorkspace(ws, s.currentUserID(r))
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/workspace/view?workspace=%d", id), http.StatusSeeOther)
+
+}
+
+// workspaceFor finds the workspace in the workspace
+// form value among the current user's workspaces.
+// Workspaces the user is not a member of are not found.
+func (s *Server) workspaceFor(w http.ResponseWriter, r *http.Request) (Workspace, Member, bool) {
+
+	id, err := strconv.Atoi(r.FormValue("workspace"))
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return Workspace{}, Member{}, false
+	}
+
+	userId := s.currentUserID(r)
+
+	workspaces, err := s.WorkspaceStore.GetWorkspaces(userId)
+	if err != nil {
+		s.serverError(w, r, err)
+		return Workspace{}, Member{}, false
+	}
+
+	for _, ws := range workspaces {
+		if ws.Id == id {
+			return ws, Member{WorkspaceId: ws.Id, UserId: userId, Role: ws.Role}, true
+		}
+	}
+
+	http.NotFound(w, r)
+	return Workspace{}, Member{}, false
+}
+
+// manageWorkspace is workspaceFor for the POST
+// routes only owners and admins may use
+func (s *Server) manageWorkspace(w http.ResponseWriter, r *http.Request) (Workspace, Member, bool) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return Workspace{}, Member{}, false
+	}
+
+	ws, viewer, ok := s.workspaceFor(w, r)
+	if !ok {
+		return Workspace{}, Member{}, false
+	}
+
+	if !CanManage(viewer.Role) {
+		http.Error(w, "Forbidden - owners and admins only", http.StatusForbidden)
+		return Workspace{}, Member{}, false
+	}
+
+	return ws, viewer, true
+}
+
+func (s *Server) showWorkspace(w http.ResponseWriter, r *http.Request) {
+
+	ws, viewer, ok := s.workspaceFor(w, r)
+	if !ok {
+		return
+	}
+
+	s.renderWorkspace(w, r, ws, viewer, "")
+}
+
+// renderWorkspace shows the members and projects of
+// ws, and to owners and admins the pending invitations.
+// An invitation just created is shown once in InviteLink.
+func (s *Server) renderWorkspace(w http.ResponseWriter, r *http.Request, ws Workspace, viewer Member, inviteLink string) {
+
+	members, err := s.WorkspaceStore.GetMembers(ws.Id)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	projects, err := s.WorkspaceStore.GetWorkspaceProjects(ws.Id)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	var invitations []Invitation
+	if CanManage(viewer.Role) {
+		invitations, err = s.WorkspaceStore.GetInvitations(ws.Id)
+		if err != nil {
+			s.serverError(w, r, err)
+			return
+		}
+	}
+
+	data := TemplateData{
+		Workspace:   ws,
+		Viewer:      viewer,
+		Members:     members,
+		Projects:    projects,
+		Invitations: invitations,
+		InviteLink:  inviteLink,
+		Roles:       InvitationRoles,
+		Now:         s.now(),
+	}
+	var ok bool
+
+	data.PageTemplate, ok = s.templateCache[WORKSPACE_PAGE_TEMPLATE]
+	if !ok {
+		fmt.Fprint(w, fmt.Sprintf("template does not exist: %s", WORKSPACE_PAGE_TEMPLATE))
+		return
+	}
+
+	data.Render(w, r)
+
+}
+
+func (s *Server) inviteMember(w http.ResponseWriter, r *http.Request) {
+
+	ws, viewer, ok := s.manageWorkspace(w, r)
+	if !ok {
+		return
+	}
+
+	inv, secret, err := NewInvitation(ws.Id, r.FormValue("email"), r.FormValue("role"), viewer.UserId, s.now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = s.WorkspaceStore.CreateInvitation(inv)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	link := fmt.Sprintf("%s://%s/invite?token=%s", scheme, r.Host, secret)
+
+	// the secret is not stored, so the page is
+	// rendered here rather than redirected to
+	w.Header().Set("Cache-Control", "no-store")
+	s.renderWorkspace(w, r, ws, viewer, link)
+
+}
+
+func (s *Server) deleteInvitation(w http.ResponseWriter, r *http.Request) {
+
+	ws, _, ok := s.manageWorkspace(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	err = s.WorkspaceStore.DeleteInvitation(ws.Id, id)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/workspace/view?workspace=%d", ws.Id), http.StatusSeeOther)
+
+}
+
+// memberFor finds the member in the user form value
+func (s *Server) memberFor(w http.ResponseWriter, r *http.Request, ws Workspace) (Member, bool) {
+
+	userId, err := strconv.Atoi(r.FormValue("user"))
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return Member{}, false
+	}
+
+	members, err := s.WorkspaceStore.GetMembers(ws.Id)
+	if err != nil {
+		s.serverError(w, r, err)
+		return Member{}, false
+	}
+
+	for _, m := range members {
+		if m.UserId == userId {
+			return m, true
+		}
+	}
+
+	http.NotFound(w, r)
+	return Member{}, false
+}
+
+// setMemberRole makes a member an admin or back.
+// Only the owner changes roles.
+func (s *Server) setMemberRole(w http.ResponseWriter, r *http.Request) {
+
+	ws, viewer, ok := s.manageWorkspace(w, r)
+	if !ok {
+		return
+	}
+
+	if viewer.Role != RoleOwner {
+		http.Error(w, "Forbidden - only the owner changes roles", http.StatusForbidden)
+		return
+	}
+
+	member, ok := s.memberFor(w, r, ws)
+	if !ok {
+		return
+	}
+
+	role := r.FormValue("role")
+	if member.Role == RoleOwner || !containsString(InvitationRoles, role) {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	err := s.WorkspaceStore.SetMemberRole(ws.Id, member.UserId, role)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/workspace/view?workspace=%d", ws.Id), http.StatusSeeOther)
+
+}
+
+// removeMember takes a member out of a workspace.
+// The owner cannot be removed and only the owner
+// removes admins.
+func (s *Server) removeMember(w http.ResponseWriter, r *http.Request) {
+
+	ws, viewer, ok := s.manageWorkspace(w, r)
+	if !ok {
+		return
+	}
+
+	member, ok := s.memberFor(w, r, ws)
+	if !ok {
+		return
+	}
+
+	if member.Role == RoleOwner || (member.Role == RoleAdmin && viewer.Role != RoleOwner) {
+		http.Error(w, "Forbidden - cannot remove this member", http.StatusForbidden)
+		return
+	}
+
+	err := s.WorkspaceStore.RemoveMember(ws.Id, member.UserId)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/workspace/view?workspace=%d", ws.Id), http.StatusSeeOther)
+
+}
+
+func (s *Server) addWorkspaceProject(w http.ResponseWriter, r *http.Request) {
+
+	ws, _, ok := s.manageWorkspace(w, r)
+	if !ok {
+		return
+	}
+
+	project := strings.TrimSpace(r.FormValue("project"))
+	if project == "" {
+		http.Error(w, "project must not be empty", http.StatusBadRequest)
+		return
+	}
+
+	err := s.WorkspaceStore.AddWorkspaceProject(ws.Id, project)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/workspace/view?workspace=%d", ws.Id), http.StatusSeeOther)
+
+}
+
+func (s *Server) removeWorkspaceProject(w http.ResponseWriter, r *http.Request) {
+
+	ws, _, ok := s.manageWorkspace(w, r)
+	if !ok {
+		return
+	}
+
+	err := s.WorkspaceStore.RemoveWorkspaceProject(ws.Id, r.FormValue("project"))
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/workspace/view?workspace=%d", ws.Id), http.StatusSeeOther)
+
+}
+
+// showTeamReport totals the time members tracked on
+// the workspace's projects.  Members see only their
+// own totals.
+func (s *Server) showTeamReport(w http.ResponseWriter, r *http.Request) {
+
+	ws, viewer, ok := s.workspaceFor(w, r)
+	if !ok {
+		return
+	}
+
+	members, err := s.WorkspaceStore.GetMembers(ws.Id)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	totals, err := s.WorkspaceStore.GetTeamReport(ws.Id)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	projects, err := s.WorkspaceStore.GetWorkspaceProjects(ws.Id)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	data := TemplateData{
+		Workspace:  ws,
+		Viewer:     viewer,
+		Projects:   projects,
+		TeamReport: NewTeamReport(members, totals, viewer),
+	}
+
+	data.PageTemplate, ok = s.templateCache[TEAM_PAGE_TEMPLATE]
+	if !ok {
+		fmt.Fprint(w, fmt.Sprintf("template does not exist: %s", TEAM_PAGE_TEMPLATE))
+		return
+	}
+
+	data.Render(w, r)
+
+}
+
+// showInvitation asks the invited user for a name
+// before accepting the invitation
+func (s *Server) showInvitation(w http.ResponseWriter, r *http.Request) {
+	s.renderInvitation(w, r, r.URL.Query().Get("token"), "")
+}
+
+func (s *Server) renderInvitation(w http.ResponseWriter, r *http.Request, token, message string) {
+
+	data := TemplateData{InviteToken: token, Error: message}
+	var ok bool
+
+	data.PageTemplate, ok = s.templateCache[INVITE_PAGE_TEMPLATE]
+	if !ok {
+		fmt.Fprint(w, fmt.Sprintf("template does not exist: %s", INVITE_PAGE_TEMPLATE))
+		return
+	}
+
+	data.Render(w, r)
+
+}
+
+// acceptInvitation joins the workspace and signs
+// the browser in as the invited user
+func (s *Server) acceptInvitation(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := r.FormValue("token")
+
+	user, err := s.WorkspaceStore.AcceptInvitation(hashSecret(token), strings.TrimSpace(r.FormValue("name")), s.now())
+	if errors.Is(err, ErrNoRecord) {
+		w.WriteHeader(http.StatusNotFound)
+		s.renderInvitation(w, r, "", "This invitation is unknown, expired or already used.")
+		return
+	}
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	err = s.startSession(w, r, user.Id)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/workspace", http.StatusSeeOther)
+
+}
+
+// login exchanges a one-time link from the login-link
+// command for a session
+func (s *Server) login(w http.ResponseWriter, r *http.Request) {
+
+	hash := hashSecret(r.URL.Query().Get("token"))
+
+	user, err := s.WorkspaceStore.GetSessionUser(hash, s.now())
+	if errors.Is(err, ErrNoRecord) {
+		http.Error(w, "Unauthorized - this link is unknown, expired or already used", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	err = s.WorkspaceStore.DeleteSession(hash)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	err = s.startSession(w, r, user.Id)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+
+}
+
+func (s *Server) logout(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if c, err := r.Cookie(SessionCookie); err == nil {
+		err = s.WorkspaceStore.DeleteSession(hashSecret(c.Value))
+		if err != nil {
+			s.serverError(w, r, err)
+			return
+		}
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: SessionCookie, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+
+}
+
+func (td TemplateData) Render(w http.ResponseWriter, r *http.Request) {
+
+	ts := td.PageTemplate
+	td.CSRFToken = CSRFToken(r)
+
+	err := ts.Execute(w, td)
+	if err != nil {
+		LoggerFrom(r.Context()).Error("rendering template", "template", ts.Name(), "err", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+
+}
+
+func NewTemplateCache() (map[string]*template.Template, error) {
+	cache := map[string]*template.Template{}
+
+	pages, err := fs.Glob(ui.Files, "html/*.page.tmpl")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, page := range pages {
+		name := filepath.Base(page)
+
+		ts, err := template.New(name).ParseFS(ui.Files, page)
+		if err != nil {
+			return nil, err
+		}
+
+		ts, err = ts.ParseFS(ui.Files, "html/*.layout.tmpl")
+		if err != nil {
+			return nil, err
+		}
+
+		ts, err = ts.ParseFS(ui.Files, "html/*.partial.tmpl")
+		if err != nil {
+			return nil, err
+		}
+
+		cache[name] = ts
+	}
+	return cache, nil
+}
+
+// showAuditLog lists the latest changes to the tasks
+// the current user may see, optionally those of one
+// task
+func (s *Server) showAuditLog(w http.ResponseWriter, r *http.Request) {
+
+	filter, err := NewAuditFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.UserId = s.currentUserID(r)
+
+	entries, err := s.AuditStore.GetAuditLog(filter)
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	data := TemplateData{Audit: entries, AuditFilter: filter}
+	var ok bool
+
+	data.PageTemplate, ok = s.templateCache[AUDIT_PAGE_TEMPLATE]
+	if !ok {
+		fmt.Fprint(w, fmt.Sprintf("template does not exist: %s", AUDIT_PAGE_TEMPLATE))
+		return
+	}
+
+	data.Render(w, r)
+
+}
+
+func (s *Server) apiAuditLog(w http.ResponseWriter, r *http.Request) {
+
+	filter, err := NewAuditFilter(r.URL.Query())
+	if err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filter.UserId = s.currentUserID(r)
+
+	entries, err := s.AuditStore.GetAuditLog(filter)
+	if err != nil {
+		s.requestLogger(r).Error("internal server error", "err", err)
+		writeJSONError(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if entries == nil {
+		entries = []AuditEntry{}
+	}
+
+	writeJSON(w, entries, http.StatusOK)
+
+}
+
+// restoreTask brings back a deleted task
+// and shows its audit trail
+func (s *Server) restoreTask(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	id, err := strconv.Atoi(r.Form.Get("id"))
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	entry := NewAuditEntry(AuditRestore, s.currentUserID(r), s.now(), nil, nil)
+	entry.TaskId = id
+
+	_, err = s.AuditStore.RecordChange(entry)
+	if errors.Is(err, ErrNoRecord) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/audit?task=%d", id), http.StatusSeeOther)
+
 }
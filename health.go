@@ -0,0 +1,100 @@
+package timetracker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	HealthOK          string = "ok"
+	HealthUnavailable string = "unavailable"
+
+	// longest a readiness probe waits on the database
+	READY_TIMEOUT time.Duration = 2 * time.Second
+)
+
+// SchemaTables are the tables a store must have
+// before the server is ready
+var SchemaTables = []string{
+	"tasks",
+	"task_session",
+	"goals",
+	"task_templates",
+	"imported_events",
+	"webhooks",
+	"webhook_deliveries",
+	"api_tokens",
+	"users",
+	"user_sessions",
+	"workspaces",
+	"workspace_members",
+	"workspace_invitations",
+	"workspace_projects",
+	"audit_log",
+}
+
+// HealthReport is the JSON body of /healthz and
+// /readyz.  Checks holds "ok" or the failure for
+// each readiness check.
+type HealthReport struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// healthz reports that the process is serving
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, HealthReport{Status: HealthOK}, http.StatusOK)
+}
+
+// readyz reports whether the database answers, has
+// every table and the templates have been parsed
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+
+	ctx, cancel := context.WithTimeout(r.Context(), READY_TIMEOUT)
+	defer cancel()
+
+	report := s.Readiness(ctx)
+
+	status := http.StatusOK
+	if report.Status != HealthOK {
+		status = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, report, status)
+}
+
+// Readiness runs the readiness checks
+func (s *Server) Readiness(ctx context.Context) HealthReport {
+
+	report := HealthReport{
+		Status: HealthOK,
+		Checks: map[string]string{
+			"database":   HealthOK,
+			"migrations": HealthOK,
+			"templates":  HealthOK,
+		},
+	}
+
+	fail := func(check string, err error) {
+		report.Status = HealthUnavailable
+		report.Checks[check] = err.Error()
+	}
+
+	if s.HealthStore == nil {
+		fail("database", fmt.Errorf("no store configured"))
+		fail("migrations", fmt.Errorf("no store configured"))
+	} else if err := s.HealthStore.Ping(ctx); err != nil {
+		fail("database", err)
+		fail("migrations", fmt.Errorf("database unreachable"))
+	} else if err := s.HealthStore.CheckSchema(ctx); err != nil {
+		fail("migrations", err)
+	}
+
+	if len(s.templateCache) == 0 {
+		fail("templates", fmt.Errorf("templates not loaded"))
+	}
+
+	return report
+}
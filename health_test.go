@@ -0,0 +1,203 @@
+package timetracker_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"timetracker"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHealthz(t *testing.T) {
+
+	t.Parallel()
+
+	s := timetracker.NewServer(timetracker.WithNoLogging())
+
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("want: 200, got: %d", rec.Code)
+	}
+
+	want := `{"status":"ok"}`
+	got := rec.Body.String()
+	if want+"\n" != got && want != got {
+		t.Errorf("want: %s, got: %s", want, got)
+	}
+
+}
+
+func TestReadyz(t *testing.T) {
+
+	t.Parallel()
+
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	s := timetracker.NewServer(timetracker.WithNoLogging())
+	s.HealthStore = &timetracker.DBStore{Db: db}
+
+	readyz := func() (int, timetracker.HealthReport) {
+		rec := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+		var report timetracker.HealthReport
+		err := json.Unmarshal(rec.Body.Bytes(), &report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, report
+	}
+
+	// database down and templates not loaded
+	mock.ExpectPing().WillReturnError(errors.New("connection refused"))
+
+	code, report := readyz()
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("want: 503, got: %d", code)
+	}
+	want := timetracker.HealthReport{
+		Status: "unavailable",
+		Checks: map[string]string{
+			"database":   "unable to reach database: connection refused",
+			"migrations": "database unreachable",
+			"templates":  "templates not loaded",
+		},
+	}
+	if !cmp.Equal(want, report) {
+		t.Error(cmp.Diff(want, report))
+	}
+
+	err = s.LoadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a table is missing
+	mock.ExpectPing()
+	mock.ExpectQuery("SELECT \\* FROM tasks WHERE 1=0").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery("SELECT \\* FROM task_session WHERE 1=0").WillReturnError(errors.New("no such table: task_session"))
+
+	code, report = readyz()
+	if code != http.StatusServiceUnavailable {
+		t.Errorf("want: 503, got: %d", code)
+	}
+	if report.Checks["migrations"] != "table task_session not available: no such table: task_session" {
+		t.Errorf("unexpected migrations check: %q", report.Checks["migrations"])
+	}
+
+	// ready
+	mock.ExpectPing()
+	for _, table := range timetracker.SchemaTables {
+		mock.ExpectQuery("SELECT \\* FROM " + table + " WHERE 1=0").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	}
+
+	code, report = readyz()
+	if code != http.StatusOK {
+		t.Errorf("want: 200, got: %d", code)
+	}
+	want = timetracker.HealthReport{
+		Status: "ok",
+		Checks: map[string]string{"database": "ok", "migrations": "ok", "templates": "ok"},
+	}
+	if !cmp.Equal(want, report) {
+		t.Error(cmp.Diff(want, report))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+func TestWaitForServerRoute(t *testing.T) {
+
+	t.Parallel()
+
+	// reserve a free port, then listen on it later
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	var buf bytes.Buffer
+	logger, err := timetracker.NewLogger(&buf, timetracker.LevelDebug, timetracker.LogFormatLogfmt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		timetracker.WaitForServerRoute(addr, logger)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("returned before the port was listening")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not return once the port was listening")
+	}
+
+	if !strings.Contains(buf.String(), "tcp not listening") {
+		t.Errorf("want: failed attempts logged at debug, got: %q", buf.String())
+	}
+
+}
+
+func TestHealthcheckCommand(t *testing.T) {
+
+	t.Parallel()
+
+	ready := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	var out bytes.Buffer
+	ok, err := timetracker.RunStandaloneCommand([]string{"healthcheck", "-url", ts.URL}, &out)
+	if !ok || err != nil {
+		t.Errorf("ready: want: true, nil, got: %v, %v", ok, err)
+	}
+
+	ready = false
+	ok, err = timetracker.RunStandaloneCommand([]string{"healthcheck", "-url", ts.URL}, &out)
+	if !ok || err == nil {
+		t.Errorf("unavailable: want: true and an error, got: %v, %v", ok, err)
+	}
+
+	ok, err = timetracker.RunStandaloneCommand([]string{"export-json"}, &out)
+	if ok || err != nil {
+		t.Errorf("export-json: want: false, nil, got: %v, %v", ok, err)
+	}
+
+}
@@ -0,0 +1,251 @@
+package timetracker
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ListSortName     string = "name"
+	ListSortStart    string = "start"
+	ListSortDuration string = "duration"
+
+	// number of tasks on the home page
+	LATEST_LIMIT int = 10
+
+	// default and maximum page size for the history
+	HISTORY_LIMIT     int = 25
+	HISTORY_LIMIT_MAX int = 200
+)
+
+// ListOptions selects a page of tasks.  Tasks are
+// ordered by Sort and then by id, which makes the
+// (sort key, id) pair a stable keyset for paging.
+// Only tasks UserId may see are listed.
+type ListOptions struct {
+	Limit      int
+	Sort       string
+	Desc       bool
+	NamePrefix string
+	Cursor     *Cursor
+	UserId     int
+}
+
+// TaskPage is one page of a task list.  Next is
+// empty on the last page.
+type TaskPage struct {
+	Tasks []Task `json:"tasks"`
+	Next  string `json:"next_cursor"`
+}
+
+// Cursor is the last task of a page, holding the
+// key that the next page starts after
+type Cursor struct {
+	Sort     string    `json:"s"`
+	Name     string    `json:"n,omitempty"`
+	Start    time.Time `json:"t,omitempty"`
+	Duration float64   `json:"d,omitempty"`
+	Id       int       `json:"i"`
+}
+
+func NewCursor(sort string, last Task) *Cursor {
+
+	c := &Cursor{Sort: sort, Id: last.Id}
+	switch sort {
+	case ListSortName:
+		c.Name = last.Name
+	case ListSortDuration:
+		c.Duration = last.ElapsedTimeSec
+	default:
+		c.Start = last.StartTime
+	}
+	return c
+}
+
+// Key returns the value of the sort column
+// the cursor points at
+func (c Cursor) Key() interface{} {
+
+	switch c.Sort {
+	case ListSortName:
+		return c.Name
+	case ListSortDuration:
+		return c.Duration
+	default:
+		return c.Start.UTC()
+	}
+}
+
+// Encode returns the cursor as an opaque url safe token
+func (c Cursor) Encode() string {
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func DecodeCursor(token string) (*Cursor, error) {
+
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	var c Cursor
+	err = json.Unmarshal(b, &c)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &c, nil
+}
+
+// NewListOptions reads list options from url query
+// values: sort, order (asc or desc), prefix, limit
+// and cursor.  The default is newest first.
+func NewListOptions(v url.Values) (ListOptions, error) {
+
+	opts := ListOptions{
+		Limit:      HISTORY_LIMIT,
+		Sort:       ListSortStart,
+		Desc:       true,
+		NamePrefix: strings.TrimSpace(v.Get("prefix")),
+	}
+
+	switch sort := v.Get("sort"); sort {
+	case "":
+	case ListSortName, ListSortStart, ListSortDuration:
+		opts.Sort = sort
+	default:
+		return ListOptions{}, fmt.Errorf("invalid sort: %q", sort)
+	}
+
+	switch order := v.Get("order"); order {
+	case "":
+	case "asc":
+		opts.Desc = false
+	case "desc":
+		opts.Desc = true
+	default:
+		return ListOptions{}, fmt.Errorf("invalid order: %q", order)
+	}
+
+	if limit := v.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return ListOptions{}, fmt.Errorf("invalid limit: %q", limit)
+		}
+		if n > HISTORY_LIMIT_MAX {
+			n = HISTORY_LIMIT_MAX
+		}
+		opts.Limit = n
+	}
+
+	if token := v.Get("cursor"); token != "" {
+		c, err := DecodeCursor(token)
+		if err != nil {
+			return ListOptions{}, err
+		}
+		if c.Sort != opts.Sort {
+			return ListOptions{}, fmt.Errorf("cursor does not match sort %q", opts.Sort)
+		}
+		opts.Cursor = c
+	}
+
+	return opts, nil
+}
+
+// Order is the order query value for the options
+func (o ListOptions) Order() string {
+	if o.Desc {
+		return "desc"
+	}
+	return "asc"
+}
+
+// Query returns url query values for the options with
+// the cursor replaced, so templates can link to pages
+func (o ListOptions) Query(cursor string) string {
+
+	v := url.Values{}
+	v.Set("sort", o.Sort)
+	v.Set("order", o.Order())
+	if o.NamePrefix != "" {
+		v.Set("prefix", o.NamePrefix)
+	}
+	if o.Limit != HISTORY_LIMIT {
+		v.Set("limit", strconv.Itoa(o.Limit))
+	}
+	if cursor != "" {
+		v.Set("cursor", cursor)
+	}
+	return v.Encode()
+}
+
+// SortQuery returns url query values that sort by
+// column, flipping the order if already sorted by it
+func (o ListOptions) SortQuery(column string) string {
+
+	sorted := ListOptions{Sort: column, Desc: column != ListSortName, NamePrefix: o.NamePrefix, Limit: o.Limit}
+	if o.Sort == column {
+		sorted.Desc = !o.Desc
+	}
+	return sorted.Query("")
+}
+
+// PageURL links to the history page at cursor.  It is
+// a template.URL so html/template keeps the & and =.
+func (o ListOptions) PageURL(cursor string) template.URL {
+	return template.URL("/task/history?" + o.Query(cursor))
+}
+
+// SortURL links to the history sorted by column
+func (o ListOptions) SortURL(column string) template.URL {
+	return template.URL("/task/history?" + o.SortQuery(column))
+}
+
+// TaskFilter selects completed tasks started in
+// [From, To).  A zero To means no upper bound and
+// empty Project or Tag match every task.  Only
+// tasks UserId may see are matched.
+type TaskFilter struct {
+	From    time.Time
+	To      time.Time
+	Project string
+	Tag     string
+	UserId  int
+}
+
+// NewTaskFilter reads a filter from url query values:
+// from and to as YYYY-MM-DD, project and tag
+func NewTaskFilter(v url.Values) (TaskFilter, error) {
+
+	from, to, err := parseDateRange(v)
+	if err != nil {
+		return TaskFilter{}, err
+	}
+
+	f := TaskFilter{
+		From:    from,
+		To:      to,
+		Project: strings.TrimSpace(v.Get("project")),
+		Tag:     strings.TrimSpace(v.Get("tag")),
+	}
+	return f, nil
+}
+
+// until returns the exclusive upper bound
+// of the date range
+func (f TaskFilter) until() time.Time {
+	if f.To.IsZero() {
+		return searchForever
+	}
+	return f.To
+}
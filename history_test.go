@@ -0,0 +1,126 @@
+package timetracker_test
+
+import (
+	"net/url"
+	"testing"
+	"time"
+	"timetracker"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNewListOptions(t *testing.T) {
+
+	t.Parallel()
+
+	got, err := timetracker.NewListOptions(url.Values{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := timetracker.ListOptions{
+		Limit: timetracker.HISTORY_LIMIT,
+		Sort:  timetracker.ListSortStart,
+		Desc:  true,
+	}
+
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+
+	cursor := timetracker.NewCursor(timetracker.ListSortDuration, timetracker.Task{Id: 3, ElapsedTimeSec: 600.5})
+
+	v := url.Values{}
+	v.Set("sort", "duration")
+	v.Set("order", "asc")
+	v.Set("prefix", " pia ")
+	v.Set("limit", "1000")
+	v.Set("cursor", cursor.Encode())
+
+	got, err = timetracker.NewListOptions(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want = timetracker.ListOptions{
+		Limit:      timetracker.HISTORY_LIMIT_MAX,
+		Sort:       timetracker.ListSortDuration,
+		NamePrefix: "pia",
+		Cursor:     &timetracker.Cursor{Sort: timetracker.ListSortDuration, Duration: 600.5, Id: 3},
+	}
+
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+
+}
+
+func TestNewListOptionsInvalid(t *testing.T) {
+
+	t.Parallel()
+
+	cursor := timetracker.NewCursor(timetracker.ListSortName, timetracker.Task{Id: 3, Name: "piano"})
+
+	tcs := []url.Values{
+		{"sort": {"project"}},
+		{"order": {"up"}},
+		{"limit": {"-1"}},
+		{"cursor": {"not a cursor"}},
+		{"sort": {"start"}, "cursor": {cursor.Encode()}},
+	}
+
+	for _, v := range tcs {
+		_, err := timetracker.NewListOptions(v)
+		if err == nil {
+			t.Errorf("want error for %v", v)
+		}
+	}
+
+}
+
+func TestCursorRoundTrip(t *testing.T) {
+
+	t.Parallel()
+
+	task := timetracker.Task{
+		Id:        42,
+		StartTime: time.Date(2021, 1, 1, 10, 30, 0, 123, time.UTC),
+	}
+
+	want := timetracker.NewCursor(timetracker.ListSortStart, task)
+
+	got, err := timetracker.DecodeCursor(want.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+
+	if !got.Key().(time.Time).Equal(task.StartTime) {
+		t.Errorf("want: %s, got: %v", task.StartTime, got.Key())
+	}
+
+}
+
+func TestListOptionsSortQuery(t *testing.T) {
+
+	t.Parallel()
+
+	opts := timetracker.ListOptions{Limit: timetracker.HISTORY_LIMIT, Sort: timetracker.ListSortStart, Desc: true, NamePrefix: "pi"}
+
+	tcs := map[string]string{
+		timetracker.ListSortStart:    "order=asc&prefix=pi&sort=start",
+		timetracker.ListSortName:     "order=asc&prefix=pi&sort=name",
+		timetracker.ListSortDuration: "order=desc&prefix=pi&sort=duration",
+	}
+
+	for column, want := range tcs {
+		got := opts.SortQuery(column)
+		if want != got {
+			t.Errorf("%s: want: %s, got: %s", column, want, got)
+		}
+	}
+
+}
@@ -0,0 +1,121 @@
+package timetracker
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// ICS_LINE_LIMIT is the maximum length of a content
+	// line in octets, excluding the CRLF (RFC 5545 3.1)
+	ICS_LINE_LIMIT int = 75
+
+	icsTimeFormat string = "20060102T150405Z"
+)
+
+// WriteICS writes completed tasks as an iCalendar
+// VCALENDAR with one VEVENT per task.  now is used
+// for DTSTAMP.
+func WriteICS(w io.Writer, tasks []Task, now time.Time) error {
+
+	bw := bufio.NewWriter(w)
+	stamp := now.UTC().Format(icsTimeFormat)
+
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//timetracker//timetracker//EN",
+		"CALSCALE:GREGORIAN",
+		"X-WR-CALNAME:timetracker",
+	}
+
+	for _, task := range tasks {
+		start := task.StartTime.UTC()
+		end := start.Add(time.Duration(task.ElapsedTimeSec * float64(time.Second)))
+
+		lines = append(lines,
+			"BEGIN:VEVENT",
+			"UID:"+TaskUID(task),
+			"DTSTAMP:"+stamp,
+			"DTSTART:"+start.Format(icsTimeFormat),
+			"DTEND:"+end.Format(icsTimeFormat),
+			"SUMMARY:"+EscapeICSText(task.Name),
+		)
+
+		if task.Notes != "" {
+			lines = append(lines, "DESCRIPTION:"+EscapeICSText(task.Notes))
+		}
+
+		var categories []string
+		if task.Project != "" {
+			categories = append(categories, EscapeICSText(task.Project))
+		}
+		for _, tag := range task.Tags {
+			categories = append(categories, EscapeICSText(tag))
+		}
+		if len(categories) > 0 {
+			lines = append(lines, "CATEGORIES:"+strings.Join(categories, ","))
+		}
+
+		lines = append(lines, "END:VEVENT")
+	}
+
+	lines = append(lines, "END:VCALENDAR")
+
+	for _, line := range lines {
+		_, err := bw.WriteString(FoldICSLine(line))
+		if err != nil {
+			return fmt.Errorf("unable to write calendar: %s", err)
+		}
+	}
+
+	return bw.Flush()
+}
+
+// TaskUID is the stable iCalendar UID of a task
+func TaskUID(task Task) string {
+	return fmt.Sprintf("task-%d@timetracker", task.Id)
+}
+
+// EscapeICSText escapes a TEXT value (RFC 5545 3.3.11)
+func EscapeICSText(text string) string {
+
+	r := strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+		"\r", `\n`,
+	)
+	return r.Replace(text)
+}
+
+// FoldICSLine terminates a content line with CRLF, folding
+// it so that no physical line exceeds ICS_LINE_LIMIT octets.
+// Continuation lines start with a space, which counts
+// towards the limit, and UTF-8 sequences are never split.
+func FoldICSLine(line string) string {
+
+	var b strings.Builder
+	limit := ICS_LINE_LIMIT
+
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		limit = ICS_LINE_LIMIT - 1
+	}
+
+	b.WriteString(line)
+	b.WriteString("\r\n")
+	return b.String()
+}
@@ -0,0 +1,1071 @@
+package timetracker
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ImportNew      string = "new"
+	ImportExisting string = "already imported"
+	ImportSkipped  string = "skipped"
+
+	// most occurrences expanded from a single
+	// recurrence rule, as a guard against rules
+	// with no end
+	ICS_MAX_OCCURRENCES int = 5000
+)
+
+// ICSEvent is one occurrence of a calendar event.
+// UID identifies the occurrence: the event UID for
+// single events and the UID plus the original start
+// for occurrences of a recurring event.
+type ICSEvent struct {
+	UID         string
+	Summary     string
+	Description string
+	Categories  []string
+	Start       time.Time
+	End         time.Time
+	Status      string
+	Reason      string
+}
+
+// Task returns the completed Task for the event
+func (e ICSEvent) Task() Task {
+
+	t := NewTask(e.Summary)
+	t.Tags = e.Categories
+	t.Notes = e.Description
+	t.StartTime = e.Start.UTC()
+	t.ElapsedTime = e.End.Sub(e.Start)
+	t.ElapsedTimeSec = t.ElapsedTime.Seconds()
+	return t
+}
+
+// ImportICS reads a calendar and creates a completed task
+// for every event occurrence that has finished by now and
+// has not been imported before, owned by userId.  With
+// dryRun nothing is written and the returned events show
+// what would happen.
+func ImportICS(store ImportStore, r io.Reader, userId int, now time.Time, dryRun bool) ([]ICSEvent, error) {
+
+	events, err := ParseICS(r, now)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+
+	for i := range events {
+		e := &events[i]
+		if e.Status == ImportSkipped {
+			continue
+		}
+
+		imported, err := store.IsImported(userId, e.UID)
+		if err != nil {
+			return nil, err
+		}
+		if imported || seen[e.UID] {
+			e.Status = ImportExisting
+			continue
+		}
+		seen[e.UID] = true
+
+		if dryRun {
+			continue
+		}
+
+		task := e.Task()
+		task.UserId = userId
+		_, err = store.ImportTask(e.UID, task)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return events, nil
+}
+
+// ParseICS returns every occurrence of the VEVENTs in a
+// calendar, oldest first.  Recurring events are expanded
+// up to now, and floating times are read in now's zone.
+// Occurrences that cannot become time entries are
+// returned with an ImportSkipped status and a reason.
+func ParseICS(r io.Reader, now time.Time) ([]ICSEvent, error) {
+
+	root, err := parseICSComponents(r)
+	if err != nil {
+		return nil, err
+	}
+
+	cal := &icsCalendar{zones: map[string]icsZone{}, local: now.Location()}
+
+	var vevents []*icsComponent
+	for _, vcal := range root.children {
+		if vcal.name != "VCALENDAR" {
+			continue
+		}
+		for _, c := range vcal.children {
+			switch c.name {
+			case "VTIMEZONE":
+				tzid := c.value("TZID")
+				z, err := parseVTimezone(c)
+				if err == nil && tzid != "" {
+					cal.zones[tzid] = z
+				}
+			case "VEVENT":
+				vevents = append(vevents, c)
+			}
+		}
+	}
+
+	if len(root.children) == 0 {
+		return nil, fmt.Errorf("no VCALENDAR found")
+	}
+
+	// overrides of single occurrences, by UID and
+	// then by the UTC start they replace
+	overrides := map[string]map[time.Time]*icsComponent{}
+	var masters []*icsComponent
+
+	for _, c := range vevents {
+		rid, ok := c.prop("RECURRENCE-ID")
+		if !ok {
+			masters = append(masters, c)
+			continue
+		}
+		t, _, err := cal.parseTime(rid)
+		if err != nil {
+			continue
+		}
+		uid := c.value("UID")
+		if overrides[uid] == nil {
+			overrides[uid] = map[time.Time]*icsComponent{}
+		}
+		overrides[uid][t] = c
+	}
+
+	var events []ICSEvent
+	for _, c := range masters {
+		events = append(events, cal.expand(c, overrides[c.value("UID")], now)...)
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Start.Before(events[j].Start)
+	})
+
+	return events, nil
+}
+
+// icsComponent is a BEGIN/END block and its properties
+type icsComponent struct {
+	name     string
+	props    []icsProp
+	children []*icsComponent
+}
+
+type icsProp struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+func (c *icsComponent) prop(name string) (icsProp, bool) {
+	for _, p := range c.props {
+		if p.name == name {
+			return p, true
+		}
+	}
+	return icsProp{}, false
+}
+
+func (c *icsComponent) value(name string) string {
+	p, _ := c.prop(name)
+	return p.value
+}
+
+func (c *icsComponent) all(name string) []icsProp {
+	var props []icsProp
+	for _, p := range c.props {
+		if p.name == name {
+			props = append(props, p)
+		}
+	}
+	return props
+}
+
+// parseICSComponents unfolds content lines and builds
+// the component tree under an unnamed root
+func parseICSComponents(r io.Reader) (*icsComponent, error) {
+
+	var lines []string
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read calendar: %s", err)
+	}
+
+	root := &icsComponent{}
+	stack := []*icsComponent{root}
+
+	for n, line := range lines {
+		p, err := parseICSProp(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n+1, err)
+		}
+
+		current := stack[len(stack)-1]
+
+		switch p.name {
+		case "BEGIN":
+			c := &icsComponent{name: strings.ToUpper(p.value)}
+			current.children = append(current.children, c)
+			stack = append(stack, c)
+		case "END":
+			if len(stack) == 1 || current.name != strings.ToUpper(p.value) {
+				return nil, fmt.Errorf("line %d: unexpected END:%s", n+1, p.value)
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			current.props = append(current.props, p)
+		}
+	}
+
+	if len(stack) != 1 {
+		return nil, fmt.Errorf("missing END:%s", stack[len(stack)-1].name)
+	}
+
+	return root, nil
+}
+
+// parseICSProp splits a content line into its
+// name, parameters and value (RFC 5545 3.1)
+func parseICSProp(line string) (icsProp, error) {
+
+	p := icsProp{params: map[string]string{}}
+
+	i := strings.IndexAny(line, ";:")
+	if i < 1 {
+		return icsProp{}, fmt.Errorf("invalid content line: %q", line)
+	}
+	p.name = strings.ToUpper(line[:i])
+
+	for line[i] == ';' {
+		rest := line[i+1:]
+		eq := strings.Index(rest, "=")
+		if eq < 1 {
+			return icsProp{}, fmt.Errorf("invalid parameter in: %q", line)
+		}
+		key := strings.ToUpper(rest[:eq])
+		rest = rest[eq+1:]
+
+		var value string
+		var consumed int
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				return icsProp{}, fmt.Errorf("unterminated quote in: %q", line)
+			}
+			value = rest[1 : end+1]
+			consumed = end + 2
+		} else {
+			end := strings.IndexAny(rest, ";:")
+			if end < 0 {
+				return icsProp{}, fmt.Errorf("missing value in: %q", line)
+			}
+			value = rest[:end]
+			consumed = end
+		}
+
+		p.params[key] = value
+		i = i + 1 + eq + 1 + consumed
+		if i >= len(line) {
+			return icsProp{}, fmt.Errorf("missing value in: %q", line)
+		}
+	}
+
+	if line[i] != ':' {
+		return icsProp{}, fmt.Errorf("invalid content line: %q", line)
+	}
+	p.value = line[i+1:]
+
+	return p, nil
+}
+
+// unescapeICSText reverses EscapeICSText
+func unescapeICSText(text string) string {
+
+	var b strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\\' && i+1 < len(text) {
+			i++
+			switch text[i] {
+			case 'n', 'N':
+				b.WriteByte('\n')
+			default:
+				b.WriteByte(text[i])
+			}
+			continue
+		}
+		b.WriteByte(text[i])
+	}
+	return b.String()
+}
+
+// splitICSList splits a comma separated value,
+// leaving escaped commas alone
+func splitICSList(value string) []string {
+
+	var parts []string
+	start := 0
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '\\':
+			i++
+		case ',':
+			parts = append(parts, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, value[start:])
+}
+
+// icsZone converts a wall clock time, held in a
+// UTC time.Time, to the instant it names
+type icsZone interface {
+	toUTC(wall time.Time) time.Time
+}
+
+type locationZone struct {
+	loc *time.Location
+}
+
+func (z locationZone) toUTC(wall time.Time) time.Time {
+	return time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), 0, z.loc).UTC()
+}
+
+// vtimezone evaluates the STANDARD and DAYLIGHT
+// observances of a VTIMEZONE definition
+type vtimezone struct {
+	observances []observance
+}
+
+type observance struct {
+	start      time.Time
+	offsetFrom time.Duration
+	offsetTo   time.Duration
+	rule       *rrule
+	rdates     []time.Time
+}
+
+func parseVTimezone(c *icsComponent) (vtimezone, error) {
+
+	var z vtimezone
+
+	for _, child := range c.children {
+		if child.name != "STANDARD" && child.name != "DAYLIGHT" {
+			continue
+		}
+
+		start, err := parseICSWallTime(child.value("DTSTART"))
+		if err != nil {
+			return vtimezone{}, err
+		}
+		from, err := parseUTCOffset(child.value("TZOFFSETFROM"))
+		if err != nil {
+			return vtimezone{}, err
+		}
+		to, err := parseUTCOffset(child.value("TZOFFSETTO"))
+		if err != nil {
+			return vtimezone{}, err
+		}
+
+		o := observance{start: start, offsetFrom: from, offsetTo: to}
+
+		if value := child.value("RRULE"); value != "" {
+			rule, err := parseRRule(value)
+			if err != nil {
+				return vtimezone{}, err
+			}
+			o.rule = &rule
+		}
+
+		for _, p := range child.all("RDATE") {
+			for _, v := range splitICSList(p.value) {
+				t, err := parseICSWallTime(v)
+				if err != nil {
+					return vtimezone{}, err
+				}
+				o.rdates = append(o.rdates, t)
+			}
+		}
+
+		z.observances = append(z.observances, o)
+	}
+
+	if len(z.observances) == 0 {
+		return vtimezone{}, fmt.Errorf("VTIMEZONE has no observances")
+	}
+	return z, nil
+}
+
+// toUTC applies the offset of the latest observance
+// onset at or before wall.  Before the first onset
+// the first observance's TZOFFSETFROM applies.
+func (z vtimezone) toUTC(wall time.Time) time.Time {
+
+	var latest time.Time
+	offset := z.observances[0].offsetFrom
+	found := false
+
+	for _, o := range z.observances {
+		onsets := append([]time.Time{o.start}, o.rdates...)
+		if o.rule != nil {
+			onsets = o.rule.occurrences(o.start, wall, ICS_MAX_OCCURRENCES)
+		}
+		for _, onset := range onsets {
+			if onset.After(wall) {
+				continue
+			}
+			if !found || onset.After(latest) {
+				latest, offset, found = onset, o.offsetTo, true
+			}
+		}
+	}
+
+	return wall.Add(-offset)
+}
+
+func parseUTCOffset(value string) (time.Duration, error) {
+
+	if len(value) != 5 && len(value) != 7 {
+		return 0, fmt.Errorf("invalid UTC offset: %q", value)
+	}
+
+	sign := time.Duration(1)
+	switch value[0] {
+	case '+':
+	case '-':
+		sign = -1
+	default:
+		return 0, fmt.Errorf("invalid UTC offset: %q", value)
+	}
+
+	var parts []int
+	for i := 1; i < len(value); i += 2 {
+		n, err := strconv.Atoi(value[i : i+2])
+		if err != nil {
+			return 0, fmt.Errorf("invalid UTC offset: %q", value)
+		}
+		parts = append(parts, n)
+	}
+	for len(parts) < 3 {
+		parts = append(parts, 0)
+	}
+
+	d := time.Duration(parts[0])*time.Hour + time.Duration(parts[1])*time.Minute + time.Duration(parts[2])*time.Second
+	return sign * d, nil
+}
+
+// parseICSWallTime parses a DATE-TIME without regard
+// to its zone, holding the wall clock in a UTC time
+func parseICSWallTime(value string) (time.Time, error) {
+
+	t, err := time.Parse("20060102T150405", strings.TrimSuffix(value, "Z"))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date-time: %q", value)
+	}
+	return t, nil
+}
+
+type icsCalendar struct {
+	zones map[string]icsZone
+	local *time.Location
+}
+
+// zone returns the zone of a DATE-TIME property.  A
+// VTIMEZONE in the calendar wins over the system zone
+// database.  Floating times are read in cal.local.
+func (cal *icsCalendar) zone(p icsProp) (icsZone, error) {
+
+	if strings.HasSuffix(p.value, "Z") {
+		return locationZone{loc: time.UTC}, nil
+	}
+
+	tzid, ok := p.params["TZID"]
+	if !ok {
+		return locationZone{loc: cal.local}, nil
+	}
+
+	if z, ok := cal.zones[tzid]; ok {
+		return z, nil
+	}
+
+	loc, err := time.LoadLocation(strings.TrimPrefix(tzid, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone: %q", tzid)
+	}
+	return locationZone{loc: loc}, nil
+}
+
+// parseTime returns the instant a DATE-TIME property
+// names, its wall clock and zone for recurrence
+// expansion, or an error for DATE values
+func (cal *icsCalendar) parseTime(p icsProp) (time.Time, icsZone, error) {
+
+	if p.params["VALUE"] == "DATE" || len(p.value) == len("20060102") {
+		return time.Time{}, nil, errAllDay
+	}
+
+	wall, err := parseICSWallTime(p.value)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+
+	z, err := cal.zone(p)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+
+	return z.toUTC(wall), z, nil
+}
+
+var errAllDay = fmt.Errorf("all-day event")
+
+// expand returns the occurrences of a VEVENT up to now
+func (cal *icsCalendar) expand(c *icsComponent, overrides map[time.Time]*icsComponent, now time.Time) []ICSEvent {
+
+	base := ICSEvent{
+		UID:         c.value("UID"),
+		Summary:     strings.TrimSpace(unescapeICSText(c.value("SUMMARY"))),
+		Description: unescapeICSText(c.value("DESCRIPTION")),
+		Status:      ImportNew,
+	}
+	for _, p := range c.all("CATEGORIES") {
+		for _, v := range splitICSList(p.value) {
+			base.Categories = append(base.Categories, unescapeICSText(v))
+		}
+	}
+	base.Categories = ParseTags(strings.Join(base.Categories, ","))
+
+	if base.Summary == "" {
+		base.Summary = "Untitled event"
+	}
+
+	skip := func(reason string) []ICSEvent {
+		e := base
+		if e.UID == "" {
+			e.UID = anonymousUID(e)
+		}
+		e.Status, e.Reason = ImportSkipped, reason
+		return []ICSEvent{e}
+	}
+
+	dtstart, ok := c.prop("DTSTART")
+	if !ok {
+		return skip("no start time")
+	}
+
+	start, z, err := cal.parseTime(dtstart)
+	if err != nil {
+		return skip(err.Error())
+	}
+	base.Start = start
+
+	duration, err := cal.duration(c, start)
+	if err != nil {
+		return skip(err.Error())
+	}
+	base.End = start.Add(duration)
+
+	if base.UID == "" {
+		base.UID = anonymousUID(base)
+	}
+
+	if strings.EqualFold(c.value("STATUS"), "CANCELLED") {
+		return skip("cancelled")
+	}
+
+	rrule := c.value("RRULE")
+	if rrule == "" {
+		return []ICSEvent{finishedBy(base, now)}
+	}
+
+	rule, err := parseRRule(rrule)
+	if err != nil {
+		return skip(err.Error())
+	}
+
+	excluded := map[time.Time]bool{}
+	for _, p := range c.all("EXDATE") {
+		for _, v := range splitICSList(p.value) {
+			p.value = v
+			t, _, err := cal.parseTime(p)
+			if err == nil {
+				excluded[t] = true
+			}
+		}
+	}
+
+	wall, err := parseICSWallTime(dtstart.value)
+	if err != nil {
+		return skip(err.Error())
+	}
+
+	var events []ICSEvent
+	for _, occurrence := range rule.occurrences(wall, now.UTC().Add(14*time.Hour), ICS_MAX_OCCURRENCES) {
+		t := z.toUTC(occurrence)
+		if excluded[t] || t.After(now) {
+			continue
+		}
+
+		e := base
+		e.UID = base.UID + "/" + t.Format(icsTimeFormat)
+		e.Start = t
+		e.End = t.Add(duration)
+
+		if o, ok := overrides[t]; ok {
+			e = cal.override(e, o)
+		}
+
+		events = append(events, finishedBy(e, now))
+	}
+
+	return events
+}
+
+// override applies a RECURRENCE-ID component
+// to the occurrence it replaces
+func (cal *icsCalendar) override(e ICSEvent, c *icsComponent) ICSEvent {
+
+	if strings.EqualFold(c.value("STATUS"), "CANCELLED") {
+		e.Status, e.Reason = ImportSkipped, "cancelled"
+		return e
+	}
+
+	if summary := strings.TrimSpace(unescapeICSText(c.value("SUMMARY"))); summary != "" {
+		e.Summary = summary
+	}
+	if _, ok := c.prop("DESCRIPTION"); ok {
+		e.Description = unescapeICSText(c.value("DESCRIPTION"))
+	}
+
+	if p, ok := c.prop("DTSTART"); ok {
+		start, _, err := cal.parseTime(p)
+		if err != nil {
+			e.Status, e.Reason = ImportSkipped, err.Error()
+			return e
+		}
+		duration := e.End.Sub(e.Start)
+		if d, err := cal.duration(c, start); err == nil {
+			duration = d
+		}
+		e.Start, e.End = start, start.Add(duration)
+	}
+
+	return e
+}
+
+// duration reads DTEND or DURATION.  An event with
+// neither lasts no time at all.
+func (cal *icsCalendar) duration(c *icsComponent, start time.Time) (time.Duration, error) {
+
+	if p, ok := c.prop("DTEND"); ok {
+		end, _, err := cal.parseTime(p)
+		if err != nil {
+			return 0, err
+		}
+		if end.Before(start) {
+			return 0, fmt.Errorf("ends before it starts")
+		}
+		return end.Sub(start), nil
+	}
+
+	if value := c.value("DURATION"); value != "" {
+		return parseICSDuration(value)
+	}
+
+	return 0, nil
+}
+
+// finishedBy skips events that take no time or
+// have not finished by now
+func finishedBy(e ICSEvent, now time.Time) ICSEvent {
+
+	if e.Status != ImportNew {
+		return e
+	}
+	if !e.End.After(e.Start) {
+		e.Status, e.Reason = ImportSkipped, "no duration"
+	} else if e.End.After(now) {
+		e.Status, e.Reason = ImportSkipped, "not finished yet"
+	}
+	return e
+}
+
+// anonymousUID stands in for a missing UID so that
+// re-importing the same file still skips the event
+func anonymousUID(e ICSEvent) string {
+	sum := sha1.Sum([]byte(e.Summary + "|" + e.Start.UTC().Format(icsTimeFormat)))
+	return fmt.Sprintf("nouid-%x", sum[:8])
+}
+
+// parseICSDuration parses a DURATION value such
+// as PT1H30M, P1D or P2W (RFC 5545 3.3.6)
+func parseICSDuration(value string) (time.Duration, error) {
+
+	invalid := fmt.Errorf("invalid duration: %q", value)
+
+	v := strings.TrimPrefix(value, "+")
+	if strings.HasPrefix(v, "-") {
+		return 0, fmt.Errorf("negative duration: %q", value)
+	}
+	if !strings.HasPrefix(v, "P") || len(v) < 3 {
+		return 0, invalid
+	}
+	v = v[1:]
+
+	units := map[byte]time.Duration{
+		'W': 7 * 24 * time.Hour,
+		'D': 24 * time.Hour,
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+	}
+
+	var d time.Duration
+	inTime := false
+	number := ""
+
+	for i := 0; i < len(v); i++ {
+		ch := v[i]
+		switch {
+		case ch == 'T':
+			inTime = true
+		case ch >= '0' && ch <= '9':
+			number += string(ch)
+		default:
+			unit, ok := units[ch]
+			if !ok || number == "" || (ch == 'M' && !inTime) {
+				return 0, invalid
+			}
+			n, err := strconv.Atoi(number)
+			if err != nil {
+				return 0, invalid
+			}
+			d += time.Duration(n) * unit
+			number = ""
+		}
+	}
+
+	if number != "" {
+		return 0, invalid
+	}
+	return d, nil
+}
+
+// rrule is the subset of RFC 5545 recurrence rules
+// used by calendar apps for meetings and by VTIMEZONE
+// daylight saving rules
+type rrule struct {
+	freq       string
+	interval   int
+	count      int
+	until      time.Time
+	byDay      []weekdayNum
+	byMonthDay []int
+	byMonth    []int
+}
+
+type weekdayNum struct {
+	n   int
+	day time.Weekday
+}
+
+var icsWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+func parseRRule(value string) (rrule, error) {
+
+	r := rrule{interval: 1}
+
+	for _, part := range strings.Split(value, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return rrule{}, fmt.Errorf("invalid recurrence rule: %q", value)
+		}
+		key, val := strings.ToUpper(kv[0]), kv[1]
+
+		var err error
+		switch key {
+		case "FREQ":
+			switch val {
+			case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+				r.freq = val
+			default:
+				return rrule{}, fmt.Errorf("unsupported recurrence frequency: %s", val)
+			}
+		case "INTERVAL":
+			r.interval, err = strconv.Atoi(val)
+			if err == nil && r.interval < 1 {
+				err = fmt.Errorf("interval must be positive")
+			}
+		case "COUNT":
+			r.count, err = strconv.Atoi(val)
+		case "UNTIL":
+			if len(val) == len("20060102") {
+				r.until, err = time.Parse("20060102", val)
+				r.until = r.until.Add(24*time.Hour - time.Second)
+			} else {
+				r.until, err = parseICSWallTime(val)
+			}
+		case "BYDAY":
+			for _, d := range strings.Split(val, ",") {
+				if len(d) < 2 {
+					return rrule{}, fmt.Errorf("invalid BYDAY: %q", val)
+				}
+				day, ok := icsWeekdays[d[len(d)-2:]]
+				if !ok {
+					return rrule{}, fmt.Errorf("invalid BYDAY: %q", val)
+				}
+				wn := weekdayNum{day: day}
+				if n := d[:len(d)-2]; n != "" {
+					wn.n, err = strconv.Atoi(n)
+					if err != nil {
+						break
+					}
+				}
+				r.byDay = append(r.byDay, wn)
+			}
+		case "BYMONTHDAY":
+			r.byMonthDay, err = parseInts(val)
+		case "BYMONTH":
+			r.byMonth, err = parseInts(val)
+		case "WKST":
+		default:
+			return rrule{}, fmt.Errorf("unsupported recurrence rule part: %s", key)
+		}
+		if err != nil {
+			return rrule{}, fmt.Errorf("invalid recurrence rule %q: %s", value, err)
+		}
+	}
+
+	if r.freq == "" {
+		return rrule{}, fmt.Errorf("recurrence rule has no FREQ: %q", value)
+	}
+	return r, nil
+}
+
+func parseInts(value string) ([]int, error) {
+
+	var ints []int
+	for _, s := range strings.Split(value, ",") {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, err
+		}
+		ints = append(ints, n)
+	}
+	return ints, nil
+}
+
+// occurrences returns the wall clock start of each
+// recurrence at or before limit, starting with start
+// itself, and at most max of them
+func (r rrule) occurrences(start, limit time.Time, max int) []time.Time {
+
+	var found []time.Time
+
+	for period := 0; len(found) < max; period++ {
+		candidates, first := r.period(start, period*r.interval)
+		if first.After(limit) || (!r.until.IsZero() && first.After(r.until)) {
+			break
+		}
+
+		for _, t := range candidates {
+			if t.Before(start) {
+				continue
+			}
+			if t.After(limit) || (!r.until.IsZero() && t.After(r.until)) {
+				return found
+			}
+			found = append(found, t)
+			if len(found) == max || (r.count > 0 && len(found) == r.count) {
+				return found
+			}
+		}
+	}
+
+	return found
+}
+
+// period returns the sorted candidate starts in the
+// n-th period after start's, and the first instant
+// of that period
+func (r rrule) period(start time.Time, n int) ([]time.Time, time.Time) {
+
+	clock := start.Sub(time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.UTC))
+	at := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Add(clock)
+	}
+
+	var days []time.Time
+	var first time.Time
+
+	switch r.freq {
+	case "DAILY":
+		day := at(start.Year(), start.Month(), start.Day()+n)
+		first = day.Add(-clock)
+		if r.matchesDay(day) {
+			days = append(days, day)
+		}
+	case "WEEKLY":
+		offset := (int(start.Weekday()) + 6) % 7
+		monday := at(start.Year(), start.Month(), start.Day()-offset+7*n)
+		first = monday.Add(-clock)
+		for i := 0; i < 7; i++ {
+			day := monday.AddDate(0, 0, i)
+			if len(r.byDay) == 0 && day.Weekday() != start.Weekday() {
+				continue
+			}
+			if r.matchesDay(day) {
+				days = append(days, day)
+			}
+		}
+	case "MONTHLY":
+		month := time.Date(start.Year(), start.Month()+time.Month(n), 1, 0, 0, 0, 0, time.UTC)
+		first = month
+		days = r.monthDays(month.Year(), month.Month(), start, at)
+	case "YEARLY":
+		year := start.Year() + n
+		first = time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC)
+		months := r.byMonth
+		if len(months) == 0 {
+			months = []int{int(start.Month())}
+		}
+		for _, m := range months {
+			days = append(days, r.monthDays(year, time.Month(m), start, at)...)
+		}
+	}
+
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+	return days, first
+}
+
+// matchesDay applies BYMONTH, BYMONTHDAY and plain
+// BYDAY as filters for daily and weekly rules
+func (r rrule) matchesDay(day time.Time) bool {
+
+	if len(r.byMonth) > 0 && !containsInt(r.byMonth, int(day.Month())) {
+		return false
+	}
+	if len(r.byMonthDay) > 0 && !containsInt(r.byMonthDay, day.Day()) {
+		return false
+	}
+	if len(r.byDay) > 0 {
+		for _, wn := range r.byDay {
+			if wn.day == day.Weekday() {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// monthDays expands BYMONTHDAY and BYDAY within one
+// month.  With neither the day of start is used.
+func (r rrule) monthDays(year int, month time.Month, start time.Time, at func(int, time.Month, int) time.Time) []time.Time {
+
+	last := time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+
+	var days []int
+
+	for _, d := range r.byMonthDay {
+		if d < 0 {
+			d = last + 1 + d
+		}
+		if d >= 1 && d <= last {
+			days = append(days, d)
+		}
+	}
+
+	if len(r.byDay) > 0 {
+		var byDay []int
+		for _, wn := range r.byDay {
+			var matches []int
+			for d := 1; d <= last; d++ {
+				if time.Date(year, month, d, 0, 0, 0, 0, time.UTC).Weekday() == wn.day {
+					matches = append(matches, d)
+				}
+			}
+			switch {
+			case wn.n == 0:
+				byDay = append(byDay, matches...)
+			case wn.n > 0 && wn.n <= len(matches):
+				byDay = append(byDay, matches[wn.n-1])
+			case wn.n < 0 && -wn.n <= len(matches):
+				byDay = append(byDay, matches[len(matches)+wn.n])
+			}
+		}
+
+		// BYDAY limits BYMONTHDAY when both are given
+		if len(r.byMonthDay) > 0 {
+			var both []int
+			for _, d := range days {
+				if containsInt(byDay, d) {
+					both = append(both, d)
+				}
+			}
+			days = both
+		} else {
+			days = byDay
+		}
+	}
+
+	if len(r.byMonthDay) == 0 && len(r.byDay) == 0 && start.Day() <= last {
+		days = []int{start.Day()}
+	}
+
+	var times []time.Time
+	for _, d := range days {
+		times = append(times, at(year, month, d))
+	}
+	return times
+}
+
+func containsInt(ints []int, n int) bool {
+	for _, i := range ints {
+		if i == n {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,243 @@
+package timetracker_test
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"timetracker"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// summarise flattens events so that failures
+// read as one line per occurrence
+func summarise(events []timetracker.ICSEvent) []string {
+
+	var lines []string
+	for _, e := range events {
+		status := e.Status
+		if e.Reason != "" {
+			status += ": " + e.Reason
+		}
+		start := ""
+		if !e.Start.IsZero() {
+			start = e.Start.UTC().Format(time.RFC3339)
+		}
+		lines = append(lines, fmt.Sprintf("%s | %s | %s | %s | %s", e.UID, e.Summary, start, e.End.Sub(e.Start), status))
+	}
+	return lines
+}
+
+func TestParseICS(t *testing.T) {
+
+	t.Parallel()
+
+	f, err := os.Open("testdata/import.ics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	now := time.Date(2021, 12, 31, 0, 0, 0, 0, time.UTC)
+
+	events, err := timetracker.ParseICS(f, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"holiday@example.com | Holiday |  | 0s | skipped: all-day event",
+		"review@example.com | Design review, round 2 | 2021-01-15T15:00:00Z | 1h30m0s | new",
+		"cancelled@example.com | Offsite | 2021-02-01T10:00:00Z | 1h0m0s | skipped: cancelled",
+		"standup@example.com/20210308T140000Z | Standup | 2021-03-08T14:00:00Z | 15m0s | new",
+		"standup@example.com/20210315T130000Z | Standup | 2021-03-15T13:00:00Z | 15m0s | new",
+		"standup@example.com/20210317T130000Z | Standup (moved) | 2021-03-17T14:00:00Z | 30m0s | new",
+		"standup@example.com/20210322T130000Z | Standup | 2021-03-22T13:00:00Z | 15m0s | new",
+		"standup@example.com/20210324T130000Z | Standup | 2021-03-24T13:00:00Z | 15m0s | new",
+		"planning@example.com | Planning | 2021-07-15T14:00:00Z | 45m0s | new",
+		"future@example.com | Retro | 2099-01-01T10:00:00Z | 1h0m0s | skipped: not finished yet",
+	}
+
+	got := summarise(events)
+
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+
+	task := events[1].Task()
+
+	wantTask := timetracker.Task{
+		Name:           "Design review, round 2",
+		Tags:           []string{"Work", "Review"},
+		Notes:          "Walk through the new schema\nand the migration plan",
+		StartTime:      time.Date(2021, 1, 15, 15, 0, 0, 0, time.UTC),
+		ElapsedTime:    90 * time.Minute,
+		ElapsedTimeSec: 5400,
+	}
+
+	if !cmp.Equal(wantTask, task) {
+		t.Error(cmp.Diff(wantTask, task))
+	}
+
+}
+
+func TestParseICSRecurrenceRules(t *testing.T) {
+
+	t.Parallel()
+
+	testCases := []struct {
+		description string
+		dtstart     string
+		rrule       string
+		want        []string
+	}{
+		{
+			description: "last friday of the month",
+			dtstart:     "20210129T160000Z",
+			rrule:       "FREQ=MONTHLY;BYDAY=-1FR;COUNT=3",
+			want:        []string{"2021-01-29", "2021-02-26", "2021-03-26"},
+		},
+		{
+			description: "every other day until",
+			dtstart:     "20210101T080000Z",
+			rrule:       "FREQ=DAILY;INTERVAL=2;UNTIL=20210107T080000Z",
+			want:        []string{"2021-01-01", "2021-01-03", "2021-01-05", "2021-01-07"},
+		},
+		{
+			description: "monthly on the 31st skips short months",
+			dtstart:     "20210131T080000Z",
+			rrule:       "FREQ=MONTHLY;COUNT=3",
+			want:        []string{"2021-01-31", "2021-03-31", "2021-05-31"},
+		},
+		{
+			description: "yearly on the second sunday of march",
+			dtstart:     "20210314T080000Z",
+			rrule:       "FREQ=YEARLY;BYMONTH=3;BYDAY=2SU;COUNT=2",
+			want:        []string{"2021-03-14", "2022-03-13"},
+		},
+	}
+
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, tc := range testCases {
+		ics := strings.Join([]string{
+			"BEGIN:VCALENDAR",
+			"BEGIN:VEVENT",
+			"UID:rule@example.com",
+			"SUMMARY:Rule",
+			"DTSTART:" + tc.dtstart,
+			"DURATION:PT1H",
+			"RRULE:" + tc.rrule,
+			"END:VEVENT",
+			"END:VCALENDAR",
+		}, "\r\n")
+
+		events, err := timetracker.ParseICS(strings.NewReader(ics), now)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.description, err)
+		}
+
+		var got []string
+		for _, e := range events {
+			got = append(got, e.Start.Format("2006-01-02"))
+		}
+
+		if !cmp.Equal(tc.want, got) {
+			t.Errorf("%s: %s", tc.description, cmp.Diff(tc.want, got))
+		}
+	}
+
+}
+
+func TestParseICSInvalid(t *testing.T) {
+
+	t.Parallel()
+
+	testCases := []struct {
+		description string
+		ics         string
+	}{
+		{description: "not a calendar", ics: "hello world"},
+		{description: "missing END", ics: "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nEND:VCALENDAR"},
+		{description: "empty", ics: ""},
+	}
+
+	for _, tc := range testCases {
+		_, err := timetracker.ParseICS(strings.NewReader(tc.ics), time.Now())
+		if err == nil {
+			t.Errorf("%s: want error, got nil", tc.description)
+		}
+	}
+
+}
+
+type fakeImportStore struct {
+	imported map[string]timetracker.Task
+}
+
+func (f *fakeImportStore) IsImported(userId int, uid string) (bool, error) {
+	_, ok := f.imported[uid]
+	return ok, nil
+}
+
+func (f *fakeImportStore) ImportTask(uid string, task timetracker.Task) (int, error) {
+	f.imported[uid] = task
+	return len(f.imported), nil
+}
+
+func (f *fakeImportStore) ReplaceTasks(actor int, deleted, created []timetracker.Task) ([]int, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+func TestImportICS(t *testing.T) {
+
+	t.Parallel()
+
+	calendar, err := os.ReadFile("testdata/import.ics")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2021, 12, 31, 0, 0, 0, 0, time.UTC)
+	store := &fakeImportStore{imported: map[string]timetracker.Task{}}
+
+	events, err := timetracker.ImportICS(store, strings.NewReader(string(calendar)), timetracker.LOCAL_USER_ID, now, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store.imported) != 0 {
+		t.Errorf("dry run imported %d tasks", len(store.imported))
+	}
+	if events[1].Status != timetracker.ImportNew {
+		t.Errorf("want: %q, got: %q", timetracker.ImportNew, events[1].Status)
+	}
+
+	_, err = timetracker.ImportICS(store, strings.NewReader(string(calendar)), 2, now, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store.imported) != 7 {
+		t.Errorf("want: 7 imported, got: %d", len(store.imported))
+	}
+	for uid, task := range store.imported {
+		if task.UserId != 2 {
+			t.Errorf("%s: want: owned by the importer, got: user %d", uid, task.UserId)
+		}
+	}
+
+	events, err = timetracker.ImportICS(store, strings.NewReader(string(calendar)), timetracker.LOCAL_USER_ID, now, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range events {
+		if e.Status == timetracker.ImportNew {
+			t.Errorf("%s imported twice", e.UID)
+		}
+	}
+	if len(store.imported) != 7 {
+		t.Errorf("want: 7 imported, got: %d", len(store.imported))
+	}
+
+}
@@ -0,0 +1,112 @@
+package timetracker_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+	"timetracker"
+)
+
+func TestWriteICS(t *testing.T) {
+
+	t.Parallel()
+
+	tasks := []timetracker.Task{
+		{
+			Id:             7,
+			Name:           "piano",
+			Project:        "music",
+			Tags:           []string{"practice", "scales"},
+			Notes:          "C major; hands together,\nslowly",
+			StartTime:      time.Date(2021, 1, 1, 9, 0, 0, 0, time.UTC),
+			ElapsedTimeSec: 5400,
+		},
+	}
+
+	var buf bytes.Buffer
+
+	err := timetracker.WriteICS(&buf, tasks, time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//timetracker//timetracker//EN",
+		"CALSCALE:GREGORIAN",
+		"X-WR-CALNAME:timetracker",
+		"BEGIN:VEVENT",
+		"UID:task-7@timetracker",
+		"DTSTAMP:20210201T000000Z",
+		"DTSTART:20210101T090000Z",
+		"DTEND:20210101T103000Z",
+		"SUMMARY:piano",
+		`DESCRIPTION:C major\; hands together\,\nslowly`,
+		"CATEGORIES:music,practice,scales",
+		"END:VEVENT",
+		"END:VCALENDAR",
+		"",
+	}, "\r\n")
+
+	got := buf.String()
+
+	if want != got {
+		t.Errorf("want: %q, got: %q", want, got)
+	}
+
+}
+
+func TestFoldICSLine(t *testing.T) {
+
+	t.Parallel()
+
+	short := "SUMMARY:piano"
+	if got := timetracker.FoldICSLine(short); got != short+"\r\n" {
+		t.Errorf("want: %q, got: %q", short+"\r\n", got)
+	}
+
+	// 74 ASCII octets then a two octet rune that
+	// must not be split across the fold
+	line := "DESCRIPTION:" + strings.Repeat("a", 62) + "é" + strings.Repeat("b", 80)
+
+	got := timetracker.FoldICSLine(line)
+
+	if !strings.HasSuffix(got, "\r\n") {
+		t.Fatalf("line is not CRLF terminated: %q", got)
+	}
+
+	physical := strings.Split(strings.TrimSuffix(got, "\r\n"), "\r\n")
+	for i, p := range physical {
+		if len(p) > timetracker.ICS_LINE_LIMIT {
+			t.Errorf("line %d is %d octets: %q", i, len(p), p)
+		}
+		if i > 0 && !strings.HasPrefix(p, " ") {
+			t.Errorf("continuation line %d does not start with a space: %q", i, p)
+		}
+	}
+
+	if !strings.HasPrefix(physical[1], " é") {
+		t.Errorf("want rune moved to the continuation line, got: %q", physical[1])
+	}
+
+	unfolded := strings.ReplaceAll(strings.TrimSuffix(got, "\r\n"), "\r\n ", "")
+	if unfolded != line {
+		t.Errorf("want: %q, got: %q", line, unfolded)
+	}
+
+}
+
+func TestEscapeICSText(t *testing.T) {
+
+	t.Parallel()
+
+	got := timetracker.EscapeICSText("a\\b;c,d\r\ne\nf")
+	want := `a\\b\;c\,d\ne\nf`
+
+	if want != got {
+		t.Errorf("want: %q, got: %q", want, got)
+	}
+
+}
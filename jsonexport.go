@@ -0,0 +1,456 @@
+package timetracker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// JSON_EXPORT_FORMAT names the document
+	// written by ExportJSON
+	JSON_EXPORT_FORMAT string = "timetracker-export"
+
+	// JSON_EXPORT_VERSION is the version of the
+	// document.  Bump it when a field changes
+	// meaning or is removed.  Version 2 added
+	// the user_id of each task.
+	JSON_EXPORT_VERSION int = 2
+
+	// ImportJSON adds tasks that are not already
+	// in the store, or replaces every task
+	ImportMerge   string = "merge"
+	ImportReplace string = "replace"
+
+	// at most MAX_RECORD_ERRORS invalid records
+	// are reported by one import
+	MAX_RECORD_ERRORS int = 20
+)
+
+// ExportTask is a task in a JSON export.  Each task
+// is one timed segment of work.  Id is the task's id
+// in the store it was exported from and UserId the
+// user who owns it.
+type ExportTask struct {
+	Id             int       `json:"id"`
+	UserId         int       `json:"user_id"`
+	Name           string    `json:"name"`
+	Project        string    `json:"project"`
+	Tags           []string  `json:"tags"`
+	Notes          string    `json:"notes"`
+	StartTime      time.Time `json:"start_time"`
+	ElapsedTimeSec float64   `json:"elapsed_time"`
+}
+
+// RecordError is a problem with one task in an import.
+// Record counts tasks from 1 and Offset is the byte
+// offset in the document just past the task.
+type RecordError struct {
+	Record int
+	Offset int64
+	Field  string
+	Err    error
+}
+
+func (e RecordError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("task %d (byte %d): %s", e.Record, e.Offset, e.Err)
+	}
+	return fmt.Sprintf("task %d (byte %d): %s: %s", e.Record, e.Offset, e.Field, e.Err)
+}
+
+func (e RecordError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationErrors are the invalid tasks of an
+// import.  Nothing is imported when there are any.
+type ValidationErrors []RecordError
+
+func (v ValidationErrors) Error() string {
+	msgs := make([]string, len(v))
+	for i, e := range v {
+		msgs[i] = e.Error()
+	}
+	return fmt.Sprintf("%d invalid tasks:\n%s", len(v), strings.Join(msgs, "\n"))
+}
+
+// JSONImportResult is what an import did, or
+// would do in a dry run
+type JSONImportResult struct {
+	Created []Task
+	Skipped int
+	Deleted []Task
+}
+
+// ExportJSON writes the tasks userId may see as a
+// versioned JSON document, every task for ALL_USERS.
+// Tasks are read a page at a time and written oldest
+// first, followed by the projects and tags they use:
+//
+//	{"format":"timetracker-export","version":2,"exported_at":"...",
+//	 "tasks":[{...},...],"projects":["music"],"tags":["scales"]}
+//
+// Deleted tasks, goals, templates and workspaces are
+// not exported; a backup keeps those.
+func ExportJSON(w io.Writer, store TaskStore, userId int, now time.Time) error {
+
+	header := struct {
+		Format     string    `json:"format"`
+		Version    int       `json:"version"`
+		ExportedAt time.Time `json:"exported_at"`
+	}{JSON_EXPORT_FORMAT, JSON_EXPORT_VERSION, now.UTC()}
+
+	b, err := json.Marshal(header)
+	if err != nil {
+		return fmt.Errorf("unable to write export: %w", err)
+	}
+
+	// the header is left open so the
+	// tasks can follow it one by one
+	_, err = fmt.Fprintf(w, "%s,\"tasks\":[", b[:len(b)-1])
+	if err != nil {
+		return fmt.Errorf("unable to write export: %w", err)
+	}
+
+	projects := map[string]bool{}
+	tags := map[string]bool{}
+	sep := "\n"
+
+	opts := ListOptions{Limit: HISTORY_LIMIT_MAX, Sort: ListSortStart, UserId: userId}
+	for {
+		page, err := store.List(opts)
+		if err != nil {
+			return err
+		}
+
+		for _, task := range page.Tasks {
+			b, err := json.Marshal(NewExportTask(task))
+			if err != nil {
+				return fmt.Errorf("unable to write task %d: %w", task.Id, err)
+			}
+			_, err = fmt.Fprintf(w, "%s%s", sep, b)
+			if err != nil {
+				return fmt.Errorf("unable to write export: %w", err)
+			}
+			sep = ",\n"
+
+			if task.Project != "" {
+				projects[task.Project] = true
+			}
+			for _, tag := range task.Tags {
+				tags[tag] = true
+			}
+		}
+
+		if page.Next == "" {
+			break
+		}
+		opts.Cursor = NewCursor(opts.Sort, page.Tasks[len(page.Tasks)-1])
+	}
+
+	footer := struct {
+		Projects []string `json:"projects"`
+		Tags     []string `json:"tags"`
+	}{sortedNames(projects), sortedNames(tags)}
+
+	b, err = json.Marshal(footer)
+	if err != nil {
+		return fmt.Errorf("unable to write export: %w", err)
+	}
+
+	// the footer's opening brace is
+	// replaced by the end of the tasks
+	_, err = fmt.Fprintf(w, "\n],%s\n", b[1:])
+	if err != nil {
+		return fmt.Errorf("unable to write export: %w", err)
+	}
+	return nil
+}
+
+// NewExportTask is task as it is exported
+func NewExportTask(task Task) ExportTask {
+
+	tags := task.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+
+	return ExportTask{
+		Id:             task.Id,
+		UserId:         task.UserId,
+		Name:           task.Name,
+		Project:        task.Project,
+		Tags:           tags,
+		Notes:          task.Notes,
+		StartTime:      task.StartTime.UTC(),
+		ElapsedTimeSec: task.ElapsedTimeSec,
+	}
+}
+
+func sortedNames(m map[string]bool) []string {
+
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ImportJSON reads a document written by ExportJSON.
+// Every task is checked before any is saved, and the
+// tasks that fail are returned as ValidationErrors.
+// With ImportMerge, tasks whose owner, name and start time
+// are already in the store are skipped.  With ImportReplace,
+// every task in the store is deleted.  Tasks get new ids,
+// keep their owner and are imported stopped.  Tasks of a
+// version 1 export belong to LOCAL_USER_ID.  A dry run reports what would
+// change without changing anything.  Each change is audited
+// as made by actor.
+//
+// With an importer the changes and their audit entries are
+// made in one transaction and an error leaves the store as
+// it was.  Without, tasks are created before any is deleted,
+// so a failed replace leaves the old tasks in place, and
+// each change is made with its audit entry through audit,
+// if there is one.
+func ImportJSON(store TaskStore, importer ImportStore, audit AuditStore, r io.Reader, actor int, mode string, dryRun bool) (JSONImportResult, error) {
+
+	if mode != ImportMerge && mode != ImportReplace {
+		return JSONImportResult{}, fmt.Errorf("unknown import mode %q, want %s or %s", mode, ImportMerge, ImportReplace)
+	}
+
+	tasks, err := readExport(r)
+	if err != nil {
+		return JSONImportResult{}, err
+	}
+
+	existing, err := store.GetAll()
+	if err != nil {
+		return JSONImportResult{}, err
+	}
+
+	var result JSONImportResult
+
+	seen := map[string]bool{}
+	if mode == ImportReplace {
+		result.Deleted = existing
+	} else {
+		for _, task := range existing {
+			seen[taskIdentity(task)] = true
+		}
+	}
+
+	for _, task := range tasks {
+		if seen[taskIdentity(task)] {
+			result.Skipped++
+			continue
+		}
+		seen[taskIdentity(task)] = true
+		result.Created = append(result.Created, task)
+	}
+
+	if dryRun {
+		return result, nil
+	}
+
+	if importer != nil {
+		ids, err := importer.ReplaceTasks(actor, result.Deleted, result.Created)
+		if err != nil {
+			return JSONImportResult{}, err
+		}
+		for i, id := range ids {
+			result.Created[i].Id = id
+		}
+		return result, nil
+	}
+
+	create, remove := store.CreateCompleted, store.Delete
+	if audit != nil {
+		create = func(task Task) (int, error) {
+			entry, err := audit.RecordChange(NewAuditEntry(AuditImport, actor, time.Now(), nil, &task))
+			return entry.TaskId, err
+		}
+		remove = func(task Task) error {
+			_, err := audit.RecordChange(NewAuditEntry(AuditDelete, actor, time.Now(), &task, nil))
+			return err
+		}
+	}
+
+	// on failure the result holds only
+	// the changes that were made
+	for i, task := range result.Created {
+		id, err := create(task)
+		if err != nil {
+			result.Created, result.Deleted = result.Created[:i], nil
+			return result, err
+		}
+		result.Created[i].Id = id
+	}
+
+	for i, task := range result.Deleted {
+		err := remove(task)
+		if err != nil {
+			result.Deleted = result.Deleted[:i]
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+// taskIdentity is what makes two tasks the same
+// task when merging
+func taskIdentity(task Task) string {
+	return fmt.Sprintf("%d %s %s", ownerOf(task), task.StartTime.UTC().Format(time.RFC3339Nano), task.Name)
+}
+
+// readExport decodes an export one task at a time and
+// checks the format, version and every task
+func readExport(r io.Reader) ([]Task, error) {
+
+	dec := json.NewDecoder(r)
+
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, fmt.Errorf("invalid export: %w", err)
+	}
+	if tok != json.Delim('{') {
+		return nil, fmt.Errorf("invalid export: want an object")
+	}
+
+	var format string
+	var version int
+	var tasks []Task
+	var invalid ValidationErrors
+
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("invalid export: %w", err)
+		}
+		key, _ := tok.(string)
+
+		switch key {
+		case "format":
+			err = dec.Decode(&format)
+		case "version":
+			err = dec.Decode(&version)
+		case "tasks":
+			tasks, invalid, err = readExportTasks(dec)
+		default:
+			// exported_at, projects, tags and fields of
+			// newer minor versions are not needed to import
+			var skip json.RawMessage
+			err = dec.Decode(&skip)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid export: %s: %w", key, err)
+		}
+	}
+
+	if format != JSON_EXPORT_FORMAT {
+		return nil, fmt.Errorf("not a timetracker export: format %q", format)
+	}
+	if version < 1 || version > JSON_EXPORT_VERSION {
+		return nil, fmt.Errorf("unsupported export version %d, want 1 to %d", version, JSON_EXPORT_VERSION)
+	}
+	if len(invalid) > 0 {
+		return nil, invalid
+	}
+	return tasks, nil
+}
+
+func readExportTasks(dec *json.Decoder) ([]Task, ValidationErrors, error) {
+
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, nil, err
+	}
+	if tok != json.Delim('[') {
+		return nil, nil, fmt.Errorf("want an array")
+	}
+
+	var tasks []Task
+	var invalid ValidationErrors
+
+	for record := 1; dec.More(); record++ {
+
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if err != nil {
+			return nil, nil, fmt.Errorf("task %d: %w", record, err)
+		}
+
+		task, errs := validateExportTask(raw)
+		for _, e := range errs {
+			e.Record, e.Offset = record, dec.InputOffset()
+			if len(invalid) < MAX_RECORD_ERRORS {
+				invalid = append(invalid, e)
+			}
+		}
+		if len(errs) == 0 {
+			tasks = append(tasks, task)
+		}
+	}
+
+	_, err = dec.Token()
+	return tasks, invalid, err
+}
+
+// validateExportTask decodes one exported task
+// and lists what is wrong with it
+func validateExportTask(raw json.RawMessage) (Task, []RecordError) {
+
+	var et ExportTask
+	dec := json.NewDecoder(strings.NewReader(string(raw)))
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(&et)
+	if err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return Task{}, []RecordError{{Field: typeErr.Field, Err: fmt.Errorf("want %s, got %s", typeErr.Type, typeErr.Value)}}
+		}
+		return Task{}, []RecordError{{Err: err}}
+	}
+
+	var errs []RecordError
+	fail := func(field, msg string) {
+		errs = append(errs, RecordError{Field: field, Err: errors.New(msg)})
+	}
+
+	if strings.TrimSpace(et.Name) == "" {
+		fail("name", "must not be empty")
+	}
+	if et.StartTime.IsZero() {
+		fail("start_time", "missing")
+	}
+	if et.ElapsedTimeSec < 0 {
+		fail("elapsed_time", "must not be negative")
+	}
+	if et.UserId < 0 {
+		fail("user_id", "must not be negative")
+	}
+	for _, tag := range et.Tags {
+		if tag == "" || tag != strings.TrimSpace(tag) || strings.Contains(tag, ",") {
+			fail("tags", fmt.Sprintf("invalid tag %q", tag))
+		}
+	}
+
+	task := Task{
+		UserId:         et.UserId,
+		Name:           et.Name,
+		Project:        et.Project,
+		Tags:           et.Tags,
+		Notes:          et.Notes,
+		StartTime:      et.StartTime,
+		ElapsedTimeSec: et.ElapsedTimeSec,
+	}
+	return task, errs
+}
@@ -0,0 +1,960 @@
+package timetracker
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// KV_SCHEMA_VERSION is the layout of the buckets.
+	// Bump it when a bucket or record changes meaning.
+	// Version 2 keyed the totals by user and added the
+	// per user name index.
+	KV_SCHEMA_VERSION int = 2
+
+	// KV_OPEN_TIMEOUT is how long NewKVStore waits for
+	// another process to let go of the file
+	KV_OPEN_TIMEOUT time.Duration = time.Second
+)
+
+// buckets of a KVStore.  Tasks are kept by id and
+// the index buckets hold keys only, each ending in
+// the task id so that tasks with the same value
+// sort by id as they do in DBStore.  The per user
+// buckets start their keys with the user id, so one
+// user's keys are found with a Seek to it.
+var (
+	kvTasks      = []byte("tasks")
+	kvByStart    = []byte("tasks_by_start")
+	kvByName     = []byte("tasks_by_name")
+	kvByUserName = []byte("tasks_by_user_name")
+	kvByDuration = []byte("tasks_by_duration")
+	kvTotals     = []byte("totals")
+	kvSessions   = []byte("sessions")
+	kvMeta       = []byte("meta")
+
+	kvBuckets = [][]byte{kvTasks, kvByStart, kvByName, kvByUserName, kvByDuration, kvTotals, kvSessions, kvMeta}
+)
+
+// kvIndexes are the buckets List can walk
+// in order for each sort
+var kvIndexes = map[string][]byte{
+	ListSortName:     kvByName,
+	ListSortStart:    kvByStart,
+	ListSortDuration: kvByDuration,
+}
+
+// KVStore keeps tasks in an embedded key-value
+// file, for single user installs that should not
+// need a SQL engine.  Only deleted tasks are left
+// out of the indexes, so reads never see them.
+type KVStore struct {
+	db *bolt.DB
+}
+
+// kvTask is a task as it is saved
+type kvTask struct {
+	Id             int        `json:"id"`
+	UserId         int        `json:"user_id"`
+	Name           string     `json:"name"`
+	Project        string     `json:"project"`
+	Tags           []string   `json:"tags"`
+	Notes          string     `json:"notes"`
+	StartTime      time.Time  `json:"start_time"`
+	ElapsedTimeSec float64    `json:"elapsed_time"`
+	DeletedAt      *time.Time `json:"deleted_at,omitempty"`
+	PausedAt       *time.Time `json:"paused_at,omitempty"`
+	PausedSec      float64    `json:"paused_time,omitempty"`
+}
+
+// kvTotal is the sum of the elapsed times of the
+// tasks of one user with one name.  The totals of
+// every user are kept under ALL_USERS.
+type kvTotal struct {
+	Total float64 `json:"total"`
+	Count int     `json:"count"`
+}
+
+// NewKVStore opens the store at path, creating
+// the file and any missing buckets
+func NewKVStore(path string) (*KVStore, error) {
+
+	if path == "" {
+		return nil, fmt.Errorf("kv store path must not be empty")
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: KV_OPEN_TIMEOUT})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open kv store %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range kvBuckets {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+
+		meta := tx.Bucket(kvMeta)
+		version := meta.Get([]byte("version"))
+		if version == nil {
+			return meta.Put([]byte("version"), []byte(strconv.Itoa(KV_SCHEMA_VERSION)))
+		}
+		v, err := strconv.Atoi(string(version))
+		if err != nil || v > KV_SCHEMA_VERSION {
+			return fmt.Errorf("unsupported kv schema version %q", version)
+		}
+		if v < KV_SCHEMA_VERSION {
+			err := reindexKV(tx)
+			if err != nil {
+				return err
+			}
+			return meta.Put([]byte("version"), []byte(strconv.Itoa(KV_SCHEMA_VERSION)))
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to set up kv store %s: %w", path, err)
+	}
+
+	return &KVStore{db: db}, nil
+}
+
+// Close closes the file
+func (k *KVStore) Close() error {
+	return k.db.Close()
+}
+
+// Ping checks the file is open
+func (k *KVStore) Ping(ctx context.Context) error {
+
+	err := k.db.View(func(tx *bolt.Tx) error { return nil })
+	if err != nil {
+		return fmt.Errorf("unable to reach kv store: %w", err)
+	}
+	return nil
+}
+
+// CheckSchema returns an error naming the
+// first bucket that is missing
+func (k *KVStore) CheckSchema(ctx context.Context) error {
+
+	return k.db.View(func(tx *bolt.Tx) error {
+		for _, name := range kvBuckets {
+			if tx.Bucket(name) == nil {
+				return fmt.Errorf("bucket %s not available", name)
+			}
+		}
+		return nil
+	})
+}
+
+func (k *KVStore) Create(task Task) (int, error) {
+
+	task.ElapsedTimeSec = 0
+	id, err := k.insert(task)
+	if err != nil {
+		return 0, fmt.Errorf("error creating task in kv store: %w", err)
+	}
+	return id, nil
+}
+
+// CreateCompleted saves a task that has already been
+// stopped, with its elapsed time, without touching the
+// task session
+func (k *KVStore) CreateCompleted(task Task) (int, error) {
+
+	id, err := k.insert(task)
+	if err != nil {
+		return 0, fmt.Errorf("error creating completed task in kv store: %w", err)
+	}
+	return id, nil
+}
+
+func (k *KVStore) insert(task Task) (int, error) {
+
+	var id int
+
+	err := k.db.Update(func(tx *bolt.Tx) error {
+		seq, err := tx.Bucket(kvTasks).NextSequence()
+		if err != nil {
+			return err
+		}
+		id = int(seq)
+
+		return putTask(tx, nil, kvTask{
+			Id:             id,
+			UserId:         ownerOf(task),
+			Name:           task.Name,
+			Project:        task.Project,
+			Tags:           ParseTags(JoinTags(task.Tags)),
+			Notes:          task.Notes,
+			StartTime:      task.StartTime,
+			ElapsedTimeSec: task.ElapsedTimeSec,
+		})
+	})
+
+	return id, err
+}
+
+// NewTaskSession makes task the current task
+// of the user it belongs to
+func (k *KVStore) NewTaskSession(task Task) error {
+
+	err := k.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(kvSessions).Put(kvId(ownerOf(task)), kvId(task.Id))
+	})
+	if err != nil {
+		return fmt.Errorf("unable to save task session: %w", err)
+	}
+	return nil
+}
+
+func (k *KVStore) UpdateStopped(task Task) error {
+
+	err := k.db.Update(func(tx *bolt.Tx) error {
+		id := tx.Bucket(kvSessions).Get(kvId(ownerOf(task)))
+		if id == nil {
+			return nil
+		}
+		return updateTask(tx, id, func(t *kvTask) {
+			t.ElapsedTimeSec = task.ElapsedTimeSec
+			t.Notes = task.Notes
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("unable to update elapsed time: %w", err)
+	}
+	return nil
+}
+
+func (k *KVStore) UpdateNotes(task Task) error {
+
+	err := k.db.Update(func(tx *bolt.Tx) error {
+		return updateTask(tx, kvId(task.Id), func(t *kvTask) {
+			t.Notes = task.Notes
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("unable to update notes: %w", err)
+	}
+	return nil
+}
+
+func (k *KVStore) Delete(task Task) error {
+
+	err := k.db.Update(func(tx *bolt.Tx) error {
+		return updateTask(tx, kvId(task.Id), func(t *kvTask) {
+			if t.DeletedAt == nil {
+				now := time.Now().UTC()
+				t.DeletedAt = &now
+			}
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("unable to delete record: %w", err)
+	}
+	return nil
+}
+
+// GetTaskByName returns the name and total elapsed
+// time of the tasks called taskname that userId may
+// see, from the totals kept on every write
+func (k *KVStore) GetTaskByName(userId int, taskname string) (Task, error) {
+
+	var task Task
+
+	err := k.db.View(func(tx *bolt.Tx) error {
+		total, err := getTotal(tx, userId, taskname)
+		if err != nil || total.Count == 0 {
+			return err
+		}
+		task = Task{Name: taskname, ElapsedTimeSec: total.Total}
+		return nil
+	})
+	if err != nil {
+		return Task{}, fmt.Errorf("failed to get report: %w", err)
+	}
+	return task, nil
+}
+
+// GetTask returns ErrNoRecord when no task has the id
+func (k *KVStore) GetTask(id int) (Task, error) {
+
+	var task Task
+
+	err := k.db.View(func(tx *bolt.Tx) error {
+		t, err := getTask(tx, kvId(id))
+		if err != nil || t == nil || t.DeletedAt != nil {
+			return err
+		}
+		task = t.task()
+		return nil
+	})
+	if err != nil {
+		return Task{}, fmt.Errorf("failed to get task: %w", err)
+	}
+	if task.Id == 0 {
+		return Task{}, ErrNoRecord
+	}
+	return task, nil
+}
+
+// GetVisibleTask is GetTask for the tasks userId
+// may see.  There are no workspaces in the kv store,
+// so those are the user's own.
+func (k *KVStore) GetVisibleTask(id, userId int) (Task, error) {
+
+	var task Task
+
+	err := k.db.View(func(tx *bolt.Tx) error {
+		t, err := getTask(tx, kvId(id))
+		if err != nil || t == nil || t.DeletedAt != nil || !t.visibleTo(userId) {
+			return err
+		}
+		task = t.task()
+		return nil
+	})
+	if err != nil {
+		return Task{}, fmt.Errorf("failed to get task: %w", err)
+	}
+	if task.Id == 0 {
+		return Task{}, ErrNoRecord
+	}
+	return task, nil
+}
+
+// GetTaskBySession returns the current task of userId,
+// which is running until it has an elapsed time
+func (k *KVStore) GetTaskBySession(userId int) (Task, error) {
+
+	var task Task
+
+	err := k.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(kvSessions).Get(kvId(userId))
+		if id == nil {
+			return nil
+		}
+		t, err := getTask(tx, id)
+		if err != nil || t == nil || t.DeletedAt != nil {
+			return err
+		}
+		task = t.task()
+		return nil
+	})
+	if err != nil {
+		return Task{}, fmt.Errorf("failed to get report: %w", err)
+	}
+	return task, nil
+}
+
+// CountRunning counts the running tasks of all users
+func (k *KVStore) CountRunning() (int, error) {
+
+	var count int
+
+	err := k.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(kvSessions).ForEach(func(_, id []byte) error {
+			t, err := getTask(tx, id)
+			if err == nil && t != nil && t.DeletedAt == nil && t.ElapsedTimeSec == 0 {
+				count++
+			}
+			return err
+		})
+	})
+	if err != nil {
+		return 0, fmt.Errorf("unable to count running tasks: %w", err)
+	}
+	return count, nil
+}
+
+// GetReport returns the total time of each task
+// name userId may see, from the totals kept on
+// every write
+func (k *KVStore) GetReport(userId int) ([]Report, error) {
+
+	var reports []Report
+
+	err := k.db.View(func(tx *bolt.Tx) error {
+		prefix := kvId(userId)
+		c := tx.Bucket(kvTotals).Cursor()
+		for key, v := c.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, v = c.Next() {
+			var total kvTotal
+			err := json.Unmarshal(v, &total)
+			if err != nil {
+				return err
+			}
+			reports = append(reports, Report{Task: string(key[len(prefix):]), TotalTime: total.Total})
+		}
+		return nil
+	})
+	if err != nil {
+		return []Report{}, fmt.Errorf("failed to get report: %w", err)
+	}
+
+	sort.SliceStable(reports, func(i, j int) bool {
+		return reports[i].TotalTime > reports[j].TotalTime
+	})
+	return reports, nil
+}
+
+// GetLatest returns the most recently started
+// tasks userId may see
+func (k *KVStore) GetLatest(userId int) ([]Task, error) {
+
+	page, err := k.List(ListOptions{Limit: LATEST_LIMIT, Sort: ListSortStart, Desc: true, UserId: userId})
+	if err != nil {
+		return []Task{}, err
+	}
+	return page.Tasks, nil
+}
+
+// List returns a page of tasks by walking the index
+// of the sort from just past the cursor.  One extra
+// task is read to find out whether there is a next
+// page.  One user's tasks by name are walked in
+// their part of the per user name index.
+func (k *KVStore) List(opts ListOptions) (TaskPage, error) {
+
+	index, ok := kvIndexes[opts.Sort]
+	if !ok {
+		opts.Sort, index = ListSortStart, kvByStart
+	}
+
+	var user []byte
+	if opts.Sort == ListSortName && opts.UserId != ALL_USERS {
+		index, user = kvByUserName, kvId(opts.UserId)
+	}
+
+	var after []byte
+	if opts.Cursor != nil {
+		after = kvCursorKey(opts.Sort, *opts.Cursor)
+	}
+	prefix := strings.ToLower(opts.NamePrefix)
+
+	var tasks []Task
+
+	err := k.db.View(func(tx *bolt.Tx) error {
+		return walkIndex(tx, index, user, after, opts.Desc, func(t kvTask) bool {
+			if !t.visibleTo(opts.UserId) {
+				return true
+			}
+			if prefix != "" && !strings.HasPrefix(strings.ToLower(t.Name), prefix) {
+				return true
+			}
+			tasks = append(tasks, t.task())
+			return len(tasks) <= opts.Limit
+		})
+	})
+	if err != nil {
+		return TaskPage{}, fmt.Errorf("failed to list tasks: %w", err)
+	}
+
+	page := TaskPage{Tasks: tasks}
+	if len(tasks) > opts.Limit {
+		page.Tasks = tasks[:opts.Limit]
+		page.Next = NewCursor(opts.Sort, page.Tasks[opts.Limit-1]).Encode()
+	}
+	return page, nil
+}
+
+// GetRecentNames returns up to limit distinct names
+// of the tasks userId may see, most recently started
+// first
+func (k *KVStore) GetRecentNames(userId, limit int) ([]string, error) {
+
+	var names []string
+	if limit < 1 {
+		return names, nil
+	}
+	seen := map[string]bool{}
+
+	err := k.db.View(func(tx *bolt.Tx) error {
+		return walkIndex(tx, kvByStart, nil, nil, true, func(t kvTask) bool {
+			if t.visibleTo(userId) && !seen[t.Name] {
+				seen[t.Name] = true
+				names = append(names, t.Name)
+			}
+			return len(names) < limit
+		})
+	})
+	if err != nil {
+		return []string{}, fmt.Errorf("failed to get recent names: %w", err)
+	}
+	return names, nil
+}
+
+// GetAll returns every task, oldest first
+func (k *KVStore) GetAll() ([]Task, error) {
+
+	var tasks []Task
+
+	err := k.db.View(func(tx *bolt.Tx) error {
+		return walkIndex(tx, kvByStart, nil, nil, false, func(t kvTask) bool {
+			tasks = append(tasks, t.task())
+			return true
+		})
+	})
+	if err != nil {
+		return []Task{}, fmt.Errorf("failed to get tasks: %w", err)
+	}
+	return tasks, nil
+}
+
+// Search matches every word of the query against the
+// words of task names and notes over the date range.
+// The rank is the share of a task's words that match.
+func (k *KVStore) Search(q SearchQuery) ([]SearchResult, error) {
+
+	terms := searchWords(q.Text)
+	if len(terms) == 0 {
+		return []SearchResult{}, nil
+	}
+
+	var results []SearchResult
+
+	err := k.db.View(func(tx *bolt.Tx) error {
+		return walkRange(tx, q.From, q.until(), func(t kvTask) {
+			if !t.visibleTo(q.UserId) {
+				return
+			}
+			if rank, ok := searchRank(terms, searchWords(t.Name+" "+t.Notes)); ok {
+				results = append(results, SearchResult{Task: t.task(), Rank: rank})
+			}
+		})
+	})
+	if err != nil {
+		return []SearchResult{}, fmt.Errorf("failed to search: %w", err)
+	}
+
+	// the walk is oldest first, so reverse it
+	// before the stable sort by rank
+	for i, j := 0, len(results)-1; i < j; i, j = i+1, j-1 {
+		results[i], results[j] = results[j], results[i]
+	}
+	if q.Sort != SearchSortTime {
+		sort.SliceStable(results, func(i, j int) bool {
+			return results[i].Rank > results[j].Rank
+		})
+	}
+	if len(results) > q.Limit {
+		results = results[:q.Limit]
+	}
+	return results, nil
+}
+
+// searchWords splits text into lower case words
+func searchWords(text string) []string {
+
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// searchRank is the share of words that are one of
+// terms, or false if any term is missing
+func searchRank(terms, words []string) (float64, bool) {
+
+	var hits int
+	for _, term := range terms {
+		n := 0
+		for _, word := range words {
+			if word == term {
+				n++
+			}
+		}
+		if n == 0 {
+			return 0, false
+		}
+		hits += n
+	}
+	return float64(hits) / float64(len(words)), true
+}
+
+// GetCompleted returns the stopped tasks matching
+// filter, oldest first
+func (k *KVStore) GetCompleted(filter TaskFilter) ([]Task, error) {
+
+	var tasks []Task
+
+	err := k.db.View(func(tx *bolt.Tx) error {
+		return walkRange(tx, filter.From, filter.until(), func(t kvTask) {
+			if t.ElapsedTimeSec <= 0 || !t.visibleTo(filter.UserId) {
+				return
+			}
+			if filter.Project != "" && t.Project != filter.Project {
+				return
+			}
+			if filter.Tag != "" && !containsString(t.Tags, filter.Tag) {
+				return
+			}
+			tasks = append(tasks, t.task())
+		})
+	})
+	if err != nil {
+		return []Task{}, fmt.Errorf("failed to get completed tasks: %w", err)
+	}
+	return tasks, nil
+}
+
+// visibleTo reports whether userId may see t
+func (t kvTask) visibleTo(userId int) bool {
+	return userId == ALL_USERS || t.UserId == userId
+}
+
+// pausedSec is how long t has been paused as at
+// now, counting a pause that has not ended yet
+func (t kvTask) pausedSec(now time.Time) float64 {
+
+	if t.PausedAt == nil {
+		return t.PausedSec
+	}
+	return t.PausedSec + now.Sub(*t.PausedAt).Seconds()
+}
+
+func (t kvTask) task() Task {
+
+	return Task{
+		Id:             t.Id,
+		UserId:         t.UserId,
+		Name:           t.Name,
+		Project:        t.Project,
+		Tags:           t.Tags,
+		Notes:          t.Notes,
+		Paused:         t.PausedAt != nil,
+		StartTime:      t.StartTime,
+		ElapsedTimeSec: t.ElapsedTimeSec,
+	}
+}
+
+// indexKeys are the keys of t in each index bucket.
+// Deleted tasks are in none.
+func (t kvTask) indexKeys() map[string][]byte {
+
+	if t.DeletedAt != nil {
+		return nil
+	}
+	return map[string][]byte{
+		string(kvByStart):    kvStartKey(t.StartTime, t.Id),
+		string(kvByName):     kvNameKey(t.Name, t.Id),
+		string(kvByUserName): kvUserKey(t.UserId, kvNameKey(t.Name, t.Id)),
+		string(kvByDuration): kvDurationKey(t.ElapsedTimeSec, t.Id),
+	}
+}
+
+func getTask(tx *bolt.Tx, id []byte) (*kvTask, error) {
+
+	v := tx.Bucket(kvTasks).Get(id)
+	if v == nil {
+		return nil, nil
+	}
+
+	var t kvTask
+	err := json.Unmarshal(v, &t)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read task %d: %w", binary.BigEndian.Uint64(id), err)
+	}
+	return &t, nil
+}
+
+// updateTask changes the task with id, if there is one
+func updateTask(tx *bolt.Tx, id []byte, change func(*kvTask)) error {
+
+	old, err := getTask(tx, id)
+	if err != nil || old == nil {
+		return err
+	}
+
+	t := *old
+	change(&t)
+	return putTask(tx, old, t)
+}
+
+// putTask saves t, moving it in the indexes and
+// totals from where old, its previous version, was
+func putTask(tx *bolt.Tx, old *kvTask, t kvTask) error {
+
+	if old != nil {
+		for bucket, key := range old.indexKeys() {
+			err := tx.Bucket([]byte(bucket)).Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+		if old.DeletedAt == nil {
+			err := addTotals(tx, *old, -old.ElapsedTimeSec, -1)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for bucket, key := range t.indexKeys() {
+		err := tx.Bucket([]byte(bucket)).Put(key, []byte{})
+		if err != nil {
+			return err
+		}
+	}
+	if t.DeletedAt == nil {
+		err := addTotals(tx, t, t.ElapsedTimeSec, 1)
+		if err != nil {
+			return err
+		}
+	}
+
+	v, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(kvTasks).Put(kvId(t.Id), v)
+}
+
+func getTotal(tx *bolt.Tx, userId int, name string) (kvTotal, error) {
+
+	var total kvTotal
+	v := tx.Bucket(kvTotals).Get(kvUserKey(userId, []byte(name)))
+	if v == nil {
+		return total, nil
+	}
+	err := json.Unmarshal(v, &total)
+	return total, err
+}
+
+// addTotals adds elapsed to the totals of the name
+// of t, for its user and for every user
+func addTotals(tx *bolt.Tx, t kvTask, elapsed float64, count int) error {
+
+	for _, userId := range []int{ALL_USERS, t.UserId} {
+		err := addTotal(tx, userId, t.Name, elapsed, count)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addTotal adds elapsed to the total of name for
+// userId, dropping the total once no task has the name
+func addTotal(tx *bolt.Tx, userId int, name string, elapsed float64, count int) error {
+
+	total, err := getTotal(tx, userId, name)
+	if err != nil {
+		return err
+	}
+	total.Total += elapsed
+	total.Count += count
+
+	key := kvUserKey(userId, []byte(name))
+	if total.Count <= 0 {
+		return tx.Bucket(kvTotals).Delete(key)
+	}
+	v, err := json.Marshal(total)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(kvTotals).Put(key, v)
+}
+
+// reindexKV rebuilds the totals and the per user name
+// index from the tasks, for files of an older version
+func reindexKV(tx *bolt.Tx) error {
+
+	for _, name := range [][]byte{kvTotals, kvByUserName} {
+		err := tx.DeleteBucket(name)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucket(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Bucket(kvTasks).ForEach(func(id, _ []byte) error {
+		t, err := getTask(tx, id)
+		if err != nil || t.DeletedAt != nil {
+			return err
+		}
+		err = tx.Bucket(kvByUserName).Put(kvUserKey(t.UserId, kvNameKey(t.Name, t.Id)), []byte{})
+		if err != nil {
+			return err
+		}
+		return addTotals(tx, *t, t.ElapsedTimeSec, 1)
+	})
+}
+
+// walkIndex calls fn with each task in index order
+// whose key starts with prefix, starting just past
+// the key prefix+after, until fn returns false
+func walkIndex(tx *bolt.Tx, index, prefix, after []byte, desc bool, fn func(kvTask) bool) error {
+
+	c := tx.Bucket(index).Cursor()
+
+	if after != nil {
+		after = append(append([]byte{}, prefix...), after...)
+	} else if desc {
+		after = kvPrefixEnd(prefix)
+	}
+
+	var k []byte
+	switch {
+	case after == nil && desc:
+		k, _ = c.Last()
+	case after == nil && prefix == nil:
+		k, _ = c.First()
+	case after == nil:
+		k, _ = c.Seek(prefix)
+	case desc:
+		// Seek finds the first key at or past after,
+		// so the one before it is the first one below
+		k, _ = c.Seek(after)
+		if k == nil {
+			k, _ = c.Last()
+		} else {
+			k, _ = c.Prev()
+		}
+	default:
+		k, _ = c.Seek(after)
+		if bytes.Equal(k, after) {
+			k, _ = c.Next()
+		}
+	}
+
+	for ; k != nil && bytes.HasPrefix(k, prefix); k = kvStep(c, desc) {
+		t, err := getTask(tx, k[len(k)-8:])
+		if err != nil {
+			return err
+		}
+		if t == nil {
+			return fmt.Errorf("index %s names missing task %d", index, binary.BigEndian.Uint64(k[len(k)-8:]))
+		}
+		if !fn(*t) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func kvStep(c *bolt.Cursor, desc bool) []byte {
+	if desc {
+		k, _ := c.Prev()
+		return k
+	}
+	k, _ := c.Next()
+	return k
+}
+
+// walkRange calls fn with each task started in
+// [from, until), oldest first
+func walkRange(tx *bolt.Tx, from, until time.Time, fn func(kvTask)) error {
+
+	end := kvStartKey(until, 0)
+	c := tx.Bucket(kvByStart).Cursor()
+
+	for k, _ := c.Seek(kvStartKey(from, 0)); k != nil && bytes.Compare(k, end) < 0; k, _ = c.Next() {
+		t, err := getTask(tx, k[len(k)-8:])
+		if err != nil {
+			return err
+		}
+		if t != nil {
+			fn(*t)
+		}
+	}
+	return nil
+}
+
+// kvId is id as a key that sorts in numeric order
+func kvId(id int) []byte {
+
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(id))
+	return b
+}
+
+// kvUserKey is key in the part of a per user
+// bucket that belongs to userId
+func kvUserKey(userId int, key []byte) []byte {
+	return append(kvId(userId), key...)
+}
+
+// kvPrefixEnd is the first key past every key
+// starting with prefix, or nil when there is none
+func kvPrefixEnd(prefix []byte) []byte {
+
+	end := append([]byte{}, prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i]++
+		if end[i] != 0 {
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// kvStartKey sorts by start time to the nanosecond.
+// Seconds and nanoseconds are kept apart so that the
+// zero time and searchForever fit, and the sign bit is
+// flipped so times before 1970 sort before later ones.
+func kvStartKey(start time.Time, id int) []byte {
+
+	b := make([]byte, 20)
+	binary.BigEndian.PutUint64(b, uint64(start.Unix())^(1<<63))
+	binary.BigEndian.PutUint32(b[8:], uint32(start.Nanosecond()))
+	binary.BigEndian.PutUint64(b[12:], uint64(id))
+	return b
+}
+
+// kvNameKey sorts by name.  The zero byte after the
+// name sorts a name before the longer names it is a
+// prefix of.
+func kvNameKey(name string, id int) []byte {
+
+	b := make([]byte, 0, len(name)+9)
+	b = append(b, name...)
+	b = append(b, 0)
+	return append(b, kvId(id)...)
+}
+
+// kvDurationKey sorts by elapsed time, using the
+// order preserving encoding of IEEE 754 floats
+func kvDurationKey(elapsed float64, id int) []byte {
+
+	bits := math.Float64bits(elapsed)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, bits)
+	binary.BigEndian.PutUint64(b[8:], uint64(id))
+	return b
+}
+
+// kvCursorKey is the index key of the task
+// a cursor points at
+func kvCursorKey(sort string, c Cursor) []byte {
+
+	switch sort {
+	case ListSortName:
+		return kvNameKey(c.Name, c.Id)
+	case ListSortDuration:
+		return kvDurationKey(c.Duration, c.Id)
+	default:
+		return kvStartKey(c.Start, c.Id)
+	}
+}
@@ -0,0 +1,184 @@
+package timetracker_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"timetracker"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func newKVStore(t *testing.T, path string) *timetracker.KVStore {
+	t.Helper()
+
+	store, err := timetracker.NewKVStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestKVStoreReopen(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "timetracker.kv")
+
+	store, err := timetracker.NewKVStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"piano", "swim"} {
+		_, err := store.CreateCompleted(timetracker.Task{Name: name, StartTime: time.Now(), ElapsedTimeSec: 60})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	store = newKVStore(t, path)
+
+	report, err := store.GetReport(timetracker.ALL_USERS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report) != 2 {
+		t.Errorf("want: both tasks kept, got: %+v", report)
+	}
+
+	id, err := store.Create(timetracker.Task{Name: "read", StartTime: time.Now()})
+	if err != nil || id != 3 {
+		t.Errorf("want: ids to carry on at 3, got: %d, %v", id, err)
+	}
+
+	ctx := context.Background()
+	if err := store.Ping(ctx); err != nil {
+		t.Error(err)
+	}
+	if err := store.CheckSchema(ctx); err != nil {
+		t.Error(err)
+	}
+
+	_, err = timetracker.NewKVStore("")
+	if err == nil {
+		t.Error("empty path: want: error, got: nil")
+	}
+
+}
+
+func TestKVStoreMigratesVersion1(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "timetracker.kv")
+
+	store, err := timetracker.NewKVStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, task := range []timetracker.Task{
+		{Name: "piano", ElapsedTimeSec: 60},
+		{Name: "piano", ElapsedTimeSec: 30, UserId: 2},
+	} {
+		task.StartTime = time.Now()
+		_, err := store.CreateCompleted(task)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	// version 1 kept one total a name and
+	// had no per user name index
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{"totals", "tasks_by_user_name"} {
+			if err := tx.DeleteBucket([]byte(name)); err != nil {
+				return err
+			}
+		}
+		totals, err := tx.CreateBucket([]byte("totals"))
+		if err != nil {
+			return err
+		}
+		if err := totals.Put([]byte("piano"), []byte(`{"total":90,"count":2}`)); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte("meta")).Put([]byte("version"), []byte("1"))
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store = newKVStore(t, path)
+
+	for userId, want := range map[int]float64{timetracker.ALL_USERS: 90, timetracker.LOCAL_USER_ID: 60, 2: 30} {
+		report, err := store.GetReport(userId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report) != 1 || report[0].TotalTime != want {
+			t.Errorf("user %d: want: piano for %.0fs, got: %+v", userId, want, report)
+		}
+	}
+
+	page, err := store.List(timetracker.ListOptions{Limit: 10, Sort: timetracker.ListSortName, UserId: 2})
+	if err != nil || len(page.Tasks) != 1 {
+		t.Errorf("want: user 2's task by name, got: %+v, %v", page.Tasks, err)
+	}
+
+}
+
+func TestWithKVStore(t *testing.T) {
+	t.Parallel()
+
+	s := timetracker.NewServer(
+		timetracker.WithNoLogging(),
+		timetracker.WithNoWebhooks(),
+		timetracker.WithKVStore(filepath.Join(t.TempDir(), "timetracker.kv")),
+	)
+	err := s.LoadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+
+	b := newBrowser(t, ts)
+
+	b.post("/task/started", url.Values{"task": {"deploy"}, "project": {"ops"}})
+	b.post("/task/notes", url.Values{"notes": {"rolling"}})
+	b.post("/task/stop", url.Values{})
+
+	_, body := b.get("/task/history")
+	if !strings.Contains(body, "deploy") {
+		t.Error("want: stopped task in history")
+	}
+
+	if code, _ := b.get("/readyz"); code != http.StatusOK {
+		t.Errorf("readyz: want: 200, got: %d", code)
+	}
+
+	// only tasks are kept in the kv store, so
+	// the other pages fall through to home
+	for path, page := range map[string]string{
+		"/goal":     "New Goal",
+		"/template": "New Template",
+		"/import":   "Calendar file",
+		"/audit":    "Audit Log",
+	} {
+		if _, body := b.get(path); strings.Contains(body, page) {
+			t.Errorf("%s: want: not served", path)
+		}
+	}
+
+}
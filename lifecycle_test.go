@@ -0,0 +1,244 @@
+package timetracker_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"timetracker"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// serve starts s on a free port and returns its
+// address and the channel Serve's result arrives on
+func serve(t *testing.T, ctx context.Context, s *timetracker.Server) (string, <-chan error) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- s.Serve(ctx, l)
+	}()
+
+	addr := l.Addr().String()
+	timetracker.WaitForServerRoute(addr, nil)
+
+	return addr, result
+}
+
+// slowRequest sends a POST whose body is still being
+// written, so the request is in flight until the
+// returned function finishes the body
+func slowRequest(t *testing.T, addr string) (finish func(), response <-chan error) {
+
+	pr, pw := io.Pipe()
+
+	req, err := http.NewRequest(http.MethodPost, "http://"+addr+"/goal/create", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	done := make(chan error, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		done <- err
+	}()
+
+	pw.Write([]byte("name=pi"))
+
+	// give the server time to read the headers
+	time.Sleep(200 * time.Millisecond)
+
+	return func() {
+		pw.Write([]byte("ano"))
+		pw.Close()
+	}, done
+}
+
+func newMockStore(t *testing.T) (*timetracker.DBStore, sqlmock.Sqlmock) {
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return &timetracker.DBStore{Db: db}, mock
+}
+
+func TestServeDrainsRequestsAndClosesStore(t *testing.T) {
+
+	t.Parallel()
+
+	store, mock := newMockStore(t)
+	mock.ExpectClose()
+
+	s := timetracker.NewServer(
+		timetracker.WithNoLogging(),
+		timetracker.WithDBStore(store),
+		timetracker.WithShutdownTimeout(5*time.Second),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	addr, result := serve(t, ctx, s)
+
+	finish, response := slowRequest(t, addr)
+
+	cancel()
+
+	// the server waits for the request in flight
+	select {
+	case err := <-result:
+		t.Fatalf("Serve returned with a request in flight: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// new connections are refused while draining
+	if _, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		t.Error("want: new connections refused, got accepted")
+	}
+
+	finish()
+
+	if err := <-response; err != nil {
+		t.Errorf("in-flight request failed: %s", err)
+	}
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("want: nil, got: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("store not closed: %s", err)
+	}
+
+}
+
+func TestServeShutdownTimeout(t *testing.T) {
+
+	t.Parallel()
+
+	store, mock := newMockStore(t)
+	mock.ExpectClose()
+
+	s := timetracker.NewServer(
+		timetracker.WithNoLogging(),
+		timetracker.WithDBStore(store),
+		timetracker.WithShutdownTimeout(100*time.Millisecond),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	addr, result := serve(t, ctx, s)
+
+	finish, response := slowRequest(t, addr)
+
+	cancel()
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("want: deadline exceeded, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not give up after the shutdown timeout")
+	}
+
+	finish()
+
+	if err := <-response; err == nil {
+		t.Error("want: request cut off, got response")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("store not closed: %s", err)
+	}
+
+}
+
+// TestServeSignal is not parallel: SIGTERM goes
+// to the whole test process
+func TestServeSignal(t *testing.T) {
+
+	s := timetracker.NewServer(timetracker.WithNoLogging())
+
+	addr, result := serve(t, context.Background(), s)
+
+	// the listener accepts before Serve is watching for
+	// signals, so wait for an answer from the server
+	for {
+		resp, err := http.Get("http://" + addr + "/healthz")
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err := syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("want: nil, got: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not stop on SIGTERM")
+	}
+
+}
+
+func TestRunReturnsErrors(t *testing.T) {
+
+	t.Parallel()
+
+	s := timetracker.NewServer(timetracker.WithNoLogging(), timetracker.WithShutdownTimeout(0))
+
+	err := s.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "shutdown timeout") {
+		t.Errorf("want: option error, got: %v", err)
+	}
+
+	// the port is taken
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	store, mock := newMockStore(t)
+	mock.ExpectClose()
+
+	port := l.Addr().(*net.TCPAddr).Port
+	s = timetracker.NewServer(timetracker.WithNoLogging(), timetracker.WithPort(port), timetracker.WithDBStore(store))
+
+	err = s.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "unable to listen") {
+		t.Errorf("want: listen error, got: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("store not closed after listen error: %s", err)
+	}
+
+}
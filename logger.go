@@ -0,0 +1,262 @@
+package timetracker
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+const (
+	LogFormatLogfmt string = "logfmt"
+	LogFormatJSON   string = "json"
+
+	RequestIdHeader string = "X-Request-Id"
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// ParseLevel reads debug, info, warn or error
+func ParseLevel(s string) (Level, error) {
+	for level, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level: %q", s)
+}
+
+// Logger writes one structured entry per line in
+// logfmt or JSON.  Fields are key value pairs.
+type Logger struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	level  Level
+	format string
+	fields []interface{}
+	now    func() time.Time
+}
+
+// NewLogger returns a Logger that drops entries
+// below level
+func NewLogger(out io.Writer, level Level, format string) (*Logger, error) {
+
+	if format != LogFormatLogfmt && format != LogFormatJSON {
+		return nil, fmt.Errorf("unknown log format: %q", format)
+	}
+
+	return &Logger{
+		mu:     &sync.Mutex{},
+		out:    out,
+		level:  level,
+		format: format,
+		now:    time.Now,
+	}, nil
+}
+
+// DiscardLogger drops every entry
+func DiscardLogger() *Logger {
+	l, _ := NewLogger(io.Discard, LevelError, LogFormatLogfmt)
+	return l
+}
+
+// With returns a Logger that adds fields to every entry
+func (l *Logger) With(fields ...interface{}) *Logger {
+	child := *l
+	child.fields = append(append([]interface{}{}, l.fields...), fields...)
+	return &child
+}
+
+func (l *Logger) Debug(msg string, fields ...interface{}) { l.log(LevelDebug, msg, fields) }
+func (l *Logger) Info(msg string, fields ...interface{})  { l.log(LevelInfo, msg, fields) }
+func (l *Logger) Warn(msg string, fields ...interface{})  { l.log(LevelWarn, msg, fields) }
+func (l *Logger) Error(msg string, fields ...interface{}) { l.log(LevelError, msg, fields) }
+
+func (l *Logger) log(level Level, msg string, fields []interface{}) {
+
+	if level < l.level {
+		return
+	}
+
+	kv := append([]interface{}{"time", l.now().UTC().Format(time.RFC3339Nano), "level", level.String(), "msg", msg}, l.fields...)
+	kv = append(kv, fields...)
+	if len(kv)%2 != 0 {
+		kv = append(kv, "(missing)")
+	}
+
+	var b bytes.Buffer
+	if l.format == LogFormatJSON {
+		writeJSONEntry(&b, kv)
+	} else {
+		writeLogfmtEntry(&b, kv)
+	}
+	b.WriteByte('\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(b.Bytes())
+}
+
+// fieldValue turns errors and Stringers into text
+// and leaves everything else to the encoder
+func fieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func writeJSONEntry(b *bytes.Buffer, kv []interface{}) {
+
+	b.WriteByte('{')
+	for i := 0; i < len(kv); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(fmt.Sprint(kv[i]))
+		b.Write(key)
+		b.WriteByte(':')
+
+		value, err := json.Marshal(fieldValue(kv[i+1]))
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(kv[i+1]))
+		}
+		b.Write(value)
+	}
+	b.WriteByte('}')
+}
+
+func writeLogfmtEntry(b *bytes.Buffer, kv []interface{}) {
+
+	for i := 0; i < len(kv); i += 2 {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(fmt.Sprint(kv[i]))
+		b.WriteByte('=')
+
+		value := fmt.Sprint(fieldValue(kv[i+1]))
+		if value == "" || strings.ContainsAny(value, " =\"\\\n\t") {
+			value = strconv.Quote(value)
+		}
+		b.WriteString(value)
+	}
+}
+
+// StdLogger adapts the Logger for APIs that take a
+// *log.Logger, such as http.Server.ErrorLog
+func (l *Logger) StdLogger(level Level) *log.Logger {
+	return log.New(stdWriter{logger: l, level: level}, "", 0)
+}
+
+type stdWriter struct {
+	logger *Logger
+	level  Level
+}
+
+func (w stdWriter) Write(p []byte) (int, error) {
+	w.logger.log(w.level, strings.TrimSpace(string(p)), nil)
+	return len(p), nil
+}
+
+type loggerKey struct{}
+
+// LoggerFrom returns the request scoped Logger set by
+// the access log middleware, or a default one
+func LoggerFrom(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+		return l
+	}
+	l, _ := NewLogger(os.Stderr, LevelInfo, LogFormatLogfmt)
+	return l
+}
+
+// newRequestId returns 16 hex characters
+func newRequestId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// AccessLog logs one entry per request and gives each
+// request an id.  A well formed incoming X-Request-Id
+// is kept so ids can be followed across services.
+func AccessLog(logger *Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		id := r.Header.Get(RequestIdHeader)
+		if !validRequestId(id) {
+			id = newRequestId()
+		}
+		w.Header().Set(RequestIdHeader, id)
+
+		rl := logger.With("request_id", id)
+		r = r.WithContext(context.WithValue(r.Context(), loggerKey{}, rl))
+
+		sr := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+
+		next.ServeHTTP(sr, r)
+
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+
+		rl.Info("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", sr.status,
+			"bytes", sr.bytes,
+			"latency", time.Since(start),
+		)
+	})
+}
+
+func validRequestId(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,203 @@
+package timetracker_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"timetracker"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestLoggerJSON(t *testing.T) {
+
+	t.Parallel()
+
+	var buf bytes.Buffer
+	logger, err := timetracker.NewLogger(&buf, timetracker.LevelInfo, timetracker.LogFormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger.Debug("dropped")
+	logger.With("request_id", "abc").Error("store failed", "err", errors.New("disk full"), "attempts", 3, "latency", 1500*time.Millisecond)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("want: 1 entry, got: %d\n%s", len(lines), buf.String())
+	}
+
+	var entry map[string]interface{}
+	err = json.Unmarshal([]byte(lines[0]), &entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]interface{}{
+		"level":      "error",
+		"msg":        "store failed",
+		"request_id": "abc",
+		"err":        "disk full",
+		"attempts":   3.0,
+		"latency":    "1.5s",
+	}
+	for k, v := range want {
+		if entry[k] != v {
+			t.Errorf("%s: want: %v, got: %v", k, v, entry[k])
+		}
+	}
+	if _, err := time.Parse(time.RFC3339Nano, entry["time"].(string)); err != nil {
+		t.Errorf("time: %s", err)
+	}
+
+}
+
+func TestLoggerLogfmt(t *testing.T) {
+
+	t.Parallel()
+
+	var buf bytes.Buffer
+	logger, err := timetracker.NewLogger(&buf, timetracker.LevelDebug, timetracker.LogFormatLogfmt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger.Debug("task stopped", "task", "piano practice", "seconds", 90, "notes", `say "hi"`, "empty", "")
+
+	got := strings.TrimSpace(buf.String())
+	want := `level=debug msg="task stopped" task="piano practice" seconds=90 notes="say \"hi\"" empty=""`
+	if !strings.HasSuffix(got, want) || !strings.HasPrefix(got, "time=") {
+		t.Errorf("want: time=... %s, got: %s", want, got)
+	}
+
+	_, err = timetracker.NewLogger(&buf, timetracker.LevelDebug, "xml")
+	if err == nil {
+		t.Error("want: error for unknown format, got nil")
+	}
+
+	level, err := timetracker.ParseLevel("WARN")
+	if err != nil || level != timetracker.LevelWarn {
+		t.Errorf("want: warn, got: %v %v", level, err)
+	}
+
+}
+
+func TestAccessLog(t *testing.T) {
+
+	t.Parallel()
+
+	var buf bytes.Buffer
+	logger, _ := timetracker.NewLogger(&buf, timetracker.LevelInfo, timetracker.LogFormatJSON)
+
+	h := timetracker.AccessLog(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timetracker.LoggerFrom(r.Context()).Warn("inside handler")
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("short and stout"))
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "/task/stop?x=1", nil)
+	req.Header.Set(timetracker.RequestIdHeader, "upstream-42")
+	rec := httptest.NewRecorder()
+
+	h.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get(timetracker.RequestIdHeader); got != "upstream-42" {
+		t.Errorf("want: upstream-42, got: %q", got)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("want: 2 entries, got: %d\n%s", len(lines), buf.String())
+	}
+
+	var inside, access map[string]interface{}
+	json.Unmarshal([]byte(lines[0]), &inside)
+	json.Unmarshal([]byte(lines[1]), &access)
+
+	if inside["request_id"] != "upstream-42" {
+		t.Errorf("handler entry request_id: want: upstream-42, got: %v", inside["request_id"])
+	}
+
+	want := map[string]interface{}{
+		"msg":        "request",
+		"request_id": "upstream-42",
+		"method":     "POST",
+		"path":       "/task/stop",
+		"status":     418.0,
+		"bytes":      15.0,
+	}
+	for k, v := range want {
+		if access[k] != v {
+			t.Errorf("%s: want: %v, got: %v", k, v, access[k])
+		}
+	}
+	if _, ok := access["latency"]; !ok {
+		t.Error("latency missing")
+	}
+
+	// malformed incoming ids are replaced
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(timetracker.RequestIdHeader, "bad id\nwith newline")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get(timetracker.RequestIdHeader); len(got) != 16 {
+		t.Errorf("want: generated 16 character id, got: %q", got)
+	}
+
+}
+
+func TestDBStoreErrorsWrap(t *testing.T) {
+
+	t.Parallel()
+
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	store := &timetracker.DBStore{Db: db}
+
+	cause := errors.New("connection reset")
+	mock.ExpectQuery(timetracker.SQLReport).WillReturnError(cause)
+
+	_, err = store.GetReport(timetracker.ALL_USERS)
+	if !errors.Is(err, cause) {
+		t.Errorf("want: error wrapping %q, got: %v", cause, err)
+	}
+
+}
+
+func TestServerLogLevel(t *testing.T) {
+
+	t.Parallel()
+
+	for _, tc := range []struct {
+		level   string
+		wantErr string
+	}{
+		{level: "quiet", wantErr: "unknown command"},
+		{level: "verbose", wantErr: "unknown command"},
+		{level: "warn", wantErr: "unknown command"},
+		{level: "loud", wantErr: "invalid LogLevel"},
+	} {
+		level := func(s *timetracker.Server) error {
+			s.LogLevel = tc.level
+			return nil
+		}
+		s := timetracker.NewServer(level)
+
+		err := s.RunCommand([]string{"no-such-command"}, io.Discard)
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s: want: error %q, got: %v", tc.level, tc.wantErr, err)
+		}
+	}
+
+}
@@ -0,0 +1,447 @@
+package timetracker
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// METRICS_BUCKETS are the latency histogram upper
+// bounds in seconds, the Prometheus client defaults
+var METRICS_BUCKETS = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics collects request and store measurements and
+// writes them in the Prometheus text exposition format.
+// Tracked seconds are one total unless TaskLabels is
+// set, when they are labelled with task names.
+type Metrics struct {
+	TaskLabels bool
+
+	mu          sync.Mutex
+	requests    map[[3]string]float64
+	latency     map[string]*histogram
+	storeCalls  map[string]*histogram
+	storeErrors map[string]float64
+	store       TaskStore
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(seconds float64) {
+	for i, le := range METRICS_BUCKETS {
+		if seconds <= le {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// NewMetrics reads running timers and tracked time
+// from store at each scrape
+func NewMetrics(store TaskStore) *Metrics {
+	return &Metrics{
+		requests:    map[[3]string]float64{},
+		latency:     map[string]*histogram{},
+		storeCalls:  map[string]*histogram{},
+		storeErrors: map[string]float64{},
+		store:       store,
+	}
+}
+
+func observe(histograms map[string]*histogram, key string, d time.Duration) {
+	h, ok := histograms[key]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(METRICS_BUCKETS))}
+		histograms[key] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// ObserveRequest records one request to a route pattern
+func (m *Metrics) ObserveRequest(route, method string, code int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[[3]string{route, method, strconv.Itoa(code)}]++
+	observe(m.latency, route, d)
+}
+
+// ObserveStoreCall records one store method call.
+// ErrNoRecord is a lookup miss, not a failure.
+func (m *Metrics) ObserveStoreCall(method string, d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	observe(m.storeCalls, method, d)
+	if err != nil && !errors.Is(err, ErrNoRecord) {
+		m.storeErrors[method]++
+	}
+}
+
+// statusRecorder keeps the status code and size
+// of a response for instrumentation
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if sr.status == 0 {
+		sr.status = code
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += n
+	return n, err
+}
+
+func (sr *statusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Middleware labels each request with the mux
+// pattern it matches, so paths with ids or query
+// strings share a route
+func (m *Metrics) Middleware(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+
+		sr := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+
+		mux.ServeHTTP(sr, r)
+
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+		m.ObserveRequest(route, r.Method, sr.status, time.Since(start))
+	})
+}
+
+// serveMetrics serves the server's Metrics, only to
+// requests with the metrics token when one is set
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+
+	if s.metricsToken != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.metricsToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="timetracker"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	s.metrics.ServeHTTP(w, r)
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	err := m.Write(w)
+	if err != nil {
+		LoggerFrom(r.Context()).Error("writing metrics", "err", err)
+	}
+}
+
+// Write writes every metric.  Timers and tracked
+// seconds are read from the store at call time.
+func (m *Metrics) Write(out io.Writer) error {
+
+	running, tracked, storeErr := m.fromStore()
+
+	w := bufio.NewWriter(out)
+
+	m.mu.Lock()
+
+	fmt.Fprintln(w, "# HELP timetracker_http_requests_total Requests handled, by route pattern, method and status code.")
+	fmt.Fprintln(w, "# TYPE timetracker_http_requests_total counter")
+	var keys [][3]string
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return strings.Join(keys[i][:], "\x00") < strings.Join(keys[j][:], "\x00")
+	})
+	for _, k := range keys {
+		fmt.Fprintf(w, "timetracker_http_requests_total{route=\"%s\",method=\"%s\",code=\"%s\"} %s\n",
+			escapeLabel(k[0]), escapeLabel(k[1]), k[2], formatFloat(m.requests[k]))
+	}
+
+	writeHistograms(w, "timetracker_http_request_duration_seconds", "Request latency, by route pattern.", "route", m.latency)
+	writeHistograms(w, "timetracker_store_call_duration_seconds", "TaskStore call latency, by method.", "method", m.storeCalls)
+
+	fmt.Fprintln(w, "# HELP timetracker_store_call_errors_total TaskStore calls that returned an error, by method.")
+	fmt.Fprintln(w, "# TYPE timetracker_store_call_errors_total counter")
+	for _, method := range sortedKeys(m.storeErrors) {
+		fmt.Fprintf(w, "timetracker_store_call_errors_total{method=\"%s\"} %s\n", escapeLabel(method), formatFloat(m.storeErrors[method]))
+	}
+
+	m.mu.Unlock()
+
+	if storeErr == nil {
+		fmt.Fprintln(w, "# HELP timetracker_running_timers Timers started and not yet stopped.")
+		fmt.Fprintln(w, "# TYPE timetracker_running_timers gauge")
+		fmt.Fprintf(w, "timetracker_running_timers %d\n", running)
+
+		if m.TaskLabels {
+			fmt.Fprintln(w, "# HELP timetracker_tracked_seconds Total seconds tracked, by task name.")
+			fmt.Fprintln(w, "# TYPE timetracker_tracked_seconds gauge")
+			for _, name := range sortedKeys(tracked) {
+				fmt.Fprintf(w, "timetracker_tracked_seconds{task=\"%s\"} %s\n", escapeLabel(name), formatFloat(tracked[name]))
+			}
+		} else {
+			var total float64
+			for _, seconds := range tracked {
+				total += seconds
+			}
+			fmt.Fprintln(w, "# HELP timetracker_tracked_seconds Total seconds tracked.")
+			fmt.Fprintln(w, "# TYPE timetracker_tracked_seconds gauge")
+			fmt.Fprintf(w, "timetracker_tracked_seconds %s\n", formatFloat(total))
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP timetracker_metrics_store_up Whether the store could be read for this scrape.")
+	fmt.Fprintln(w, "# TYPE timetracker_metrics_store_up gauge")
+	if storeErr == nil {
+		fmt.Fprintln(w, "timetracker_metrics_store_up 1")
+	} else {
+		fmt.Fprintln(w, "timetracker_metrics_store_up 0")
+	}
+
+	return w.Flush()
+}
+
+// fromStore reads the running timer and the
+// per task totals
+func (m *Metrics) fromStore() (int, map[string]float64, error) {
+
+	if m.store == nil {
+		return 0, nil, fmt.Errorf("no store")
+	}
+
+	running, err := m.store.CountRunning()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	reports, err := m.store.GetReport(ALL_USERS)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	tracked := map[string]float64{}
+	for _, r := range reports {
+		tracked[r.Task] += r.TotalTime
+	}
+
+	return running, tracked, nil
+}
+
+func writeHistograms(w io.Writer, name, help, label string, histograms map[string]*histogram) {
+
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+
+	var keys []string
+	for k := range histograms {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		h := histograms[k]
+		l := fmt.Sprintf("%s=\"%s\"", label, escapeLabel(k))
+		for i, le := range METRICS_BUCKETS {
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, l, formatFloat(le), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, l, h.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", name, l, formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, l, h.count)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// escapeLabel escapes a label value as the
+// exposition format requires
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// Instrument wraps store so every call is timed
+// and its errors counted
+func (m *Metrics) Instrument(store TaskStore) TaskStore {
+	return instrumentedStore{store: store, metrics: m}
+}
+
+// instrumentedStore times every TaskStore call
+type instrumentedStore struct {
+	store   TaskStore
+	metrics *Metrics
+}
+
+func (is instrumentedStore) observe(method string, start time.Time, err error) {
+	is.metrics.ObserveStoreCall(method, time.Since(start), err)
+}
+
+func (is instrumentedStore) Create(task Task) (int, error) {
+	start := time.Now()
+	id, err := is.store.Create(task)
+	is.observe("Create", start, err)
+	return id, err
+}
+
+func (is instrumentedStore) CreateCompleted(task Task) (int, error) {
+	start := time.Now()
+	id, err := is.store.CreateCompleted(task)
+	is.observe("CreateCompleted", start, err)
+	return id, err
+}
+
+func (is instrumentedStore) UpdateStopped(task Task) error {
+	start := time.Now()
+	err := is.store.UpdateStopped(task)
+	is.observe("UpdateStopped", start, err)
+	return err
+}
+
+func (is instrumentedStore) UpdateNotes(task Task) error {
+	start := time.Now()
+	err := is.store.UpdateNotes(task)
+	is.observe("UpdateNotes", start, err)
+	return err
+}
+
+func (is instrumentedStore) GetReport(userId int) ([]Report, error) {
+	start := time.Now()
+	reports, err := is.store.GetReport(userId)
+	is.observe("GetReport", start, err)
+	return reports, err
+}
+
+func (is instrumentedStore) GetLatest(userId int) ([]Task, error) {
+	start := time.Now()
+	tasks, err := is.store.GetLatest(userId)
+	is.observe("GetLatest", start, err)
+	return tasks, err
+}
+
+func (is instrumentedStore) List(opts ListOptions) (TaskPage, error) {
+	start := time.Now()
+	page, err := is.store.List(opts)
+	is.observe("List", start, err)
+	return page, err
+}
+
+func (is instrumentedStore) GetRecentNames(userId, limit int) ([]string, error) {
+	start := time.Now()
+	names, err := is.store.GetRecentNames(userId, limit)
+	is.observe("GetRecentNames", start, err)
+	return names, err
+}
+
+func (is instrumentedStore) GetAll() ([]Task, error) {
+	start := time.Now()
+	tasks, err := is.store.GetAll()
+	is.observe("GetAll", start, err)
+	return tasks, err
+}
+
+func (is instrumentedStore) Search(q SearchQuery) ([]SearchResult, error) {
+	start := time.Now()
+	results, err := is.store.Search(q)
+	is.observe("Search", start, err)
+	return results, err
+}
+
+func (is instrumentedStore) GetCompleted(filter TaskFilter) ([]Task, error) {
+	start := time.Now()
+	tasks, err := is.store.GetCompleted(filter)
+	is.observe("GetCompleted", start, err)
+	return tasks, err
+}
+
+func (is instrumentedStore) GetTask(id int) (Task, error) {
+	start := time.Now()
+	task, err := is.store.GetTask(id)
+	is.observe("GetTask", start, err)
+	return task, err
+}
+
+func (is instrumentedStore) GetVisibleTask(id, userId int) (Task, error) {
+	start := time.Now()
+	task, err := is.store.GetVisibleTask(id, userId)
+	is.observe("GetVisibleTask", start, err)
+	return task, err
+}
+
+func (is instrumentedStore) GetTaskByName(userId int, name string) (Task, error) {
+	start := time.Now()
+	task, err := is.store.GetTaskByName(userId, name)
+	is.observe("GetTaskByName", start, err)
+	return task, err
+}
+
+func (is instrumentedStore) GetTaskBySession(userId int) (Task, error) {
+	start := time.Now()
+	task, err := is.store.GetTaskBySession(userId)
+	is.observe("GetTaskBySession", start, err)
+	return task, err
+}
+
+func (is instrumentedStore) CountRunning() (int, error) {
+	start := time.Now()
+	count, err := is.store.CountRunning()
+	is.observe("CountRunning", start, err)
+	return count, err
+}
+
+func (is instrumentedStore) Delete(task Task) error {
+	start := time.Now()
+	err := is.store.Delete(task)
+	is.observe("Delete", start, err)
+	return err
+}
+
+func (is instrumentedStore) NewTaskSession(task Task) error {
+	start := time.Now()
+	err := is.store.NewTaskSession(task)
+	is.observe("NewTaskSession", start, err)
+	return err
+}
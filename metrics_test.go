@@ -0,0 +1,170 @@
+package timetracker_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"timetracker"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestMetricsStore(t *testing.T) {
+
+	t.Parallel()
+
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	raw := &timetracker.DBStore{Db: db}
+	m := timetracker.NewMetrics(raw)
+	m.TaskLabels = true
+	store := m.Instrument(raw)
+
+	mock.ExpectExec(timetracker.SQLDelete).WithArgs(3).WillReturnError(errors.New("disk full"))
+	mock.ExpectQuery(timetracker.SQLTaskById).WithArgs(4).WillReturnRows(
+		sqlmock.NewRows([]string{"id", "task_name", "project", "tags", "notes", "start_time", "elapsed_time", "user_id"}))
+
+	if err := store.Delete(timetracker.Task{Id: 3}); err == nil {
+		t.Error("want: error, got nil")
+	}
+	if _, err := store.GetTask(4); err != timetracker.ErrNoRecord {
+		t.Errorf("want: ErrNoRecord, got: %v", err)
+	}
+
+	mock.ExpectQuery(timetracker.SQLCountRunning).WillReturnRows(
+		sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery(timetracker.SQLReport).WillReturnRows(
+		sqlmock.NewRows([]string{"task_name", "total"}).
+			AddRow("piano", 90.0).
+			AddRow(`say "hi"`, 30.5))
+
+	var buf bytes.Buffer
+	err = m.Write(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+
+	want := []string{
+		"# TYPE timetracker_store_call_duration_seconds histogram",
+		`timetracker_store_call_duration_seconds_count{method="Delete"} 1`,
+		`timetracker_store_call_duration_seconds_bucket{method="GetTask",le="+Inf"} 1`,
+		`timetracker_store_call_errors_total{method="Delete"} 1`,
+		"timetracker_running_timers 1",
+		`timetracker_tracked_seconds{task="piano"} 90`,
+		`timetracker_tracked_seconds{task="say \"hi\""} 30.5`,
+		"timetracker_metrics_store_up 1",
+	}
+	for _, line := range want {
+		if !strings.Contains(got, line+"\n") {
+			t.Errorf("missing line %q in:\n%s", line, got)
+		}
+	}
+
+	if strings.Contains(got, `timetracker_store_call_errors_total{method="GetTask"}`) {
+		t.Error("ErrNoRecord counted as a store error")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+
+	t.Parallel()
+
+	m := timetracker.NewMetrics(nil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+		}
+	})
+	mux.HandleFunc("/task/stop", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("stopped"))
+	})
+
+	h := m.Middleware(mux)
+
+	for _, target := range []string{"/task/stop", "/task/stop?x=1", "/", "/no/such/page"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	}
+
+	var buf bytes.Buffer
+	m.Write(&buf)
+	got := buf.String()
+
+	want := []string{
+		`timetracker_http_requests_total{route="/",method="GET",code="200"} 1`,
+		`timetracker_http_requests_total{route="/",method="GET",code="404"} 1`,
+		`timetracker_http_requests_total{route="/task/stop",method="GET",code="200"} 2`,
+		`timetracker_http_request_duration_seconds_count{route="/task/stop"} 2`,
+		"timetracker_metrics_store_up 0",
+	}
+	for _, line := range want {
+		if !strings.Contains(got, line+"\n") {
+			t.Errorf("missing line %q in:\n%s", line, got)
+		}
+	}
+
+	if strings.Contains(got, "timetracker_running_timers") {
+		t.Error("store metrics written without a store")
+	}
+
+}
+
+func TestMetricsAccess(t *testing.T) {
+
+	t.Parallel()
+
+	testCases := []struct {
+		description string
+		opts        []timetracker.Option
+		token       string
+		want        int
+	}{
+		{description: "login required", opts: []timetracker.Option{timetracker.WithMetrics(), timetracker.WithRequiredLogin()}, want: http.StatusUnauthorized},
+		{description: "no token", opts: []timetracker.Option{timetracker.WithMetricsToken("s3cret"), timetracker.WithRequiredLogin()}, want: http.StatusUnauthorized},
+		{description: "wrong token", opts: []timetracker.Option{timetracker.WithMetricsToken("s3cret")}, token: "guess", want: http.StatusUnauthorized},
+		{description: "token", opts: []timetracker.Option{timetracker.WithMetricsToken("s3cret"), timetracker.WithRequiredLogin()}, token: "s3cret", want: http.StatusOK},
+		{description: "open", opts: []timetracker.Option{timetracker.WithMetrics()}, want: http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		_, ts := newSqliteServer(t, tc.opts...)
+
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/metrics", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+
+		resp, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if tc.want != resp.StatusCode {
+			t.Errorf("%s: want: %d, got: %d", tc.description, tc.want, resp.StatusCode)
+		}
+		if resp.StatusCode == http.StatusOK && !strings.Contains(string(body), "timetracker_tracked_seconds 0\n") {
+			t.Errorf("%s: want: tracked seconds without task labels, got:\n%s", tc.description, body)
+		}
+	}
+
+}
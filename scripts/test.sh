@@ -0,0 +1,12 @@
+#!/bin/sh
+# Runs the tests against both SQLite drivers: go-sqlite3
+# through cgo, with and without FTS5, and the pure Go
+# driver the container image and releases are built with.
+set -eu
+
+cd "$(dirname "$0")/.."
+
+go vet ./...
+go test ./...
+go test -tags sqlite_fts5 ./...
+CGO_ENABLED=0 go test -tags sqlite_purego ./...
@@ -0,0 +1,154 @@
+package timetracker
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SearchSortRelevance string = "relevance"
+	SearchSortTime      string = "time"
+
+	// default and maximum number of search results
+	SEARCH_LIMIT     int = 50
+	SEARCH_LIMIT_MAX int = 500
+)
+
+// searchForever stands in for an open ended
+// upper bound on the date range
+var searchForever = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+
+// SearchQuery is a full text search over task
+// names and notes.  From is inclusive, To is
+// exclusive and a zero To means no upper bound.
+// Only tasks UserId may see are searched.
+type SearchQuery struct {
+	Text   string
+	From   time.Time
+	To     time.Time
+	Sort   string
+	Limit  int
+	UserId int
+}
+
+// SearchResult is a matching task and its rank.
+// Higher ranks are better matches.
+type SearchResult struct {
+	Task Task    `json:"task"`
+	Rank float64 `json:"rank"`
+}
+
+// NewSearchQuery reads a search from url query values:
+// q, from and to as YYYY-MM-DD, sort and limit.
+// The to date is included in the results.
+func NewSearchQuery(v url.Values) (SearchQuery, error) {
+
+	q := SearchQuery{
+		Text:  strings.TrimSpace(v.Get("q")),
+		Sort:  SearchSortRelevance,
+		Limit: SEARCH_LIMIT,
+	}
+
+	if q.Text == "" {
+		return SearchQuery{}, fmt.Errorf("search text must not be empty")
+	}
+
+	var err error
+	q.From, q.To, err = parseDateRange(v)
+	if err != nil {
+		return SearchQuery{}, err
+	}
+
+	switch sort := v.Get("sort"); sort {
+	case "":
+	case SearchSortRelevance, SearchSortTime:
+		q.Sort = sort
+	default:
+		return SearchQuery{}, fmt.Errorf("invalid sort: %q", sort)
+	}
+
+	if limit := v.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			return SearchQuery{}, fmt.Errorf("invalid limit: %q", limit)
+		}
+		if n > SEARCH_LIMIT_MAX {
+			n = SEARCH_LIMIT_MAX
+		}
+		q.Limit = n
+	}
+
+	return q, nil
+}
+
+// parseDateRange reads from and to dates as YYYY-MM-DD.
+// The returned to is the start of the day after the to
+// date so that it can be used as an exclusive bound.
+func parseDateRange(v url.Values) (time.Time, time.Time, error) {
+
+	var from, to time.Time
+
+	if value := v.Get("from"); value != "" {
+		t, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid from date: %q", value)
+		}
+		from = t
+	}
+
+	if value := v.Get("to"); value != "" {
+		t, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid to date: %q", value)
+		}
+		to = t.AddDate(0, 0, 1)
+	}
+
+	if !to.IsZero() && !to.After(from) {
+		return time.Time{}, time.Time{}, fmt.Errorf("to date must not be before from date")
+	}
+
+	return from, to, nil
+}
+
+// FromDate formats From for a date input
+func (q SearchQuery) FromDate() string {
+	if q.From.IsZero() {
+		return ""
+	}
+	return q.From.Format("2006-01-02")
+}
+
+// ToDate formats To for a date input.  It is the
+// inverse of NewSearchQuery so the last day shown
+// is the last day included.
+func (q SearchQuery) ToDate() string {
+	if q.To.IsZero() {
+		return ""
+	}
+	return q.To.AddDate(0, 0, -1).Format("2006-01-02")
+}
+
+// until returns the exclusive upper bound
+// of the date range
+func (q SearchQuery) until() time.Time {
+	if q.To.IsZero() {
+		return searchForever
+	}
+	return q.To
+}
+
+// ftsQuery turns free text into an FTS5 query that
+// matches every word, quoting each one so that user
+// input cannot be read as FTS5 query syntax
+func ftsQuery(text string) string {
+
+	var terms []string
+	for _, word := range strings.Fields(text) {
+		terms = append(terms, `"`+strings.ReplaceAll(word, `"`, `""`)+`"`)
+	}
+	return strings.Join(terms, " ")
+}
@@ -0,0 +1,104 @@
+package timetracker_test
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"timetracker"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNewSearchQuery(t *testing.T) {
+
+	t.Parallel()
+
+	v := url.Values{}
+	v.Set("q", " piano scales ")
+	v.Set("from", "2021-01-01")
+	v.Set("to", "2021-01-31")
+	v.Set("sort", "time")
+
+	got, err := timetracker.NewSearchQuery(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := timetracker.SearchQuery{
+		Text:  "piano scales",
+		From:  time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+		To:    time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC),
+		Sort:  timetracker.SearchSortTime,
+		Limit: timetracker.SEARCH_LIMIT,
+	}
+
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+
+	if got.ToDate() != "2021-01-31" {
+		t.Errorf("want: 2021-01-31, got: %s", got.ToDate())
+	}
+
+}
+
+func TestNewSearchQueryInvalid(t *testing.T) {
+
+	t.Parallel()
+
+	tcs := []url.Values{
+		{},
+		{"q": {"piano"}, "from": {"01/01/2021"}},
+		{"q": {"piano"}, "from": {"2021-02-01"}, "to": {"2021-01-01"}},
+		{"q": {"piano"}, "sort": {"name"}},
+		{"q": {"piano"}, "limit": {"0"}},
+	}
+
+	for _, v := range tcs {
+		_, err := timetracker.NewSearchQuery(v)
+		if err == nil {
+			t.Errorf("want error for %v", v)
+		}
+	}
+
+}
+
+func TestSearchPage(t *testing.T) {
+
+	t.Parallel()
+
+	// default builds use go-sqlite3 without FTS5
+	s, ts := newSqliteServer(t)
+
+	start := time.Date(2021, 1, 1, 9, 0, 0, 0, time.UTC)
+	for _, task := range []timetracker.Task{
+		{UserId: timetracker.LOCAL_USER_ID, Name: "deploy", Notes: "billing api", StartTime: start, ElapsedTimeSec: 60},
+		{UserId: timetracker.LOCAL_USER_ID, Name: "piano", Notes: "scales", StartTime: start.Add(time.Hour), ElapsedTimeSec: 60},
+	} {
+		_, err := s.TaskStore.CreateCompleted(task)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := newBrowser(t, ts)
+
+	code, body := b.get("/search?q=Billing+API")
+	if code != http.StatusOK {
+		t.Fatalf("want: %d, got: %d\n%s", http.StatusOK, code, body)
+	}
+	if !strings.Contains(body, "deploy") || strings.Contains(body, "piano") {
+		t.Errorf("want: only deploy in results, got:\n%s", body)
+	}
+
+	code, body = b.get("/api/search?q=scales")
+	if code != http.StatusOK {
+		t.Fatalf("api: want: %d, got: %d\n%s", http.StatusOK, code, body)
+	}
+	if !strings.Contains(body, `"name":"piano"`) || strings.Contains(body, "deploy") {
+		t.Errorf("api: want: only piano in results, got: %s", body)
+	}
+
+}
@@ -0,0 +1,188 @@
+package timetracker
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	CSRFCookie    string = "timetracker_csrf"
+	CSRFFormField string = "csrf_token"
+	CSRFHeader    string = "X-CSRF-Token"
+
+	// the largest request body read while
+	// looking for the form token
+	MAX_FORM_SIZE int64 = 10 << 20
+
+	// ContentSecurityPolicy allows the page's own scripts
+	// and styles and the Google fonts stylesheet, and
+	// forbids framing
+	ContentSecurityPolicy string = "default-src 'self'; " +
+		"script-src 'self'; " +
+		"style-src 'self' https://fonts.googleapis.com; " +
+		"font-src 'self' https://fonts.gstatic.com; " +
+		"img-src 'self' data:; " +
+		"object-src 'none'; " +
+		"base-uri 'self'; " +
+		"form-action 'self'; " +
+		"frame-ancestors 'none'"
+)
+
+const csrfSecretLength = 32
+
+// SecureHeaders sets the Content-Security-Policy and
+// the headers that stop framing and content sniffing
+func SecureHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Content-Security-Policy", ContentSecurityPolicy)
+		h.Set("X-Frame-Options", "DENY")
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Referrer-Policy", "same-origin")
+		next.ServeHTTP(w, r)
+	})
+}
+
+type csrfKey struct{}
+
+// CSRF protects form posts with a per-session token.
+// Each browser session gets a random secret in a cookie;
+// pages embed it masked with a fresh one-time pad, so the
+// token differs on every render, and every POST, PUT,
+// PATCH or DELETE must send a token that unmasks to the
+// cookie's secret in the csrf_token form field or the
+// X-CSRF-Token header.  API calls with a bearer token
+// are exempt.
+func CSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		secret := csrfSecretFrom(r)
+		if secret == nil {
+			secret = make([]byte, csrfSecretLength)
+			rand.Read(secret)
+			http.SetCookie(w, &http.Cookie{
+				Name:     CSRFCookie,
+				Value:    base64.RawURLEncoding.EncodeToString(secret),
+				Path:     "/",
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+
+		// the token depends on the cookie, so pages
+		// are not cached across sessions
+		w.Header().Add("Vary", "Cookie")
+
+		r = r.WithContext(context.WithValue(r.Context(), csrfKey{}, secret))
+
+		if csrfSafeMethod(r.Method) || bearerAPIRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !sameOrigin(r) {
+			http.Error(w, "Forbidden - cross origin request", http.StatusForbidden)
+			return
+		}
+
+		token := r.Header.Get(CSRFHeader)
+		if token == "" {
+			r.Body = http.MaxBytesReader(w, r.Body, MAX_FORM_SIZE)
+			if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+				r.ParseMultipartForm(MAX_FORM_SIZE)
+			}
+			token = r.PostFormValue(CSRFFormField)
+		}
+
+		if !validCSRFToken(secret, token) {
+			http.Error(w, "Forbidden - CSRF token invalid", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// CSRFToken returns a token for forms in the response
+// to r, or "" when r did not pass through CSRF
+func CSRFToken(r *http.Request) string {
+
+	secret, ok := r.Context().Value(csrfKey{}).([]byte)
+	if !ok {
+		return ""
+	}
+
+	masked := make([]byte, 2*csrfSecretLength)
+	rand.Read(masked[:csrfSecretLength])
+	for i := 0; i < csrfSecretLength; i++ {
+		masked[csrfSecretLength+i] = masked[i] ^ secret[i]
+	}
+	return base64.RawURLEncoding.EncodeToString(masked)
+}
+
+func csrfSecretFrom(r *http.Request) []byte {
+
+	c, err := r.Cookie(CSRFCookie)
+	if err != nil {
+		return nil
+	}
+	secret, err := base64.RawURLEncoding.DecodeString(c.Value)
+	if err != nil || len(secret) != csrfSecretLength {
+		return nil
+	}
+	return secret
+}
+
+func validCSRFToken(secret []byte, token string) bool {
+
+	masked, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(masked) != 2*csrfSecretLength {
+		return false
+	}
+
+	unmasked := make([]byte, csrfSecretLength)
+	for i := 0; i < csrfSecretLength; i++ {
+		unmasked[i] = masked[i] ^ masked[csrfSecretLength+i]
+	}
+	return subtle.ConstantTimeCompare(unmasked, secret) == 1
+}
+
+// bearerAPIRequest reports whether r is an API call
+// authenticated by apiAuth.  Browsers cannot add an
+// Authorization header to a cross-site request, so
+// these need no CSRF token.
+func bearerAPIRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/") &&
+		strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+func csrfSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// sameOrigin rejects requests whose Origin header names
+// another host.  Requests without one, from older
+// browsers and other clients, rely on the token alone.
+func sameOrigin(r *http.Request) bool {
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return u.Host == r.Host
+}
@@ -0,0 +1,221 @@
+package timetracker_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+	"timetracker"
+)
+
+func TestTemplatesEscapeInjection(t *testing.T) {
+	t.Parallel()
+
+	const (
+		script = "<script>alert(1)</script>"
+		attr   = `"'><img src=x onerror=alert(2)>`
+	)
+
+	task := timetracker.Task{
+		Id:        1,
+		Name:      script,
+		Project:   attr,
+		Tags:      []string{script, attr},
+		Notes:     "[link](javascript:alert(3)) <img src=x onerror=alert(4)> " + script,
+		StartTime: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	data := timetracker.TemplateData{
+		Tasks:     []timetracker.Task{task},
+		Results:   []timetracker.SearchResult{{Task: task}},
+		Page:      timetracker.TaskPage{Tasks: []timetracker.Task{task}, Next: attr},
+		Names:     []string{script, attr},
+		Reports:   []timetracker.Report{{Task: script}},
+		Templates: []timetracker.TaskTemplate{{Id: 1, Name: attr, Project: script}},
+		Goals:     []timetracker.GoalProgress{{Goal: timetracker.Goal{Name: script, Scope: "task", Kind: "target", Period: "weekly", Target: 1}}},
+		Webhooks:  []timetracker.Webhook{{Id: 1, URL: "javascript:alert(5)", Events: []string{script}}},
+		Imports:   []timetracker.ICSEvent{{Summary: script, Reason: attr}},
+		Calendar:  "</textarea>" + script,
+		Search:    timetracker.SearchQuery{Text: attr},
+		List:      timetracker.ListOptions{Sort: "name", NamePrefix: attr, Limit: timetracker.HISTORY_LIMIT},
+		Error:     script,
+		CSRFToken: attr,
+
+		Tokens:      []timetracker.APIToken{{Id: 1, Name: script, Prefix: attr, Scopes: []string{script}}},
+		NewToken:    attr,
+		Workspaces:  []timetracker.Workspace{{Id: 1, Name: script, Role: attr}},
+		Workspace:   timetracker.Workspace{Id: 1, Name: script},
+		Viewer:      timetracker.Member{Role: timetracker.RoleOwner},
+		Members:     []timetracker.Member{{UserId: 2, Name: script, Email: attr, Role: timetracker.RoleMember}},
+		Invitations: []timetracker.Invitation{{Id: 1, Email: script, Role: attr}},
+		Projects:    []string{script, attr},
+		Roles:       []string{attr},
+		TeamReport:  []timetracker.MemberReport{{Member: timetracker.Member{Name: script}, Reports: []timetracker.Report{{Task: script}}}},
+		InviteLink:  "javascript:alert(6)",
+		InviteToken: attr,
+		User:        timetracker.User{Name: script},
+		SignedIn:    true,
+	}
+
+	cache, err := timetracker.NewTemplateCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, ts := range cache {
+		var b bytes.Buffer
+		err := ts.Execute(&b, data)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		got := b.String()
+
+		for _, injected := range []string{"<script>alert", "<img src=x", `href="javascript:`, "href='javascript:", "</textarea><script"} {
+			if strings.Contains(got, injected) {
+				t.Errorf("%s: rendered %q unescaped", name, injected)
+			}
+		}
+	}
+
+}
+
+// csrfSession is a browser session: it keeps the
+// cookie and reads the token from the last page
+type csrfSession struct {
+	t       *testing.T
+	handler http.Handler
+	cookies []*http.Cookie
+}
+
+func (c *csrfSession) do(req *http.Request) *httptest.ResponseRecorder {
+	for _, cookie := range c.cookies {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	c.handler.ServeHTTP(rec, req)
+	if cookies := rec.Result().Cookies(); len(cookies) > 0 {
+		c.cookies = cookies
+	}
+	return rec
+}
+
+func (c *csrfSession) token() string {
+	rec := c.do(httptest.NewRequest(http.MethodGet, "/form", nil))
+	return rec.Body.String()
+}
+
+func (c *csrfSession) post(form url.Values, header http.Header) int {
+	req := httptest.NewRequest(http.MethodPost, "/form", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	return c.do(req).Code
+}
+
+func TestCSRF(t *testing.T) {
+	t.Parallel()
+
+	// the page body is the token, as a template would embed it
+	handler := timetracker.CSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(timetracker.CSRFToken(r)))
+	}))
+
+	browser := &csrfSession{t: t, handler: handler}
+	token := browser.token()
+
+	if len(browser.cookies) != 1 || !browser.cookies[0].HttpOnly || browser.cookies[0].SameSite != http.SameSiteLaxMode {
+		t.Fatalf("want: HttpOnly SameSite=Lax session cookie, got: %v", browser.cookies)
+	}
+
+	// tokens are masked differently on every page
+	second := browser.token()
+	if token == second {
+		t.Error("want: a fresh token per render, got the same one twice")
+	}
+
+	other := &csrfSession{t: t, handler: handler}
+	otherToken := other.token()
+
+	testCases := []struct {
+		description string
+		form        url.Values
+		header      http.Header
+		want        int
+	}{
+		{description: "form token", form: url.Values{"csrf_token": {token}}, want: http.StatusOK},
+		{description: "older token", form: url.Values{"csrf_token": {second}}, want: http.StatusOK},
+		{description: "header token", header: http.Header{"X-Csrf-Token": {token}}, want: http.StatusOK},
+		{description: "same origin", form: url.Values{"csrf_token": {token}}, header: http.Header{"Origin": {"http://example.com"}}, want: http.StatusOK},
+		{description: "no token", want: http.StatusForbidden},
+		{description: "garbage token", form: url.Values{"csrf_token": {"abc"}}, want: http.StatusForbidden},
+		{description: "other session's token", form: url.Values{"csrf_token": {otherToken}}, want: http.StatusForbidden},
+		{description: "cross origin", form: url.Values{"csrf_token": {token}}, header: http.Header{"Origin": {"https://evil.example"}}, want: http.StatusForbidden},
+	}
+
+	for _, tc := range testCases {
+		got := browser.post(tc.form, tc.header)
+		if tc.want != got {
+			t.Errorf("%s: want: %d, got: %d", tc.description, tc.want, got)
+		}
+	}
+
+	// a forged post from a browser without the cookie
+	forger := &csrfSession{t: t, handler: handler}
+	if got := forger.post(url.Values{"csrf_token": {token}}, nil); got != http.StatusForbidden {
+		t.Errorf("no cookie: want: 403, got: %d", got)
+	}
+
+}
+
+func TestServerSecurity(t *testing.T) {
+	t.Parallel()
+
+	s := timetracker.NewServer(timetracker.WithNoLogging())
+	err := s.LoadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := s.Handler()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	for header, want := range map[string]string{
+		"Content-Security-Policy": timetracker.ContentSecurityPolicy,
+		"X-Frame-Options":         "DENY",
+		"X-Content-Type-Options":  "nosniff",
+	} {
+		if got := rec.Header().Get(header); want != got {
+			t.Errorf("%s: want: %q, got: %q", header, want, got)
+		}
+	}
+
+	// every state changing route needs the token
+	for _, path := range []string{"/task/started", "/task/stop", "/task/delete", "/goal/create", "/template/start", "/import"} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader("task=x"))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("POST %s without token: want: 403, got: %d", path, rec.Code)
+		}
+	}
+
+	// the CSRF check lets GET through, so the
+	// timer must not start or stop on one
+	for _, path := range []string{"/task/started?task=x", "/task/stop"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+		if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != http.MethodPost {
+			t.Errorf("GET %s: want: 405 allowing POST, got: %d %q", path, rec.Code, rec.Header().Get("Allow"))
+		}
+	}
+
+}
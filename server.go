@@ -3,41 +3,174 @@ package timetracker
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"html/template"
+	"io"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"sync"
 	"syscall"
-	"text/template"
 	"time"
 	"timetracker/ui"
 
 	_ "github.com/lib/pq"
-	_ "github.com/mattn/go-sqlite3"
 )
 
 type TaskStore interface {
 	Create(task Task) (int, error)
+	CreateCompleted(Task) (int, error)
 	UpdateStopped(Task) error
-	GetReport() ([]Report, error)
-	GetLatest() ([]Task, error)
-	GetTaskByName(string) (Task, error)
-	GetTaskBySession() (Task, error)
+	UpdateNotes(Task) error
+	GetReport(int) ([]Report, error)
+	GetLatest(int) ([]Task, error)
+	List(ListOptions) (TaskPage, error)
+	GetRecentNames(int, int) ([]string, error)
+	GetAll() ([]Task, error)
+	Search(SearchQuery) ([]SearchResult, error)
+	GetCompleted(TaskFilter) ([]Task, error)
+	GetTask(int) (Task, error)
+	GetVisibleTask(int, int) (Task, error)
+	GetTaskByName(int, string) (Task, error)
+	GetTaskBySession(int) (Task, error)
+	CountRunning() (int, error)
 	Delete(Task) error
 	NewTaskSession(Task) error
 }
 
+type GoalStore interface {
+	CreateGoal(Goal) (int, error)
+	GetGoals(int) ([]Goal, error)
+	DeleteGoal(Goal) error
+	GetGoalProgress(int, time.Time) ([]GoalProgress, error)
+}
+
+type TemplateStore interface {
+	CreateTemplate(TaskTemplate) (int, error)
+	GetTemplates(int) ([]TaskTemplate, error)
+	GetTemplate(int, int) (TaskTemplate, error)
+	DeleteTemplate(TaskTemplate) error
+}
+
+type WebhookStore interface {
+	CreateWebhook(Webhook) (int, error)
+	GetWebhooks(int) ([]Webhook, error)
+	GetTaskWebhooks(Task) ([]Webhook, error)
+	DeleteWebhook(Webhook) error
+	CreateDelivery(WebhookDelivery) (int, error)
+	GetDueDeliveries(time.Time, int) ([]WebhookDelivery, error)
+	GetDeliveries(int, int) ([]WebhookDelivery, error)
+	UpdateDelivery(WebhookDelivery) error
+}
+
+type APITokenStore interface {
+	CreateAPIToken(APIToken) (int, error)
+	GetAPITokens() ([]APIToken, error)
+	GetAPITokenByHash(string) (APIToken, error)
+	RevokeAPIToken(int, time.Time) error
+	TouchAPIToken(int, time.Time) error
+}
+
+type WorkspaceStore interface {
+	GetUser(int) (User, error)
+	CreateSession(string, int, time.Time) error
+	GetSessionUser(string, time.Time) (User, error)
+	DeleteSession(string) error
+	CreateWorkspace(Workspace, int) (int, error)
+	GetWorkspaces(int) ([]Workspace, error)
+	GetMembers(int) ([]Member, error)
+	SetMemberRole(int, int, string) error
+	RemoveMember(int, int) error
+	CreateInvitation(Invitation) (int, error)
+	GetInvitations(int) ([]Invitation, error)
+	DeleteInvitation(int, int) error
+	AcceptInvitation(string, string, time.Time) (User, error)
+	GetWorkspaceProjects(int) ([]string, error)
+	AddWorkspaceProject(int, string) error
+	RemoveWorkspaceProject(int, string) error
+	GetTeamReport(int) ([]TeamTotal, error)
+}
+
+type AuditStore interface {
+	RecordChange(AuditEntry) (AuditEntry, error)
+	GetAuditLog(AuditFilter) ([]AuditEntry, error)
+}
+
+// BackupStore writes, checks and restores backup
+// files in the store's BackupFormat
+type BackupStore interface {
+	BackupFormat() string
+	Backup(context.Context, string) error
+	InspectBackup(context.Context, string) ([]TableCount, error)
+	Restore(context.Context, string) error
+}
+
+// ProjectionStore rebuilds the tasks it serves
+// from the log of events it keeps
+type ProjectionStore interface {
+	Rebuild(full bool) (RebuildResult, error)
+}
+
+// PauseStore pauses and resumes the running task
+// of the user a task belongs to
+type PauseStore interface {
+	Pause(Task) error
+	Resume(Task) error
+}
+
+type HealthStore interface {
+	Ping(context.Context) error
+	CheckSchema(context.Context) error
+}
+
+type ImportStore interface {
+	IsImported(int, string) (bool, error)
+	ImportTask(string, Task) (int, error)
+	ReplaceTasks(int, []Task, []Task) ([]int, error)
+}
+
 type Server struct {
-	httpServer    *http.Server
-	Addr          string
-	logger        *log.Logger
-	Port          int
-	LogLevel      string
-	templateCache map[string]*template.Template
-	TaskStore     TaskStore
+	httpServer      *http.Server
+	Addr            string
+	logger          *Logger
+	Port            int
+	templateCache   map[string]*template.Template
+	TaskStore       TaskStore
+	GoalStore       GoalStore
+	TemplateStore   TemplateStore
+	ImportStore     ImportStore
+	WebhookStore    WebhookStore
+	HealthStore     HealthStore
+	APITokenStore   APITokenStore
+	WorkspaceStore  WorkspaceStore
+	AuditStore      AuditStore
+	BackupStore     BackupStore
+	ProjectionStore ProjectionStore
+	PauseStore      PauseStore
+	webhooks        *WebhookDispatcher
+	metrics         *Metrics
+	backups         *BackupScheduler
+	backupConfig    *backupConfig
+	metricsToken    string
+	taskMetrics     bool
+	requireTokens   bool
+	requireLogin    bool
+	tls             *certReloader
+	redirectPort    int
+	location        *time.Location
+	noWebhooks      bool
+
+	// closer is the store to close on shutdown
+	closer          io.Closer
+	shutdownTimeout time.Duration
+	err             error
+
+	// Deprecated: use WithLogger or WithNoLogging.  LogLevel
+	// is read by NewServer after the options, when neither
+	// was given: "quiet" discards logs, "verbose" logs at
+	// info and debug, info, warn and error set the level.
+	LogLevel string
 }
 
 // type to hold options for Server struct
@@ -54,7 +187,74 @@ func WithPort(port int) Option {
 
 func WithNoLogging() Option {
 	return func(s *Server) error {
-		s.LogLevel = "quiet"
+		s.logger = DiscardLogger()
+		return nil
+	}
+}
+
+// levelLogger is the logfmt Logger on stdout for the
+// deprecated LogLevel field, info level when it is empty
+func levelLogger(name string) (*Logger, error) {
+
+	switch name {
+	case "quiet":
+		return DiscardLogger(), nil
+	case "", "verbose":
+		return NewLogger(os.Stdout, LevelInfo, LogFormatLogfmt)
+	}
+
+	level, err := ParseLevel(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LogLevel: %w", err)
+	}
+	return NewLogger(os.Stdout, level, LogFormatLogfmt)
+}
+
+// WithLogger replaces the default info level
+// logfmt Logger on stdout
+func WithLogger(logger *Logger) Option {
+	return func(s *Server) error {
+		if logger == nil {
+			return fmt.Errorf("logger must not be nil")
+		}
+		s.logger = logger
+		return nil
+	}
+}
+
+// WithMetrics serves Prometheus metrics on /metrics
+// and times every TaskStore call.  With WithRequiredLogin
+// scrapers must sign in unless WithMetricsToken is set.
+func WithMetrics() Option {
+	return func(s *Server) error {
+		s.metrics = NewMetrics(nil)
+		return nil
+	}
+}
+
+// WithMetricsToken serves metrics as WithMetrics does,
+// but only to requests with the token in an
+// Authorization: Bearer header.  Scrapers sending it
+// need not sign in.
+func WithMetricsToken(token string) Option {
+	return func(s *Server) error {
+		if token == "" {
+			return fmt.Errorf("metrics token must not be empty")
+		}
+		s.metricsToken = token
+		if s.metrics == nil {
+			s.metrics = NewMetrics(nil)
+		}
+		return nil
+	}
+}
+
+// WithTaskMetrics labels tracked seconds with task
+// names.  Anyone who can read /metrics can then read
+// every user's task names.
+func WithTaskMetrics() Option {
+	return func(s *Server) error {
+		s.taskMetrics = true
 		return nil
 	}
 }
@@ -67,20 +267,199 @@ func WithPostgresStore(conn string) Option {
 			return err
 		}
 
-		s.TaskStore = db
+		return WithDBStore(db)(s)
+	}
+}
+
+// WithSqliteStore opens the SQLite database at path,
+// creating it and any missing tables.  By default it is
+// opened in WAL mode with foreign keys on, a busy timeout
+// of SQLITE_BUSY_TIMEOUT and at most SQLITE_MAX_OPEN_CONNS
+// connections; opts change these.
+func WithSqliteStore(path string, opts ...SqliteOption) Option {
+	return func(s *Server) error {
+
+		db, err := NewSqliteStore(path, opts...)
+		if err != nil {
+			return err
+		}
+
+		return WithDBStore(db)(s)
+	}
+}
+
+// WithSqliteFile opens the SQLite database at path.
+//
+// Deprecated: use WithSqliteStore.
+func WithSqliteFile(path string) Option {
+	return WithSqliteStore(path)
+}
+
+// WithKVStore keeps tasks in the embedded key-value
+// file at path, creating it if needed.  Only tasks are
+// stored, so goals, templates, calendar imports,
+// webhooks, API tokens, workspaces, the audit log and
+// backups are not available.
+func WithKVStore(path string) Option {
+	return func(s *Server) error {
+
+		kv, err := NewKVStore(path)
+		if err != nil {
+			return err
+		}
+
+		s.TaskStore = kv
+		s.HealthStore = kv
+		s.closer = kv
 		return nil
 	}
 }
 
-func WithSqliteStore() Option {
+// WithEventStore records every change to a task in the
+// append-only event log at path and serves tasks from a
+// projection of it.  Like WithKVStore, only tasks are
+// stored.  It is the only store that can pause tasks.
+func WithEventStore(path string) Option {
 	return func(s *Server) error {
 
-		db, err := NewSqliteStore()
+		events, err := NewEventStore(path)
 		if err != nil {
 			return err
 		}
 
+		s.TaskStore = events
+		s.HealthStore = events
+		s.ProjectionStore = events
+		s.PauseStore = events
+		s.closer = events
+		return nil
+	}
+}
+
+// WithDBStore uses an open DBStore for every store
+// interface.  The Server closes it when Run returns.
+func WithDBStore(db *DBStore) Option {
+	return func(s *Server) error {
 		s.TaskStore = db
+		s.GoalStore = db
+		s.TemplateStore = db
+		s.ImportStore = db
+		s.WebhookStore = db
+		s.HealthStore = db
+		s.APITokenStore = db
+		s.WorkspaceStore = db
+		s.AuditStore = db
+		s.BackupStore = db
+		s.closer = db
+		return nil
+	}
+}
+
+// WithTLS serves HTTPS with the PEM encoded certificate
+// and key.  Renewed files are picked up without a
+// restart.
+func WithTLS(certFile, keyFile string) Option {
+	return func(s *Server) error {
+		r, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		s.tls = r
+		return nil
+	}
+}
+
+// WithHTTPRedirect listens for plain HTTP on port and
+// redirects every request to HTTPS.  It needs WithTLS.
+func WithHTTPRedirect(port int) Option {
+	return func(s *Server) error {
+		if port <= 0 {
+			return fmt.Errorf("redirect port must be positive")
+		}
+		s.redirectPort = port
+		return nil
+	}
+}
+
+// WithRequiredAPITokens turns away API requests
+// without an Authorization: Bearer token.  Without
+// it tokens are checked when sent but not required.
+func WithRequiredAPITokens() Option {
+	return func(s *Server) error {
+		s.requireTokens = true
+		return nil
+	}
+}
+
+// WithRequiredLogin turns away browsers that have not
+// signed in with a login link or an invitation, and API
+// requests without a token.  Without it they act as the
+// local user.
+func WithRequiredLogin() Option {
+	return func(s *Server) error {
+		s.requireLogin = true
+		s.requireTokens = true
+		return nil
+	}
+}
+
+// WithTimeZone sets the zone the goal week starts in
+// and of floating times in imported calendars.  Task
+// times are still stored in UTC.  name is an IANA
+// zone such as Europe/Berlin, or Local.
+func WithTimeZone(name string) Option {
+	return func(s *Server) error {
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			return fmt.Errorf("unknown time zone %q: %w", name, err)
+		}
+		s.location = loc
+		return nil
+	}
+}
+
+// WithNoWebhooks turns off the webhook pages and
+// the delivery worker
+func WithNoWebhooks() Option {
+	return func(s *Server) error {
+		s.noWebhooks = true
+		return nil
+	}
+}
+
+type backupConfig struct {
+	dir      string
+	interval time.Duration
+	keep     int
+}
+
+// WithBackups backs the store up into dir every
+// interval while the server runs, keeping the newest
+// keep backups.  A keep of 0 keeps them all.
+func WithBackups(dir string, interval time.Duration, keep int) Option {
+	return func(s *Server) error {
+		if dir == "" {
+			return fmt.Errorf("backup directory must not be empty")
+		}
+		if interval <= 0 {
+			return fmt.Errorf("backup interval must be positive")
+		}
+		if keep < 0 {
+			return fmt.Errorf("backups to keep must not be negative")
+		}
+		s.backupConfig = &backupConfig{dir: dir, interval: interval, keep: keep}
+		return nil
+	}
+}
+
+// WithShutdownTimeout bounds how long Run waits for
+// in-flight requests and background workers
+func WithShutdownTimeout(timeout time.Duration) Option {
+	return func(s *Server) error {
+		if timeout <= 0 {
+			return fmt.Errorf("shutdown timeout must be positive")
+		}
+		s.shutdownTimeout = timeout
 		return nil
 	}
 }
@@ -90,89 +469,291 @@ func NewServer(opts ...Option) *Server {
 
 	// create Server instance with defaults
 	s := &Server{
-		Port:     4000,
-		LogLevel: "verbose",
+		Port:            4000,
+		shutdownTimeout: 15 * time.Second,
+		location:        time.Local,
 	}
 
 	// set override options.  loop takes in
 	// With funcs loaded with input params and
 	// executes to update Server struct
 	for _, o := range opts {
-		o(s)
+		err := o(s)
+		if err != nil && s.err == nil {
+			s.err = err
+		}
 	}
 
-	newLogger := log.New(os.Stdout, "", log.LstdFlags)
-	if s.LogLevel == "quiet" {
-		newLogger.SetOutput(ioutil.Discard)
+	if s.logger == nil {
+		var err error
+		s.logger, err = levelLogger(s.LogLevel)
+		if err != nil {
+			s.logger = DiscardLogger()
+			if s.err == nil {
+				s.err = err
+			}
+		}
 	}
 
 	// update struct...perhaps there is a better way.
 	s.Addr = fmt.Sprintf(":%d", s.Port)
-	s.logger = newLogger
+
+	// the store option may come after WithMetrics,
+	// so the store is instrumented once all are set
+	if s.metrics != nil && s.TaskStore != nil {
+		s.metrics.store = s.TaskStore
+		s.TaskStore = s.metrics.Instrument(s.TaskStore)
+	}
+	if s.metrics != nil {
+		s.metrics.TaskLabels = s.taskMetrics
+	}
+
+	if s.tls != nil {
+		s.tls.logger = s.logger
+	} else if s.redirectPort != 0 && s.err == nil {
+		s.err = fmt.Errorf("redirecting to https needs WithTLS")
+	}
+
+	if s.noWebhooks {
+		s.WebhookStore = nil
+	}
+
+	if s.WebhookStore != nil {
+		s.webhooks = NewWebhookDispatcher(s.WebhookStore, nil, s.logger)
+	}
+
+	if c := s.backupConfig; c != nil && s.BackupStore != nil {
+		s.backups = NewBackupScheduler(s.BackupStore, c.dir, c.interval, c.keep, s.logger)
+	}
 
 	return s
 
 }
 
+// ListenAndServe runs the server until SIGINT or SIGTERM
 func (s *Server) ListenAndServe() error {
+	return s.Run(context.Background())
+}
+
+// Run listens on Addr and serves until ctx is done or
+// the process gets SIGINT or SIGTERM, then shuts down
+func (s *Server) Run(ctx context.Context) error {
+
+	if s.err != nil {
+		return s.err
+	}
 
-	var err error
-	s.templateCache, err = NewTemplateCache()
+	l, err := net.Listen("tcp", s.Addr)
 	if err != nil {
-		log.Fatal(err)
+		s.close()
+		return fmt.Errorf("unable to listen on %s: %w", s.Addr, err)
+	}
+
+	return s.Serve(ctx, l)
+}
+
+// Serve accepts connections on l until ctx is done or
+// the process gets SIGINT or SIGTERM.  It then stops
+// accepting, waits up to the shutdown timeout for
+// in-flight requests and background workers, and
+// closes the store.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if s.err != nil {
+		l.Close()
+		s.close()
+		return s.err
+	}
+
+	err := s.LoadTemplates()
+	if err != nil {
+		l.Close()
+		s.close()
+		return fmt.Errorf("unable to load templates: %w", err)
 	}
 
 	s.httpServer = &http.Server{
-		Addr:              s.Addr,
+		Handler:           s.routes(),
 		IdleTimeout:       5 * time.Minute,
 		ReadHeaderTimeout: time.Minute,
-		ErrorLog:          s.logger,
+		ErrorLog:          s.logger.StdLogger(LevelError),
 	}
 
-	s.httpServer.Handler = s.routes()
-	s.logger.Println("Starting up on ", s.Addr)
+	// the redirect listener is opened here so that a
+	// port clash is reported before serving starts
+	var redirect *http.Server
+	var redirectListener net.Listener
+	if s.redirectPort != 0 {
+		redirectListener, err = net.Listen("tcp", fmt.Sprintf(":%d", s.redirectPort))
+		if err != nil {
+			l.Close()
+			s.close()
+			return fmt.Errorf("unable to listen for redirects on :%d: %w", s.redirectPort, err)
+		}
+		redirect = &http.Server{
+			Handler:           AccessLog(s.logger, RedirectHandler(l.Addr().(*net.TCPAddr).Port)),
+			ReadHeaderTimeout: time.Minute,
+			ErrorLog:          s.logger.StdLogger(LevelError),
+		}
+	}
 
-	if err := s.httpServer.ListenAndServe(); err != nil {
-		WaitForServerRoute(s.Addr + "/task")
-		s.logger.Println("server start:", err)
-		return err
+	workers, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+	done := s.startWorkers(workers)
+
+	serveErr := make(chan error, 2)
+	go func() {
+		if s.tls != nil {
+			s.httpServer.TLSConfig = TLSConfig(s.tls.GetCertificate)
+			serveErr <- s.httpServer.ServeTLS(l, "", "")
+			return
+		}
+		serveErr <- s.httpServer.Serve(l)
+	}()
+
+	if redirect != nil {
+		go func() {
+			serveErr <- redirect.Serve(redirectListener)
+		}()
+		s.logger.Info("redirecting to https", "addr", redirectListener.Addr().String())
+	}
+
+	s.logger.Info("starting up", "addr", l.Addr().String(), "tls", s.tls != nil)
+
+	select {
+	case err = <-serveErr:
+		// Serve only returns early on a listener failure
+		s.logger.Error("server stopped", "err", err)
+	case <-ctx.Done():
+		s.logger.Info("shutting down", "timeout", s.shutdownTimeout)
+		err = nil
+	}
+
+	shutdown, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+
+	if redirect != nil {
+		redirect.Shutdown(shutdown)
+	}
+
+	if shutdownErr := s.httpServer.Shutdown(shutdown); shutdownErr != nil {
+		s.httpServer.Close()
+		if err == nil {
+			err = fmt.Errorf("unable to drain connections: %w", shutdownErr)
+		}
+	}
+
+	stopWorkers()
+	select {
+	case <-done:
+	case <-shutdown.Done():
+		if err == nil {
+			err = fmt.Errorf("background workers did not stop: %w", shutdown.Err())
+		}
+	}
+
+	if closeErr := s.close(); closeErr != nil && err == nil {
+		err = closeErr
 	}
 
-	c := make(chan os.Signal, 1)
-	// We'll accept graceful shutdowns when quit via SIGINT (Ctrl+C)
-	// SIGKILL, SIGQUIT or SIGTERM (Ctrl+/) will not be caught.
-	signal.Notify(c, syscall.SIGTERM)
+	if err == nil {
+		s.logger.Info("shut down cleanly")
+	}
+	return err
+}
+
+// startWorkers runs the background workers until ctx
+// is done.  The returned channel closes once all of
+// them have returned.
+func (s *Server) startWorkers(ctx context.Context) <-chan struct{} {
+
+	var wg sync.WaitGroup
+
+	if s.webhooks != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.webhooks.Run(ctx)
+		}()
+	}
+
+	if s.backups != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.backups.Run(ctx)
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return done
+}
+
+// close closes the store
+func (s *Server) close() error {
 
-	// Block until we receive our signal.
-	<-c
-	s.Shutdown()
+	if s.closer == nil {
+		return nil
+	}
 
+	err := s.closer.Close()
+	if err != nil {
+		return fmt.Errorf("unable to close store: %w", err)
+	}
 	return nil
 }
 
-// waitForServerRoute checks if the main route is reachable
-func WaitForServerRoute(url string) {
+// WaitForServerRoute blocks until addr, a host:port,
+// accepts tcp connections.  Each failed attempt is
+// logged at debug level to logger, which may be nil.
+func WaitForServerRoute(addr string, logger *Logger) {
+
+	if logger == nil {
+		logger = DiscardLogger()
+	}
 
 	for {
-		_, err := net.Dial("tcp", url)
-		if err == nil {
-			log.Println("tcp not listening")
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			logger.Debug("tcp not listening", "addr", addr, "error", err)
 			time.Sleep(100 * time.Millisecond)
 			continue
 		}
+		conn.Close()
 		break
 	}
 
 }
 
-func (s *Server) Shutdown() {
+// LoadTemplates parses the page templates
+func (s *Server) LoadTemplates() error {
 
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
-	defer cancel()
-	s.logger.Println("shutting down..")
-	s.httpServer.Shutdown(ctx)
-	os.Exit(0)
+	cache, err := NewTemplateCache()
+	if err != nil {
+		return err
+	}
+	s.templateCache = cache
+	return nil
+}
 
+// now is the current time in the server's zone
+func (s *Server) now() time.Time {
+	if s.location == nil {
+		return time.Now()
+	}
+	return time.Now().In(s.location)
+}
+
+// Handler returns the server's routes
+func (s *Server) Handler() http.Handler {
+	return s.routes()
 }
 
 func GetEnvironmentVariable(env string) (string, error) {
@@ -185,23 +766,37 @@ func GetEnvironmentVariable(env string) (string, error) {
 	return value, nil
 }
 
+// BuildDbConnection builds a Postgres DSN from
+// TIMETRACKER_DB_HOST, _PORT, _USER and _NAME
 func BuildDbConnection() (string, error) {
+	return buildDbConnection(os.Getenv)
+}
+
+func buildDbConnection(getenv func(string) string) (string, error) {
 
-	host, err := GetEnvironmentVariable("TIMETRACKER_DB_HOST")
+	lookup := func(env string) (string, error) {
+		value := getenv(env)
+		if value == "" {
+			return "", fmt.Errorf("problem getting environment variable: %s value not set", env)
+		}
+		return value, nil
+	}
+
+	host, err := lookup("TIMETRACKER_DB_HOST")
 	if err != nil {
-		return "", fmt.Errorf("problem getting environment variable: %s", err)
+		return "", err
 	}
-	port, err := GetEnvironmentVariable("TIMETRACKER_DB_PORT")
+	port, err := lookup("TIMETRACKER_DB_PORT")
 	if err != nil {
-		return "", fmt.Errorf("problem getting environment variable: %s", err)
+		return "", err
 	}
-	user, err := GetEnvironmentVariable("TIMETRACKER_DB_USER")
+	user, err := lookup("TIMETRACKER_DB_USER")
 	if err != nil {
-		return "", fmt.Errorf("problem getting environment variable: %s", err)
+		return "", err
 	}
-	dbname, err := GetEnvironmentVariable("TIMETRACKER_DB_NAME")
+	dbname, err := lookup("TIMETRACKER_DB_NAME")
 	if err != nil {
-		return "", fmt.Errorf("problem getting environment variable: %s", err)
+		return "", err
 	}
 
 	convertPort, err := strconv.Atoi(port)
@@ -217,13 +812,99 @@ func (s *Server) routes() http.Handler {
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", s.home)
+	mux.HandleFunc("/healthz", s.healthz)
+	mux.HandleFunc("/readyz", s.readyz)
 	mux.HandleFunc("/task/report", s.showTaskReport)
 	mux.HandleFunc("/task/create", s.createNewTaskForm)
 	mux.HandleFunc("/task/started", s.startedTask)
 	mux.HandleFunc("/task/stop", s.stopTask)
+	mux.HandleFunc("/task/notes", s.saveNotes)
+	mux.HandleFunc("/task/export", s.exportTasks)
+	mux.HandleFunc("/task/history", s.showHistory)
+	mux.HandleFunc("/api/task/history", s.apiAuth(ScopeRead, s.apiHistory))
+	mux.HandleFunc("/api/task/start", s.apiAuth(ScopeTimers, s.apiStartTask))
+	mux.HandleFunc("/api/task/stop", s.apiAuth(ScopeTimers, s.apiStopTask))
+	mux.HandleFunc("/search", s.search)
+	mux.HandleFunc("/api/search", s.apiAuth(ScopeRead, s.apiSearch))
+	mux.HandleFunc("/task/delete", s.deleteTask)
+
+	if s.PauseStore != nil {
+		mux.HandleFunc("/task/pause", s.pauseTask)
+		mux.HandleFunc("/task/resume", s.pauseTask)
+	}
+
+	if s.GoalStore != nil {
+		mux.HandleFunc("/goal", s.showGoals)
+		mux.HandleFunc("/goal/create", s.createGoal)
+		mux.HandleFunc("/goal/delete", s.deleteGoal)
+	}
+
+	if s.TemplateStore != nil {
+		mux.HandleFunc("/template", s.showTemplates)
+		mux.HandleFunc("/template/create", s.createTemplate)
+		mux.HandleFunc("/template/delete", s.deleteTemplate)
+		mux.HandleFunc("/template/start", s.startTemplate)
+	}
+
+	if s.ImportStore != nil {
+		mux.HandleFunc("/import", s.importCalendar)
+	}
 
 	fileServer := http.FileServer(http.FS(ui.Files))
 	mux.Handle("/static/", fileServer)
 
-	return mux
+	if s.WebhookStore != nil {
+		mux.HandleFunc("/webhook", s.showWebhooks)
+		mux.HandleFunc("/webhook/create", s.createWebhook)
+		mux.HandleFunc("/webhook/delete", s.deleteWebhook)
+		mux.HandleFunc("/webhook/deliveries", s.showDeliveries)
+	}
+
+	if s.APITokenStore != nil {
+		mux.HandleFunc("/settings/tokens", s.showTokens)
+		mux.HandleFunc("/settings/tokens/create", s.createToken)
+		mux.HandleFunc("/settings/tokens/revoke", s.revokeToken)
+		mux.HandleFunc("/calendar.ics", s.calendar)
+	}
+
+	if s.WorkspaceStore != nil {
+		mux.HandleFunc("/login", s.login)
+		mux.HandleFunc("/logout", s.logout)
+		mux.HandleFunc("/invite", s.showInvitation)
+		mux.HandleFunc("/invite/accept", s.acceptInvitation)
+		mux.HandleFunc("/workspace", s.showWorkspaces)
+		mux.HandleFunc("/workspace/create", s.createWorkspace)
+		mux.HandleFunc("/workspace/view", s.showWorkspace)
+		mux.HandleFunc("/workspace/report", s.showTeamReport)
+		mux.HandleFunc("/workspace/invite", s.inviteMember)
+		mux.HandleFunc("/workspace/invite/delete", s.deleteInvitation)
+		mux.HandleFunc("/workspace/member/role", s.setMemberRole)
+		mux.HandleFunc("/workspace/member/remove", s.removeMember)
+		mux.HandleFunc("/workspace/project/add", s.addWorkspaceProject)
+		mux.HandleFunc("/workspace/project/remove", s.removeWorkspaceProject)
+	}
+
+	if s.AuditStore != nil {
+		mux.HandleFunc("/audit", s.showAuditLog)
+		mux.HandleFunc("/audit/restore", s.restoreTask)
+		mux.HandleFunc("/api/audit", s.apiAuth(ScopeRead, s.apiAuditLog))
+	}
+
+	var handler http.Handler = mux
+	if s.metrics != nil {
+		mux.HandleFunc("/metrics", s.serveMetrics)
+		handler = s.metrics.Middleware(mux)
+	}
+
+	if s.WorkspaceStore != nil {
+		handler = s.identify(handler)
+	}
+
+	handler = SecureHeaders(CSRF(handler))
+
+	if s.tls != nil {
+		handler = hsts(handler)
+	}
+
+	return AccessLog(s.logger, handler)
 }
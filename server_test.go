@@ -5,7 +5,6 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -19,14 +18,14 @@ import (
 func TestRenderHomePage(t *testing.T) {
 	t.Parallel()
 
-	startTime, err := time.Parse(time.RFC3339, "2021-01-01T00:00:00+00:00")
-	if err != nil {
-		t.Fatal(err)
-	}
+	startTime := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
 
 	tasks := []timetracker.Task{
 		{
 			Name:           "piano",
+			Project:        "music",
+			Tags:           []string{"practice", "scales"},
+			Notes:          "C major, **hands together**",
 			StartTime:      startTime,
 			ElapsedTimeSec: 10.0,
 		},
@@ -37,7 +36,14 @@ func TestRenderHomePage(t *testing.T) {
 		},
 	}
 
-	data := timetracker.TemplateData{Tasks: tasks}
+	templates := []timetracker.TaskTemplate{
+		{
+			Id:   1,
+			Name: "standup",
+		},
+	}
+
+	data := timetracker.TemplateData{Tasks: tasks, Templates: templates}
 
 	templateCache, err := timetracker.NewTemplateCache()
 	if err != nil {
@@ -55,7 +61,7 @@ func TestRenderHomePage(t *testing.T) {
 		data.Render(w, r)
 	}))
 
-	WaitForServerRoute(ts.URL)
+	timetracker.WaitForServerRoute(ts.Listener.Addr().String(), nil)
 
 	client := ts.Client()
 
@@ -99,7 +105,18 @@ func TestRenderTaskReportPage(t *testing.T) {
 		},
 	}
 
-	data := timetracker.TemplateData{Reports: reports}
+	goals := []timetracker.GoalProgress{
+		{
+			Goal:  timetracker.Goal{Id: 1, Name: "piano", Scope: "task", Kind: "target", Period: "weekly", Target: 36000},
+			Spent: 18000,
+		},
+		{
+			Goal:  timetracker.Goal{Id: 2, Name: "website", Scope: "project", Kind: "budget", Period: "total", Target: 3600},
+			Spent: 5400,
+		},
+	}
+
+	data := timetracker.TemplateData{Reports: reports, Goals: goals}
 
 	templateCache, err := timetracker.NewTemplateCache()
 	if err != nil {
@@ -118,7 +135,7 @@ func TestRenderTaskReportPage(t *testing.T) {
 		data.Render(w, r)
 	}))
 
-	WaitForServerRoute(ts.URL)
+	timetracker.WaitForServerRoute(ts.Listener.Addr().String(), nil)
 
 	client := ts.Client()
 
@@ -147,17 +164,3 @@ func TestRenderTaskReportPage(t *testing.T) {
 	}
 
 }
-
-func WaitForServerRoute(url string) {
-
-	for {
-		_, err := net.Dial("tcp", url)
-		if err == nil {
-			log.Println("tcp not listening")
-			time.Sleep(100 * time.Millisecond)
-			continue
-		}
-		break
-	}
-
-}
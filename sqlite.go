@@ -0,0 +1,416 @@
+package timetracker
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// SQLITE_BUSY_TIMEOUT is how long a statement waits
+	// for another connection's write lock before failing
+	// with "database is locked"
+	SQLITE_BUSY_TIMEOUT time.Duration = 5 * time.Second
+
+	// SQLITE_MAX_OPEN_CONNS limits the connections to
+	// one database file.  SQLite allows one writer at a
+	// time, so more connections only add lock waits.
+	SQLITE_MAX_OPEN_CONNS int = 4
+
+	SQLITE_JOURNAL_MODE string = "WAL"
+)
+
+//go:embed store/sqlite/sqlite_init.sql store/sqlite/sqlite_fts.sql
+var sqliteSchema embed.FS
+
+// sqliteColumns were added to tables after they were
+// first created.  CREATE TABLE IF NOT EXISTS leaves an
+// existing table alone, so databases created before a
+// column existed have it added when they are opened.
+var sqliteColumns = []struct {
+	table, column, definition string
+}{
+	{"tasks", "project", "TEXT NOT NULL DEFAULT ''"},
+	{"tasks", "tags", "TEXT NOT NULL DEFAULT ''"},
+	{"tasks", "notes", "TEXT NOT NULL DEFAULT ''"},
+	{"tasks", "user_id", "INTEGER NOT NULL DEFAULT 1"},
+	{"tasks", "deleted_at", "TIMESTAMP"},
+	{"task_session", "user_id", "INTEGER NOT NULL DEFAULT 1"},
+	{"goals", "user_id", "INTEGER NOT NULL DEFAULT 1"},
+	{"task_templates", "user_id", "INTEGER NOT NULL DEFAULT 1"},
+	{"webhooks", "user_id", "INTEGER NOT NULL DEFAULT 1"},
+}
+
+// sqliteForeignKeyTables reference another table.
+// Databases created before they had foreign keys
+// have them rebuilt when they are opened.
+var sqliteForeignKeyTables = []string{
+	"webhook_deliveries",
+	"api_tokens",
+	"user_sessions",
+	"workspace_members",
+	"workspace_invitations",
+	"workspace_projects",
+}
+
+var sqliteJournalModes = []string{"DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF"}
+
+type sqliteOptions struct {
+	journalMode  string
+	foreignKeys  bool
+	busyTimeout  time.Duration
+	maxOpenConns int
+}
+
+// SqliteOption changes how NewSqliteStore opens
+// a database
+type SqliteOption func(*sqliteOptions)
+
+// SqliteJournalMode sets the journal mode, WAL by
+// default, which lets reads run alongside a write
+func SqliteJournalMode(mode string) SqliteOption {
+	return func(o *sqliteOptions) {
+		o.journalMode = strings.ToUpper(mode)
+	}
+}
+
+// SqliteForeignKeys turns enforcement of foreign
+// keys on or off.  It is on by default, so deleting
+// a webhook or workspace deletes the rows that
+// reference it.
+func SqliteForeignKeys(on bool) SqliteOption {
+	return func(o *sqliteOptions) {
+		o.foreignKeys = on
+	}
+}
+
+// SqliteBusyTimeout sets how long a statement waits
+// for a lock, SQLITE_BUSY_TIMEOUT by default
+func SqliteBusyTimeout(d time.Duration) SqliteOption {
+	return func(o *sqliteOptions) {
+		o.busyTimeout = d
+	}
+}
+
+// SqliteMaxOpenConns limits the open connections,
+// SQLITE_MAX_OPEN_CONNS by default
+func SqliteMaxOpenConns(n int) SqliteOption {
+	return func(o *sqliteOptions) {
+		o.maxOpenConns = n
+	}
+}
+
+// NewSqliteStore opens the database file at path,
+// creating it and any missing tables and columns.
+// Full text search needs FTS5, which go-sqlite3 only
+// compiles in with the sqlite_fts5 build tag; without
+// it search falls back to matching words as substrings.
+// The pure Go driver always has FTS5.
+func NewSqliteStore(path string, opts ...SqliteOption) (*DBStore, error) {
+
+	if path == "" {
+		return nil, fmt.Errorf("sqlite path must not be empty")
+	}
+
+	o := sqliteOptions{
+		journalMode:  SQLITE_JOURNAL_MODE,
+		foreignKeys:  true,
+		busyTimeout:  SQLITE_BUSY_TIMEOUT,
+		maxOpenConns: SQLITE_MAX_OPEN_CONNS,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if !containsString(sqliteJournalModes, o.journalMode) {
+		return nil, fmt.Errorf("unknown sqlite journal mode %q", o.journalMode)
+	}
+	if o.busyTimeout < 0 {
+		return nil, fmt.Errorf("sqlite busy timeout must not be negative")
+	}
+	if o.maxOpenConns < 1 {
+		return nil, fmt.Errorf("sqlite needs at least one open connection")
+	}
+
+	// every connection to an in-memory database
+	// gets a database of its own
+	if strings.Contains(path, ":memory:") || strings.Contains(path, "mode=memory") {
+		o.maxOpenConns = 1
+	}
+
+	db, err := sql.Open(SQLITE_DRIVER, sqliteDSN(path, o))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(o.maxOpenConns)
+	db.SetMaxIdleConns(o.maxOpenConns)
+
+	fts, err := migrateSqlite(db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to set up sqlite database %s: %w", path, err)
+	}
+
+	return &DBStore{Db: db, Driver: "sqlite3", noFTS: !fts}, nil
+}
+
+// sqliteDSN is path as a URI with the pragmas every
+// connection is opened with.  Write transactions take
+// the lock when they begin, so two transactions never
+// deadlock upgrading a read lock.
+func sqliteDSN(path string, o sqliteOptions) string {
+
+	params := sqliteParams(o)
+
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	if !strings.HasPrefix(path, "file:") {
+		path = "file:" + strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(path)
+		sep = "?"
+	}
+	return path + sep + params.Encode()
+}
+
+// migrateSqlite brings the schema of db up to date in
+// one transaction.  Every statement is safe to run on
+// a database that already has the schema.  It reports
+// whether the full text index could be created.
+func migrateSqlite(db *sql.DB) (bool, error) {
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	err = execSQLFile(tx, "store/sqlite/sqlite_init.sql")
+	if err != nil {
+		return false, err
+	}
+
+	for _, c := range sqliteColumns {
+		columns, err := sqliteTableColumns(tx, c.table)
+		if err != nil {
+			return false, err
+		}
+		if containsString(columns, c.column) {
+			continue
+		}
+		_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.column, c.definition))
+		if err != nil {
+			return false, fmt.Errorf("unable to add %s.%s: %w", c.table, c.column, err)
+		}
+	}
+
+	err = migrateImportedEvents(tx)
+	if err != nil {
+		return false, err
+	}
+
+	err = migrateForeignKeys(tx)
+	if err != nil {
+		return false, err
+	}
+
+	var indexed int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name='tasks_fts'`).Scan(&indexed)
+	if err != nil {
+		return false, err
+	}
+
+	err = execSQLFile(tx, "store/sqlite/sqlite_fts.sql")
+	if err != nil && strings.Contains(err.Error(), "no such module: fts5") {
+		// built without sqlite_fts5, search falls back
+		// to substrings
+		return false, tx.Commit()
+	}
+	if err != nil {
+		return false, err
+	}
+
+	// tasks saved before the index existed
+	if indexed == 0 {
+		_, err = tx.Exec(`INSERT INTO tasks_fts(tasks_fts) VALUES('rebuild')`)
+		if err != nil {
+			return false, fmt.Errorf("unable to index tasks: %w", err)
+		}
+	}
+
+	return true, tx.Commit()
+}
+
+func execSQLFile(tx *sql.Tx, name string) error {
+
+	file, err := sqliteSchema.ReadFile(name)
+	if err != nil {
+		return err
+	}
+
+	for _, q := range splitSQL(string(file)) {
+		_, err := tx.Exec(q)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func sqliteTableColumns(tx *sql.Tx, table string) ([]string, error) {
+
+	rows, err := tx.Query(fmt.Sprintf("SELECT name FROM pragma_table_info('%s')", table))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var name string
+		err := rows.Scan(&name)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read columns of %s: %w", table, err)
+		}
+		columns = append(columns, name)
+	}
+	return columns, rows.Err()
+}
+
+// migrateImportedEvents rebuilds an imported_events table
+// keyed by uid alone, so that the same event can be
+// imported once per user.  SQLite cannot change a primary
+// key in place.  Events belong to the owner of the task
+// they became.
+func migrateImportedEvents(tx *sql.Tx) error {
+
+	columns, err := sqliteTableColumns(tx, "imported_events")
+	if err != nil {
+		return err
+	}
+	if containsString(columns, "user_id") {
+		return nil
+	}
+
+	for _, stmt := range []string{
+		`ALTER TABLE imported_events RENAME TO imported_events_old`,
+		`CREATE TABLE imported_events(uid TEXT NOT NULL, task_id INTEGER NOT NULL, user_id INTEGER NOT NULL DEFAULT 1, PRIMARY KEY (user_id, uid))`,
+		`INSERT INTO imported_events(uid, task_id, user_id) SELECT e.uid, e.task_id, COALESCE(t.user_id, 1) FROM imported_events_old e LEFT JOIN tasks t ON t.id=e.task_id`,
+		`DROP TABLE imported_events_old`,
+	} {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return fmt.Errorf("unable to migrate imported_events: %w", err)
+		}
+	}
+	return nil
+}
+
+// migrateForeignKeys rebuilds the tables in
+// sqliteForeignKeyTables that have no foreign keys.
+// SQLite cannot add a constraint to a table, so each
+// is renamed, created again from the schema and its
+// rows copied back, leaving out rows whose parent
+// is gone.
+func migrateForeignKeys(tx *sql.Tx) error {
+
+	var rebuilt []string
+	for _, table := range sqliteForeignKeyTables {
+		var keys int
+		err := tx.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM pragma_foreign_key_list('%s')", table)).Scan(&keys)
+		if err != nil {
+			return fmt.Errorf("unable to read foreign keys of %s: %w", table, err)
+		}
+		if keys > 0 {
+			continue
+		}
+
+		// indexes move with the table and would stop
+		// the schema from creating them again
+		indexes, err := sqliteTableIndexes(tx, table)
+		if err != nil {
+			return err
+		}
+		for _, index := range indexes {
+			_, err := tx.Exec("DROP INDEX " + index)
+			if err != nil {
+				return fmt.Errorf("unable to drop index %s: %w", index, err)
+			}
+		}
+
+		_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s RENAME TO %s_old", table, table))
+		if err != nil {
+			return fmt.Errorf("unable to rebuild %s: %w", table, err)
+		}
+		rebuilt = append(rebuilt, table)
+	}
+	if len(rebuilt) == 0 {
+		return nil
+	}
+
+	err := execSQLFile(tx, "store/sqlite/sqlite_init.sql")
+	if err != nil {
+		return err
+	}
+
+	for _, table := range rebuilt {
+		columns, err := sqliteTableColumns(tx, table+"_old")
+		if err != nil {
+			return err
+		}
+
+		parents, err := tx.Query(fmt.Sprintf(`SELECT "table", "from", "to" FROM pragma_foreign_key_list('%s')`, table))
+		if err != nil {
+			return fmt.Errorf("unable to read foreign keys of %s: %w", table, err)
+		}
+		var where []string
+		for parents.Next() {
+			var parent, from, to string
+			err := parents.Scan(&parent, &from, &to)
+			if err != nil {
+				parents.Close()
+				return fmt.Errorf("unable to read foreign keys of %s: %w", table, err)
+			}
+			where = append(where, fmt.Sprintf("%s IN (SELECT %s FROM %s)", from, to, parent))
+		}
+		parents.Close()
+		if err := parents.Err(); err != nil {
+			return fmt.Errorf("unable to read foreign keys of %s: %w", table, err)
+		}
+
+		list := strings.Join(columns, ", ")
+		_, err = tx.Exec(fmt.Sprintf("INSERT INTO %s(%s) SELECT %s FROM %s_old WHERE %s", table, list, list, table, strings.Join(where, " AND ")))
+		if err != nil {
+			return fmt.Errorf("unable to rebuild %s: %w", table, err)
+		}
+		_, err = tx.Exec(fmt.Sprintf("DROP TABLE %s_old", table))
+		if err != nil {
+			return fmt.Errorf("unable to rebuild %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// sqliteTableIndexes are the indexes created on table,
+// leaving out the ones SQLite makes for its keys
+func sqliteTableIndexes(tx *sql.Tx, table string) ([]string, error) {
+
+	rows, err := tx.Query(`SELECT name FROM sqlite_master WHERE type='index' AND tbl_name=$1 AND sql IS NOT NULL`, table)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read indexes of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	var indexes []string
+	for rows.Next() {
+		var name string
+		err := rows.Scan(&name)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read indexes of %s: %w", table, err)
+		}
+		indexes = append(indexes, name)
+	}
+	return indexes, rows.Err()
+}
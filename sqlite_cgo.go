@@ -0,0 +1,78 @@
+//go:build cgo && !sqlite_purego
+// +build cgo,!sqlite_purego
+
+package timetracker
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// SQLITE_DRIVER is the database/sql driver SQLite
+// stores are opened with.  Builds with cgo use
+// go-sqlite3; build with the sqlite_purego tag or
+// CGO_ENABLED=0 for the pure Go driver.
+const SQLITE_DRIVER string = "sqlite3"
+
+// sqliteParams are the go-sqlite3 DSN parameters
+// setting the pragmas of each connection
+func sqliteParams(o sqliteOptions) url.Values {
+
+	foreignKeys := "0"
+	if o.foreignKeys {
+		foreignKeys = "1"
+	}
+
+	params := url.Values{}
+	params.Set("_journal_mode", o.journalMode)
+	params.Set("_busy_timeout", fmt.Sprint(o.busyTimeout.Milliseconds()))
+	params.Set("_foreign_keys", foreignKeys)
+	params.Set("_txlock", "immediate")
+	return params
+}
+
+// sqliteRestore copies the database file at path over
+// the database of conn with SQLite's online backup API
+func sqliteRestore(ctx context.Context, conn interface{}, path string) error {
+
+	dst, ok := conn.(*sqlite3.SQLiteConn)
+	if !ok {
+		return fmt.Errorf("restore needs the go-sqlite3 driver")
+	}
+
+	db, err := sql.Open(SQLITE_DRIVER, "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	srcConn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to open backup: %w", err)
+	}
+	defer srcConn.Close()
+
+	return srcConn.Raw(func(sc interface{}) error {
+
+		src, ok := sc.(*sqlite3.SQLiteConn)
+		if !ok {
+			return fmt.Errorf("restore needs the go-sqlite3 driver")
+		}
+
+		b, err := dst.Backup("main", src, "main")
+		if err != nil {
+			return fmt.Errorf("unable to start restore: %w", err)
+		}
+
+		_, err = b.Step(-1)
+		if err != nil {
+			b.Finish()
+			return fmt.Errorf("unable to restore: %w", err)
+		}
+		return b.Finish()
+	})
+}
@@ -0,0 +1,66 @@
+//go:build !cgo || sqlite_purego
+// +build !cgo sqlite_purego
+
+package timetracker
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"modernc.org/sqlite"
+)
+
+// SQLITE_DRIVER is the database/sql driver SQLite
+// stores are opened with.  Builds without cgo, or with
+// the sqlite_purego tag, use the pure Go driver, which
+// includes FTS5.
+const SQLITE_DRIVER string = "sqlite"
+
+// sqliteParams are the modernc.org/sqlite DSN parameters
+// setting the pragmas of each connection.  Times are
+// written the way go-sqlite3 writes them, so a database
+// can be opened by builds with either driver.
+func sqliteParams(o sqliteOptions) url.Values {
+
+	foreignKeys := "0"
+	if o.foreignKeys {
+		foreignKeys = "1"
+	}
+
+	params := url.Values{}
+	params.Add("_pragma", fmt.Sprintf("journal_mode(%s)", o.journalMode))
+	params.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", o.busyTimeout.Milliseconds()))
+	params.Add("_pragma", fmt.Sprintf("foreign_keys(%s)", foreignKeys))
+	params.Set("_txlock", "immediate")
+	params.Set("_time_format", "sqlite")
+	return params
+}
+
+// restorer is the online backup API of a
+// modernc.org/sqlite connection
+type restorer interface {
+	NewRestore(string) (*sqlite.Backup, error)
+}
+
+// sqliteRestore copies the database file at path over
+// the database of conn with SQLite's online backup API
+func sqliteRestore(ctx context.Context, conn interface{}, path string) error {
+
+	dst, ok := conn.(restorer)
+	if !ok {
+		return fmt.Errorf("restore needs the modernc.org/sqlite driver")
+	}
+
+	b, err := dst.NewRestore("file:" + path + "?mode=ro")
+	if err != nil {
+		return fmt.Errorf("unable to start restore: %w", err)
+	}
+
+	_, err = b.Step(-1)
+	if err != nil {
+		b.Finish()
+		return fmt.Errorf("unable to restore: %w", err)
+	}
+	return b.Finish()
+}
@@ -0,0 +1,275 @@
+package timetracker_test
+
+import (
+	"database/sql"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+	"timetracker"
+)
+
+func TestSqliteStoreReopen(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "timetracker.db")
+
+	store, err := timetracker.NewSqliteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Create(timetracker.Task{Name: "deploy", StartTime: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = timetracker.NewSqliteStore(path, timetracker.SqliteBusyTimeout(2*time.Second))
+	if err != nil {
+		t.Fatalf("reopen: %s", err)
+	}
+	defer store.Close()
+
+	if got := taskNames(t, store); len(got) != 1 {
+		t.Errorf("want: the task saved before, got: %v", got)
+	}
+
+	for pragma, want := range map[string]string{
+		"journal_mode": "wal",
+		"foreign_keys": "1",
+		"busy_timeout": "2000",
+	} {
+		var got string
+		err := store.Db.QueryRow("PRAGMA " + pragma).Scan(&got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want != got {
+			t.Errorf("%s: want: %s, got: %s", pragma, want, got)
+		}
+	}
+
+	if got := store.Db.Stats().MaxOpenConnections; got != timetracker.SQLITE_MAX_OPEN_CONNS {
+		t.Errorf("want: at most %d connections, got: %d", timetracker.SQLITE_MAX_OPEN_CONNS, got)
+	}
+
+}
+
+func TestSqliteStoreMigratesOldSchema(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "timetracker.db")
+
+	// the schema of the first release
+	db, err := sql.Open(timetracker.SQLITE_DRIVER, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{
+		"CREATE TABLE tasks (id INTEGER PRIMARY KEY, task_name TEXT NOT NULL, start_time TIMESTAMP NOT NULL, elapsed_time NUMERIC DEFAULT 0)",
+		"CREATE TABLE task_session(taskid INTEGER)",
+		"INSERT INTO tasks(task_name, start_time, elapsed_time) VALUES('piano', '2021-01-01 09:00:00+00:00', 600)",
+	} {
+		_, err := db.Exec(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	store, err := timetracker.NewSqliteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	tasks, err := store.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tasks) != 1 || tasks[0].Name != "piano" || tasks[0].ElapsedTimeSec != 600 {
+		t.Errorf("want: piano kept, got: %+v", tasks)
+	}
+
+	_, err = store.Create(timetracker.Task{Name: "scales", Project: "music", StartTime: time.Now()})
+	if err != nil {
+		t.Errorf("want: new columns usable, got: %s", err)
+	}
+
+}
+
+func TestSqliteStoreMigratesImportedEvents(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "timetracker.db")
+
+	// imported_events keyed by uid alone
+	db, err := sql.Open(timetracker.SQLITE_DRIVER, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{
+		"CREATE TABLE tasks (id INTEGER PRIMARY KEY, task_name TEXT NOT NULL, start_time TIMESTAMP NOT NULL, elapsed_time NUMERIC DEFAULT 0)",
+		"CREATE TABLE imported_events(uid TEXT PRIMARY KEY, task_id INTEGER NOT NULL)",
+		"INSERT INTO tasks(task_name, start_time, elapsed_time) VALUES('standup', '2021-01-01 09:00:00+00:00', 900)",
+		"INSERT INTO imported_events(uid, task_id) VALUES('standup@example.com', 1)",
+	} {
+		_, err := db.Exec(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	store := newSqliteStore(t, path)
+
+	for _, tc := range []struct {
+		userId int
+		want   bool
+	}{{timetracker.LOCAL_USER_ID, true}, {2, false}} {
+		got, err := store.IsImported(tc.userId, "standup@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.want != got {
+			t.Errorf("user %d: want imported: %t, got: %t", tc.userId, tc.want, got)
+		}
+	}
+
+	_, err = store.ImportTask("standup@example.com", timetracker.Task{Name: "standup", StartTime: time.Now(), UserId: 2})
+	if err != nil {
+		t.Errorf("want: another user may import the same event, got: %s", err)
+	}
+
+}
+
+func TestSqliteStoreMigratesForeignKeys(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "timetracker.db")
+
+	// webhook_deliveries without a foreign key and
+	// a delivery left behind by a deleted webhook
+	db, err := sql.Open(timetracker.SQLITE_DRIVER, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{
+		"CREATE TABLE webhooks(id INTEGER PRIMARY KEY, url TEXT NOT NULL, secret TEXT NOT NULL, events TEXT NOT NULL)",
+		"CREATE TABLE webhook_deliveries(id INTEGER PRIMARY KEY, webhook_id INTEGER NOT NULL, event TEXT NOT NULL, payload TEXT NOT NULL, status TEXT NOT NULL, attempts INTEGER NOT NULL DEFAULT 0, response_code INTEGER NOT NULL DEFAULT 0, error TEXT NOT NULL DEFAULT '', next_attempt TIMESTAMP NOT NULL, created_at TIMESTAMP NOT NULL)",
+		"CREATE INDEX webhook_deliveries_due_idx ON webhook_deliveries (status, next_attempt)",
+		"INSERT INTO webhooks(url, secret, events) VALUES('https://example.com/hook', 's3cret', 'task.started')",
+		"INSERT INTO webhook_deliveries(webhook_id, event, payload, status, next_attempt, created_at) VALUES(1, 'task.started', '{}', 'pending', '2021-01-01 09:00:00+00:00', '2021-01-01 09:00:00+00:00')",
+		"INSERT INTO webhook_deliveries(webhook_id, event, payload, status, next_attempt, created_at) VALUES(7, 'task.started', '{}', 'pending', '2021-01-01 09:00:00+00:00', '2021-01-01 09:00:00+00:00')",
+	} {
+		_, err := db.Exec(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	store := newSqliteStore(t, path)
+
+	var keys, indexes int
+	err = store.Db.QueryRow("SELECT COUNT(*) FROM pragma_foreign_key_list('webhook_deliveries')").Scan(&keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name='webhook_deliveries_due_idx'").Scan(&indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys != 1 || indexes != 1 {
+		t.Errorf("want: 1 foreign key and the due index, got: %d keys, %d indexes", keys, indexes)
+	}
+
+	deliveries, err := store.GetDeliveries(timetracker.ALL_USERS, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].WebhookId != 1 {
+		t.Errorf("want: the delivery of webhook 1 kept, got: %+v", deliveries)
+	}
+
+	_, err = store.CreateDelivery(timetracker.WebhookDelivery{WebhookId: 7, Event: "task.started", Payload: "{}", Status: timetracker.DeliveryPending})
+	if err == nil {
+		t.Error("want: a delivery for a missing webhook refused")
+	}
+
+	// a new session needs its user
+	_, err = store.Db.Exec("INSERT INTO user_sessions(hash, user_id, expires_at) VALUES('abc', 99, CURRENT_TIMESTAMP)")
+	if err == nil {
+		t.Error("want: a session for a missing user refused")
+	}
+
+}
+
+func TestSqliteStoreConcurrentWrites(t *testing.T) {
+	t.Parallel()
+
+	store := newSqliteStore(t, filepath.Join(t.TempDir(), "timetracker.db"))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for w := 0; w < 10; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				id, err := store.Create(timetracker.Task{Name: "deploy", StartTime: time.Now()})
+				if err == nil {
+					err = store.UpdateNotes(timetracker.Task{Id: id, Notes: "shipped"})
+				}
+				if err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if got := taskNames(t, store); len(got) != 100 {
+		t.Errorf("want: 100 tasks, got: %d", len(got))
+	}
+
+}
+
+func TestSqliteStoreOptions(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	for name, opts := range map[string][]timetracker.SqliteOption{
+		"journal mode": {timetracker.SqliteJournalMode("sideways")},
+		"connections":  {timetracker.SqliteMaxOpenConns(0)},
+		"busy timeout": {timetracker.SqliteBusyTimeout(-time.Second)},
+	} {
+		_, err := timetracker.NewSqliteStore(filepath.Join(dir, "timetracker.db"), opts...)
+		if err == nil {
+			t.Errorf("%s: want: error, got: nil", name)
+		}
+	}
+
+	_, err := timetracker.NewSqliteStore("")
+	if err == nil {
+		t.Error("empty path: want: error, got: nil")
+	}
+
+	store, err := timetracker.NewSqliteStore(filepath.Join(dir, "delete.db"), timetracker.SqliteJournalMode("delete"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	var mode string
+	err = store.Db.QueryRow("PRAGMA journal_mode").Scan(&mode)
+	if err != nil || mode != "delete" {
+		t.Errorf("want: delete journal, got: %q, %v", mode, err)
+	}
+
+}
@@ -1,11 +1,276 @@
 CREATE TABLE IF NOT EXISTS tasks (
     id SERIAL PRIMARY KEY,
     task_name VARCHAR(255) NOT NULL,
+    project VARCHAR(255) NOT NULL DEFAULT '',
+    tags TEXT NOT NULL DEFAULT '',
+    notes TEXT NOT NULL DEFAULT '',
     start_time TIMESTAMP NOT NULL,
-    elapsed_time NUMERIC DEFAULT 0
+    elapsed_time NUMERIC DEFAULT 0,
+    user_id INTEGER NOT NULL DEFAULT 1,
+    deleted_at TIMESTAMP,
+    search tsvector GENERATED ALWAYS AS (to_tsvector('english', task_name || ' ' || notes)) STORED
 );
 
 
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS project VARCHAR(255) NOT NULL DEFAULT '';
+
+
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS tags TEXT NOT NULL DEFAULT '';
+
+
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS notes TEXT NOT NULL DEFAULT '';
+
+
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS search tsvector GENERATED ALWAYS AS (to_tsvector('english', task_name || ' ' || notes)) STORED;
+
+
+CREATE INDEX IF NOT EXISTS tasks_search_idx ON tasks USING GIN (search);
+
+
 CREATE TABLE IF NOT EXISTS task_session(
-    taskid INTEGER
-);
\ No newline at end of file
+    taskid INTEGER,
+    user_id INTEGER NOT NULL DEFAULT 1 PRIMARY KEY
+);
+
+
+CREATE TABLE IF NOT EXISTS goals(
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    scope VARCHAR(16) NOT NULL,
+    kind VARCHAR(16) NOT NULL,
+    period VARCHAR(16) NOT NULL,
+    target NUMERIC NOT NULL,
+    user_id INTEGER NOT NULL DEFAULT 1
+);
+
+
+CREATE TABLE IF NOT EXISTS task_templates(
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    project VARCHAR(255) NOT NULL DEFAULT '',
+    tags TEXT NOT NULL DEFAULT '',
+    notes TEXT NOT NULL DEFAULT '',
+    user_id INTEGER NOT NULL DEFAULT 1
+);
+
+
+CREATE TABLE IF NOT EXISTS imported_events(
+    uid TEXT NOT NULL,
+    task_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL DEFAULT 1,
+    PRIMARY KEY (user_id, uid)
+);
+
+
+CREATE TABLE IF NOT EXISTS webhooks(
+    id SERIAL PRIMARY KEY,
+    url TEXT NOT NULL,
+    secret VARCHAR(255) NOT NULL,
+    events TEXT NOT NULL,
+    user_id INTEGER NOT NULL DEFAULT 1
+);
+
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries(
+    id SERIAL PRIMARY KEY,
+    webhook_id INTEGER NOT NULL,
+    event VARCHAR(32) NOT NULL,
+    payload TEXT NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    response_code INTEGER NOT NULL DEFAULT 0,
+    error TEXT NOT NULL DEFAULT '',
+    next_attempt TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (status, next_attempt);
+
+
+CREATE TABLE IF NOT EXISTS api_tokens(
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL DEFAULT 1,
+    name VARCHAR(255) NOT NULL,
+    prefix VARCHAR(16) NOT NULL,
+    hash CHAR(64) NOT NULL UNIQUE,
+    scopes VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP,
+    last_used_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS user_id INTEGER NOT NULL DEFAULT 1;
+
+
+ALTER TABLE api_tokens ADD COLUMN IF NOT EXISTS user_id INTEGER NOT NULL DEFAULT 1;
+
+
+ALTER TABLE task_session ADD COLUMN IF NOT EXISTS user_id INTEGER NOT NULL DEFAULT 1;
+
+
+ALTER TABLE task_session DROP COLUMN IF EXISTS userName;
+
+
+DELETE FROM task_session a USING task_session b WHERE a.user_id = b.user_id AND a.ctid < b.ctid;
+
+
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conrelid = 'task_session'::regclass AND contype = 'p') THEN
+        ALTER TABLE task_session ADD PRIMARY KEY (user_id);
+    END IF;
+END;
+$$;
+
+
+CREATE TABLE IF NOT EXISTS users(
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    email VARCHAR(255) NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL
+);
+
+
+INSERT INTO users(id, name, email, created_at) VALUES(1, 'me', '', now()) ON CONFLICT DO NOTHING;
+
+
+SELECT setval('users_id_seq', (SELECT MAX(id) FROM users));
+
+
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+
+
+CREATE TABLE IF NOT EXISTS audit_log(
+    id SERIAL PRIMARY KEY,
+    task_id INTEGER NOT NULL,
+    action VARCHAR(16) NOT NULL,
+    actor_id INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    before_value TEXT NOT NULL DEFAULT '',
+    after_value TEXT NOT NULL DEFAULT ''
+);
+
+
+CREATE INDEX IF NOT EXISTS audit_log_task_idx ON audit_log (task_id);
+
+
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+
+DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log;
+
+
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
+
+
+CREATE TABLE IF NOT EXISTS user_sessions(
+    hash CHAR(64) PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+
+CREATE TABLE IF NOT EXISTS workspaces(
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+
+CREATE TABLE IF NOT EXISTS workspace_members(
+    workspace_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL,
+    role VARCHAR(16) NOT NULL,
+    joined_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (workspace_id, user_id)
+);
+
+
+CREATE TABLE IF NOT EXISTS workspace_invitations(
+    id SERIAL PRIMARY KEY,
+    workspace_id INTEGER NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    role VARCHAR(16) NOT NULL,
+    hash CHAR(64) NOT NULL UNIQUE,
+    invited_by INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    accepted_at TIMESTAMP
+);
+
+
+CREATE TABLE IF NOT EXISTS workspace_projects(
+    workspace_id INTEGER NOT NULL,
+    project VARCHAR(255) NOT NULL,
+    PRIMARY KEY (workspace_id, project)
+);
+
+
+ALTER TABLE goals ADD COLUMN IF NOT EXISTS user_id INTEGER NOT NULL DEFAULT 1;
+
+
+ALTER TABLE task_templates ADD COLUMN IF NOT EXISTS user_id INTEGER NOT NULL DEFAULT 1;
+
+
+ALTER TABLE webhooks ADD COLUMN IF NOT EXISTS user_id INTEGER NOT NULL DEFAULT 1;
+
+
+ALTER TABLE imported_events ADD COLUMN IF NOT EXISTS user_id INTEGER NOT NULL DEFAULT 1;
+
+
+-- events imported before they had an owner belong to
+-- the owner of the task they became, and the same event
+-- can be imported once per user
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM pg_constraint WHERE conrelid = 'imported_events'::regclass AND contype = 'p' AND array_length(conkey, 1) = 1) THEN
+        UPDATE imported_events e SET user_id = t.user_id FROM tasks t WHERE t.id = e.task_id;
+        ALTER TABLE imported_events DROP CONSTRAINT imported_events_pkey;
+        ALTER TABLE imported_events ADD PRIMARY KEY (user_id, uid);
+    END IF;
+END;
+$$;
+
+
+-- rows left behind by a deleted parent are removed
+-- before the foreign keys are added
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'webhook_deliveries_webhook_id_fkey') THEN
+        DELETE FROM webhook_deliveries WHERE webhook_id NOT IN (SELECT id FROM webhooks);
+        ALTER TABLE webhook_deliveries ADD CONSTRAINT webhook_deliveries_webhook_id_fkey FOREIGN KEY (webhook_id) REFERENCES webhooks(id) ON DELETE CASCADE;
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'api_tokens_user_id_fkey') THEN
+        DELETE FROM api_tokens WHERE user_id NOT IN (SELECT id FROM users);
+        ALTER TABLE api_tokens ADD CONSTRAINT api_tokens_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'user_sessions_user_id_fkey') THEN
+        DELETE FROM user_sessions WHERE user_id NOT IN (SELECT id FROM users);
+        ALTER TABLE user_sessions ADD CONSTRAINT user_sessions_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'workspace_members_workspace_id_fkey') THEN
+        DELETE FROM workspace_members WHERE workspace_id NOT IN (SELECT id FROM workspaces);
+        ALTER TABLE workspace_members ADD CONSTRAINT workspace_members_workspace_id_fkey FOREIGN KEY (workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE;
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'workspace_members_user_id_fkey') THEN
+        DELETE FROM workspace_members WHERE user_id NOT IN (SELECT id FROM users);
+        ALTER TABLE workspace_members ADD CONSTRAINT workspace_members_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'workspace_invitations_workspace_id_fkey') THEN
+        DELETE FROM workspace_invitations WHERE workspace_id NOT IN (SELECT id FROM workspaces);
+        ALTER TABLE workspace_invitations ADD CONSTRAINT workspace_invitations_workspace_id_fkey FOREIGN KEY (workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE;
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'workspace_projects_workspace_id_fkey') THEN
+        DELETE FROM workspace_projects WHERE workspace_id NOT IN (SELECT id FROM workspaces);
+        ALTER TABLE workspace_projects ADD CONSTRAINT workspace_projects_workspace_id_fkey FOREIGN KEY (workspace_id) REFERENCES workspaces(id) ON DELETE CASCADE;
+    END IF;
+END;
+$$;
@@ -0,0 +1,22 @@
+CREATE VIRTUAL TABLE IF NOT EXISTS tasks_fts USING fts5(
+    task_name,
+    notes,
+    content='tasks',
+    content_rowid='id'
+);
+
+
+CREATE TRIGGER IF NOT EXISTS tasks_fts_insert AFTER INSERT ON tasks BEGIN
+    INSERT INTO tasks_fts(rowid, task_name, notes) VALUES (new.id, new.task_name, new.notes);
+END;
+
+
+CREATE TRIGGER IF NOT EXISTS tasks_fts_delete AFTER DELETE ON tasks BEGIN
+    INSERT INTO tasks_fts(tasks_fts, rowid, task_name, notes) VALUES ('delete', old.id, old.task_name, old.notes);
+END;
+
+
+CREATE TRIGGER IF NOT EXISTS tasks_fts_update AFTER UPDATE ON tasks BEGIN
+    INSERT INTO tasks_fts(tasks_fts, rowid, task_name, notes) VALUES ('delete', old.id, old.task_name, old.notes);
+    INSERT INTO tasks_fts(rowid, task_name, notes) VALUES (new.id, new.task_name, new.notes);
+END;
\ No newline at end of file
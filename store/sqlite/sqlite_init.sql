@@ -1,11 +1,164 @@
-CREATE TABLE tasks (
+CREATE TABLE IF NOT EXISTS tasks (
     id INTEGER PRIMARY KEY,
     task_name TEXT NOT NULL,
+    project TEXT NOT NULL DEFAULT '',
+    tags TEXT NOT NULL DEFAULT '',
+    notes TEXT NOT NULL DEFAULT '',
     start_time TIMESTAMP NOT NULL,
-    elapsed_time NUMERIC DEFAULT 0
+    elapsed_time NUMERIC DEFAULT 0,
+    user_id INTEGER NOT NULL DEFAULT 1,
+    deleted_at TIMESTAMP
 );
 
 
-CREATE TABLE task_session(
-    taskid INTEGER
-);
\ No newline at end of file
+CREATE TABLE IF NOT EXISTS task_session(
+    taskid INTEGER,
+    user_id INTEGER NOT NULL DEFAULT 1
+);
+
+
+CREATE TABLE IF NOT EXISTS goals(
+    id INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    scope TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    period TEXT NOT NULL,
+    target NUMERIC NOT NULL,
+    user_id INTEGER NOT NULL DEFAULT 1
+);
+
+
+CREATE TABLE IF NOT EXISTS task_templates(
+    id INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    project TEXT NOT NULL DEFAULT '',
+    tags TEXT NOT NULL DEFAULT '',
+    notes TEXT NOT NULL DEFAULT '',
+    user_id INTEGER NOT NULL DEFAULT 1
+);
+
+
+CREATE TABLE IF NOT EXISTS imported_events(
+    uid TEXT NOT NULL,
+    task_id INTEGER NOT NULL,
+    user_id INTEGER NOT NULL DEFAULT 1,
+    PRIMARY KEY (user_id, uid)
+);
+
+
+CREATE TABLE IF NOT EXISTS webhooks(
+    id INTEGER PRIMARY KEY,
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    events TEXT NOT NULL,
+    user_id INTEGER NOT NULL DEFAULT 1
+);
+
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries(
+    id INTEGER PRIMARY KEY,
+    webhook_id INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+    event TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    status TEXT NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    response_code INTEGER NOT NULL DEFAULT 0,
+    error TEXT NOT NULL DEFAULT '',
+    next_attempt TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due_idx ON webhook_deliveries (status, next_attempt);
+
+
+CREATE TABLE IF NOT EXISTS api_tokens(
+    id INTEGER PRIMARY KEY,
+    user_id INTEGER NOT NULL DEFAULT 1 REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    prefix TEXT NOT NULL,
+    hash TEXT NOT NULL UNIQUE,
+    scopes TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP,
+    last_used_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+
+CREATE TABLE IF NOT EXISTS users(
+    id INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    email TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL
+);
+
+
+INSERT OR IGNORE INTO users(id, name, email, created_at) VALUES(1, 'me', '', CURRENT_TIMESTAMP);
+
+
+CREATE TABLE IF NOT EXISTS user_sessions(
+    hash TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    expires_at TIMESTAMP NOT NULL
+);
+
+
+CREATE TABLE IF NOT EXISTS workspaces(
+    id INTEGER PRIMARY KEY,
+    name TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+
+CREATE TABLE IF NOT EXISTS workspace_members(
+    workspace_id INTEGER NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role TEXT NOT NULL,
+    joined_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (workspace_id, user_id)
+);
+
+
+CREATE TABLE IF NOT EXISTS workspace_invitations(
+    id INTEGER PRIMARY KEY,
+    workspace_id INTEGER NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+    email TEXT NOT NULL,
+    role TEXT NOT NULL,
+    hash TEXT NOT NULL UNIQUE,
+    invited_by INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    accepted_at TIMESTAMP
+);
+
+
+CREATE TABLE IF NOT EXISTS workspace_projects(
+    workspace_id INTEGER NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+    project TEXT NOT NULL,
+    PRIMARY KEY (workspace_id, project)
+);
+
+
+CREATE TABLE IF NOT EXISTS audit_log(
+    id INTEGER PRIMARY KEY,
+    task_id INTEGER NOT NULL,
+    action TEXT NOT NULL,
+    actor_id INTEGER NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    before_value TEXT NOT NULL DEFAULT '',
+    after_value TEXT NOT NULL DEFAULT ''
+);
+
+
+CREATE INDEX IF NOT EXISTS audit_log_task_idx ON audit_log (task_id);
+
+
+CREATE TRIGGER IF NOT EXISTS audit_log_no_update BEFORE UPDATE ON audit_log BEGIN
+    SELECT RAISE(ABORT, 'audit_log is append-only');
+END;
+
+
+CREATE TRIGGER IF NOT EXISTS audit_log_no_delete BEFORE DELETE ON audit_log BEGIN
+    SELECT RAISE(ABORT, 'audit_log is append-only');
+END;
\ No newline at end of file
@@ -0,0 +1,519 @@
+package timetracker_test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+	"timetracker"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// taskStores are the TaskStore implementations that
+// must behave alike.  Each call opens an empty store.
+var taskStores = map[string]func(t *testing.T) timetracker.TaskStore{
+	"sqlite": func(t *testing.T) timetracker.TaskStore {
+		return newSqliteStore(t, filepath.Join(t.TempDir(), "timetracker.db"))
+	},
+	"kv": func(t *testing.T) timetracker.TaskStore {
+		return newKVStore(t, filepath.Join(t.TempDir(), "timetracker.kv"))
+	},
+	"events": func(t *testing.T) timetracker.TaskStore {
+		return newEventStore(t, filepath.Join(t.TempDir(), "timetracker.events"))
+	},
+}
+
+// storeCases are run against every one of taskStores
+var storeCases = map[string]func(*testing.T, timetracker.TaskStore){
+	"session":   testStoreSession,
+	"report":    testStoreReport,
+	"list":      testStoreList,
+	"names":     testStoreRecentNames,
+	"search":    testStoreSearch,
+	"completed": testStoreCompleted,
+	"delete":    testStoreDelete,
+	"owners":    testStoreOwners,
+}
+
+func TestTaskStoreConformance(t *testing.T) {
+	t.Parallel()
+
+	for name, open := range taskStores {
+		name, open := name, open
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			for c, test := range storeCases {
+				c, test := c, test
+				t.Run(c, func(t *testing.T) {
+					t.Parallel()
+					test(t, open(t))
+				})
+			}
+		})
+	}
+}
+
+var storeStart = time.Date(2021, 3, 1, 9, 0, 0, 0, time.UTC)
+
+// seedTasks saves stopped tasks, each starting an
+// hour after the one before, and returns their ids
+func seedTasks(t *testing.T, store timetracker.TaskStore, tasks ...timetracker.Task) []int {
+	t.Helper()
+
+	var ids []int
+	for i, task := range tasks {
+		task.StartTime = storeStart.Add(time.Duration(i) * time.Hour)
+		id, err := store.CreateCompleted(task)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func taskIds(tasks []timetracker.Task) []int {
+
+	ids := []int{}
+	for _, task := range tasks {
+		ids = append(ids, task.Id)
+	}
+	return ids
+}
+
+func testStoreSession(t *testing.T, store timetracker.TaskStore) {
+
+	running, err := store.GetTaskBySession(timetracker.LOCAL_USER_ID)
+	if err != nil || running.Id != 0 {
+		t.Fatalf("want: no task before the first start, got: %+v, %v", running, err)
+	}
+
+	task := timetracker.Task{Name: "piano", Project: "music", Tags: []string{"scales"}, StartTime: storeStart}
+	task.Id, err = store.Create(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.NewTaskSession(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	running, err = store.GetTaskBySession(timetracker.LOCAL_USER_ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := task
+	want.UserId = timetracker.LOCAL_USER_ID
+	if !cmp.Equal(want, running) {
+		t.Error(cmp.Diff(want, running))
+	}
+
+	count, err := store.CountRunning()
+	if err != nil || count != 1 {
+		t.Errorf("want: 1 running, got: %d, %v", count, err)
+	}
+
+	err = store.UpdateStopped(timetracker.Task{ElapsedTimeSec: 90, Notes: "slow"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, err = store.CountRunning()
+	if err != nil || count != 0 {
+		t.Errorf("want: none running, got: %d, %v", count, err)
+	}
+
+	got, err := store.GetTask(task.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = task
+	want.UserId = timetracker.LOCAL_USER_ID
+	want.ElapsedTimeSec, want.Notes = 90, "slow"
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+
+	err = store.UpdateNotes(timetracker.Task{Id: task.Id, Notes: "faster"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = store.GetTask(task.Id)
+	if err != nil || got.Notes != "faster" {
+		t.Errorf("want: notes updated, got: %q, %v", got.Notes, err)
+	}
+
+	_, err = store.GetTask(task.Id + 100)
+	if !errors.Is(err, timetracker.ErrNoRecord) {
+		t.Errorf("want: ErrNoRecord, got: %v", err)
+	}
+
+}
+
+func testStoreReport(t *testing.T, store timetracker.TaskStore) {
+
+	seedTasks(t, store,
+		timetracker.Task{Name: "piano", ElapsedTimeSec: 60},
+		timetracker.Task{Name: "swim", ElapsedTimeSec: 300},
+		timetracker.Task{Name: "piano", ElapsedTimeSec: 30},
+	)
+
+	got, err := store.GetReport(timetracker.ALL_USERS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []timetracker.Report{{Task: "swim", TotalTime: 300}, {Task: "piano", TotalTime: 90}}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+
+	task, err := store.GetTaskByName(timetracker.ALL_USERS, "piano")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Name != "piano" || task.ElapsedTimeSec != 90 {
+		t.Errorf("want: piano for 90s, got: %+v", task)
+	}
+
+	task, err = store.GetTaskByName(timetracker.ALL_USERS, "cello")
+	if err != nil || !cmp.Equal(timetracker.Task{}, task) {
+		t.Errorf("want: no task, got: %+v, %v", task, err)
+	}
+
+}
+
+func testStoreList(t *testing.T, store timetracker.TaskStore) {
+
+	// ids in start order are 0 to 4
+	ids := seedTasks(t, store,
+		timetracker.Task{Name: "Piano", ElapsedTimeSec: 30},
+		timetracker.Task{Name: "swim", ElapsedTimeSec: 10},
+		timetracker.Task{Name: "pilates", ElapsedTimeSec: 30},
+		timetracker.Task{Name: "read", ElapsedTimeSec: 50},
+		timetracker.Task{Name: "piano", ElapsedTimeSec: 20},
+	)
+
+	testCases := []struct {
+		opts timetracker.ListOptions
+		want []int
+	}{
+		{opts: timetracker.ListOptions{Sort: timetracker.ListSortStart}, want: []int{ids[0], ids[1], ids[2], ids[3], ids[4]}},
+		{opts: timetracker.ListOptions{Sort: timetracker.ListSortStart, Desc: true}, want: []int{ids[4], ids[3], ids[2], ids[1], ids[0]}},
+		{opts: timetracker.ListOptions{Sort: timetracker.ListSortName}, want: []int{ids[0], ids[4], ids[2], ids[3], ids[1]}},
+		{opts: timetracker.ListOptions{Sort: timetracker.ListSortName, Desc: true}, want: []int{ids[1], ids[3], ids[2], ids[4], ids[0]}},
+		{opts: timetracker.ListOptions{Sort: timetracker.ListSortDuration}, want: []int{ids[1], ids[4], ids[0], ids[2], ids[3]}},
+		{opts: timetracker.ListOptions{Sort: timetracker.ListSortDuration, Desc: true}, want: []int{ids[3], ids[2], ids[0], ids[4], ids[1]}},
+		{opts: timetracker.ListOptions{Sort: timetracker.ListSortStart, NamePrefix: "PI"}, want: []int{ids[0], ids[2], ids[4]}},
+	}
+
+	for _, tc := range testCases {
+
+		// two tasks a page, following the cursors
+		opts := tc.opts
+		opts.Limit = 2
+		got := []int{}
+		for pages := 0; pages < 5; pages++ {
+			page, err := store.List(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, taskIds(page.Tasks)...)
+			if page.Next == "" {
+				break
+			}
+			opts.Cursor, err = timetracker.DecodeCursor(page.Next)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if !cmp.Equal(tc.want, got) {
+			t.Errorf("%+v: %s", tc.opts, cmp.Diff(tc.want, got))
+		}
+	}
+
+	latest, err := store.GetLatest(timetracker.ALL_USERS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int{ids[4], ids[3], ids[2], ids[1], ids[0]}
+	if got := taskIds(latest); !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+
+	all, err := store.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []int{ids[0], ids[1], ids[2], ids[3], ids[4]}
+	if got := taskIds(all); !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+
+}
+
+func testStoreRecentNames(t *testing.T, store timetracker.TaskStore) {
+
+	seedTasks(t, store,
+		timetracker.Task{Name: "piano", ElapsedTimeSec: 60},
+		timetracker.Task{Name: "swim", ElapsedTimeSec: 60},
+		timetracker.Task{Name: "read", ElapsedTimeSec: 60},
+		timetracker.Task{Name: "piano", ElapsedTimeSec: 60},
+	)
+
+	got, err := store.GetRecentNames(timetracker.ALL_USERS, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"piano", "read"}
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+
+}
+
+func testStoreSearch(t *testing.T, store timetracker.TaskStore) {
+
+	ids := seedTasks(t, store,
+		timetracker.Task{Name: "deploy", Notes: "deploy the api", ElapsedTimeSec: 60},
+		timetracker.Task{Name: "meeting", Notes: "talked about when to deploy the new billing service next quarter", ElapsedTimeSec: 60},
+		timetracker.Task{Name: "piano", Notes: "scales", ElapsedTimeSec: 60},
+		timetracker.Task{Name: "deploy", Notes: "rolled back", ElapsedTimeSec: 60},
+	)
+
+	q := timetracker.SearchQuery{Text: "deploy", Sort: timetracker.SearchSortTime, Limit: 10}
+	results, err := store.Search(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []int
+	for _, r := range results {
+		got = append(got, r.Task.Id)
+	}
+	want := []int{ids[3], ids[1], ids[0]}
+	if !cmp.Equal(want, got) {
+		t.Errorf("by time: %s", cmp.Diff(want, got))
+	}
+
+	q.Sort, q.Limit = timetracker.SearchSortRelevance, 1
+	results, err = store.Search(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Task.Id != ids[0] {
+		t.Errorf("want: the task named and noted deploy first, got: %+v", results)
+	}
+
+	q = timetracker.SearchQuery{Text: "deploy api", From: storeStart.Add(time.Minute), Limit: 10}
+	results, err = store.Search(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 0 {
+		t.Errorf("want: nothing matching every word in range, got: %+v", results)
+	}
+
+}
+
+func testStoreCompleted(t *testing.T, store timetracker.TaskStore) {
+
+	ids := seedTasks(t, store,
+		timetracker.Task{Name: "piano", Project: "music", Tags: []string{"scales", "slow"}, ElapsedTimeSec: 60},
+		timetracker.Task{Name: "swim", Project: "sport", ElapsedTimeSec: 60},
+		timetracker.Task{Name: "cello", Project: "music", Tags: []string{"scales"}, ElapsedTimeSec: 60},
+		timetracker.Task{Name: "piano", Project: "music", Tags: []string{"slow"}, ElapsedTimeSec: 60},
+	)
+
+	// running tasks are not completed
+	_, err := store.Create(timetracker.Task{Name: "piano", Project: "music", Tags: []string{"scales"}, StartTime: storeStart.Add(30 * time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		filter timetracker.TaskFilter
+		want   []int
+	}{
+		{filter: timetracker.TaskFilter{}, want: []int{ids[0], ids[1], ids[2], ids[3]}},
+		{filter: timetracker.TaskFilter{Project: "music"}, want: []int{ids[0], ids[2], ids[3]}},
+		{filter: timetracker.TaskFilter{Tag: "scales"}, want: []int{ids[0], ids[2]}},
+		{filter: timetracker.TaskFilter{Project: "music", Tag: "slow"}, want: []int{ids[0], ids[3]}},
+		{filter: timetracker.TaskFilter{From: storeStart.Add(time.Hour), To: storeStart.Add(3 * time.Hour)}, want: []int{ids[1], ids[2]}},
+		{filter: timetracker.TaskFilter{Tag: "slo"}, want: []int{}},
+	}
+
+	for _, tc := range testCases {
+		tasks, err := store.GetCompleted(tc.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := taskIds(tasks); !cmp.Equal(tc.want, got) {
+			t.Errorf("%+v: %s", tc.filter, cmp.Diff(tc.want, got))
+		}
+	}
+
+	tasks, err := store.GetCompleted(timetracker.TaskFilter{Tag: "slow", Project: "music"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := timetracker.Task{Id: ids[0], UserId: timetracker.LOCAL_USER_ID, Name: "piano", Project: "music", Tags: []string{"scales", "slow"}, StartTime: storeStart, ElapsedTimeSec: 60}
+	if len(tasks) == 0 || !cmp.Equal(want, tasks[0]) {
+		t.Errorf("want: %+v, got: %+v", want, tasks)
+	}
+
+}
+
+func testStoreDelete(t *testing.T, store timetracker.TaskStore) {
+
+	ids := seedTasks(t, store,
+		timetracker.Task{Name: "piano", Notes: "scales", ElapsedTimeSec: 60},
+		timetracker.Task{Name: "swim", Notes: "scales", ElapsedTimeSec: 60},
+	)
+
+	task := timetracker.Task{Name: "piano", StartTime: storeStart.Add(5 * time.Hour)}
+	id, err := store.Create(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+	task.Id = id
+	err = store.NewTaskSession(task)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []int{ids[0], id} {
+		err := store.Delete(timetracker.Task{Id: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// deleting twice is not an error
+	err = store.Delete(timetracker.Task{Id: ids[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.GetTask(ids[0])
+	if !errors.Is(err, timetracker.ErrNoRecord) {
+		t.Errorf("want: ErrNoRecord, got: %v", err)
+	}
+
+	running, err := store.GetTaskBySession(timetracker.LOCAL_USER_ID)
+	if err != nil || running.Id != 0 {
+		t.Errorf("want: deleted task not running, got: %+v, %v", running, err)
+	}
+	count, err := store.CountRunning()
+	if err != nil || count != 0 {
+		t.Errorf("want: none running, got: %d, %v", count, err)
+	}
+
+	all, err := store.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := taskIds(all); !cmp.Equal([]int{ids[1]}, got) {
+		t.Errorf("all: %s", cmp.Diff([]int{ids[1]}, got))
+	}
+
+	report, err := store.GetReport(timetracker.ALL_USERS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []timetracker.Report{{Task: "swim", TotalTime: 60}}
+	if !cmp.Equal(want, report) {
+		t.Error(cmp.Diff(want, report))
+	}
+
+	byName, err := store.GetTaskByName(timetracker.ALL_USERS, "piano")
+	if err != nil || byName.Name != "" {
+		t.Errorf("want: no piano left, got: %+v, %v", byName, err)
+	}
+
+	names, err := store.GetRecentNames(timetracker.ALL_USERS, 10)
+	if err != nil || !cmp.Equal([]string{"swim"}, names) {
+		t.Errorf("want: only swim, got: %v, %v", names, err)
+	}
+
+}
+
+func testStoreOwners(t *testing.T, store timetracker.TaskStore) {
+
+	ids := seedTasks(t, store,
+		timetracker.Task{Name: "piano", Notes: "scales", ElapsedTimeSec: 60},
+		timetracker.Task{Name: "swim", ElapsedTimeSec: 300, UserId: 2},
+		timetracker.Task{Name: "piano", Notes: "scales", ElapsedTimeSec: 30, UserId: 2},
+	)
+	mine := []int{ids[1], ids[2]}
+
+	report, err := store.GetReport(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []timetracker.Report{{Task: "swim", TotalTime: 300}, {Task: "piano", TotalTime: 30}}
+	if !cmp.Equal(want, report) {
+		t.Error(cmp.Diff(want, report))
+	}
+
+	page, err := store.List(timetracker.ListOptions{Limit: 10, Sort: timetracker.ListSortStart, UserId: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := taskIds(page.Tasks); !cmp.Equal(mine, got) {
+		t.Errorf("list: %s", cmp.Diff(mine, got))
+	}
+
+	for _, tc := range []struct {
+		opts timetracker.ListOptions
+		want []int
+	}{
+		{opts: timetracker.ListOptions{Limit: 10, Sort: timetracker.ListSortName, UserId: 2}, want: []int{ids[2], ids[1]}},
+		{opts: timetracker.ListOptions{Limit: 10, Sort: timetracker.ListSortName, Desc: true, UserId: 2}, want: []int{ids[1], ids[2]}},
+		{opts: timetracker.ListOptions{Limit: 10, Sort: timetracker.ListSortName, Desc: true, UserId: timetracker.LOCAL_USER_ID}, want: ids[:1]},
+	} {
+		page, err := store.List(tc.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := taskIds(page.Tasks); !cmp.Equal(tc.want, got) {
+			t.Errorf("list %+v: %s", tc.opts, cmp.Diff(tc.want, got))
+		}
+	}
+
+	completed, err := store.GetCompleted(timetracker.TaskFilter{UserId: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := taskIds(completed); !cmp.Equal(mine, got) {
+		t.Errorf("completed: %s", cmp.Diff(mine, got))
+	}
+
+	latest, err := store.GetLatest(timetracker.LOCAL_USER_ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := taskIds(latest); !cmp.Equal(ids[:1], got) {
+		t.Errorf("latest: %s", cmp.Diff(ids[:1], got))
+	}
+
+	_, err = store.GetVisibleTask(ids[0], 2)
+	if !errors.Is(err, timetracker.ErrNoRecord) {
+		t.Errorf("other user's task: want: ErrNoRecord, got: %v", err)
+	}
+	task, err := store.GetVisibleTask(ids[1], 2)
+	if err != nil || task.Name != "swim" {
+		t.Errorf("own task: want: swim, got: %+v, %v", task, err)
+	}
+
+	byName, err := store.GetTaskByName(2, "piano")
+	if err != nil || byName.ElapsedTimeSec != 30 {
+		t.Errorf("by name: want: piano for 30s, got: %+v, %v", byName, err)
+	}
+
+	names, err := store.GetRecentNames(timetracker.LOCAL_USER_ID, 10)
+	if err != nil || !cmp.Equal([]string{"piano"}, names) {
+		t.Errorf("names: want: only piano, got: %v, %v", names, err)
+	}
+
+}
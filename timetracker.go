@@ -1,17 +1,27 @@
 package timetracker
 
 import (
+	"bytes"
 	"fmt"
+	"html/template"
+	"strings"
 	"time"
+
+	"github.com/yuin/goldmark"
 )
 
 type Task struct {
-	Id             int
-	Name           string `db:"task_name"`
-	Active         bool
-	StartTime      time.Time `db:"start_time"`
-	ElapsedTime    time.Duration
-	ElapsedTimeSec float64 `db:"elapsed_time"`
+	Id             int           `json:"id"`
+	UserId         int           `json:"-"`
+	Name           string        `db:"task_name" json:"name"`
+	Project        string        `db:"project" json:"project"`
+	Tags           []string      `db:"tags" json:"tags"`
+	Notes          string        `db:"notes" json:"notes"`
+	Active         bool          `json:"active"`
+	Paused         bool          `json:"paused,omitempty"`
+	StartTime      time.Time     `db:"start_time" json:"start_time"`
+	ElapsedTime    time.Duration `json:"-"`
+	ElapsedTimeSec float64       `db:"elapsed_time" json:"elapsed_time"`
 }
 
 type Report struct {
@@ -19,6 +29,128 @@ type Report struct {
 	TotalTime float64
 }
 
+const (
+	GoalScopeTask    string = "task"
+	GoalScopeProject string = "project"
+
+	GoalKindTarget string = "target"
+	GoalKindBudget string = "budget"
+
+	GoalPeriodWeekly string = "weekly"
+	GoalPeriodTotal  string = "total"
+)
+
+// Goal is a time target or budget for a task
+// or project.  Target is held in seconds to
+// match the elapsed_time column.  Goals belong
+// to UserId and count that user's tasks.
+type Goal struct {
+	Id     int
+	Name   string  `db:"name"`
+	Scope  string  `db:"scope"`
+	Kind   string  `db:"kind"`
+	Period string  `db:"period"`
+	Target float64 `db:"target"`
+	UserId int     `db:"user_id"`
+}
+
+// GoalProgress pairs a Goal with the time spent
+// towards it in the goal's current period
+type GoalProgress struct {
+	Goal  Goal
+	Spent float64
+}
+
+func NewGoal(name, scope, kind, period string, hours float64) (Goal, error) {
+
+	if strings.TrimSpace(name) == "" {
+		return Goal{}, fmt.Errorf("goal name must not be empty")
+	}
+	if scope != GoalScopeTask && scope != GoalScopeProject {
+		return Goal{}, fmt.Errorf("invalid goal scope: %q", scope)
+	}
+	if kind != GoalKindTarget && kind != GoalKindBudget {
+		return Goal{}, fmt.Errorf("invalid goal kind: %q", kind)
+	}
+	if period != GoalPeriodWeekly && period != GoalPeriodTotal {
+		return Goal{}, fmt.Errorf("invalid goal period: %q", period)
+	}
+	if hours <= 0 {
+		return Goal{}, fmt.Errorf("goal target must be greater than zero")
+	}
+
+	g := Goal{
+		Name:   strings.TrimSpace(name),
+		Scope:  scope,
+		Kind:   kind,
+		Period: period,
+		Target: hours * time.Hour.Seconds(),
+	}
+	return g, nil
+}
+
+// PeriodStart returns the start of the goal's
+// current period.  Weekly goals reset at midnight
+// on Monday in now's zone, total goals never reset.
+func (g Goal) PeriodStart(now time.Time) time.Time {
+
+	if g.Period != GoalPeriodWeekly {
+		return time.Time{}
+	}
+	return WeekStart(now)
+}
+
+// WeekStart returns midnight on the Monday of the
+// week containing now, in now's zone
+func WeekStart(now time.Time) time.Time {
+
+	offset := (int(now.Weekday()) + 6) % 7
+	day := now.AddDate(0, 0, -offset)
+	return time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, now.Location())
+}
+
+// NewGoalProgress picks the goal's entry out of an
+// aggregated report as returned by GetReportSince
+func NewGoalProgress(goal Goal, reports []Report) GoalProgress {
+
+	p := GoalProgress{Goal: goal}
+	for _, r := range reports {
+		if r.Task == goal.Name {
+			p.Spent = r.TotalTime
+			break
+		}
+	}
+	return p
+}
+
+// Percent is the share of the target spent, capped at
+// 100 so it can be used directly as a progress bar value
+func (p GoalProgress) Percent() int {
+
+	if p.Goal.Target <= 0 {
+		return 0
+	}
+	pct := int(p.Spent / p.Goal.Target * 100)
+	if pct > 100 {
+		return 100
+	}
+	return pct
+}
+
+// Overrun reports whether a budget has been exceeded.
+// Going past a target is not an overrun.
+func (p GoalProgress) Overrun() bool {
+	return p.Goal.Kind == GoalKindBudget && p.Spent > p.Goal.Target
+}
+
+func (p GoalProgress) SpentHours() string {
+	return fmt.Sprintf("%.1fh", p.Spent/time.Hour.Seconds())
+}
+
+func (p GoalProgress) TargetHours() string {
+	return fmt.Sprintf("%.1fh", p.Goal.Target/time.Hour.Seconds())
+}
+
 func NewTask(task string) Task {
 	t := Task{
 		Name: task,
@@ -26,6 +158,67 @@ func NewTask(task string) Task {
 	return t
 }
 
+// TaskTemplate is a saved task that can be started
+// with one click instead of being retyped.  Only
+// UserId sees and starts it.
+type TaskTemplate struct {
+	Id      int
+	Name    string   `db:"name"`
+	Project string   `db:"project"`
+	Tags    []string `db:"tags"`
+	Notes   string   `db:"notes"`
+	UserId  int      `db:"user_id"`
+}
+
+func NewTaskTemplate(name, project, tags, notes string) (TaskTemplate, error) {
+
+	if strings.TrimSpace(name) == "" {
+		return TaskTemplate{}, fmt.Errorf("template name must not be empty")
+	}
+
+	tt := TaskTemplate{
+		Name:    strings.TrimSpace(name),
+		Project: strings.TrimSpace(project),
+		Tags:    ParseTags(tags),
+		Notes:   notes,
+	}
+	return tt, nil
+}
+
+// NewTask returns an unstarted Task filled in
+// from the template
+func (tt TaskTemplate) NewTask() Task {
+	t := NewTask(tt.Name)
+	t.Project = tt.Project
+	t.Tags = tt.Tags
+	t.Notes = tt.Notes
+	return t
+}
+
+// ParseTags splits a comma separated list of tags,
+// dropping blanks and duplicates
+func ParseTags(tags string) []string {
+
+	var parsed []string
+	seen := map[string]bool{}
+
+	for _, tag := range strings.Split(tags, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		parsed = append(parsed, tag)
+	}
+	return parsed
+}
+
+// JoinTags is the inverse of ParseTags and is
+// how tags are stored in the database
+func JoinTags(tags []string) string {
+	return strings.Join(tags, ",")
+}
+
 func (t Task) GetActive() bool {
 	return t.Active
 }
@@ -42,6 +235,18 @@ func (t *Task) Stop(now time.Time) {
 	t.Active = false
 }
 
+// NotesHTML renders the task notes as Markdown.
+// Raw HTML and unsafe link schemes in the notes are
+// dropped, so the result is trusted by html/template.
+func (t Task) NotesHTML() template.HTML {
+
+	var buf bytes.Buffer
+	if err := goldmark.Convert([]byte(t.Notes), &buf); err != nil {
+		return ""
+	}
+	return template.HTML(buf.String())
+}
+
 func (t Task) GetMessage() string {
 
 	return fmt.Sprintf("You spent %s seconds on the %s task", t.ElapsedTime, t.Name)
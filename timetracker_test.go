@@ -5,6 +5,8 @@ import (
 	"testing"
 	"time"
 	"timetracker"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 var startTime = time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
@@ -104,3 +106,158 @@ func TestGetMessage(t *testing.T) {
 	}
 
 }
+
+func TestNewGoal(t *testing.T) {
+
+	got, err := timetracker.NewGoal(" piano ", timetracker.GoalScopeTask, timetracker.GoalKindTarget, timetracker.GoalPeriodWeekly, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := timetracker.Goal{
+		Name:   "piano",
+		Scope:  "task",
+		Kind:   "target",
+		Period: "weekly",
+		Target: 36000,
+	}
+
+	if want != got {
+		t.Errorf("want: %v, got: %v", want, got)
+	}
+
+	_, err = timetracker.NewGoal("piano", "team", timetracker.GoalKindTarget, timetracker.GoalPeriodWeekly, 10)
+	if err == nil {
+		t.Error("want error for invalid scope")
+	}
+
+	_, err = timetracker.NewGoal("piano", timetracker.GoalScopeTask, timetracker.GoalKindTarget, timetracker.GoalPeriodWeekly, 0)
+	if err == nil {
+		t.Error("want error for zero target")
+	}
+
+}
+
+func TestWeekStart(t *testing.T) {
+
+	want := time.Date(2021, 1, 4, 0, 0, 0, 0, time.UTC)
+
+	for _, now := range []time.Time{
+		time.Date(2021, 1, 4, 0, 0, 0, 0, time.UTC),
+		time.Date(2021, 1, 6, 13, 30, 0, 0, time.UTC),
+		time.Date(2021, 1, 10, 23, 59, 59, 0, time.UTC),
+	} {
+		got := timetracker.WeekStart(now)
+		if !got.Equal(want) {
+			t.Errorf("%s: want: %s, got: %s", now, want, got)
+		}
+	}
+
+	// either side of Monday midnight in Los Angeles is
+	// a different week, although both are Monday in UTC
+	la, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	for _, tc := range []struct {
+		now  time.Time
+		want time.Time
+	}{
+		{now: time.Date(2021, 1, 10, 23, 59, 0, 0, la), want: time.Date(2021, 1, 4, 0, 0, 0, 0, la)},
+		{now: time.Date(2021, 1, 11, 0, 0, 0, 0, la), want: time.Date(2021, 1, 11, 0, 0, 0, 0, la)},
+		{now: time.Date(2021, 1, 11, 0, 30, 0, 0, la), want: time.Date(2021, 1, 11, 0, 0, 0, 0, la)},
+	} {
+		got := timetracker.WeekStart(tc.now)
+		if !got.Equal(tc.want) {
+			t.Errorf("%s: want: %s, got: %s", tc.now, tc.want, got)
+		}
+	}
+
+}
+
+func TestGoalProgress(t *testing.T) {
+
+	reports := []timetracker.Report{
+		{Task: "piano", TotalTime: 18000},
+		{Task: "website", TotalTime: 5400},
+	}
+
+	target := timetracker.Goal{Name: "piano", Kind: timetracker.GoalKindTarget, Target: 36000}
+
+	p := timetracker.NewGoalProgress(target, reports)
+	if p.Percent() != 50 {
+		t.Errorf("want: 50, got: %d", p.Percent())
+	}
+	if p.Overrun() {
+		t.Error("target should not overrun")
+	}
+
+	budget := timetracker.Goal{Name: "website", Kind: timetracker.GoalKindBudget, Target: 3600}
+
+	p = timetracker.NewGoalProgress(budget, reports)
+	if p.Percent() != 100 {
+		t.Errorf("want: 100, got: %d", p.Percent())
+	}
+	if !p.Overrun() {
+		t.Error("budget should overrun")
+	}
+	if p.SpentHours() != "1.5h" {
+		t.Errorf("want: 1.5h, got: %s", p.SpentHours())
+	}
+
+}
+
+func TestParseTags(t *testing.T) {
+
+	got := timetracker.ParseTags(" meeting, daily,,meeting ")
+	want := []string{"meeting", "daily"}
+
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+
+	if timetracker.JoinTags(got) != "meeting,daily" {
+		t.Errorf("want: meeting,daily, got: %s", timetracker.JoinTags(got))
+	}
+
+}
+
+func TestTaskTemplateNewTask(t *testing.T) {
+
+	tt, err := timetracker.NewTaskTemplate("standup", "team", "meeting, daily", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := tt.NewTask()
+	want := timetracker.Task{
+		Name:    "standup",
+		Project: "team",
+		Tags:    []string{"meeting", "daily"},
+	}
+
+	if !cmp.Equal(want, got) {
+		t.Error(cmp.Diff(want, got))
+	}
+
+	_, err = timetracker.NewTaskTemplate(" ", "", "", "")
+	if err == nil {
+		t.Error("want error for empty name")
+	}
+
+}
+
+func TestNotesHTML(t *testing.T) {
+
+	task := timetracker.NewTask("piano")
+	task.Notes = "practised **scales** <script>alert(1)</script>"
+
+	got := string(task.NotesHTML())
+	want := "<p>practised <strong>scales</strong> <!-- raw HTML omitted -->alert(1)<!-- raw HTML omitted --></p>\n"
+
+	if want != got {
+		t.Errorf("want: %q, got: %q", want, got)
+	}
+
+}
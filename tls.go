@@ -0,0 +1,254 @@
+package timetracker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// HSTS_MAX_AGE is sent in Strict-Transport-Security
+	// on every response served over TLS
+	HSTS_MAX_AGE time.Duration = 365 * 24 * time.Hour
+
+	// the certificate files are checked for changes at
+	// most once per TLS_RELOAD_INTERVAL, on a handshake
+	TLS_RELOAD_INTERVAL time.Duration = time.Second
+
+	DEV_CERT_VALIDITY time.Duration = 365 * 24 * time.Hour
+)
+
+// TLSConfig is the tls.Config used for HTTPS: TLS 1.2
+// or newer with forward secret AEAD cipher suites
+func TLSConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *tls.Config {
+	return &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+		},
+		GetCertificate: getCertificate,
+	}
+}
+
+// certReloader serves a certificate pair from disk and
+// picks up a renewed pair without a restart.  A pair
+// that fails to load, such as one caught half written,
+// is logged and the previous certificate kept.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	logger   *Logger
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+
+	r := &certReloader{certFile: certFile, keyFile: keyFile, logger: DiscardLogger()}
+
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return nil, err
+	}
+
+	err = r.load(modTime)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// filesModTime is the later modification
+// time of the two files
+func (r *certReloader) filesModTime() (time.Time, error) {
+
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("unable to read certificate: %w", err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) load(modTime time.Time) error {
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load certificate: %w", err)
+	}
+
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.lastCheck) < TLS_RELOAD_INTERVAL {
+		return r.cert, nil
+	}
+	r.lastCheck = now
+
+	modTime, err := r.filesModTime()
+	if err != nil {
+		r.logger.Warn("keeping certificate", "err", err)
+		return r.cert, nil
+	}
+	if modTime.Equal(r.modTime) {
+		return r.cert, nil
+	}
+
+	err = r.load(modTime)
+	if err != nil {
+		r.logger.Warn("keeping certificate", "err", err)
+		return r.cert, nil
+	}
+
+	r.logger.Info("reloaded certificate", "cert", r.certFile)
+	return r.cert, nil
+}
+
+// hsts tells browsers to use HTTPS for later visits
+func hsts(next http.Handler) http.Handler {
+
+	value := fmt.Sprintf("max-age=%d", int(HSTS_MAX_AGE.Seconds()))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RedirectHandler sends plain HTTP requests to the
+// same host and path over HTTPS on httpsPort
+func RedirectHandler(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		if host == "" {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+
+		// JoinHostPort brackets IPv6 addresses
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+
+		// 308 keeps the method and body of a form post
+		code := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			code = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, target, code)
+	})
+}
+
+// GenerateDevCert writes a self-signed ECDSA certificate
+// and key for localhost and hosts, for trying HTTPS
+// locally.  Browsers will warn about it.
+func GenerateDevCert(certFile, keyFile string, hosts []string, now time.Time) error {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("unable to generate key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("unable to generate serial number: %w", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"timetracker development"}, CommonName: "localhost"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(DEV_CERT_VALIDITY),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	for _, h := range hosts {
+		h = strings.TrimSpace(h)
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if h != "" {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("unable to create certificate: %w", err)
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("unable to encode key: %w", err)
+	}
+
+	err = writePEM(keyFile, "PRIVATE KEY", keyDER, 0600)
+	if err != nil {
+		return err
+	}
+	return writePEM(certFile, "CERTIFICATE", der, 0644)
+}
+
+func writePEM(name, blockType string, der []byte, perm os.FileMode) error {
+
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return fmt.Errorf("unable to write %s: %w", name, err)
+	}
+
+	err = pem.Encode(f, &pem.Block{Type: blockType, Bytes: der})
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("unable to write %s: %w", name, err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,268 @@
+package timetracker_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"timetracker"
+)
+
+func devCert(t *testing.T, dir string, hosts ...string) (certFile, keyFile string) {
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+
+	err := timetracker.GenerateDevCert(certFile, keyFile, hosts, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// tlsClient trusts certFile and opens a new
+// connection for every request
+func tlsClient(t *testing.T, certFile string) *http.Client {
+
+	pem, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(pem)
+
+	return &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: pool},
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func TestGenerateDevCert(t *testing.T) {
+	t.Parallel()
+
+	certFile, keyFile := devCert(t, t.TempDir(), "timetracker.test", "10.0.0.2")
+
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, host := range []string{"localhost", "timetracker.test", "127.0.0.1", "10.0.0.2"} {
+		err := cert.VerifyHostname(host)
+		if err != nil {
+			t.Errorf("want: certificate for %s, got: %s", host, err)
+		}
+	}
+
+	info, err := os.Stat(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("want: key mode 0600, got: %o", info.Mode().Perm())
+	}
+
+}
+
+func TestServeTLS(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	certFile, keyFile := devCert(t, dir)
+
+	// a free port for the redirect listener
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	redirectPort := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+
+	s := timetracker.NewServer(
+		timetracker.WithNoLogging(),
+		timetracker.WithTLS(certFile, keyFile),
+		timetracker.WithHTTPRedirect(redirectPort),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	addr, result := serve(t, ctx, s)
+	defer func() {
+		cancel()
+		<-result
+	}()
+
+	client := tlsClient(t, certFile)
+
+	resp, err := client.Get("https://" + addr + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("want: 200, got: %d", resp.StatusCode)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Strict-Transport-Security"), "max-age=") {
+		t.Errorf("want: HSTS header, got: %q", resp.Header.Get("Strict-Transport-Security"))
+	}
+	if resp.TLS.Version < tls.VersionTLS12 {
+		t.Errorf("want: TLS 1.2 or newer, got: %x", resp.TLS.Version)
+	}
+
+	// old protocol versions are refused
+	old := tlsClient(t, certFile)
+	old.Transport.(*http.Transport).TLSClientConfig.MaxVersion = tls.VersionTLS11
+	_, err = old.Get("https://" + addr + "/healthz")
+	if err == nil {
+		t.Error("want: TLS 1.1 refused, got: connection")
+	}
+
+	// plain HTTP is redirected to HTTPS
+	timetracker.WaitForServerRoute(net.JoinHostPort("127.0.0.1", strconv.Itoa(redirectPort)), nil)
+	resp, err = client.Get("http://127.0.0.1:" + strconv.Itoa(redirectPort) + "/task/history?page=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	_, port, _ := net.SplitHostPort(addr)
+	want := "https://127.0.0.1:" + port + "/task/history?page=2"
+	if resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != want {
+		t.Errorf("want: 301 to %s, got: %d to %s", want, resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+}
+
+func TestTLSCertificateReload(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	certFile, keyFile := devCert(t, dir)
+
+	s := timetracker.NewServer(timetracker.WithNoLogging(), timetracker.WithTLS(certFile, keyFile))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	addr, result := serve(t, ctx, s)
+	defer func() {
+		cancel()
+		<-result
+	}()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives: true,
+	}}
+
+	serial := func() string {
+		resp, err := client.Get("https://" + addr + "/healthz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.TLS.PeerCertificates[0].SerialNumber.String()
+	}
+
+	first := serial()
+
+	// a renewed pair is picked up
+	renewed := t.TempDir()
+	newCert, newKey := devCert(t, renewed)
+	for _, f := range [][2]string{{newCert, certFile}, {newKey, keyFile}} {
+		err := os.Rename(f[0], f[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		later := time.Now().Add(time.Minute)
+		os.Chtimes(f[1], later, later)
+	}
+
+	time.Sleep(timetracker.TLS_RELOAD_INTERVAL + 100*time.Millisecond)
+
+	second := serial()
+	if first == second {
+		t.Fatal("want: renewed certificate, got: the old one")
+	}
+
+	// a broken pair is ignored
+	err := os.WriteFile(certFile, []byte("not a certificate"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(2 * time.Minute)
+	os.Chtimes(certFile, later, later)
+
+	time.Sleep(timetracker.TLS_RELOAD_INTERVAL + 100*time.Millisecond)
+
+	if serial() != second {
+		t.Error("want: certificate kept after a failed reload, got: a different one")
+	}
+
+}
+
+func TestRedirectHandler(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		method string
+		host   string
+		target string
+		port   int
+		code   int
+		want   string
+	}{
+		{method: "GET", host: "example.com", target: "/task/history?page=2", port: 4443, code: 301, want: "https://example.com:4443/task/history?page=2"},
+		{method: "GET", host: "example.com:80", target: "/", port: 443, code: 301, want: "https://example.com/"},
+		{method: "POST", host: "example.com:8080", target: "/task/stop", port: 443, code: 308, want: "https://example.com/task/stop"},
+		{method: "GET", host: "[::1]:80", target: "/goal", port: 4443, code: 301, want: "https://[::1]:4443/goal"},
+		{method: "GET", host: "[::1]", target: "/goal", port: 443, code: 301, want: "https://[::1]/goal"},
+	}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest(tc.method, tc.target, nil)
+		req.Host = tc.host
+		rec := httptest.NewRecorder()
+
+		timetracker.RedirectHandler(tc.port).ServeHTTP(rec, req)
+
+		if rec.Code != tc.code || rec.Header().Get("Location") != tc.want {
+			t.Errorf("%s %s%s: want: %d %s, got: %d %s", tc.method, tc.host, tc.target, tc.code, tc.want, rec.Code, rec.Header().Get("Location"))
+		}
+	}
+
+}
+
+func TestTLSOptionErrors(t *testing.T) {
+	t.Parallel()
+
+	s := timetracker.NewServer(timetracker.WithNoLogging(), timetracker.WithHTTPRedirect(8080))
+	err := s.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "WithTLS") {
+		t.Errorf("want: redirect needs TLS, got: %v", err)
+	}
+
+	s = timetracker.NewServer(timetracker.WithNoLogging(), timetracker.WithTLS("missing.pem", "missing-key.pem"))
+	err = s.Run(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("want: certificate error, got: %v", err)
+	}
+
+}
@@ -0,0 +1,394 @@
+package timetracker
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	EventTaskStarted string = "task.started"
+	EventTaskStopped string = "task.stopped"
+	EventTaskUpdated string = "task.updated"
+	EventTaskDeleted string = "task.deleted"
+
+	DeliveryPending   string = "pending"
+	DeliveryDelivered string = "delivered"
+	DeliveryFailed    string = "failed"
+
+	// request headers sent with every delivery.  The
+	// signature is sha256= and the hex HMAC-SHA256 of
+	// the body keyed with the webhook secret.
+	WebhookSignatureHeader string = "X-Timetracker-Signature"
+	WebhookEventHeader     string = "X-Timetracker-Event"
+	WebhookDeliveryHeader  string = "X-Timetracker-Delivery"
+
+	// a delivery is retried with doubling backoff
+	// and given up after WEBHOOK_MAX_ATTEMPTS
+	WEBHOOK_MAX_ATTEMPTS  int           = 8
+	WEBHOOK_BACKOFF       time.Duration = 30 * time.Second
+	WEBHOOK_BACKOFF_MAX   time.Duration = time.Hour
+	WEBHOOK_POLL_INTERVAL time.Duration = 10 * time.Second
+	WEBHOOK_TIMEOUT       time.Duration = 10 * time.Second
+	WEBHOOK_BATCH         int           = 50
+	DELIVERY_LOG_LIMIT    int           = 100
+)
+
+// WebhookEvents lists the events a webhook
+// can subscribe to
+var WebhookEvents = []string{EventTaskStarted, EventTaskStopped, EventTaskUpdated, EventTaskDeleted}
+
+// sharedAddressSpace is 100.64.0.0/10, the carrier
+// grade NAT range some clouds serve metadata from
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// Webhook is a subscription that receives a signed
+// POST for each of its Events.  Only UserId sees it
+// and its secret.
+type Webhook struct {
+	Id     int
+	URL    string
+	Secret string
+	Events []string
+	UserId int
+}
+
+// NewWebhook validates a subscription.  An empty
+// secret is replaced with a random one.
+func NewWebhook(rawurl, secret string, events []string) (Webhook, error) {
+
+	u, err := url.Parse(strings.TrimSpace(rawurl))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return Webhook{}, fmt.Errorf("webhook url must be an absolute http or https url")
+	}
+
+	// names are checked when a delivery connects
+	host := strings.ToLower(u.Hostname())
+	ip := net.ParseIP(host)
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") || (ip != nil && !webhookAddrAllowed(ip)) {
+		return Webhook{}, fmt.Errorf("webhook url must not point at a loopback, private or link-local address")
+	}
+
+	if len(events) == 0 {
+		return Webhook{}, fmt.Errorf("choose at least one event")
+	}
+	for _, e := range events {
+		if !containsString(WebhookEvents, e) {
+			return Webhook{}, fmt.Errorf("unknown event: %q", e)
+		}
+	}
+
+	if secret == "" {
+		b := make([]byte, 20)
+		_, err := rand.Read(b)
+		if err != nil {
+			return Webhook{}, fmt.Errorf("unable to generate secret: %s", err)
+		}
+		secret = hex.EncodeToString(b)
+	}
+
+	return Webhook{URL: u.String(), Secret: secret, Events: events}, nil
+}
+
+// webhookAddrAllowed reports whether a delivery may
+// connect to ip.  Loopback, private, link-local (which
+// holds the 169.254.169.254 metadata address), shared,
+// multicast and unspecified addresses are refused.
+func webhookAddrAllowed(ip net.IP) bool {
+
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		ip.IsUnspecified() || sharedAddressSpace.Contains(ip))
+}
+
+// webhookDialControl refuses connections to the
+// addresses webhookAddrAllowed rejects.  It sees the
+// address after the name is resolved, so names that
+// resolve to one, and redirects to one, are refused.
+func webhookDialControl(network, address string, _ syscall.RawConn) error {
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !webhookAddrAllowed(ip) {
+		return fmt.Errorf("webhook address %s is not allowed", host)
+	}
+	return nil
+}
+
+// newWebhookClient returns a client whose connections
+// go through webhookDialControl.  No proxy is used since
+// the check would then see the proxy's address.
+func newWebhookClient() *http.Client {
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{
+		Timeout:   WEBHOOK_TIMEOUT,
+		KeepAlive: 30 * time.Second,
+		Control:   webhookDialControl,
+	}).DialContext
+	return &http.Client{Timeout: WEBHOOK_TIMEOUT, Transport: transport}
+}
+
+// Subscribes reports whether the webhook wants event
+func (wh Webhook) Subscribes(event string) bool {
+	return containsString(wh.Events, event)
+}
+
+// WebhookPayload is the JSON body of a delivery
+type WebhookPayload struct {
+	Event     string    `json:"event"`
+	CreatedAt time.Time `json:"created_at"`
+	Task      Task      `json:"task"`
+}
+
+// WebhookDelivery is one event queued for one webhook.
+// URL and Secret are read from the webhook.
+type WebhookDelivery struct {
+	Id           int
+	WebhookId    int
+	URL          string
+	Secret       string
+	Event        string
+	Payload      string
+	Status       string
+	Attempts     int
+	ResponseCode int
+	Error        string
+	NextAttempt  time.Time
+	CreatedAt    time.Time
+}
+
+// SignWebhook returns the signature header value for body
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook checks a signature header value in
+// constant time.  Receivers written in Go can use it.
+func VerifyWebhook(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(SignWebhook(secret, body)), []byte(signature))
+}
+
+// WebhookBackoff is the wait before the attempt
+// following the given number of failed attempts
+func WebhookBackoff(attempts int) time.Duration {
+
+	wait := WEBHOOK_BACKOFF
+	for i := 1; i < attempts; i++ {
+		wait *= 2
+		if wait >= WEBHOOK_BACKOFF_MAX {
+			return WEBHOOK_BACKOFF_MAX
+		}
+	}
+	return wait
+}
+
+// WebhookDispatcher queues deliveries in the store and
+// sends them from a background worker, so a slow or
+// failing receiver never holds up a request
+type WebhookDispatcher struct {
+	store  WebhookStore
+	client *http.Client
+	logger *Logger
+	wake   chan struct{}
+}
+
+// NewWebhookDispatcher returns a dispatcher that sends
+// with client, or when nil with a client that refuses
+// loopback, private and link-local addresses
+func NewWebhookDispatcher(store WebhookStore, client *http.Client, logger *Logger) *WebhookDispatcher {
+
+	if client == nil {
+		client = newWebhookClient()
+	}
+	if logger == nil {
+		logger = DiscardLogger()
+	}
+
+	return &WebhookDispatcher{
+		store:  store,
+		client: client,
+		logger: logger,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Emit queues a delivery of event to every webhook
+// subscribed to it whose owner may see task
+func (d *WebhookDispatcher) Emit(event string, task Task, now time.Time) error {
+
+	webhooks, err := d.store.GetTaskWebhooks(task)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(WebhookPayload{Event: event, CreatedAt: now.UTC(), Task: task})
+	if err != nil {
+		return fmt.Errorf("unable to encode webhook payload: %s", err)
+	}
+
+	queued := false
+	for _, wh := range webhooks {
+		if !wh.Subscribes(event) {
+			continue
+		}
+
+		_, err := d.store.CreateDelivery(WebhookDelivery{
+			WebhookId:   wh.Id,
+			Event:       event,
+			Payload:     string(payload),
+			Status:      DeliveryPending,
+			NextAttempt: now.UTC(),
+			CreatedAt:   now.UTC(),
+		})
+		if err != nil {
+			return err
+		}
+		queued = true
+	}
+
+	if queued {
+		select {
+		case d.wake <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// DeliverDue sends every pending delivery whose next
+// attempt is due by now and records the outcome.  When
+// ctx is done it stops, leaving the deliveries it has
+// not finished pending.
+func (d *WebhookDispatcher) DeliverDue(ctx context.Context, now time.Time) error {
+
+	deliveries, err := d.store.GetDueDeliveries(now.UTC(), WEBHOOK_BATCH)
+	if err != nil {
+		return err
+	}
+
+	for _, delivery := range deliveries {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		delivery = d.send(ctx, delivery, now.UTC())
+
+		// a post cut short by ctx is not counted
+		// as an attempt
+		if ctx.Err() != nil && delivery.Status != DeliveryDelivered {
+			return nil
+		}
+
+		err := d.store.UpdateDelivery(delivery)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// send makes one attempt and schedules the next
+// one when it fails
+func (d *WebhookDispatcher) send(ctx context.Context, delivery WebhookDelivery, now time.Time) WebhookDelivery {
+
+	delivery.Attempts++
+	delivery.ResponseCode = 0
+	delivery.Error = ""
+
+	err := d.post(ctx, &delivery)
+	if err == nil {
+		delivery.Status = DeliveryDelivered
+		return delivery
+	}
+
+	delivery.Error = err.Error()
+
+	if delivery.Attempts >= WEBHOOK_MAX_ATTEMPTS {
+		delivery.Status = DeliveryFailed
+		d.logger.Warn("webhook delivery failed", "delivery", delivery.Id, "url", delivery.URL, "attempts", delivery.Attempts, "err", err)
+		return delivery
+	}
+
+	delivery.NextAttempt = now.Add(WebhookBackoff(delivery.Attempts))
+	return delivery
+}
+
+func (d *WebhookDispatcher) post(ctx context.Context, delivery *WebhookDelivery) error {
+
+	body := []byte(delivery.Payload)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "timetracker-webhook")
+	req.Header.Set(WebhookEventHeader, delivery.Event)
+	req.Header.Set(WebhookDeliveryHeader, fmt.Sprint(delivery.Id))
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(delivery.Secret, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	delivery.ResponseCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver responded %s", resp.Status)
+	}
+	return nil
+}
+
+// Run delivers due webhooks every WEBHOOK_POLL_INTERVAL,
+// and straight away after Emit, until ctx is done
+func (d *WebhookDispatcher) Run(ctx context.Context) {
+
+	ticker := time.NewTicker(WEBHOOK_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		err := d.DeliverDue(ctx, time.Now())
+		if err != nil {
+			d.logger.Error("webhook delivery", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,431 @@
+package timetracker_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"timetracker"
+)
+
+// memoryWebhookStore keeps webhooks and
+// deliveries in memory for dispatcher tests
+type memoryWebhookStore struct {
+	mu         sync.Mutex
+	webhooks   []timetracker.Webhook
+	deliveries []timetracker.WebhookDelivery
+}
+
+func (m *memoryWebhookStore) CreateWebhook(wh timetracker.Webhook) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	wh.Id = len(m.webhooks) + 1
+	m.webhooks = append(m.webhooks, wh)
+	return wh.Id, nil
+}
+
+func (m *memoryWebhookStore) GetWebhooks(userId int) ([]timetracker.Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]timetracker.Webhook{}, m.webhooks...), nil
+}
+
+// GetTaskWebhooks matches on owner alone, as the
+// memory store has no workspaces
+func (m *memoryWebhookStore) GetTaskWebhooks(task timetracker.Task) ([]timetracker.Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var webhooks []timetracker.Webhook
+	for _, wh := range m.webhooks {
+		if wh.UserId == task.UserId {
+			webhooks = append(webhooks, wh)
+		}
+	}
+	return webhooks, nil
+}
+
+func (m *memoryWebhookStore) DeleteWebhook(wh timetracker.Webhook) error {
+	return nil
+}
+
+func (m *memoryWebhookStore) CreateDelivery(wd timetracker.WebhookDelivery) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	wd.Id = len(m.deliveries) + 1
+	m.deliveries = append(m.deliveries, wd)
+	return wd.Id, nil
+}
+
+func (m *memoryWebhookStore) GetDueDeliveries(now time.Time, limit int) ([]timetracker.WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var due []timetracker.WebhookDelivery
+	for _, wd := range m.deliveries {
+		if wd.Status == timetracker.DeliveryPending && !wd.NextAttempt.After(now) {
+			wh := m.webhooks[wd.WebhookId-1]
+			wd.URL, wd.Secret = wh.URL, wh.Secret
+			due = append(due, wd)
+		}
+	}
+	return due, nil
+}
+
+func (m *memoryWebhookStore) GetDeliveries(userId, limit int) ([]timetracker.WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]timetracker.WebhookDelivery{}, m.deliveries...), nil
+}
+
+func (m *memoryWebhookStore) UpdateDelivery(wd timetracker.WebhookDelivery) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deliveries[wd.Id-1] = wd
+	return nil
+}
+
+type received struct {
+	event     string
+	signature string
+	body      []byte
+}
+
+// receiver answers with the queued status codes
+// in turn, then 200, and records each request
+func receiver(t *testing.T, codes ...int) (*httptest.Server, func() []received) {
+
+	var mu sync.Mutex
+	var got []received
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		mu.Lock()
+		got = append(got, received{
+			event:     r.Header.Get(timetracker.WebhookEventHeader),
+			signature: r.Header.Get(timetracker.WebhookSignatureHeader),
+			body:      body,
+		})
+		n := len(got)
+		mu.Unlock()
+
+		if n <= len(codes) {
+			w.WriteHeader(codes[n-1])
+		}
+	}))
+	t.Cleanup(ts.Close)
+
+	return ts, func() []received {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]received{}, got...)
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+
+	t.Parallel()
+
+	ts, requests := receiver(t)
+
+	store := &memoryWebhookStore{}
+	wh, err := timetracker.NewWebhook("https://example.com/hook", "s3cret", []string{timetracker.EventTaskStopped})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the receiver is on loopback, which NewWebhook refuses
+	wh.URL = ts.URL
+	store.CreateWebhook(wh)
+
+	d := timetracker.NewWebhookDispatcher(store, ts.Client(), nil)
+
+	now := time.Date(2021, 1, 1, 9, 0, 0, 0, time.UTC)
+	task := timetracker.Task{Id: 4, Name: "piano", ElapsedTimeSec: 60}
+
+	err = d.Emit(timetracker.EventTaskStarted, task, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Emit(timetracker.EventTaskStopped, task, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = d.DeliverDue(context.Background(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := requests()
+	if len(got) != 1 {
+		t.Fatalf("want: 1 delivery of the subscribed event, got: %d", len(got))
+	}
+
+	if got[0].event != timetracker.EventTaskStopped {
+		t.Errorf("want: %q, got: %q", timetracker.EventTaskStopped, got[0].event)
+	}
+
+	if !timetracker.VerifyWebhook("s3cret", got[0].body, got[0].signature) {
+		t.Errorf("signature %q does not verify", got[0].signature)
+	}
+	if timetracker.VerifyWebhook("wrong", got[0].body, got[0].signature) {
+		t.Error("signature verifies with the wrong secret")
+	}
+
+	var payload timetracker.WebhookPayload
+	err = json.Unmarshal(got[0].body, &payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload.Event != timetracker.EventTaskStopped || payload.Task.Name != "piano" || !payload.CreatedAt.Equal(now) {
+		t.Errorf("unexpected payload: %+v", payload)
+	}
+
+	deliveries, _ := store.GetDeliveries(timetracker.ALL_USERS, 10)
+	if deliveries[0].Status != timetracker.DeliveryDelivered || deliveries[0].ResponseCode != 200 {
+		t.Errorf("want: delivered 200, got: %s %d", deliveries[0].Status, deliveries[0].ResponseCode)
+	}
+
+}
+
+func TestWebhookRetry(t *testing.T) {
+
+	t.Parallel()
+
+	ts, requests := receiver(t, http.StatusInternalServerError, http.StatusBadGateway)
+
+	store := &memoryWebhookStore{}
+	wh, err := timetracker.NewWebhook("https://example.com/hook", "", timetracker.WebhookEvents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wh.Secret == "" {
+		t.Error("want: generated secret, got empty")
+	}
+	wh.URL = ts.URL
+	store.CreateWebhook(wh)
+
+	d := timetracker.NewWebhookDispatcher(store, ts.Client(), nil)
+
+	now := time.Date(2021, 1, 1, 9, 0, 0, 0, time.UTC)
+
+	err = d.Emit(timetracker.EventTaskDeleted, timetracker.Task{Id: 9, Name: "swim"}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// first attempt fails and is retried after the backoff
+	d.DeliverDue(context.Background(), now)
+	deliveries, _ := store.GetDeliveries(timetracker.ALL_USERS, 10)
+	first := deliveries[0]
+	if first.Status != timetracker.DeliveryPending || first.Attempts != 1 || first.ResponseCode != 500 {
+		t.Fatalf("want: pending after 1 attempt with 500, got: %+v", first)
+	}
+	if !first.NextAttempt.Equal(now.Add(timetracker.WEBHOOK_BACKOFF)) {
+		t.Errorf("want: next attempt %s, got: %s", now.Add(timetracker.WEBHOOK_BACKOFF), first.NextAttempt)
+	}
+
+	// nothing is sent before the backoff has passed
+	d.DeliverDue(context.Background(), now.Add(time.Second))
+	if len(requests()) != 1 {
+		t.Fatalf("want: 1 request before backoff, got: %d", len(requests()))
+	}
+
+	now = first.NextAttempt
+	d.DeliverDue(context.Background(), now)
+	deliveries, _ = store.GetDeliveries(timetracker.ALL_USERS, 10)
+	if !deliveries[0].NextAttempt.Equal(now.Add(2 * timetracker.WEBHOOK_BACKOFF)) {
+		t.Errorf("want: doubled backoff, got next attempt: %s", deliveries[0].NextAttempt)
+	}
+
+	d.DeliverDue(context.Background(), deliveries[0].NextAttempt)
+	deliveries, _ = store.GetDeliveries(timetracker.ALL_USERS, 10)
+	if deliveries[0].Status != timetracker.DeliveryDelivered || deliveries[0].Attempts != 3 {
+		t.Errorf("want: delivered on attempt 3, got: %+v", deliveries[0])
+	}
+	if len(requests()) != 3 {
+		t.Errorf("want: 3 requests, got: %d", len(requests()))
+	}
+
+}
+
+func TestWebhookGivesUp(t *testing.T) {
+
+	t.Parallel()
+
+	codes := make([]int, timetracker.WEBHOOK_MAX_ATTEMPTS)
+	for i := range codes {
+		codes[i] = http.StatusServiceUnavailable
+	}
+	ts, requests := receiver(t, codes...)
+
+	store := &memoryWebhookStore{}
+	store.CreateWebhook(timetracker.Webhook{URL: ts.URL, Secret: "s", Events: timetracker.WebhookEvents})
+
+	d := timetracker.NewWebhookDispatcher(store, ts.Client(), nil)
+
+	now := time.Date(2021, 1, 1, 9, 0, 0, 0, time.UTC)
+	d.Emit(timetracker.EventTaskUpdated, timetracker.Task{Id: 1}, now)
+
+	for i := 0; i < timetracker.WEBHOOK_MAX_ATTEMPTS+2; i++ {
+		d.DeliverDue(context.Background(), now)
+		now = now.Add(timetracker.WEBHOOK_BACKOFF_MAX)
+	}
+
+	deliveries, _ := store.GetDeliveries(timetracker.ALL_USERS, 10)
+	if deliveries[0].Status != timetracker.DeliveryFailed {
+		t.Errorf("want: %q, got: %q", timetracker.DeliveryFailed, deliveries[0].Status)
+	}
+	if len(requests()) != timetracker.WEBHOOK_MAX_ATTEMPTS {
+		t.Errorf("want: %d requests, got: %d", timetracker.WEBHOOK_MAX_ATTEMPTS, len(requests()))
+	}
+
+}
+
+func TestWebhookDeliveryCancel(t *testing.T) {
+
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// the receiver hangs until the test ends
+	var requests int
+	var mu sync.Mutex
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		cancel()
+		<-release
+	}))
+	t.Cleanup(ts.Close)
+	t.Cleanup(func() { close(release) })
+
+	store := &memoryWebhookStore{}
+	store.CreateWebhook(timetracker.Webhook{URL: ts.URL, Secret: "s", Events: timetracker.WebhookEvents})
+
+	d := timetracker.NewWebhookDispatcher(store, ts.Client(), nil)
+
+	now := time.Date(2021, 1, 1, 9, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		d.Emit(timetracker.EventTaskUpdated, timetracker.Task{Id: i + 1}, now)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- d.DeliverDue(ctx, now)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(timetracker.WEBHOOK_TIMEOUT / 2):
+		t.Fatal("DeliverDue did not return after its context was cancelled")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 1 {
+		t.Errorf("want: batch stopped after 1 request, got: %d", requests)
+	}
+
+	deliveries, _ := store.GetDeliveries(timetracker.ALL_USERS, 10)
+	for _, wd := range deliveries {
+		if wd.Status != timetracker.DeliveryPending || wd.Attempts != 0 {
+			t.Errorf("want: pending without an attempt, got: %+v", wd)
+		}
+	}
+
+}
+
+func TestNewWebhook(t *testing.T) {
+
+	t.Parallel()
+
+	testCases := []struct {
+		description string
+		url         string
+		events      []string
+		errorWanted bool
+	}{
+		{description: "valid", url: "https://example.com/hook", events: []string{"task.started"}},
+		{description: "relative url", url: "/hook", events: []string{"task.started"}, errorWanted: true},
+		{description: "not http", url: "ftp://example.com", events: []string{"task.started"}, errorWanted: true},
+		{description: "no events", url: "https://example.com/hook", errorWanted: true},
+		{description: "unknown event", url: "https://example.com/hook", events: []string{"task.paused"}, errorWanted: true},
+		{description: "public address", url: "http://93.184.216.34:8080/hook", events: []string{"task.started"}},
+		{description: "localhost", url: "http://localhost:8080/hook", events: []string{"task.started"}, errorWanted: true},
+		{description: "loopback", url: "http://127.0.0.1/hook", events: []string{"task.started"}, errorWanted: true},
+		{description: "ipv6 loopback", url: "http://[::1]/hook", events: []string{"task.started"}, errorWanted: true},
+		{description: "mapped loopback", url: "http://[::ffff:127.0.0.1]/hook", events: []string{"task.started"}, errorWanted: true},
+		{description: "private", url: "https://10.0.0.5/hook", events: []string{"task.started"}, errorWanted: true},
+		{description: "metadata", url: "http://169.254.169.254/latest/meta-data", events: []string{"task.started"}, errorWanted: true},
+		{description: "shared", url: "http://100.100.100.200/", events: []string{"task.started"}, errorWanted: true},
+		{description: "unspecified", url: "http://0.0.0.0/hook", events: []string{"task.started"}, errorWanted: true},
+	}
+
+	for _, tc := range testCases {
+		_, err := timetracker.NewWebhook(tc.url, "", tc.events)
+		if (err != nil) != tc.errorWanted {
+			t.Errorf("%s: unexpected error: %v", tc.description, err)
+		}
+	}
+
+}
+
+func TestWebhookRefusesLoopback(t *testing.T) {
+
+	t.Parallel()
+
+	ts, requests := receiver(t)
+
+	// stored directly, as a name resolving to loopback
+	// would pass NewWebhook, so the dial check refuses it
+	store := &memoryWebhookStore{}
+	store.CreateWebhook(timetracker.Webhook{URL: ts.URL, Secret: "s3cret", Events: timetracker.WebhookEvents})
+
+	d := timetracker.NewWebhookDispatcher(store, nil, nil)
+
+	now := time.Date(2021, 1, 1, 9, 0, 0, 0, time.UTC)
+	err := d.Emit(timetracker.EventTaskStarted, timetracker.Task{Id: 1, Name: "piano"}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.DeliverDue(context.Background(), now)
+
+	deliveries, _ := store.GetDeliveries(timetracker.ALL_USERS, 10)
+	if len(deliveries) != 1 || !strings.Contains(deliveries[0].Error, "not allowed") {
+		t.Errorf("want: delivery refused, got: %+v", deliveries)
+	}
+	if len(requests()) != 0 {
+		t.Errorf("want: no requests, got: %d", len(requests()))
+	}
+
+}
+
+func TestWebhookBackoff(t *testing.T) {
+
+	t.Parallel()
+
+	want := []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute}
+	for i, w := range want {
+		if got := timetracker.WebhookBackoff(i + 1); got != w {
+			t.Errorf("attempt %d: want: %s, got: %s", i+1, w, got)
+		}
+	}
+
+	if got := timetracker.WebhookBackoff(20); got != timetracker.WEBHOOK_BACKOFF_MAX {
+		t.Errorf("want: %s, got: %s", timetracker.WEBHOOK_BACKOFF_MAX, got)
+	}
+
+}
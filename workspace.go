@@ -0,0 +1,300 @@
+package timetracker
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+const (
+	// the owner created a workspace and can change roles,
+	// admins manage members, invitations and projects and
+	// see everyone's time, members see only their own
+	RoleOwner  string = "owner"
+	RoleAdmin  string = "admin"
+	RoleMember string = "member"
+
+	// LOCAL_USER_ID is the user the schema creates.  It owns
+	// tasks tracked without signing in and existing tasks.
+	LOCAL_USER_ID int = 1
+
+	// ALL_USERS in place of a user id reads every
+	// user's tasks, for exports, backups and metrics
+	ALL_USERS int = 0
+
+	SessionCookie string = "timetracker_session"
+
+	SESSION_LIFETIME    time.Duration = 30 * 24 * time.Hour
+	LOGIN_LINK_LIFETIME time.Duration = 15 * time.Minute
+	INVITATION_LIFETIME time.Duration = 7 * 24 * time.Hour
+)
+
+// InvitationRoles are the roles an invitation can
+// grant.  A workspace has one owner.
+var InvitationRoles = []string{RoleMember, RoleAdmin}
+
+type User struct {
+	Id        int
+	Name      string
+	Email     string
+	CreatedAt time.Time
+}
+
+// Workspace is a team's shared space.  Role is the
+// role of the user the workspace was listed for.
+type Workspace struct {
+	Id        int
+	Name      string
+	CreatedAt time.Time
+	Role      string
+}
+
+type Member struct {
+	WorkspaceId int
+	UserId      int
+	Name        string
+	Email       string
+	Role        string
+	JoinedAt    time.Time
+}
+
+// Invitation lets whoever holds its link join a
+// workspace.  Only the hash of the link's secret
+// is stored.
+type Invitation struct {
+	Id          int
+	WorkspaceId int
+	Email       string
+	Role        string
+	Hash        string
+	InvitedBy   int
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+	AcceptedAt  time.Time
+}
+
+// TeamTotal is a GetReport style total for one
+// member's task in a workspace's projects
+type TeamTotal struct {
+	UserId int
+	Report
+}
+
+// MemberReport is one row of the team report
+type MemberReport struct {
+	Member
+	Reports   []Report
+	TotalTime float64
+}
+
+// CanManage reports whether role may invite and remove
+// members, change projects and see everyone's time
+func CanManage(role string) bool {
+	return role == RoleOwner || role == RoleAdmin
+}
+
+func NewWorkspace(name string, now time.Time) (Workspace, error) {
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return Workspace{}, fmt.Errorf("workspace name must not be empty")
+	}
+
+	return Workspace{Name: name, CreatedAt: now.UTC(), Role: RoleOwner}, nil
+}
+
+// NewInvitation returns an invitation and the secret
+// for its link, which cannot be recovered later
+func NewInvitation(workspaceId int, email, role string, invitedBy int, now time.Time) (Invitation, string, error) {
+
+	addr, err := mail.ParseAddress(strings.TrimSpace(email))
+	if err != nil {
+		return Invitation{}, "", fmt.Errorf("invalid email: %q", email)
+	}
+
+	if !containsString(InvitationRoles, role) {
+		return Invitation{}, "", fmt.Errorf("invalid role: %q", role)
+	}
+
+	secret, err := newSecret()
+	if err != nil {
+		return Invitation{}, "", err
+	}
+
+	inv := Invitation{
+		WorkspaceId: workspaceId,
+		Email:       strings.ToLower(addr.Address),
+		Role:        role,
+		Hash:        hashSecret(secret),
+		InvitedBy:   invitedBy,
+		CreatedAt:   now.UTC(),
+		ExpiresAt:   now.UTC().Add(INVITATION_LIFETIME),
+	}
+
+	return inv, secret, nil
+}
+
+// NewTeamReport gathers each member's totals.  Owners
+// and admins see every member, members only themselves.
+func NewTeamReport(members []Member, totals []TeamTotal, viewer Member) []MemberReport {
+
+	var report []MemberReport
+	for _, m := range members {
+		if !CanManage(viewer.Role) && m.UserId != viewer.UserId {
+			continue
+		}
+
+		mr := MemberReport{Member: m}
+		for _, t := range totals {
+			if t.UserId == m.UserId {
+				mr.Reports = append(mr.Reports, t.Report)
+				mr.TotalTime += t.TotalTime
+			}
+		}
+		report = append(report, mr)
+	}
+
+	return report
+}
+
+// newSecret returns a random URL safe secret
+func newSecret() (string, error) {
+
+	b := make([]byte, 24)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("unable to generate secret: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashSecret is how random secrets are stored
+// and looked up
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+type userKey struct{}
+
+// identify puts the user of a session cookie into
+// the request context.  Without WithRequiredLogin
+// requests without a session act as the local user.
+func (s *Server) identify(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if c, err := r.Cookie(SessionCookie); err == nil {
+			user, err := s.WorkspaceStore.GetSessionUser(hashSecret(c.Value), s.now())
+			switch {
+			case err == nil:
+				r = r.WithContext(context.WithValue(r.Context(), userKey{}, user))
+				next.ServeHTTP(w, r)
+				return
+			case !errors.Is(err, ErrNoRecord):
+				s.serverError(w, r, err)
+				return
+			}
+		}
+
+		if s.requireLogin && !s.signInExempt(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="timetracker"`)
+			http.Error(w, "Unauthorized - sign in with a link from `timetracker login-link` or an invitation", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// signInExempt are the routes that work without a
+// session when login is required: signing in, probes
+// and routes with their own tokens.  Metrics only have
+// their own token when one is set.
+func (s *Server) signInExempt(r *http.Request) bool {
+
+	switch r.URL.Path {
+	case "/login", "/invite", "/invite/accept", "/healthz", "/readyz", "/calendar.ics":
+		return true
+	case "/metrics":
+		return s.metricsToken != ""
+	}
+	return strings.HasPrefix(r.URL.Path, "/static/") || strings.HasPrefix(r.URL.Path, "/api/")
+}
+
+// currentUserID is the user an API token or session
+// belongs to, or the local user
+func (s *Server) currentUserID(r *http.Request) int {
+
+	if token, ok := APITokenFrom(r.Context()); ok {
+		return token.UserId
+	}
+	if user, ok := r.Context().Value(userKey{}).(User); ok {
+		return user.Id
+	}
+	return LOCAL_USER_ID
+}
+
+// currentUser looks up the user of currentUserID
+func (s *Server) currentUser(r *http.Request) (User, error) {
+
+	if user, ok := r.Context().Value(userKey{}).(User); ok {
+		return user, nil
+	}
+	return s.WorkspaceStore.GetUser(s.currentUserID(r))
+}
+
+// startSession signs the browser in as user
+func (s *Server) startSession(w http.ResponseWriter, r *http.Request, userId int) error {
+
+	secret, err := newSecret()
+	if err != nil {
+		return err
+	}
+
+	expires := s.now().UTC().Add(SESSION_LIFETIME)
+	err = s.WorkspaceStore.CreateSession(hashSecret(secret), userId, expires)
+	if err != nil {
+		return err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    secret,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+// NewLoginLink creates a one-time sign in link
+// for user, valid for LOGIN_LINK_LIFETIME
+func NewLoginLink(store WorkspaceStore, baseURL string, userId int, now time.Time) (string, error) {
+
+	_, err := store.GetUser(userId)
+	if err != nil {
+		return "", fmt.Errorf("unable to find user %d: %w", userId, err)
+	}
+
+	secret, err := newSecret()
+	if err != nil {
+		return "", err
+	}
+
+	err = store.CreateSession(hashSecret(secret), userId, now.UTC().Add(LOGIN_LINK_LIFETIME))
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSuffix(baseURL, "/") + "/login?token=" + secret, nil
+}
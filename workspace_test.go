@@ -0,0 +1,496 @@
+package timetracker_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+	"timetracker"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNewInvitation(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2021, 1, 1, 9, 0, 0, 0, time.UTC)
+
+	inv, secret, err := timetracker.NewInvitation(1, "Ana <Ana@Example.com>", timetracker.RoleAdmin, 1, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if inv.Email != "ana@example.com" || inv.Role != timetracker.RoleAdmin {
+		t.Errorf("want: ana@example.com as admin, got: %s as %s", inv.Email, inv.Role)
+	}
+	if secret == "" || inv.Hash == secret || inv.Hash != timetracker.HashAPIToken(secret) {
+		t.Error("want: only the hash of the secret stored")
+	}
+	if !inv.ExpiresAt.Equal(now.Add(timetracker.INVITATION_LIFETIME)) {
+		t.Errorf("want: expiry %v, got: %v", now.Add(timetracker.INVITATION_LIFETIME), inv.ExpiresAt)
+	}
+
+	for _, tc := range []struct{ email, role string }{
+		{email: "not an address", role: timetracker.RoleMember},
+		{email: "ana@example.com", role: timetracker.RoleOwner},
+		{email: "ana@example.com", role: ""},
+	} {
+		_, _, err := timetracker.NewInvitation(1, tc.email, tc.role, 1, now)
+		if err == nil {
+			t.Errorf("%q %q: want: error, got: nil", tc.email, tc.role)
+		}
+	}
+
+	_, err = timetracker.NewWorkspace("  ", now)
+	if err == nil {
+		t.Error("empty workspace name: want: error, got: nil")
+	}
+
+}
+
+func TestNewTeamReport(t *testing.T) {
+	t.Parallel()
+
+	owner := timetracker.Member{UserId: 1, Name: "me", Role: timetracker.RoleOwner}
+	admin := timetracker.Member{UserId: 2, Name: "bo", Role: timetracker.RoleAdmin}
+	member := timetracker.Member{UserId: 3, Name: "cy", Role: timetracker.RoleMember}
+	members := []timetracker.Member{admin, member, owner}
+
+	totals := []timetracker.TeamTotal{
+		{UserId: 1, Report: timetracker.Report{Task: "deploy", TotalTime: 60}},
+		{UserId: 3, Report: timetracker.Report{Task: "review", TotalTime: 90}},
+		{UserId: 3, Report: timetracker.Report{Task: "deploy", TotalTime: 30}},
+	}
+
+	all := []timetracker.MemberReport{
+		{Member: admin},
+		{Member: member, Reports: []timetracker.Report{{Task: "review", TotalTime: 90}, {Task: "deploy", TotalTime: 30}}, TotalTime: 120},
+		{Member: owner, Reports: []timetracker.Report{{Task: "deploy", TotalTime: 60}}, TotalTime: 60},
+	}
+
+	testCases := []struct {
+		viewer timetracker.Member
+		want   []timetracker.MemberReport
+	}{
+		{viewer: owner, want: all},
+		{viewer: admin, want: all},
+		{viewer: member, want: all[1:2]},
+	}
+
+	for _, tc := range testCases {
+		got := timetracker.NewTeamReport(members, totals, tc.viewer)
+		if !cmp.Equal(tc.want, got) {
+			t.Errorf("%s: %s", tc.viewer.Role, cmp.Diff(tc.want, got))
+		}
+	}
+
+}
+
+// browser is a client with its own cookies that
+// posts forms with the CSRF token of the last page
+type browser struct {
+	t      *testing.T
+	url    string
+	client *http.Client
+	token  string
+}
+
+var csrfField = regexp.MustCompile(`name='csrf_token' value='([^']+)'`)
+
+func newBrowser(t *testing.T, ts *httptest.Server) *browser {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return &browser{t: t, url: ts.URL, client: client}
+}
+
+func (b *browser) read(resp *http.Response, err error) (int, string) {
+	b.t.Helper()
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	if m := csrfField.FindSubmatch(body); m != nil {
+		b.token = string(m[1])
+	}
+	return resp.StatusCode, string(body)
+}
+
+func (b *browser) get(path string) (int, string) {
+	b.t.Helper()
+	return b.read(b.client.Get(b.url + path))
+}
+
+func (b *browser) post(path string, form url.Values) (int, string) {
+	b.t.Helper()
+	if b.token == "" {
+		b.get("/task/create")
+	}
+	form.Set("csrf_token", b.token)
+	return b.read(b.client.PostForm(b.url+path, form))
+}
+
+func newSqliteServer(t *testing.T, opts ...timetracker.Option) (*timetracker.Server, *httptest.Server) {
+	t.Helper()
+
+	opts = append([]timetracker.Option{
+		timetracker.WithNoLogging(),
+		timetracker.WithNoWebhooks(),
+		timetracker.WithSqliteStore(filepath.Join(t.TempDir(), "timetracker.db")),
+	}, opts...)
+
+	s := timetracker.NewServer(opts...)
+	err := s.LoadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+// newWebhookServer is newSqliteServer with the webhook
+// pages on.  The dispatcher is not run, so deliveries
+// stay pending.
+func newWebhookServer(t *testing.T) (*timetracker.Server, *httptest.Server) {
+	t.Helper()
+
+	s := timetracker.NewServer(
+		timetracker.WithNoLogging(),
+		timetracker.WithSqliteStore(filepath.Join(t.TempDir(), "timetracker.db")),
+	)
+	err := s.LoadTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+func TestWorkspaces(t *testing.T) {
+	t.Parallel()
+
+	_, ts := newSqliteServer(t)
+
+	// without signing in, the browser is the local user
+	owner := newBrowser(t, ts)
+
+	code, _ := owner.post("/workspace/create", url.Values{"name": {"Platform"}})
+	if code != http.StatusSeeOther {
+		t.Fatalf("create workspace: want: 303, got: %d", code)
+	}
+	owner.post("/workspace/create", url.Values{"name": {"Private"}})
+	owner.post("/workspace/project/add", url.Values{"workspace": {"1"}, "project": {"ops"}})
+
+	code, body := owner.post("/workspace/invite", url.Values{"workspace": {"1"}, "email": {"ana@example.com"}, "role": {"member"}})
+	link := regexp.MustCompile(`/invite\?token=[\w-]+`).FindString(body)
+	if code != http.StatusOK || link == "" {
+		t.Fatalf("invite: want: 200 with a link, got: %d", code)
+	}
+
+	ana := newBrowser(t, ts)
+	ana.get(link)
+	code, _ = ana.post("/invite/accept", url.Values{"token": {strings.TrimPrefix(link, "/invite?token=")}, "name": {"Ana"}})
+	if code != http.StatusSeeOther {
+		t.Fatalf("accept: want: 303, got: %d", code)
+	}
+
+	code, _ = newBrowser(t, ts).post("/invite/accept", url.Values{"token": {strings.TrimPrefix(link, "/invite?token=")}})
+	if code != http.StatusNotFound {
+		t.Errorf("accept twice: want: 404, got: %d", code)
+	}
+
+	for _, tracker := range []struct {
+		b    *browser
+		task string
+	}{{owner, "deploy"}, {ana, "review"}, {ana, "offsite"}} {
+		project := "ops"
+		if tracker.task == "offsite" {
+			project = "other"
+		}
+		tracker.b.post("/task/started", url.Values{"task": {tracker.task}, "project": {project}})
+		tracker.b.post("/task/stop", url.Values{})
+	}
+
+	_, body = owner.get("/workspace/report?workspace=1")
+	if !strings.Contains(body, "deploy") || !strings.Contains(body, "review") || strings.Contains(body, "offsite") {
+		t.Errorf("owner's report: want: deploy and review only, got:\n%s", body)
+	}
+
+	code, body = ana.get("/workspace/report?workspace=1")
+	if code != http.StatusOK || !strings.Contains(body, "review") || strings.Contains(body, "deploy") {
+		t.Errorf("member's report: want: own review only, got: %d\n%s", code, body)
+	}
+
+	testCases := []struct {
+		description string
+		b           *browser
+		path        string
+		form        url.Values
+		want        int
+	}{
+		{description: "member inviting", b: ana, path: "/workspace/invite", form: url.Values{"workspace": {"1"}, "email": {"bo@example.com"}, "role": {"member"}}, want: http.StatusForbidden},
+		{description: "member adding project", b: ana, path: "/workspace/project/add", form: url.Values{"workspace": {"1"}, "project": {"x"}}, want: http.StatusForbidden},
+		{description: "member removing owner", b: ana, path: "/workspace/member/remove", form: url.Values{"workspace": {"1"}, "user": {"1"}}, want: http.StatusForbidden},
+		{description: "owner removing owner", b: owner, path: "/workspace/member/remove", form: url.Values{"workspace": {"1"}, "user": {"1"}}, want: http.StatusForbidden},
+		{description: "owner making owner", b: owner, path: "/workspace/member/role", form: url.Values{"workspace": {"1"}, "user": {"2"}, "role": {"owner"}}, want: http.StatusBadRequest},
+		{description: "other workspace", b: ana, path: "/workspace/project/add", form: url.Values{"workspace": {"2"}, "project": {"x"}}, want: http.StatusNotFound},
+		{description: "promote", b: owner, path: "/workspace/member/role", form: url.Values{"workspace": {"1"}, "user": {"2"}, "role": {"admin"}}, want: http.StatusSeeOther},
+		{description: "admin adding project", b: ana, path: "/workspace/project/add", form: url.Values{"workspace": {"1"}, "project": {"other"}}, want: http.StatusSeeOther},
+		{description: "remove", b: owner, path: "/workspace/member/remove", form: url.Values{"workspace": {"1"}, "user": {"2"}}, want: http.StatusSeeOther},
+	}
+
+	for _, tc := range testCases {
+		code, _ := tc.b.post(tc.path, tc.form)
+		if tc.want != code {
+			t.Errorf("%s: want: %d, got: %d", tc.description, tc.want, code)
+		}
+	}
+
+	code, _ = ana.get("/workspace/view?workspace=1")
+	if code != http.StatusNotFound {
+		t.Errorf("removed member: want: 404, got: %d", code)
+	}
+
+}
+
+func TestTaskVisibility(t *testing.T) {
+	t.Parallel()
+
+	_, ts := newSqliteServer(t)
+
+	owner := newBrowser(t, ts)
+	owner.post("/workspace/create", url.Values{"name": {"Platform"}})
+	owner.post("/workspace/project/add", url.Values{"workspace": {"1"}, "project": {"ops"}})
+
+	_, body := owner.post("/workspace/invite", url.Values{"workspace": {"1"}, "email": {"ana@example.com"}, "role": {"member"}})
+	link := regexp.MustCompile(`/invite\?token=[\w-]+`).FindString(body)
+
+	ana := newBrowser(t, ts)
+	ana.get(link)
+	ana.post("/invite/accept", url.Values{"token": {strings.TrimPrefix(link, "/invite?token=")}, "name": {"Ana"}})
+
+	// tasks 1, 2 and 3
+	for _, tracker := range []struct {
+		b       *browser
+		task    string
+		project string
+	}{{owner, "deploy", "ops"}, {ana, "review", "ops"}, {ana, "offsite", "other"}} {
+		tracker.b.post("/task/started", url.Values{"task": {tracker.task}, "project": {tracker.project}})
+		tracker.b.post("/task/stop", url.Values{})
+	}
+
+	testCases := []struct {
+		description string
+		b           *browser
+		want        []string
+		hidden      []string
+	}{
+		{description: "member", b: ana, want: []string{"review", "offsite"}, hidden: []string{"deploy"}},
+		{description: "owner", b: owner, want: []string{"deploy", "review"}, hidden: []string{"offsite"}},
+	}
+
+	for _, tc := range testCases {
+		for _, path := range []string{"/", "/task/history", "/task/report", "/api/task/history", "/task/export", "/task/create", "/audit", "/api/audit"} {
+			_, body := tc.b.get(path)
+			for _, task := range tc.want {
+				if !strings.Contains(body, task) {
+					t.Errorf("%s %s: want: %s", tc.description, path, task)
+				}
+			}
+			for _, task := range tc.hidden {
+				if strings.Contains(body, task) {
+					t.Errorf("%s %s: want: no %s", tc.description, path, task)
+				}
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		description string
+		b           *browser
+		path        string
+		id          string
+		want        int
+	}{
+		{description: "member deleting owner's task", b: ana, path: "/task/delete", id: "1", want: http.StatusNotFound},
+		{description: "owner deleting member's task", b: owner, path: "/task/delete", id: "2", want: http.StatusSeeOther},
+		{description: "member restoring own task", b: ana, path: "/audit/restore", id: "2", want: http.StatusSeeOther},
+		{description: "owner deleting own task", b: owner, path: "/task/delete", id: "1", want: http.StatusSeeOther},
+		{description: "member restoring owner's task", b: ana, path: "/audit/restore", id: "1", want: http.StatusNotFound},
+		{description: "owner deleting member's other task", b: owner, path: "/task/delete", id: "3", want: http.StatusNotFound},
+	} {
+		code, _ := tc.b.post(tc.path, url.Values{"id": {tc.id}})
+		if tc.want != code {
+			t.Errorf("%s: want: %d, got: %d", tc.description, tc.want, code)
+		}
+	}
+
+}
+
+func TestSettingsOwnership(t *testing.T) {
+	t.Parallel()
+
+	_, ts := newWebhookServer(t)
+
+	owner := newBrowser(t, ts)
+	owner.post("/workspace/create", url.Values{"name": {"Platform"}})
+
+	_, body := owner.post("/workspace/invite", url.Values{"workspace": {"1"}, "email": {"ana@example.com"}, "role": {"admin"}})
+	link := regexp.MustCompile(`/invite\?token=[\w-]+`).FindString(body)
+
+	ana := newBrowser(t, ts)
+	ana.get(link)
+	ana.post("/invite/accept", url.Values{"token": {strings.TrimPrefix(link, "/invite?token=")}, "name": {"Ana"}})
+
+	owner.post("/goal/create", url.Values{"name": {"piano"}, "scope": {"task"}, "kind": {"target"}, "period": {"weekly"}, "hours": {"5"}})
+	owner.post("/template/create", url.Values{"name": {"standup"}, "project": {"team"}})
+	owner.post("/webhook/create", url.Values{"url": {"https://example.com/hook"}, "secret": {"s3cret"}, "event": {"task.started"}})
+
+	for path, private := range map[string]string{"/goal": "piano", "/template": "standup", "/": "standup", "/webhook": "s3cret"} {
+		if _, body := owner.get(path); !strings.Contains(body, private) {
+			t.Errorf("owner %s: want: %s", path, private)
+		}
+		if _, body := ana.get(path); strings.Contains(body, private) {
+			t.Errorf("other user %s: want: no %s", path, private)
+		}
+	}
+
+	for _, tc := range []struct {
+		description string
+		b           *browser
+		path        string
+		want        int
+	}{
+		{description: "other user starting template", b: ana, path: "/template/start", want: http.StatusNotFound},
+		{description: "other user deleting goal", b: ana, path: "/goal/delete", want: http.StatusNotFound},
+		{description: "other user deleting template", b: ana, path: "/template/delete", want: http.StatusNotFound},
+		{description: "other user deleting webhook", b: ana, path: "/webhook/delete", want: http.StatusNotFound},
+		{description: "owner deleting goal", b: owner, path: "/goal/delete", want: http.StatusSeeOther},
+		{description: "owner deleting template", b: owner, path: "/template/delete", want: http.StatusSeeOther},
+		{description: "owner deleting webhook", b: owner, path: "/webhook/delete", want: http.StatusSeeOther},
+	} {
+		code, _ := tc.b.post(tc.path, url.Values{"id": {"1"}})
+		if tc.want != code {
+			t.Errorf("%s: want: %d, got: %d", tc.description, tc.want, code)
+		}
+	}
+
+}
+
+func TestWebhookVisibility(t *testing.T) {
+	t.Parallel()
+
+	s, ts := newWebhookServer(t)
+
+	owner := newBrowser(t, ts)
+	owner.post("/workspace/create", url.Values{"name": {"Platform"}})
+	owner.post("/workspace/project/add", url.Values{"workspace": {"1"}, "project": {"ops"}})
+
+	_, body := owner.post("/workspace/invite", url.Values{"workspace": {"1"}, "email": {"ana@example.com"}, "role": {"member"}})
+	link := regexp.MustCompile(`/invite\?token=[\w-]+`).FindString(body)
+
+	ana := newBrowser(t, ts)
+	ana.get(link)
+	ana.post("/invite/accept", url.Values{"token": {strings.TrimPrefix(link, "/invite?token=")}, "name": {"Ana"}})
+
+	// webhooks 1 and 2
+	for _, b := range []*browser{owner, ana} {
+		b.post("/webhook/create", url.Values{"url": {"https://example.com/hook"}, "secret": {"s3cret"}, "event": {"task.started"}})
+	}
+
+	for _, tc := range []struct {
+		description string
+		b           *browser
+		project     string
+		want        []int
+	}{
+		{description: "owner's task", b: owner, project: "ops", want: []int{1}},
+		{description: "member's workspace task", b: ana, project: "ops", want: []int{1, 2}},
+		{description: "member's other task", b: ana, project: "other", want: []int{2}},
+	} {
+		before, err := s.WebhookStore.GetDeliveries(timetracker.ALL_USERS, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tc.b.post("/task/started", url.Values{"task": {"deploy"}, "project": {tc.project}})
+		tc.b.post("/task/stop", url.Values{})
+
+		after, err := s.WebhookStore.GetDeliveries(timetracker.ALL_USERS, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// deliveries are newest first
+		var got []int
+		for _, wd := range after[:len(after)-len(before)] {
+			got = append([]int{wd.WebhookId}, got...)
+		}
+		if !cmp.Equal(tc.want, got) {
+			t.Errorf("%s: want webhooks: %v, got: %v", tc.description, tc.want, got)
+		}
+	}
+
+}
+
+func TestRequiredLogin(t *testing.T) {
+	t.Parallel()
+
+	s, ts := newSqliteServer(t, timetracker.WithRequiredLogin())
+
+	b := newBrowser(t, ts)
+	for path, want := range map[string]int{"/": http.StatusUnauthorized, "/workspace": http.StatusUnauthorized, "/healthz": http.StatusOK} {
+		if code, _ := b.get(path); want != code {
+			t.Errorf("GET %s signed out: want: %d, got: %d", path, want, code)
+		}
+	}
+
+	link, err := timetracker.NewLoginLink(s.WorkspaceStore, ts.URL, timetracker.LOCAL_USER_ID, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := strings.TrimPrefix(link, ts.URL)
+
+	if code, _ := b.get(path); code != http.StatusSeeOther {
+		t.Fatalf("login: want: 303, got: %d", code)
+	}
+	if code, _ := b.get("/workspace"); code != http.StatusOK {
+		t.Errorf("signed in: want: 200, got: %d", code)
+	}
+
+	if code, _ := newBrowser(t, ts).get(path); code != http.StatusUnauthorized {
+		t.Errorf("login link used twice: want: 401, got: %d", code)
+	}
+
+	b.post("/logout", url.Values{})
+	if code, _ := b.get("/workspace"); code != http.StatusUnauthorized {
+		t.Errorf("signed out: want: 401, got: %d", code)
+	}
+
+	_, err = timetracker.NewLoginLink(s.WorkspaceStore, ts.URL, 42, time.Now())
+	if err == nil {
+		t.Error("unknown user: want: error, got: nil")
+	}
+
+}